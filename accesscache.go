@@ -0,0 +1,102 @@
+package fuse
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessCache remembers the outcome of access checks, see
+// Conn.SetAccessCacheTTL.
+type accessCache struct {
+	// Accessed atomically. Must stay first, see Conn.
+	ttl int64
+
+	mu      sync.Mutex
+	entries map[accessKey]accessEntry
+}
+
+type accessKey struct {
+	node     NodeID
+	uid, gid uint32
+	mask     uint32
+}
+
+type accessEntry struct {
+	err     error
+	expires time.Time
+}
+
+// sweep expired entries once the cache grows past this many
+const accessCacheSweep = 4096
+
+// SetAccessCacheTTL makes AccessRequest.RespondCached remember each
+// decision for d. A zero d, the default, disables the cache.
+//
+// A cached decision is stale if the permissions change in the
+// meantime by any means other than a SetattrRequest responded to on
+// c, which drops the decisions for its node: a change made directly
+// to the backing store, or a group membership change of the caller,
+// goes unnoticed until the decision expires. Keep d short, and call
+// InvalidateAccess when the server knows better.
+func (c *Conn) SetAccessCacheTTL(d time.Duration) {
+	atomic.StoreInt64(&c.access.ttl, int64(d))
+}
+
+// InvalidateAccess drops the cached access decisions for node.
+func (c *Conn) InvalidateAccess(node NodeID) {
+	a := &c.access
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k := range a.entries {
+		if k.node == node {
+			delete(a.entries, k)
+		}
+	}
+}
+
+// RespondCached responds to the request with the result of decide,
+// which returns nil to allow access or an error to deny it. With an
+// access cache enabled, see Conn.SetAccessCacheTTL, decide is only
+// called if there is no recent decision for the same node, caller
+// uid and gid, and mask.
+func (r *AccessRequest) RespondCached(decide func() error) {
+	err := r.Conn.accessDecision(r, decide)
+	if err != nil {
+		r.RespondError(err)
+		return
+	}
+	r.Respond()
+}
+
+func (c *Conn) accessDecision(r *AccessRequest, decide func() error) error {
+	ttl := time.Duration(atomic.LoadInt64(&c.access.ttl))
+	if ttl <= 0 {
+		return decide()
+	}
+	key := accessKey{node: r.Node, uid: r.Uid, gid: r.Gid, mask: r.Mask}
+	a := &c.access
+	a.mu.Lock()
+	e, ok := a.entries[key]
+	a.mu.Unlock()
+	now := c.now()
+	if ok && now.Before(e.expires) {
+		return e.err
+	}
+
+	err := decide()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.entries == nil {
+		a.entries = make(map[accessKey]accessEntry)
+	}
+	if len(a.entries) >= accessCacheSweep {
+		for k, e := range a.entries {
+			if !now.Before(e.expires) {
+				delete(a.entries, k)
+			}
+		}
+	}
+	a.entries[key] = accessEntry{err: err, expires: now.Add(ttl)}
+	return err
+}
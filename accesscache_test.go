@@ -0,0 +1,58 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessRespondCached(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	c.nowFunc = clock.Now
+	c.SetAccessCacheTTL(time.Second)
+
+	calls := 0
+	deny := func() error {
+		calls++
+		return EPERM
+	}
+	access := func(mask uint32) {
+		req := k.request(c, opAccess, msg(mask, uint32(0)))
+		req.(*AccessRequest).RespondCached(deny)
+		hdr, _ := k.recv()
+		if g, e := hdr.Error, -int32(EPERM); g != e {
+			t.Errorf("wrong error: %d != %d", g, e)
+		}
+	}
+
+	access(2)
+	access(2)
+	if g, e := calls, 1; g != e {
+		t.Errorf("decision made %d times within the TTL", g)
+	}
+	// another mask is another decision
+	access(4)
+	if g, e := calls, 2; g != e {
+		t.Errorf("wrong number of decisions: %d != %d", g, e)
+	}
+
+	clock.Advance(time.Second)
+	access(2)
+	if g, e := calls, 3; g != e {
+		t.Errorf("expired decision was reused: %d != %d", g, e)
+	}
+
+	c.InvalidateAccess(7)
+	access(2)
+	if g, e := calls, 4; g != e {
+		t.Errorf("invalidated decision was reused: %d != %d", g, e)
+	}
+
+	c.SetAccessCacheTTL(0)
+	access(2)
+	if g, e := calls, 5; g != e {
+		t.Errorf("decision cached with the cache disabled: %d != %d", g, e)
+	}
+}
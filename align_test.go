@@ -0,0 +1,38 @@
+package fuse
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// The 64-bit atomic operations panic on 32-bit platforms unless their
+// operands are 8-byte aligned. Run with GOARCH=386 to check.
+func TestConnAtomicAlignment(t *testing.T) {
+	var c Conn
+	for _, f := range []struct {
+		name string
+		off  uintptr
+	}{
+		{"flags", unsafe.Offsetof(c.flags)},
+		{"stats", unsafe.Offsetof(c.stats)},
+		{"slow", unsafe.Offsetof(c.slow)},
+		{"cacheWarn", unsafe.Offsetof(c.cacheWarn)},
+		{"timeout", unsafe.Offsetof(c.timeout)},
+		{"access.ttl", unsafe.Offsetof(c.access) + unsafe.Offsetof(c.access.ttl)},
+	} {
+		if f.off%8 != 0 {
+			t.Errorf("Conn.%s is at offset %d, not 8-byte aligned", f.name, f.off)
+		}
+	}
+
+	conn := &Conn{}
+	conn.SetSlowThreshold(time.Second)
+	conn.SetRequestTimeout(time.Second)
+	conn.SetCacheWarning(0.5)
+	conn.SetAccessCacheTTL(time.Second)
+	atomic.AddUint64(&conn.stats.interrupts, 1)
+	conn.Stats()
+	conn.hasFlag(InitAsyncRead)
+}
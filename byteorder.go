@@ -0,0 +1,20 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// hostOrder is the byte order of the FUSE protocol. The kernel sends
+// its structs as they are laid out in memory, so this is the byte
+// order of the host, not a fixed one.
+var hostOrder = nativeOrder()
+
+// nativeOrder returns the byte order of the host.
+func nativeOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
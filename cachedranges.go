@@ -0,0 +1,119 @@
+package fuse
+
+import (
+	"sync"
+)
+
+// A ByteRange is a part of the contents of a file.
+type ByteRange struct {
+	Offset int64
+	Size   int64
+}
+
+func (b ByteRange) end() int64 {
+	return b.Offset + b.Size
+}
+
+// cacheTracker remembers what file data the kernel was handed for its
+// page cache, see Conn.CachedRanges.
+type cacheTracker struct {
+	mu sync.Mutex
+	// sorted, neither overlapping nor adjacent
+	nodes map[NodeID][]ByteRange
+}
+
+// CachedRanges returns the parts of the contents of node the kernel
+// is believed to hold in its page cache, in order.
+//
+// This is a best-effort view, meant for servers coordinating caching
+// with other clients of shared storage. It is built from data pushed
+// to the kernel's cache by the server with NotifyStore, and from
+// invalidations, which remove ranges, see NotifyInvalInode. An open
+// response without OpenKeepCache counts as an invalidation of the
+// whole file, since the kernel then drops its cached data. Data the
+// kernel caches from ordinary reads is not seen, and the kernel may
+// evict pages at any time, so the kernel can hold both more and less
+// than reported.
+func (c *Conn) CachedRanges(node NodeID) []ByteRange {
+	t := &c.cached
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]ByteRange(nil), t.nodes[node]...)
+}
+
+// noteStored records size bytes at off of node as cached.
+func (c *Conn) noteStored(node NodeID, off, size int64) {
+	if size <= 0 {
+		return
+	}
+	t := &c.cached
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes == nil {
+		t.nodes = make(map[NodeID][]ByteRange)
+	}
+	add := ByteRange{Offset: off, Size: size}
+	var ranges []ByteRange
+	for _, r := range t.nodes[node] {
+		switch {
+		case r.end() < add.Offset:
+			ranges = append(ranges, r)
+		case add.end() < r.Offset:
+			ranges = append(ranges, add)
+			add = r
+		default:
+			// merge
+			start, end := r.Offset, r.end()
+			if add.Offset < start {
+				start = add.Offset
+			}
+			if add.end() > end {
+				end = add.end()
+			}
+			add = ByteRange{Offset: start, Size: end - start}
+		}
+	}
+	t.nodes[node] = append(ranges, add)
+}
+
+// noteInvalidated records size bytes at off of node as no longer
+// cached. A size of zero or less means up to the end of the file, as
+// for NotifyInvalInode.
+func (c *Conn) noteInvalidated(node NodeID, off, size int64) {
+	t := &c.cached
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.nodes[node]
+	if !ok {
+		return
+	}
+	if off <= 0 && size <= 0 {
+		delete(t.nodes, node)
+		return
+	}
+	end := off + size
+	var ranges []ByteRange
+	for _, r := range old {
+		if r.Offset < off {
+			// keep the part before the invalidated range
+			head := r
+			if head.end() > off {
+				head.Size = off - head.Offset
+			}
+			ranges = append(ranges, head)
+		}
+		if size > 0 && r.end() > end {
+			// and the part after it
+			tail := r
+			if tail.Offset < end {
+				tail = ByteRange{Offset: end, Size: r.end() - end}
+			}
+			ranges = append(ranges, tail)
+		}
+	}
+	if len(ranges) == 0 {
+		delete(t.nodes, node)
+		return
+	}
+	t.nodes[node] = ranges
+}
@@ -0,0 +1,44 @@
+package fuse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCachedRanges(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	check := func(what string, want ...ByteRange) {
+		if g := c.CachedRanges(2); !reflect.DeepEqual(g, want) {
+			t.Errorf("%s: wrong ranges: %v != %v", what, g, want)
+		}
+	}
+
+	c.noteStored(2, 0, 4096)
+	c.noteStored(2, 8192, 4096)
+	check("store", ByteRange{0, 4096}, ByteRange{8192, 4096})
+	c.noteStored(2, 4096, 4096)
+	check("store between", ByteRange{0, 12288})
+	c.noteStored(3, 0, 100)
+
+	c.noteInvalidated(2, 4096, 100)
+	check("invalidate middle", ByteRange{0, 4096}, ByteRange{4196, 8092})
+	c.noteInvalidated(2, 8192, 0)
+	check("invalidate to end", ByteRange{0, 4096}, ByteRange{4196, 3996})
+
+	open := func(flags OpenResponseFlags) {
+		r := &OpenRequest{Header: Header{Conn: c, ID: 1, Node: 2}}
+		r.Respond(&OpenResponse{Flags: flags})
+		k.recv()
+	}
+	open(OpenKeepCache)
+	check("open keeping the cache", ByteRange{0, 4096}, ByteRange{4196, 3996})
+	open(0)
+	check("open")
+
+	if g, e := c.CachedRanges(3), []ByteRange{{0, 100}}; !reflect.DeepEqual(g, e) {
+		t.Errorf("other node changed: %v != %v", g, e)
+	}
+}
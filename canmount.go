@@ -0,0 +1,46 @@
+package fuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Errors returned by CanMount.
+var (
+	ErrNotDirectory   = errors.New("fuse: mountpoint is not a directory")
+	ErrAlreadyMounted = errors.New("fuse: mountpoint is already a FUSE mount")
+)
+
+// CanMount checks that dir is usable as a mountpoint, so that callers
+// can tell users what is wrong before trying to Mount. A missing dir
+// is reported with the error from os.Stat, see os.IsNotExist; a dir
+// that is not a directory with ErrNotDirectory; and, where the mount
+// table can be read, a dir that already has a FUSE file system
+// mounted on it with ErrAlreadyMounted.
+//
+// Mount can still fail, for example for lack of permissions.
+func CanMount(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrNotDirectory
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	mounted, err := isFuseMount(abs)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return ErrAlreadyMounted
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package fuse
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func isFuseMount(dir string) (bool, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		// no mount table to look at
+		return false, nil
+	}
+	defer f.Close()
+	return findFuseMount(f, dir)
+}
+
+// findFuseMount reports whether the mount table in r, in the format of
+// /proc/mounts, has a FUSE file system mounted on dir.
+func findFuseMount(r io.Reader, dir string) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		fstype := fields[2]
+		if fstype != "fuse" && fstype != "fuseblk" && !strings.HasPrefix(fstype, "fuse.") {
+			continue
+		}
+		if unescapeMount(fields[1]) == dir {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMount undoes the octal escapes the kernel uses for
+// whitespace and backslashes in mount table fields.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
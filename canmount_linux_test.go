@@ -0,0 +1,35 @@
+package fuse
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMounts = `proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 /mnt/disk ext4 rw,relatime 0 0
+hello /mnt/hello fuse rw,nosuid,nodev,relatime,user_id=1000,group_id=1000 0 0
+sshfs /home/me/with\040space fuse.sshfs rw,nosuid,nodev 0 0
+/dev/sdb1 /mnt/ntfs fuseblk rw,relatime 0 0
+`
+
+func TestFindFuseMount(t *testing.T) {
+	for _, tc := range []struct {
+		dir  string
+		want bool
+	}{
+		{"/mnt/hello", true},
+		{"/home/me/with space", true},
+		{"/mnt/ntfs", true},
+		{"/mnt/disk", false},
+		{"/proc", false},
+		{"/mnt", false},
+	} {
+		got, err := findFuseMount(strings.NewReader(testMounts), tc.dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.dir, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: wrong result: %v != %v", tc.dir, got, tc.want)
+		}
+	}
+}
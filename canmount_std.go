@@ -0,0 +1,8 @@
+// +build !linux
+
+package fuse
+
+func isFuseMount(dir string) (bool, error) {
+	// no portable way to read the mount table
+	return false, nil
+}
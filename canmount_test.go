@@ -0,0 +1,30 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuse-canmount-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := CanMount(dir); err != nil {
+		t.Errorf("empty directory: %v", err)
+	}
+	if err := CanMount(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CanMount(file); err != ErrNotDirectory {
+		t.Errorf("expected ErrNotDirectory, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package fuse
+
+import (
+	"fmt"
+	"time"
+)
+
+// Capabilities sums up what a Conn agreed on with the kernel at init.
+type Capabilities struct {
+	// Protocol version negotiated, and the one the kernel speaks.
+	Protocol Protocol
+	Kernel   Protocol
+	// Flags enabled on both sides.
+	Flags InitFlags
+	// Largest write the kernel sends, and the readahead it uses.
+	MaxWrite     uint32
+	MaxReadahead uint32
+	// Pages per request, with InitMaxPages; zero for the kernel's
+	// default.
+	MaxPages uint16
+	// Background request limits; zero for the kernel's defaults, or
+	// if the protocol is too old to carry them.
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	// Timestamp granularity; zero for the kernel's default, or if the
+	// kernel is too old to take it.
+	TimeGran time.Duration
+	// Depth of file systems stacked below, with InitPassthrough.
+	MaxStackDepth uint32
+}
+
+func (c Capabilities) String() string {
+	return fmt.Sprintf("protocol %v (kernel %v) flags=%v max_write=%d max_readahead=%d max_pages=%d max_background=%d congestion_threshold=%d time_gran=%v max_stack_depth=%d",
+		c.Protocol, c.Kernel, c.Flags, c.MaxWrite, c.MaxReadahead, c.MaxPages, c.MaxBackground, c.CongestionThreshold, c.TimeGran, c.MaxStackDepth)
+}
+
+// Capabilities returns what c agreed on with the kernel, as set when
+// the InitRequest was responded to. Before that, it is the zero
+// value.
+func (c *Conn) Capabilities() Capabilities {
+	caps, _ := c.caps.Load().(Capabilities)
+	return caps
+}
@@ -0,0 +1,46 @@
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapabilities(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	if g, e := c.Capabilities(), (Capabilities{}); g != e {
+		t.Errorf("capabilities before init: %v", g)
+	}
+
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(31),
+		uint32(64*1024),
+		uint32(InitAsyncRead|InitBigWrites|InitMaxPages),
+	))
+	req.(*InitRequest).Respond(&InitResponse{
+		MaxReadahead:  128 * 1024,
+		Flags:         InitBigWrites | InitWritebackCache,
+		MaxWrite:      1 << 20,
+		MaxBackground: 64,
+		TimeGran:      time.Second,
+	})
+	k.recv()
+
+	want := Capabilities{
+		Protocol: Protocol{kernelVersion, kernelMinorVersion},
+		Kernel:   Protocol{7, 31},
+		// not offered by the kernel: no writeback cache
+		Flags:        InitBigWrites,
+		MaxWrite:     maxWrite,
+		MaxReadahead: 64 * 1024,
+		TimeGran:     time.Second,
+	}
+	if kernelMinorVersion >= 13 {
+		want.MaxBackground = 64
+	}
+	if g := c.Capabilities(); g != want {
+		t.Errorf("wrong capabilities:\n got %v\nwant %v", g, want)
+	}
+}
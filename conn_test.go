@@ -0,0 +1,148 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+
+	sysunix "golang.org/x/sys/unix"
+)
+
+// testKernel is the kernel side of a synthetic Conn. Requests written
+// to it are read by Conn.ReadRequest, and responses written by the
+// Conn can be read back from it.
+type testKernel struct {
+	t   testing.TB
+	dev *os.File
+}
+
+// newTestConn returns a Conn that is not backed by a mount, and the
+// testKernel talking to it. A datagram socket pair keeps message
+// boundaries intact, just like the FUSE device does.
+func newTestConn(t testing.TB) (*Conn, *testKernel) {
+	return newTestConnType(t, syscall.SOCK_DGRAM)
+}
+
+// newTestConnType is like newTestConn, with a socket pair of the given
+// type. With SOCK_SEQPACKET, closing the testKernel ends the
+// connection, like an unmount: ReadRequest returns io.EOF.
+func newTestConnType(t testing.TB, typ int) (*Conn, *testKernel) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	c := &Conn{
+		dev: os.NewFile(uintptr(fds[0]), "fuse-test-conn"),
+	}
+	k := &testKernel{
+		t:   t,
+		dev: os.NewFile(uintptr(fds[1]), "fuse-test-kernel"),
+	}
+	return c, k
+}
+
+func (k *testKernel) Close() {
+	k.dev.Close()
+}
+
+// closeDevice makes c's device behave like one the kernel has closed,
+// as after a forced unmount: writing responses to it fails with
+// EBADF. Requests sent afterwards can still be read. The device is
+// replaced with the read end of a pipe, whose write end becomes the
+// testKernel's.
+func (k *testKernel) closeDevice(c *Conn) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		k.t.Fatalf("pipe: %v", err)
+	}
+	if err := sysunix.Dup2(p[0], int(c.dev.Fd())); err != nil {
+		k.t.Fatalf("dup2: %v", err)
+	}
+	syscall.Close(p[0])
+	k.dev.Close()
+	k.dev = os.NewFile(uintptr(p[1]), "fuse-test-kernel")
+}
+
+// msg encodes the parts in the kernel's byte order. Strings and byte
+// slices are copied verbatim, everything else must be a fixed-size
+// value accepted by encoding/binary.
+func msg(parts ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		switch p := p.(type) {
+		case string:
+			buf.WriteString(p)
+		case []byte:
+			buf.Write(p)
+		default:
+			if err := binary.Write(&buf, hostOrder, p); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// send writes a request with the given opcode, request ID and node,
+// followed by body.
+func (k *testKernel) send(opcode uint32, id RequestID, node NodeID, body []byte) {
+	k.sendExt(opcode, id, node, body, nil)
+}
+
+// sendExt is like send, but appends the request extensions in ext,
+// which must be a multiple of 8 bytes long.
+func (k *testKernel) sendExt(opcode uint32, id RequestID, node NodeID, body []byte, ext []byte) {
+	if len(ext)%8 != 0 {
+		k.t.Fatalf("bad extension length: %d", len(ext))
+	}
+	hdr := msg(
+		uint32(inHeaderSize+len(body)+len(ext)),
+		opcode,
+		uint64(id),
+		uint64(node),
+		uint32(1000),       // uid
+		uint32(1001),       // gid
+		uint32(1234),       // pid
+		uint16(len(ext)/8), // total_extlen
+		uint16(0),          // padding
+	)
+	m := append(append(hdr, body...), ext...)
+	if _, err := k.dev.Write(m); err != nil {
+		k.t.Fatalf("kernel write: %v", err)
+	}
+}
+
+// recv reads a single response and splits it into the header and the
+// rest of the message.
+func (k *testKernel) recv() (outHeader, []byte) {
+	buf := make([]byte, bufSize)
+	n, err := k.dev.Read(buf)
+	if err != nil {
+		k.t.Fatalf("kernel read: %v", err)
+	}
+	buf = buf[:n]
+	if n < outHeaderSize {
+		k.t.Fatalf("response too short: %d bytes", n)
+	}
+	hdr := outHeader{
+		Len:    hostOrder.Uint32(buf[0:4]),
+		Error:  int32(hostOrder.Uint32(buf[4:8])),
+		Unique: hostOrder.Uint64(buf[8:16]),
+	}
+	if g, e := hdr.Len, uint32(n); g != e {
+		k.t.Errorf("response length in header is wrong: %d != %d", g, e)
+	}
+	return hdr, buf[outHeaderSize:]
+}
+
+// request sends a request and decodes it with c.ReadRequest.
+func (k *testKernel) request(c *Conn, opcode uint32, body []byte) Request {
+	k.send(opcode, 42, 7, body)
+	req, err := c.ReadRequest()
+	if err != nil {
+		k.t.Fatalf("ReadRequest: %v", err)
+	}
+	return req
+}
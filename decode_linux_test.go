@@ -0,0 +1,129 @@
+package fuse
+
+import (
+	"testing"
+)
+
+// sendLen sends a request whose header claims a length of hdrLen,
+// whatever the actual length.
+func (k *testKernel) sendLen(opcode uint32, hdrLen uint32, body []byte) {
+	m := append(msg(
+		hdrLen,
+		opcode,
+		uint64(42), // id
+		uint64(7),  // node
+		uint32(1000), uint32(1001), uint32(1234),
+		uint32(0),
+	), body...)
+	if _, err := k.dev.Write(m); err != nil {
+		k.t.Fatalf("kernel write: %v", err)
+	}
+}
+
+func TestDecodeBadHeaderLen(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// what FreeBSD sends for INIT
+	init := msg(uint32(7), uint32(8), uint32(65536), uint32(0))
+	k.sendLen(opInit, inHeaderSize, init)
+	if _, err := c.ReadRequest(); err == nil {
+		t.Error("expected an error for a short INIT length")
+	}
+
+	// what OSXFUSE sends for WRITE
+	write := msg(uint64(1), uint64(0), uint32(4), uint32(0), "data")
+	k.sendLen(opWrite, inHeaderSize+writeInSize, write)
+	if _, err := c.ReadRequest(); err == nil {
+		t.Error("expected an error for a short WRITE length")
+	}
+}
+
+// setattrBody encodes a setattrIn that changes only the size.
+func setattrBody(valid SetattrValid, fh, size, lockOwner uint64) []byte {
+	return msg(
+		uint32(valid),
+		uint32(0), // padding
+		fh,
+		size,
+		lockOwner,
+		uint64(0), uint64(0), uint64(0), // atime, mtime, unused
+		uint32(0), uint32(0), uint32(0), // atimensec, mtimensec, unused
+		uint32(0), uint32(0), // mode, unused
+		uint32(0), uint32(0), uint32(0), // uid, gid, unused
+	)
+}
+
+func TestDecodeSetattrLockOwner(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// ftruncate(fd, 4096) while holding a POSIX lock
+	req := k.request(c, opSetattr, setattrBody(SetattrSize|SetattrHandle|SetattrLockOwner, 3, 4096, 0xdeadbeef))
+	r, ok := req.(*SetattrRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if !r.Valid.LockOwner() {
+		t.Errorf("lock owner not valid: %v", r.Valid)
+	}
+	if g, e := r.LockOwner, uint64(0xdeadbeef); g != e {
+		t.Errorf("wrong lock owner: %#x != %#x", g, e)
+	}
+	if g, e := r.Size, uint64(4096); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+}
+
+func TestDecodeSetattrNodeOnly(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// truncate(2) by path
+	req := k.request(c, opSetattr, setattrBody(SetattrSize, 0, 4096, 0))
+	r, ok := req.(*SetattrRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Node, NodeID(7); g != e {
+		t.Errorf("wrong node: %v != %v", g, e)
+	}
+	if r.HandleValid() {
+		t.Errorf("handle valid without SetattrHandle: %v", r)
+	}
+	if g, e := r.Size, uint64(4096); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+}
+
+func TestSetattrIsFtruncate(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	tests := []struct {
+		name  string
+		valid SetattrValid
+		want  bool
+	}{
+		{"truncate", SetattrSize, false},
+		{"ftruncate", SetattrSize | SetattrHandle, true},
+		{"fchmod", SetattrMode | SetattrHandle, false},
+	}
+	for _, tt := range tests {
+		req := k.request(c, opSetattr, setattrBody(tt.valid, 3, 0, 0))
+		r, ok := req.(*SetattrRequest)
+		if !ok {
+			t.Fatalf("wrong request type: %T", req)
+		}
+		if g := r.IsFtruncate(); g != tt.want {
+			t.Errorf("%s: IsFtruncate is %v", tt.name, g)
+		}
+	}
+}
@@ -0,0 +1,1925 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestReadHeaderByteOrder(t *testing.T) {
+	want := Header{
+		Len:    inHeaderSize,
+		Opcode: opGetattr,
+		ID:     0x0102030405060708,
+		Node:   0x1112131415161718,
+		Uid:    1000,
+		Gid:    1001,
+		Pid:    0x01020304,
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var buf bytes.Buffer
+		for _, v := range []interface{}{
+			want.Len, want.Opcode, uint64(want.ID), uint64(want.Node),
+			want.Uid, want.Gid, want.Pid, uint32(0),
+		} {
+			if err := binary.Write(&buf, order, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var h Header
+		if err := readHeader(&h, buf.Bytes(), order); err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		h.start = time.Time{}
+		if h != want {
+			t.Errorf("%v: wrong header:\n got %+v\nwant %+v", order, h, want)
+		}
+	}
+	if hostOrder != binary.LittleEndian && hostOrder != binary.BigEndian {
+		t.Errorf("unknown host byte order: %v", hostOrder)
+	}
+}
+
+func TestDecodeTmpfile(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opTmpfile, msg(
+		uint32(syscall.O_RDWR),       // flags
+		uint32(syscall.S_IFREG|0640), // mode
+		"/\x00",                      // placeholder name
+	))
+	r, ok := req.(*TmpfileRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Node, NodeID(7); g != e {
+		t.Errorf("wrong node: %v != %v", g, e)
+	}
+	if !r.Flags.IsReadWrite() {
+		t.Errorf("wrong flags: %v", r.Flags)
+	}
+	if g, e := r.Mode, os.FileMode(0640); g != e {
+		t.Errorf("wrong mode: %v != %v", g, e)
+	}
+
+	resp := &CreateResponse{}
+	resp.Node = 99
+	resp.Handle = 5
+	r.Respond(resp)
+	hdr, body := k.recv()
+	if g, e := hdr.Unique, uint64(42); g != e {
+		t.Errorf("wrong unique: %d != %d", g, e)
+	}
+	if g, e := uintptr(len(body)), unsafe.Sizeof(createOut{})-outHeaderSize; g != e {
+		t.Fatalf("wrong reply size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[0:8]), uint64(99); g != e {
+		t.Errorf("wrong node in reply: %d != %d", g, e)
+	}
+	fh := body[len(body)-16:]
+	if g, e := hostOrder.Uint64(fh[0:8]), uint64(5); g != e {
+		t.Errorf("wrong handle in reply: %d != %d", g, e)
+	}
+}
+
+func TestDecodeTmpfileShort(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	k.send(opTmpfile, 42, 7, msg(uint32(syscall.O_RDWR)))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a short tmpfile message")
+	}
+}
+
+func TestDecodeCreateSecurityContext(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.flags = uint64(InitSecurityContext)
+
+	label := "system_u:object_r:tmp_t:s0\x00"
+	ctx := msg(
+		uint32(len(label)), // size of the context
+		uint32(0),          // padding
+		"security.selinux\x00",
+		label,
+	)
+	req := k.request(c, opCreate, msg(
+		uint32(syscall.O_WRONLY),
+		uint32(syscall.S_IFREG|0600),
+		"file\x00",
+		uint32(secctxHeaderSize+len(ctx)),
+		uint32(1),
+		ctx,
+	))
+	r, ok := req.(*CreateRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Name, "file"; g != e {
+		t.Errorf("wrong name: %q != %q", g, e)
+	}
+	if g, e := len(r.SecurityContext()), 1; g != e {
+		t.Fatalf("wrong number of security contexts: %d != %d", g, e)
+	}
+	if g, e := r.SecurityContext()[0].Name, "security.selinux"; g != e {
+		t.Errorf("wrong security context name: %q != %q", g, e)
+	}
+	if g, e := string(r.SecurityContext()[0].Context), label; g != e {
+		t.Errorf("wrong security context: %q != %q", g, e)
+	}
+}
+
+func TestDecodeCreateExclusive(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	for _, tt := range []struct {
+		flags uint32
+		excl  bool
+	}{
+		{syscall.O_WRONLY | syscall.O_CREAT, false},
+		{syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL, true},
+	} {
+		req := k.request(c, opCreate, msg(tt.flags, uint32(syscall.S_IFREG|0600), "file\x00"))
+		r, ok := req.(*CreateRequest)
+		if !ok {
+			t.Fatalf("wrong request type: %T", req)
+		}
+		if g, e := r.IsExclusive(), tt.excl; g != e {
+			t.Errorf("flags %v: wrong IsExclusive: %v != %v", r.Flags, g, e)
+		}
+		r.RespondError(EEXIST)
+		k.recv()
+	}
+}
+
+func TestDecodeRename(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	for _, tt := range []struct {
+		opcode uint32
+		body   []byte
+		flags  RenameFlags
+	}{
+		{opRename, msg(uint64(9), "old\x00new\x00"), 0},
+		{opRename2, msg(uint64(9), uint32(0), uint32(0), "old\x00new\x00"), 0},
+		{opRename2, msg(uint64(9), uint32(1), uint32(0), "old\x00new\x00"), RenameNoReplace},
+		{opRename2, msg(uint64(9), uint32(2), uint32(0), "old\x00new\x00"), RenameExchange},
+	} {
+		req := k.request(c, tt.opcode, tt.body)
+		r, ok := req.(*RenameRequest)
+		if !ok {
+			t.Fatalf("wrong request type: %T", req)
+		}
+		if r.NewDir != 9 || r.OldName != "old" || r.NewName != "new" {
+			t.Errorf("%v: wrong rename: %v", opcodeNames[tt.opcode], r)
+		}
+		if g, e := r.Flags, tt.flags; g != e {
+			t.Errorf("%v: wrong flags: %v != %v", opcodeNames[tt.opcode], g, e)
+		}
+		r.Respond()
+		k.recv()
+	}
+}
+
+func TestDecodeRename2Short(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// A Rename body is too short for Rename2.
+	k.send(opRename2, 42, 7, msg(uint64(9), "o\x00n\x00"))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected error decoding short Rename2")
+	}
+}
+
+func TestDecodeExchangeData(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opExchange, msg(uint64(5), uint64(9), uint64(1), "a.doc\x00b.doc\x00"))
+	r, ok := req.(*ExchangeDataRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if r.OldDir != 5 || r.NewDir != 9 || r.OldName != "a.doc" || r.NewName != "b.doc" || r.Options != 1 {
+		t.Errorf("wrong exchange: %v", r)
+	}
+	r.Respond()
+	if hdr, _ := k.recv(); hdr.Error != 0 {
+		t.Errorf("unexpected error: %d", hdr.Error)
+	}
+
+	// Missing the terminator of the second name.
+	k.send(opExchange, 43, 7, msg(uint64(5), uint64(9), uint64(0), "a\x00b"))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected error decoding malformed Exchange")
+	}
+}
+
+func TestDecodeSetvolname(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opSetvolname, msg("Backup Disk\x00"))
+	r, ok := req.(*SetvolnameRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Name, "Backup Disk"; g != e {
+		t.Errorf("wrong name: %q != %q", g, e)
+	}
+	r.Respond()
+	if hdr, body := k.recv(); hdr.Error != 0 || len(body) != 0 {
+		t.Errorf("wrong reply: error %d, %d bytes", hdr.Error, len(body))
+	}
+
+	// The name must be terminated.
+	k.send(opSetvolname, 43, 7, msg("Backup Disk"))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected error decoding unterminated Setvolname")
+	}
+}
+
+func TestDecodeBmap(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opBmap, msg(uint64(12), uint32(4096), uint32(0)))
+	r, ok := req.(*BmapRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if r.Block != 12 || r.BlockSize != 4096 {
+		t.Errorf("wrong bmap: %v", r)
+	}
+	r.RespondError(ENOSYS)
+	k.recv()
+
+	k.send(opBmap, 43, 7, msg(uint64(12)))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected error decoding short Bmap")
+	}
+}
+
+func TestRenameFlagsString(t *testing.T) {
+	if g, e := (RenameNoReplace | RenameExchange).String(), "RenameNoReplace+RenameExchange"; g != e {
+		t.Errorf("wrong String: %q != %q", g, e)
+	}
+}
+
+func TestDecodeCreateTrailingWithoutSecurityContext(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	k.send(opCreate, 42, 7, msg(
+		uint32(syscall.O_WRONLY),
+		uint32(syscall.S_IFREG|0600),
+		"file\x00junk",
+	))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for trailing data without InitSecurityContext")
+	}
+}
+
+func TestInitSecurityContext(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(36), // version
+		uint32(65536), // max readahead
+		uint32(InitAsyncRead)|initExt,
+		uint32(InitSecurityContext>>32),
+	))
+	r, ok := req.(*InitRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Flags, InitAsyncRead|InitSecurityContext; g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+	if g, e := c.Protocol(), (Protocol{kernelVersion, kernelMinorVersion}); g != e {
+		t.Errorf("wrong negotiated protocol: %v != %v", g, e)
+	}
+
+	r.Respond(&InitResponse{
+		MaxWrite: 4096,
+		Flags:    InitSecurityContext,
+	})
+	_, body := k.recv()
+	if g, e := uintptr(len(body)), unsafe.Sizeof(initOut{})-outHeaderSize; g != e {
+		t.Fatalf("wrong reply size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[12:16]), uint32(initExt); g != e {
+		t.Errorf("wrong flags in reply: %#x != %#x", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[32:36]), uint32(InitSecurityContext>>32); g != e {
+		t.Errorf("wrong flags2 in reply: %#x != %#x", g, e)
+	}
+	if !c.hasFlag(InitSecurityContext) {
+		t.Error("InitSecurityContext was not negotiated")
+	}
+}
+
+func TestInitFlags2OldKernel(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// 7.31 has no flags2; the trailing word must be ignored
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(31),
+		uint32(65536),
+		uint32(InitAsyncRead),
+		uint32(InitPassthrough>>32),
+	))
+	r := req.(*InitRequest)
+	if g, e := r.Flags, InitAsyncRead; g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+
+	r.Respond(&InitResponse{
+		MaxWrite: 4096,
+		Flags:    InitAsyncRead | InitPassthrough,
+	})
+	_, body := k.recv()
+	if g, e := hostOrder.Uint32(body[12:16]), uint32(InitAsyncRead); g != e {
+		t.Errorf("wrong flags in reply: %#x != %#x", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[32:36]), uint32(0); g != e {
+		t.Errorf("wrong flags2 in reply: %#x != %#x", g, e)
+	}
+	if c.hasFlag(InitPassthrough) {
+		t.Error("InitPassthrough negotiated with an old kernel")
+	}
+}
+
+func TestInitLayouts(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// the 16 bytes of old kernels
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(12),
+		uint32(65536),
+		uint32(InitAsyncRead|InitBigWrites),
+	))
+	r := req.(*InitRequest)
+	if g, e := r.Flags, InitAsyncRead|InitBigWrites; g != e {
+		t.Errorf("short init: wrong flags: %v != %v", g, e)
+	}
+	r.Respond(&InitResponse{MaxWrite: 4096, Flags: InitBigWrites})
+	_, body := k.recv()
+	if g, e := len(body), initOutCompatSize-outHeaderSize; g != e {
+		t.Errorf("short init: wrong reply size: %d != %d", g, e)
+	}
+
+	// the whole struct, as sent since 7.36
+	req = k.request(c, opInit, msg(
+		uint32(7), uint32(36),
+		uint32(65536),
+		uint32(InitBigWrites|InitMaxPages)|initExt,
+		uint32(InitPassthrough>>32),
+		[11]uint32{},
+	))
+	r = req.(*InitRequest)
+	if g, e := r.Flags, InitBigWrites|InitMaxPages|InitPassthrough; g != e {
+		t.Errorf("long init: wrong flags: %v != %v", g, e)
+	}
+	r.Respond(&InitResponse{MaxWrite: 4096, Flags: InitBigWrites | InitMaxPages, MaxPages: 64})
+	_, body = k.recv()
+	if g, e := uintptr(len(body)), unsafe.Sizeof(initOut{})-outHeaderSize; g != e {
+		t.Fatalf("long init: wrong reply size: %d != %d", g, e)
+	}
+	if g, e := InitFlags(hostOrder.Uint32(body[12:16])), InitBigWrites|InitMaxPages; g != e {
+		t.Errorf("long init: wrong flags in reply: %v != %v", g, e)
+	}
+	off := unsafe.Offsetof(initOut{}.MaxPages) - outHeaderSize
+	if g, e := hostOrder.Uint16(body[off:]), uint16(64); g != e {
+		t.Errorf("long init: wrong max_pages: %d != %d", g, e)
+	}
+	if !c.hasFlag(InitMaxPages) {
+		t.Error("InitMaxPages was not negotiated")
+	}
+}
+
+func TestInitReplySizeOldKernel(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(12),
+		uint32(65536),
+		uint32(0),
+	))
+	r := req.(*InitRequest)
+	r.Respond(&InitResponse{MaxWrite: 4096})
+	_, body := k.recv()
+	if g, e := uintptr(len(body)), unsafe.Offsetof(initOut{}.TimeGran)-outHeaderSize; g != e {
+		t.Errorf("wrong reply size: %d != %d", g, e)
+	}
+}
+
+func TestInitMaxWriteSplice(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opInit, msg(
+		uint32(7), uint32(12),
+		uint32(65536),
+		uint32(InitSpliceWrite|InitSpliceMove),
+	))
+	r := req.(*InitRequest)
+	r.Respond(&InitResponse{
+		Flags:    InitSpliceWrite | InitSpliceMove,
+		MaxWrite: 1 << 20,
+	})
+	_, body := k.recv()
+	// splicing replies does not keep write data out of the buffer
+	// requests are read into
+	maxWriteOff := unsafe.Offsetof(initOut{}.MaxWrite) - outHeaderSize
+	if g, e := hostOrder.Uint32(body[maxWriteOff:]), uint32(maxWrite); g != e {
+		t.Errorf("MaxWrite not clamped: %d != %d", g, e)
+	}
+}
+
+func TestInitMaxWriteMaxPages(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.maxWriteLimit = 1 << 20
+
+	page := syscall.Getpagesize()
+	maxWriteOff := unsafe.Offsetof(initOut{}.MaxWrite) - outHeaderSize
+	maxPagesOff := unsafe.Offsetof(initOut{}.MaxPages) - outHeaderSize
+
+	// without InitMaxPages, the kernel does not take more than the
+	// default
+	req := k.request(c, opInit, msg(uint32(7), uint32(31), uint32(65536), uint32(0)))
+	req.(*InitRequest).Respond(&InitResponse{MaxWrite: 1 << 20})
+	_, body := k.recv()
+	if g, e := hostOrder.Uint32(body[maxWriteOff:]), uint32(maxWrite); g != e {
+		t.Errorf("MaxWrite without InitMaxPages: %d != %d", g, e)
+	}
+	if g, e := c.bufferSize(), bufSize; g != e {
+		t.Errorf("buffer size without InitMaxPages: %d != %d", g, e)
+	}
+
+	req = k.request(c, opInit, msg(uint32(7), uint32(31), uint32(65536), uint32(InitMaxPages)))
+	req.(*InitRequest).Respond(&InitResponse{MaxWrite: 4 << 20})
+	_, body = k.recv()
+	if g, e := hostOrder.Uint32(body[maxWriteOff:]), uint32(1<<20); g != e {
+		t.Errorf("wrong MaxWrite: %d != %d", g, e)
+	}
+	if g, e := InitFlags(hostOrder.Uint32(body[12:16])), InitMaxPages; g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+	if g, e := int(hostOrder.Uint16(body[maxPagesOff:])), (1<<20)/page; g != e {
+		t.Errorf("wrong MaxPages: %d != %d", g, e)
+	}
+	if !c.hasFlag(InitMaxPages) {
+		t.Error("InitMaxPages not negotiated")
+	}
+	if g, e := c.bufferSize(), page+1<<20; g != e {
+		t.Errorf("wrong buffer size: %d != %d", g, e)
+	}
+	if g, e := len(c.readBuffer()), page+1<<20; g != e {
+		t.Errorf("wrong read buffer size: %d != %d", g, e)
+	}
+}
+
+func TestInitWritebackCache(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	for _, offered := range []bool{true, false} {
+		flags := InitAsyncRead
+		if offered {
+			flags |= InitWritebackCache
+		}
+		req := k.request(c, opInit, msg(uint32(7), uint32(31), uint32(65536), uint32(flags))).(*InitRequest)
+		resp := &InitResponse{MaxWrite: 4096}
+		if g, e := resp.EnableWritebackCache(req), offered; g != e {
+			t.Errorf("offered=%v: EnableWritebackCache returned %v", offered, g)
+		}
+		// set by hand, it is not echoed either
+		resp.Flags |= InitWritebackCache
+		req.Respond(resp)
+		_, body := k.recv()
+		echoed := InitFlags(hostOrder.Uint32(body[12:16]))&InitWritebackCache != 0
+		if echoed != offered {
+			t.Errorf("offered=%v: echoed %v", offered, echoed)
+		}
+		if g, e := c.hasFlag(InitWritebackCache), offered; g != e {
+			t.Errorf("offered=%v: negotiated %v", offered, g)
+		}
+	}
+}
+
+func TestInitMaxStackDepth(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	off := unsafe.Offsetof(initOut{}.MaxStackDepth) - outHeaderSize
+	for _, tt := range []struct {
+		offered InitFlags
+		depth   uint32
+		want    uint32
+	}{
+		{InitPassthrough, 2, 2},
+		{InitPassthrough, 0, 1},
+		// only sent with passthrough
+		{0, 2, 0},
+	} {
+		req := k.request(c, opInit, msg(
+			uint32(7), uint32(40),
+			uint32(65536),
+			uint32(InitAsyncRead)|initExt,
+			uint32(tt.offered>>32),
+		)).(*InitRequest)
+		req.Respond(&InitResponse{
+			MaxWrite:      4096,
+			Flags:         InitPassthrough,
+			MaxStackDepth: tt.depth,
+		})
+		_, body := k.recv()
+		if g, e := hostOrder.Uint32(body[off:]), tt.want; g != e {
+			t.Errorf("offered=%v depth=%d: wrong max_stack_depth: %d != %d", tt.offered, tt.depth, g, e)
+		}
+		if g, e := c.Capabilities().MaxStackDepth, tt.want; g != e {
+			t.Errorf("offered=%v depth=%d: wrong capability: %d != %d", tt.offered, tt.depth, g, e)
+		}
+	}
+
+	req := k.request(c, opInit, msg(uint32(7), uint32(40), uint32(65536), uint32(initExt), uint32(InitPassthrough>>32)))
+	req.(*InitRequest).Respond(&InitResponse{Flags: InitPassthrough, MaxStackDepth: 3})
+	hdr, _ := k.recv()
+	if g, e := hdr.Error, -int32(syscall.EINVAL); g != e {
+		t.Errorf("too deep: wrong error: %d != %d", g, e)
+	}
+}
+
+func TestInitMaxBackground(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	off := unsafe.Offsetof(initOut{}.MaxBackground) - outHeaderSize
+	for _, tt := range []struct {
+		proto Protocol
+		want  bool
+	}{
+		// what we negotiate with current kernels
+		{Protocol{7, kernelMinorVersion}, kernelMinorVersion >= 13},
+		{Protocol{7, 12}, false},
+		{Protocol{7, 13}, true},
+	} {
+		req := k.request(c, opInit, msg(uint32(7), uint32(31), uint32(65536), uint32(0)))
+		c.proto = tt.proto
+		req.(*InitRequest).Respond(&InitResponse{
+			MaxWrite:            4096,
+			MaxBackground:       64,
+			CongestionThreshold: 48,
+		})
+		_, body := k.recv()
+		bg, ct := hostOrder.Uint16(body[off:]), hostOrder.Uint16(body[off+2:])
+		if tt.want && (bg != 64 || ct != 48) {
+			t.Errorf("%v: wrong background limits: %d, %d", tt.proto, bg, ct)
+		}
+		if !tt.want && (bg != 0 || ct != 0) {
+			t.Errorf("%v: background limits sent: %d, %d", tt.proto, bg, ct)
+		}
+	}
+}
+
+func TestInitTimeGran(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	newInit := func() *InitRequest {
+		return k.request(c, opInit, msg(uint32(7), uint32(31), uint32(65536), uint32(0))).(*InitRequest)
+	}
+	off := unsafe.Offsetof(initOut{}.TimeGran) - outHeaderSize
+
+	newInit().Respond(&InitResponse{MaxWrite: 4096, TimeGran: time.Second})
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	if g, e := hostOrder.Uint32(body[off:]), uint32(1e9); g != e {
+		t.Errorf("wrong time_gran: %d != %d", g, e)
+	}
+
+	for _, gran := range []time.Duration{-time.Second, 3 * time.Millisecond, 10 * time.Second} {
+		resp := &InitResponse{MaxWrite: 4096, TimeGran: gran}
+		if resp.Validate() == nil {
+			t.Errorf("%v: accepted", gran)
+		}
+		newInit().Respond(resp)
+		hdr, _ := k.recv()
+		if g, e := hdr.Error, -int32(syscall.EINVAL); g != e {
+			t.Errorf("%v: wrong error: %d != %d", gran, g, e)
+		}
+	}
+}
+
+func TestDecodeExtendedHeader(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+
+	// an extension of a type we don't know about
+	ext := msg(uint32(16), uint32(99), uint64(0))
+	k.sendExt(opReadlink, 42, 7, nil, ext)
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	r, ok := req.(*ReadlinkRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.TotalExtLen, uint16(2); g != e {
+		t.Errorf("wrong extension length: %d != %d", g, e)
+	}
+	if g, e := r.Pid, uint32(1234); g != e {
+		t.Errorf("wrong pid: %d != %d", g, e)
+	}
+}
+
+func TestDecodeExtendedHeaderOldKernel(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 8}
+
+	// before 7.38, the extension length is padding and must be
+	// ignored
+	k.sendExt(opGetattr, 42, 7, msg(uint32(0), uint32(0), uint64(0)), msg(uint64(0)))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if g, e := req.Hdr().TotalExtLen, uint16(0); g != e {
+		t.Errorf("wrong extension length: %d != %d", g, e)
+	}
+}
+
+func TestDecodeExtendedHeaderBadLength(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+
+	// total_extlen claims more than the message holds
+	k.dev.Write(msg(
+		uint32(inHeaderSize), uint32(opGetattr), uint64(42), uint64(7),
+		uint32(1000), uint32(1001), uint32(1234),
+		uint16(4), uint16(0),
+	))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a bad extension length")
+	}
+}
+
+func TestDecodeMkdirSecurityContextExtension(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+	c.flags = uint64(InitSecurityContext)
+
+	label := "label\x00"
+	ext := msg(
+		uint32(40), // size, padded to 8 bytes
+		uint32(1),  // nr_secctx
+		uint32(len(label)),
+		uint32(0),
+		"security.smack\x00",
+		label,
+		[]byte{0, 0, 0},
+	)
+	k.sendExt(opMkdir, 42, 7, msg(
+		uint32(0755), // mode
+		uint32(0),    // padding
+		"dir\x00",
+	), ext)
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	r, ok := req.(*MkdirRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Name, "dir"; g != e {
+		t.Errorf("wrong name: %q != %q", g, e)
+	}
+	if g, e := len(r.SecurityContext()), 1; g != e {
+		t.Fatalf("wrong number of security contexts: %d != %d", g, e)
+	}
+	if g, e := r.SecurityContext()[0].Name, "security.smack"; g != e {
+		t.Errorf("wrong security context name: %q != %q", g, e)
+	}
+	if g, e := string(r.SecurityContext()[0].Context), label; g != e {
+		t.Errorf("wrong security context: %q != %q", g, e)
+	}
+}
+
+func TestDecodeSupplementaryGroups(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+
+	ext := msg(
+		uint32(24), // size
+		uint32(extGroups),
+		uint32(3), // nr_groups
+		uint32(10), uint32(20), uint32(30),
+	)
+	k.sendExt(opMkdir, 42, 7, msg(
+		uint32(0755), // mode
+		uint32(0),    // padding
+		"dir\x00",
+	), ext)
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	r, ok := req.(*MkdirRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Name, "dir"; g != e {
+		t.Errorf("wrong name: %q != %q", g, e)
+	}
+	groups := r.SupplementaryGroups()
+	if g, e := len(groups), 3; g != e {
+		t.Fatalf("wrong number of groups: %d != %d", g, e)
+	}
+	for i, e := range []uint32{10, 20, 30} {
+		if g := groups[i]; g != e {
+			t.Errorf("wrong group %d: %d != %d", i, g, e)
+		}
+	}
+
+	// without the extension, there are no groups
+	k.send(opReadlink, 43, 7, nil)
+	req, err = c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if g := req.Hdr().SupplementaryGroups(); g != nil {
+		t.Errorf("unexpected groups: %v", g)
+	}
+}
+
+func TestDecodeSupplementaryGroupsShort(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+
+	// claims more groups than fit in the extension
+	k.sendExt(opReadlink, 42, 7, nil, msg(
+		uint32(16), uint32(extGroups),
+		uint32(2), uint32(10),
+	))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a short groups extension")
+	}
+}
+
+func TestDecodeExtensionSkipCorrupt(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.kernel = Protocol{7, 38}
+	c.SetSkipCorrupt(true)
+
+	// total_extlen claims more than the message holds
+	k.dev.Write(msg(
+		uint32(inHeaderSize), uint32(opGetattr), uint64(42), uint64(7),
+		uint32(1000), uint32(1001), uint32(1234),
+		uint16(4), uint16(0),
+	))
+	// claims more groups than fit in the extension
+	k.sendExt(opReadlink, 43, 7, nil, msg(
+		uint32(16), uint32(extGroups),
+		uint32(2), uint32(10),
+	))
+	k.send(opLookup, 44, 7, []byte("ok\x00"))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if r, ok := req.(*LookupRequest); !ok || r.ID != 44 {
+		t.Errorf("expected the good lookup, got %v", req)
+	}
+	for _, id := range []uint64{42, 43} {
+		hdr, _ := k.recv()
+		if hdr.Unique != id || hdr.Error != -int32(EIO) {
+			t.Errorf("expected EIO for %d, got %d for %d", id, hdr.Error, hdr.Unique)
+		}
+	}
+}
+
+func TestDecodeRead(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// before 7.9, readIn is 24 bytes and ends in padding
+	req := k.request(c, opRead, msg(
+		uint64(3),      // fh
+		uint64(8192),   // offset
+		uint32(4096),   // size
+		uint32(0xdead), // padding
+	))
+	r, ok := req.(*ReadRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Offset, int64(8192); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := r.Size, 4096; g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := r.ReadFlags, ReadFlags(0); g != e {
+		t.Errorf("padding decoded as read flags: %v", g)
+	}
+}
+
+func TestDecodeReadLockOwner(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opRead, msg(
+		uint64(3),    // fh
+		uint64(8192), // offset
+		uint32(4096), // size
+		uint32(ReadLockOwner),
+		uint64(0x1234), // lock owner
+		uint32(syscall.O_RDONLY|syscall.O_NONBLOCK),
+		uint32(0), // padding
+	))
+	r, ok := req.(*ReadRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Size, 4096; g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := r.ReadFlags, ReadLockOwner; g != e {
+		t.Errorf("wrong read flags: %v != %v", g, e)
+	}
+	if g, e := r.LockOwner, uint64(0x1234); g != e {
+		t.Errorf("wrong lock owner: %#x != %#x", g, e)
+	}
+	if g, e := r.FileFlags, OpenReadOnly|OpenFlags(syscall.O_NONBLOCK); g != e {
+		t.Errorf("wrong file flags: %v != %v", g, e)
+	}
+}
+
+func TestDecodeWrite(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opWrite, msg(
+		uint64(3),    // fh
+		uint64(8192), // offset
+		uint32(5),    // size
+		uint32(WriteCache),
+		"hello",
+		"junk", // not part of the data
+	))
+	r, ok := req.(*WriteRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Offset, int64(8192); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := r.Flags, WriteCache; g != e {
+		t.Errorf("wrong write flags: %v != %v", g, e)
+	}
+	if g, e := string(r.Data), "hello"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+}
+
+func TestDecodeWriteShort(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// size claims more data than the message holds
+	k.send(opWrite, 42, 7, msg(uint64(3), uint64(0), uint32(10), uint32(0), "hello"))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a truncated write")
+	}
+}
+
+func TestDecodeReleaseFlockUnlock(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opRelease, msg(
+		uint64(3), // fh
+		uint32(syscall.O_RDWR),
+		uint32(ReleaseFlush|ReleaseFlockUnlock),
+		uint64(0x123456789a), // lock owner
+	))
+	r, ok := req.(*ReleaseRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if !r.ReleaseFlags.FlockUnlock() {
+		t.Errorf("FlockUnlock not set: %v", r.ReleaseFlags)
+	}
+	if g, e := r.LockOwner, uint64(0x123456789a); g != e {
+		t.Errorf("wrong lock owner: %#x != %#x", g, e)
+	}
+}
+
+func TestDecodeGetlk(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// before 7.9, lkIn has no flags
+	req := k.request(c, opGetlk, msg(
+		uint64(3),      // fh
+		uint64(0xf00d), // owner
+		uint64(100),    // start
+		uint64(199),    // end
+		uint32(syscall.F_WRLCK),
+		uint32(1234), // pid
+	))
+	r, ok := req.(*GetlkRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.LockOwner, uint64(0xf00d); g != e {
+		t.Errorf("wrong lock owner: %#x != %#x", g, e)
+	}
+	want := FileLock{Start: 100, End: 199, Type: LockWrite, Pid: 1234}
+	if g := r.Lock; g != want {
+		t.Errorf("wrong lock: %v != %v", g, want)
+	}
+}
+
+func TestDecodeSetlk(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.proto = Protocol{7, 9}
+
+	body := func(typ uint32, end uint64, flags LockFlags) []byte {
+		return msg(
+			uint64(3),      // fh
+			uint64(0xf00d), // owner
+			uint64(4096),   // start
+			end,
+			typ,
+			uint32(1234), // pid
+			uint32(flags),
+			uint32(0), // padding
+		)
+	}
+
+	req := k.request(c, opSetlk, body(syscall.F_RDLCK, LockEnd, 0))
+	r, ok := req.(*SetlkRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if r.Sleep {
+		t.Error("Setlk decoded as sleeping")
+	}
+	want := FileLock{Start: 4096, End: LockEnd, Type: LockRead, Pid: 1234}
+	if g := r.Lock; g != want {
+		t.Errorf("wrong lock: %v != %v", g, want)
+	}
+
+	req = k.request(c, opSetlkw, body(syscall.F_UNLCK, 8191, LockFlock))
+	r, ok = req.(*SetlkRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if !r.Sleep {
+		t.Error("Setlkw decoded as not sleeping")
+	}
+	if g, e := r.Lock.Type, LockUnlock; g != e {
+		t.Errorf("wrong lock type: %v != %v", g, e)
+	}
+	if g, e := r.Lock.End, uint64(8191); g != e {
+		t.Errorf("wrong end: %d != %d", g, e)
+	}
+	if g, e := r.LockFlags, LockFlock; g != e {
+		t.Errorf("wrong lock flags: %v != %v", g, e)
+	}
+
+	// the short layout is not accepted once 7.9 is in use
+	k.send(opSetlk, 43, 7, body(syscall.F_RDLCK, LockEnd, 0)[:lkInCompatSize])
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a short lock message")
+	}
+}
+
+func TestDecodeReaddirplus(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opReaddirplus, msg(
+		uint64(3),    // fh
+		uint64(152),  // offset
+		uint32(4096), // size
+		uint32(0),    // padding
+	))
+	r, ok := req.(*ReadRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if !r.Dir || !r.Plus {
+		t.Errorf("wrong kind of read: dir=%v plus=%v", r.Dir, r.Plus)
+	}
+	if g, e := r.Offset, int64(152); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+}
+
+func TestDecodeFallocate(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opFallocate, msg(
+		uint64(3),    // fh
+		uint64(4096), // offset
+		uint64(8192), // length
+		uint32(FallocKeepSize|FallocPunchHole),
+		uint32(0), // padding
+	))
+	r, ok := req.(*FallocateRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Offset, int64(4096); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := r.Length, int64(8192); g != e {
+		t.Errorf("wrong length: %d != %d", g, e)
+	}
+	if g, e := r.Mode, FallocKeepSize|FallocPunchHole; g != e {
+		t.Errorf("wrong mode: %v != %v", g, e)
+	}
+
+	r.Respond()
+	hdr, body := k.recv()
+	if hdr.Error != 0 || hdr.Unique != 42 {
+		t.Errorf("wrong reply header: %+v", hdr)
+	}
+	if len(body) != 0 {
+		t.Errorf("reply has a body: %x", body)
+	}
+}
+
+func TestDecodeLseek(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opLseek, msg(
+		uint64(3),    // fh
+		uint64(4096), // offset
+		uint32(SeekHole),
+		uint32(0), // padding
+	))
+	r, ok := req.(*LseekRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Offset, int64(4096); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := r.Whence, SeekHole; g != e {
+		t.Errorf("wrong whence: %d != %d", g, e)
+	}
+
+	r.Respond(1 << 33)
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	if want := msg(uint64(1 << 33)); !bytes.Equal(body, want) {
+		t.Errorf("wrong lseekOut:\n got %x\nwant %x", body, want)
+	}
+}
+
+func TestDecodeCopyFileRange(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opCopyFileRange, msg(
+		uint64(3),     // fh_in
+		uint64(4096),  // off_in
+		uint64(9),     // nodeid_out
+		uint64(4),     // fh_out
+		uint64(1<<32), // off_out
+		uint64(65536), // len
+		uint64(0),     // flags
+	))
+	r, ok := req.(*CopyFileRangeRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Node, NodeID(7); g != e {
+		t.Errorf("wrong source node: %v != %v", g, e)
+	}
+	if g, e := r.HandleIn, HandleID(3); g != e {
+		t.Errorf("wrong source handle: %v != %v", g, e)
+	}
+	if g, e := r.OffsetIn, int64(4096); g != e {
+		t.Errorf("wrong source offset: %d != %d", g, e)
+	}
+	if g, e := r.NodeOut, NodeID(9); g != e {
+		t.Errorf("wrong destination node: %v != %v", g, e)
+	}
+	if g, e := r.HandleOut, HandleID(4); g != e {
+		t.Errorf("wrong destination handle: %v != %v", g, e)
+	}
+	if g, e := r.OffsetOut, int64(1<<32); g != e {
+		t.Errorf("wrong destination offset: %d != %d", g, e)
+	}
+	if g, e := r.Length, uint64(65536); g != e {
+		t.Errorf("wrong length: %d != %d", g, e)
+	}
+
+	r.Respond(1000)
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	if want := msg(uint32(1000), uint32(0)); !bytes.Equal(body, want) {
+		t.Errorf("wrong writeOut:\n got %x\nwant %x", body, want)
+	}
+}
+
+func TestDecodeIoctl(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opIoctl, msg(
+		uint64(3),          // fh
+		uint32(Ioctl32Bit), // flags
+		uint32(0xc0045401), // cmd
+		uint64(0x7fff0000), // arg
+		uint32(4),          // in_size
+		uint32(4),          // out_size
+		"ping",
+	))
+	r, ok := req.(*IoctlRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Flags, Ioctl32Bit; g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+	if g, e := r.Cmd, uint32(0xc0045401); g != e {
+		t.Errorf("wrong cmd: %#x != %#x", g, e)
+	}
+	if g, e := r.Arg, uint64(0x7fff0000); g != e {
+		t.Errorf("wrong arg: %#x != %#x", g, e)
+	}
+	if g, e := string(r.InData), "ping"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+	if g, e := r.OutSize, uint32(4); g != e {
+		t.Errorf("wrong out size: %d != %d", g, e)
+	}
+
+	// data past OutSize is not sent
+	r.Respond(&IoctlResponse{Result: 1, Data: []byte("pong!")})
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	want := msg(int32(1), uint32(0), uint32(0), uint32(0), "pong")
+	if !bytes.Equal(body, want) {
+		t.Errorf("wrong reply:\n got %x\nwant %x", body, want)
+	}
+}
+
+func TestIoctlRetry(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	resp := &IoctlResponse{
+		InIovs:  []IoctlIovec{{Base: 0x1000, Len: 16}},
+		OutIovs: []IoctlIovec{{Base: 0x1000, Len: 16}, {Base: 0x2000, Len: 64}},
+	}
+	r := &IoctlRequest{Header: Header{Conn: c, ID: 1}, Flags: IoctlUnrestricted}
+	r.Respond(resp)
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	want := msg(
+		int32(0), uint32(IoctlRetry), uint32(1), uint32(2),
+		uint64(0x1000), uint64(16),
+		uint64(0x1000), uint64(16),
+		uint64(0x2000), uint64(64),
+	)
+	if !bytes.Equal(body, want) {
+		t.Errorf("wrong retry:\n got %x\nwant %x", body, want)
+	}
+
+	// the kernel only retries unrestricted ioctls
+	r = &IoctlRequest{Header: Header{Conn: c, ID: 2}}
+	r.Respond(resp)
+	hdr, _ = k.recv()
+	if g, e := hdr.Error, -int32(EIO); g != e {
+		t.Errorf("wrong error for a restricted retry: %d != %d", g, e)
+	}
+}
+
+func TestDecodePoll(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	body := msg(
+		uint64(3),    // fh
+		uint64(0x55), // kh
+		uint32(PollScheduleNotify),
+		uint32(0x1|0x4), // events, POLLIN|POLLOUT
+	)
+	// before 7.21, events is padding
+	req := k.request(c, opPoll, body)
+	r, ok := req.(*PollRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if g, e := r.Handle, HandleID(3); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+	if g, e := r.Kh, uint64(0x55); g != e {
+		t.Errorf("wrong kernel poll handle: %#x != %#x", g, e)
+	}
+	if g, e := r.Flags, PollScheduleNotify; g != e {
+		t.Errorf("wrong poll flags: %v != %v", g, e)
+	}
+	if g, e := r.Events, uint32(0); g != e {
+		t.Errorf("padding decoded as events: %#x", g)
+	}
+
+	c.proto = Protocol{7, 21}
+	r = k.request(c, opPoll, body).(*PollRequest)
+	if g, e := r.Events, uint32(0x5); g != e {
+		t.Errorf("wrong events: %#x != %#x", g, e)
+	}
+
+	r.Respond(0x4)
+	hdr, out := k.recv()
+	if g, e := hdr.Unique, uint64(42); g != e {
+		t.Errorf("wrong request ID: %d != %d", g, e)
+	}
+	if want := msg(uint32(0x4), uint32(0)); !bytes.Equal(out, want) {
+		t.Errorf("wrong pollOut:\n got %x\nwant %x", out, want)
+	}
+}
+
+func TestDecodeBatchForget(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	k.send(opBatchForget, 42, 0, msg(
+		uint32(3), // count
+		uint32(0), // padding
+		uint64(2), uint64(1),
+		uint64(5), uint64(3),
+		uint64(9), uint64(1<<40),
+	))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := req.(*BatchForgetRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	want := []ForgetItem{{2, 1}, {5, 3}, {9, 1 << 40}}
+	if !reflect.DeepEqual(r.Forget, want) {
+		t.Errorf("wrong items: %v != %v", r.Forget, want)
+	}
+}
+
+func TestDecodeBatchForgetShort(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// count claims more records than the message holds; the largest
+	// count must neither overflow the bounds check nor be allocated
+	for _, count := range []uint32{2, 1 << 28, 0xffffffff} {
+		k.send(opBatchForget, 42, 0, msg(count, uint32(0), uint64(2), uint64(1)))
+		if _, err := c.ReadRequest(); err == nil {
+			t.Fatalf("expected an error for a batch forget of %d records", count)
+		}
+	}
+}
+
+func TestDecodeOpen(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opOpen, msg(
+		uint32(syscall.O_WRONLY|syscall.O_TRUNC),
+		uint32(OpenKillSuidgid),
+	))
+	r, ok := req.(*OpenRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if r.Dir {
+		t.Error("open decoded as opendir")
+	}
+	if g, e := r.Flags, OpenWriteOnly|OpenFlags(syscall.O_TRUNC); g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+	if g, e := r.OpenFlags, OpenKillSuidgid; g != e {
+		t.Errorf("wrong open flags: %v != %v", g, e)
+	}
+
+	k.send(opOpendir, 43, 7, msg(uint32(syscall.O_RDONLY)))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a short open message")
+	}
+}
+
+func TestDecodeGetattr(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// before 7.9, there is no getattr_in
+	req := k.request(c, opGetattr, nil)
+	r, ok := req.(*GetattrRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if r.HandleValid() {
+		t.Errorf("handle valid without getattr_in: %v", r)
+	}
+	if g, e := r.Handle, HandleID(0); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+}
+
+func TestDecodeGetattrHandle(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// fstat(2)
+	req := k.request(c, opGetattr, msg(uint32(GetattrFh), uint32(0), uint64(5)))
+	r, ok := req.(*GetattrRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	if !r.HandleValid() {
+		t.Errorf("handle not valid: %v", r)
+	}
+	if g, e := r.Handle, HandleID(5); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+
+	// stat(2)
+	req = k.request(c, opGetattr, msg(uint32(0), uint32(0), uint64(0)))
+	r = req.(*GetattrRequest)
+	if r.HandleValid() {
+		t.Errorf("handle valid for node-only getattr: %v", r)
+	}
+	if g, e := r.Handle, HandleID(0); g != e {
+		t.Errorf("wrong handle: %v != %v", g, e)
+	}
+
+	// a kernel without getattr_in
+	req = k.request(c, opGetattr, nil)
+	if r := req.(*GetattrRequest); r.HandleValid() {
+		t.Errorf("handle valid without getattr_in: %v", r)
+	}
+
+	k.send(opGetattr, 43, 7, msg(uint32(GetattrFh)))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a truncated getattr_in")
+	}
+}
+
+func TestRequestContextInterrupt(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	read := k.request(c, opRead, benchReadBody)
+	ctx := read.Context()
+	select {
+	case <-ctx.Done():
+		t.Fatal("context cancelled before the interrupt")
+	default:
+	}
+
+	k.send(opInterrupt, 43, 0, msg(uint64(42)))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := req.(*InterruptRequest); !ok || r.IntrID != 42 {
+		t.Fatalf("expected an interrupt for 42, got %v", req)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled by the interrupt")
+	}
+	if read.Context() != ctx {
+		t.Error("Context returned a different context")
+	}
+	read.RespondError(EINTR)
+	k.recv()
+
+	// a context asked for after the interrupt starts out cancelled
+	getattr := k.request(c, opGetattr, nil)
+	k.send(opInterrupt, 44, 0, msg(uint64(42)))
+	if _, err := c.ReadRequest(); err != nil {
+		t.Fatal(err)
+	}
+	if getattr.Context().Err() == nil {
+		t.Error("context of an interrupted request not cancelled")
+	}
+	getattr.RespondError(EINTR)
+	k.recv()
+
+	// requests without a response are never cancelled
+	forget := k.request(c, opForget, benchForgetBody)
+	if forget.Context().Err() != nil {
+		t.Error("context of a forget cancelled")
+	}
+}
+
+func TestDecodeInterruptDedup(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var dropped []droppedInterrupt
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(droppedInterrupt); ok {
+			dropped = append(dropped, msg)
+		}
+	}
+	c.SetInterruptDedup(true)
+
+	read := func() Request {
+		req, err := c.ReadRequest()
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		return req
+	}
+
+	k.send(opGetattr, 42, 7, nil)
+	getattr := read()
+	k.send(opInterrupt, 43, 0, msg(uint64(42)))
+	if r, ok := read().(*InterruptRequest); !ok || r.IntrID != 42 {
+		t.Fatalf("expected an interrupt for request 42, got %v", r)
+	}
+
+	// repeated interrupts are dropped
+	k.send(opInterrupt, 44, 0, msg(uint64(42)))
+	k.send(opInterrupt, 45, 0, msg(uint64(42)))
+	k.send(opGetattr, 46, 7, nil)
+	if r, ok := read().(*GetattrRequest); !ok || r.ID != 46 {
+		t.Fatalf("expected getattr 46 after dropping duplicates, got %v", r)
+	}
+	if g, e := len(dropped), 2; g != e {
+		t.Errorf("wrong number of dropped interrupts: %d != %d", g, e)
+	}
+
+	// once the request is done, interrupts for it are delivered again
+	getattr.RespondError(EINTR)
+	k.recv()
+	k.send(opInterrupt, 47, 0, msg(uint64(42)))
+	if _, ok := read().(*InterruptRequest); !ok {
+		t.Fatal("expected an interrupt for a request no longer in flight")
+	}
+
+	stats := c.Stats()
+	if g, e := stats.Interrupts, uint64(4); g != e {
+		t.Errorf("wrong interrupt count: %d != %d", g, e)
+	}
+	if g, e := stats.DroppedInterrupts, uint64(2); g != e {
+		t.Errorf("wrong dropped interrupt count: %d != %d", g, e)
+	}
+
+	// without deduplication, everything is delivered
+	c.SetInterruptDedup(false)
+	k.send(opInterrupt, 48, 0, msg(uint64(46)))
+	k.send(opInterrupt, 49, 0, msg(uint64(46)))
+	for i := 0; i < 2; i++ {
+		if _, ok := read().(*InterruptRequest); !ok {
+			t.Fatal("expected an interrupt with deduplication off")
+		}
+	}
+}
+
+func TestInterruptOrdering(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var early []earlyInterrupt
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(earlyInterrupt); ok {
+			early = append(early, msg)
+		}
+	}
+
+	read := func() Request {
+		req, err := c.ReadRequest()
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		return req
+	}
+
+	// the interrupt comes after the response: delivered, and the
+	// registry is left alone
+	k.send(opGetattr, 42, 7, nil)
+	read().RespondError(ENOSYS)
+	k.recv()
+	k.send(opInterrupt, 43, 0, msg(uint64(42)))
+	r, ok := read().(*InterruptRequest)
+	if !ok || r.IntrID != 42 {
+		t.Fatalf("expected an interrupt for request 42, got %v", r)
+	}
+	r.Respond()
+	if g, e := len(c.inflight), 0; g != e {
+		t.Errorf("interrupt after completion left %d requests in flight", g)
+	}
+
+	// the interrupt overtakes its request: the kernel is asked to
+	// resend it, and the server never sees it
+	k.send(opInterrupt, 45, 0, msg(uint64(44)))
+	k.send(opGetattr, 44, 7, nil)
+	getattr := read()
+	if g, e := getattr.Hdr().ID, RequestID(44); g != e {
+		t.Fatalf("expected getattr 44, got %v", getattr)
+	}
+	hdr, _ := k.recv()
+	if g, e := hdr.Unique, uint64(45); g != e {
+		t.Errorf("wrong request answered: %d != %d", g, e)
+	}
+	if g, e := hdr.Error, -int32(syscall.EAGAIN); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+	if g, e := len(early), 1; g != e {
+		t.Errorf("wrong number of early interrupts: %d != %d", g, e)
+	}
+
+	// resent, it is delivered
+	k.send(opInterrupt, 47, 0, msg(uint64(44)))
+	if r, ok := read().(*InterruptRequest); !ok || r.IntrID != 44 {
+		t.Fatalf("expected the resent interrupt, got %v", r)
+	}
+	getattr.RespondError(EINTR)
+	k.recv()
+	if g, e := len(c.inflight), 0; g != e {
+		t.Errorf("%d requests left in flight", g)
+	}
+}
+
+func TestDecodeSkipCorrupt(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// lookup names must be NUL-terminated
+	k.send(opLookup, 42, 7, []byte("foo"))
+	if _, err := c.ReadRequest(); err == nil {
+		t.Fatal("expected an error for a malformed lookup")
+	}
+
+	c.SetSkipCorrupt(true)
+	k.send(opLookup, 43, 7, []byte("foo"))
+	k.send(opLookup, 44, 7, []byte("bar\x00"))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if r, ok := req.(*LookupRequest); !ok || r.ID != 44 || r.Name != "bar" {
+		t.Errorf("expected the good lookup, got %v", req)
+	}
+
+	// the skipped request was failed
+	hdr, _ := k.recv()
+	if g, e := hdr.Unique, uint64(43); g != e {
+		t.Errorf("wrong request answered: %d != %d", g, e)
+	}
+	if g, e := hdr.Error, -int32(EIO); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+}
+
+// benchRequest is a request message built once, to be fed to
+// ReadRequest over and over.
+type benchRequest struct {
+	c  *Conn
+	k  *testKernel
+	m  []byte
+	fd int
+}
+
+func newBenchRequest(tb testing.TB, opcode uint32, node NodeID, body []byte) *benchRequest {
+	c, k := newTestConn(tb)
+	hdr := msg(
+		uint32(inHeaderSize+len(body)),
+		opcode,
+		uint64(42),
+		uint64(node),
+		uint32(1000), // uid
+		uint32(1001), // gid
+		uint32(1234), // pid
+		uint32(0),    // total_extlen, padding
+	)
+	return &benchRequest{
+		c:  c,
+		k:  k,
+		m:  append(hdr, body...),
+		fd: int(k.dev.Fd()),
+	}
+}
+
+func (br *benchRequest) Close() {
+	br.c.Close()
+	br.k.Close()
+}
+
+// read sends the message and decodes it. The request is left in
+// flight; as all of them use the same ID, that does not grow the
+// in-flight registry.
+func (br *benchRequest) read(tb testing.TB) Request {
+	if _, err := syscall.Write(br.fd, br.m); err != nil {
+		tb.Fatalf("kernel write: %v", err)
+	}
+	req, err := br.c.ReadRequest()
+	if err != nil {
+		tb.Fatalf("ReadRequest: %v", err)
+	}
+	return req
+}
+
+func benchmarkReadRequest(b *testing.B, opcode uint32, body []byte) {
+	br := newBenchRequest(b, opcode, 7, body)
+	defer br.Close()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(br.m)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// as if responded to, so writes give back their buffer
+		br.read(b).Hdr().release()
+	}
+}
+
+var (
+	benchLookupBody = msg("some-file-name\x00")
+	benchReadBody   = msg(uint64(3), uint64(8192), uint32(4096), uint32(0))
+	benchWriteBody  = msg(uint64(3), uint64(8192), uint32(4096), uint32(0), make([]byte, 4096))
+	benchForgetBody = msg(uint64(1))
+)
+
+func BenchmarkReadRequestLookup(b *testing.B) {
+	benchmarkReadRequest(b, opLookup, benchLookupBody)
+}
+
+func BenchmarkReadRequestGetattr(b *testing.B) {
+	benchmarkReadRequest(b, opGetattr, nil)
+}
+
+func BenchmarkReadRequestRead(b *testing.B) {
+	benchmarkReadRequest(b, opRead, benchReadBody)
+}
+
+func BenchmarkReadRequestWrite(b *testing.B) {
+	benchmarkReadRequest(b, opWrite, benchWriteBody)
+}
+
+func BenchmarkReadRequestForget(b *testing.B) {
+	benchmarkReadRequest(b, opForget, benchForgetBody)
+}
+
+// benchmarkWrite measures writing 1 MiB with requests of at most
+// maxWrite bytes each, negotiated as a server with the MaxWrite mount
+// option would.
+func benchmarkWrite(b *testing.B, limit uint32) {
+	c, k := newTestConn(b)
+	defer c.Close()
+	defer k.Close()
+	// room for the largest datagrams on both ends
+	for _, f := range []*os.File{c.dev, k.dev} {
+		for _, opt := range []int{syscall.SO_SNDBUF, syscall.SO_RCVBUF} {
+			if err := syscall.SetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, opt, 4<<20); err != nil {
+				b.Skipf("socket buffers: %v", err)
+			}
+		}
+	}
+	c.maxWriteLimit = limit
+
+	k.send(opInit, 1, 0, msg(uint32(7), uint32(31), uint32(65536), uint32(InitMaxPages)))
+	req, err := c.ReadRequest()
+	if err != nil {
+		b.Fatalf("ReadRequest: %v", err)
+	}
+	req.(*InitRequest).Respond(&InitResponse{MaxWrite: limit})
+	k.recv()
+	chunk := int(atomic.LoadUint32(&c.maxWrite))
+
+	const total = 1 << 20
+	body := msg(uint64(3), uint64(0), uint32(chunk), uint32(0), make([]byte, chunk))
+	m := append(msg(
+		uint32(inHeaderSize+len(body)), uint32(opWrite), uint64(2), uint64(7),
+		uint32(1000), uint32(1001), uint32(1234), uint32(0),
+	), body...)
+	fd := int(k.dev.Fd())
+	reply := make([]byte, 64)
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := 0; off < total; off += chunk {
+			if _, err := syscall.Write(fd, m); err != nil {
+				b.Fatalf("kernel write: %v", err)
+			}
+			req, err := c.ReadRequest()
+			if err != nil {
+				b.Fatalf("ReadRequest: %v", err)
+			}
+			w := req.(*WriteRequest)
+			w.Respond(&WriteResponse{Size: len(w.Data)})
+			if _, err := k.dev.Read(reply); err != nil {
+				b.Fatalf("kernel read: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkWrite1MiBDefault(b *testing.B) {
+	benchmarkWrite(b, maxWrite)
+}
+
+func BenchmarkWrite1MiBMaxPages(b *testing.B) {
+	benchmarkWrite(b, 1<<20)
+}
+
+// TestReadRequestAllocs guards the allocations of the decode path.
+// Each request costs its Request value plus the boxing of the read
+// buffer as it goes back into the pool; anything more is a
+// regression.
+func TestReadRequestAllocs(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode uint32
+		body   []byte
+		allocs float64
+	}{
+		// the name string is one more
+		{"lookup", opLookup, benchLookupBody, 3},
+		{"getattr", opGetattr, nil, 2},
+		{"read", opRead, benchReadBody, 2},
+		// the data is not copied, but the request holds on to the
+		// read buffer
+		{"write", opWrite, benchWriteBody, 3},
+		{"forget", opForget, benchForgetBody, 2},
+	}
+	for _, tt := range tests {
+		br := newBenchRequest(t, tt.opcode, 7, tt.body)
+		got := testing.AllocsPerRun(100, func() {
+			br.read(t).Hdr().release()
+		})
+		br.Close()
+		if got > tt.allocs {
+			t.Errorf("%s: %v allocations per request, want at most %v", tt.name, got, tt.allocs)
+		}
+	}
+}
+
+func TestRequestOpName(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	tests := []struct {
+		opcode uint32
+		body   []byte
+		name   string
+	}{
+		{opLookup, benchLookupBody, "lookup"},
+		{opGetattr, nil, "getattr"},
+		{opRead, benchReadBody, "read"},
+		{opReaddir, benchReadBody, "readdir"},
+		{opReaddirplus, benchReadBody, "readdirplus"},
+		{opLseek, msg(uint64(3), uint64(0), uint32(SeekData), uint32(0)), "lseek"},
+	}
+	for _, tt := range tests {
+		req := k.request(c, tt.opcode, tt.body)
+		if g, e := req.OpName(), tt.name; g != e {
+			t.Errorf("wrong name for %T: %q != %q", req, g, e)
+		}
+	}
+
+	h := &Header{Opcode: 999}
+	if g, e := h.OpName(), "opcode999"; g != e {
+		t.Errorf("wrong name for an unknown opcode: %q != %q", g, e)
+	}
+}
+
+func TestStatsMaxSizes(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	data := make([]byte, 64*1024)
+	w := k.request(c, opWrite, msg(uint64(3), uint64(0), uint32(len(data)), uint32(0), data)).(*WriteRequest)
+	g := k.request(c, opGetattr, nil)
+
+	w.Respond(&WriteResponse{Size: len(data)})
+	k.recv()
+	g.RespondError(ENOENT)
+	k.recv()
+
+	stats := c.Stats()
+	if g, e := stats.MaxRequestSize, uint64(inHeaderSize+writeInSize+len(data)); g != e {
+		t.Errorf("wrong request high-water mark: %d != %d", g, e)
+	}
+	if g, e := stats.MaxResponseSize, uint64(unsafe.Sizeof(writeOut{})); g != e {
+		t.Errorf("wrong response high-water mark: %d != %d", g, e)
+	}
+}
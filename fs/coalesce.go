@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/bpowers/fuse"
+)
+
+// maxCoalescedWrite is the most data buffered for a single handle.
+// Writes at least this large are passed to the handle as they are.
+const maxCoalescedWrite = 128 * 1024
+
+// writeBuffer holds adjacent writes to a handle that have been
+// acknowledged to the kernel but not yet passed to the handle.
+type writeBuffer struct {
+	req   fuse.WriteRequest
+	timer *time.Timer
+}
+
+// bufferWrite adds r to the write buffer of sh. If r does not continue
+// the buffered data, that data is written out first. It reports false
+// if r is too large to buffer and must be passed to the handle by the
+// caller. A non-nil error belongs to an earlier, already acknowledged
+// write, and r has not been buffered.
+func (sh *serveHandle) bufferWrite(ctx context.Context, r *fuse.WriteRequest, window time.Duration) (bool, error) {
+	sh.wmu.Lock()
+	defer sh.wmu.Unlock()
+
+	if b := sh.wbuf; b != nil {
+		end := b.req.Offset + int64(len(b.req.Data))
+		if end != r.Offset || b.req.Flags != r.Flags || len(b.req.Data)+len(r.Data) > maxCoalescedWrite {
+			sh.writeOutLocked(ctx)
+		}
+	}
+	if err := sh.werr; err != nil {
+		sh.werr = nil
+		return false, err
+	}
+	if len(r.Data) >= maxCoalescedWrite {
+		return false, nil
+	}
+
+	if sh.wbuf == nil {
+		b := &writeBuffer{req: *r}
+		// the request buffer is reused once r has been answered
+		b.req.Data = append(make([]byte, 0, len(r.Data)), r.Data...)
+		b.timer = time.AfterFunc(window, func() {
+			sh.wmu.Lock()
+			defer sh.wmu.Unlock()
+			if sh.wbuf == b {
+				sh.writeOutLocked(context.Background())
+			}
+		})
+		sh.wbuf = b
+		return true, nil
+	}
+	sh.wbuf.req.Data = append(sh.wbuf.req.Data, r.Data...)
+	return true, nil
+}
+
+// writeOut passes any buffered writes to the handle. Errors are kept
+// for the next Write, Flush, Fsync or Release of the handle.
+func (sh *serveHandle) writeOut(ctx context.Context) {
+	sh.wmu.Lock()
+	defer sh.wmu.Unlock()
+	sh.writeOutLocked(ctx)
+}
+
+func (sh *serveHandle) writeOutLocked(ctx context.Context) {
+	b := sh.wbuf
+	if b == nil {
+		return
+	}
+	sh.wbuf = nil
+	b.timer.Stop()
+
+	h := sh.handle.(HandleWriter)
+	resp := &fuse.WriteResponse{}
+	err := h.Write(ctx, &b.req, resp)
+	if err == nil && resp.Size != len(b.req.Data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil && sh.werr == nil {
+		sh.werr = err
+	}
+}
+
+// flushWrites passes any buffered writes to the handle, and returns
+// the first error from writes that were already acknowledged.
+func (sh *serveHandle) flushWrites(ctx context.Context) error {
+	sh.wmu.Lock()
+	defer sh.wmu.Unlock()
+	sh.writeOutLocked(ctx)
+	err := sh.werr
+	sh.werr = nil
+	return err
+}
+
+// writeOutNode writes out the buffered writes of every handle open on
+// node, so that its attributes reflect them.
+func (c *serveConn) writeOutNode(ctx context.Context, node fuse.NodeID) {
+	if c.coalesce == 0 {
+		return
+	}
+	var handles []*serveHandle
+	c.meta.Lock()
+	for _, sh := range c.handle {
+		if sh != nil && sh.nodeID == node {
+			handles = append(handles, sh)
+		}
+	}
+	c.meta.Unlock()
+	for _, sh := range handles {
+		sh.writeOut(ctx)
+	}
+}
@@ -1,14 +1,26 @@
 package fs_test
 
 import (
+	"encoding/binary"
 	"errors"
 	"flag"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
+	"unsafe"
 )
 
+// hostOrder is the byte order of the numbers in FUSE replies.
+var hostOrder binary.ByteOrder = binary.BigEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		hostOrder = binary.LittleEndian
+	}
+}
+
 var childHelpers = map[string]func(){}
 
 type childProcess struct {
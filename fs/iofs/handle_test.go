@@ -0,0 +1,64 @@
+// +build go1.16
+
+package iofs
+
+import (
+	"bytes"
+	"io/fs"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"golang.org/x/net/context"
+)
+
+// seekFile is an fs.File that can seek, but not read at an offset.
+type seekFile struct {
+	r *bytes.Reader
+}
+
+func (f seekFile) Stat() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f seekFile) Close() error               { return nil }
+
+func (f seekFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f seekFile) Seek(off int64, whence int) (int64, error) {
+	n, err := f.r.Seek(off, whence)
+	// give a concurrent read the chance to move the offset
+	runtime.Gosched()
+	return n, err
+}
+
+func TestReadSeekerConcurrent(t *testing.T) {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	h := &fileHandle{f: seekFile{bytes.NewReader(data)}}
+
+	const size = 512
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				off := int64((g*100+i)%(len(data)/size)) * size
+				req := &fuse.ReadRequest{Offset: off, Size: size}
+				var resp fuse.ReadResponse
+				if err := h.Read(context.Background(), req, &resp); err != nil {
+					t.Errorf("Read: %v", err)
+					return
+				}
+				if !bytes.Equal(resp.Data, data[off:off+size]) {
+					t.Errorf("wrong data at %d", off)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
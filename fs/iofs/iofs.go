@@ -0,0 +1,192 @@
+// +build go1.16
+
+// Package iofs serves an io/fs file system, such as an embed.FS or a
+// zip archive, as a read-only FUSE file system.
+//
+//	c, err := fuse.Mount(dir, fuse.ReadOnly())
+//	...
+//	err = fs.Serve(c, iofs.New(fsys), nil)
+//
+// The contents of fsys are assumed not to change while served.
+package iofs // import "github.com/bpowers/fuse/fs/iofs"
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/bpowers/fuse"
+	fusefs "github.com/bpowers/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// New returns a file system serving the contents of fsys.
+func New(fsys fs.FS) fusefs.FS {
+	return fileSystem{fsys}
+}
+
+type fileSystem struct {
+	fsys fs.FS
+}
+
+var _ = fusefs.FS(fileSystem{})
+
+func (f fileSystem) Root() (fusefs.Node, error) {
+	fi, err := fs.Stat(f.fsys, ".")
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return &node{fsys: f.fsys, name: ".", info: fi}, nil
+}
+
+// node is a file or directory in fsys. Its metadata is read once, at
+// lookup.
+type node struct {
+	fusefs.NodeRef
+	fsys fs.FS
+	name string
+	info fs.FileInfo
+}
+
+var _ = fusefs.Node(&node{})
+var _ = fusefs.NodeStringLookuper(&node{})
+var _ = fusefs.NodeOpener(&node{})
+
+func (n *node) Attr(a *fuse.Attr) {
+	// read-only, whatever fsys says
+	a.Mode = n.info.Mode() &^ 0222
+	a.Size = uint64(n.info.Size())
+	a.Mtime = n.info.ModTime()
+	a.Ctime = a.Mtime
+	a.Atime = a.Mtime
+	a.Nlink = 1
+	if n.info.IsDir() {
+		a.Nlink = 2
+	}
+}
+
+func (n *node) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	if !n.info.IsDir() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	p := path.Join(n.name, name)
+	fi, err := fs.Stat(n.fsys, p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return &node{fsys: n.fsys, name: p, info: fi}, nil
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	if n.info.IsDir() {
+		return &dirHandle{node: n}, nil
+	}
+	f, err := n.fsys.Open(n.name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	// the contents never change
+	resp.Flags |= fuse.OpenKeepCache
+	return &fileHandle{f: f}, nil
+}
+
+type dirHandle struct {
+	node *node
+}
+
+var _ = fusefs.HandleReadDirAller(&dirHandle{})
+
+func (h *dirHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := fs.ReadDir(h.node.fsys, h.node.name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	dirents := make([]fuse.Dirent, 0, len(entries))
+	for _, e := range entries {
+		de := fuse.Dirent{
+			Name: e.Name(),
+			Type: fuse.DT_File,
+		}
+		switch {
+		case e.IsDir():
+			de.Type = fuse.DT_Dir
+		case e.Type()&fs.ModeSymlink != 0:
+			de.Type = fuse.DT_Link
+		}
+		dirents = append(dirents, de)
+	}
+	return dirents, nil
+}
+
+// fileHandle reads from an open file of fsys. Files implementing
+// io.ReaderAt or io.Seeker can be read at any offset; others only
+// sequentially.
+type fileHandle struct {
+	f fs.File
+
+	// Reads can be concurrent, as with readahead. mu keeps a seek
+	// and the read following it together, and guards off.
+	mu sync.Mutex
+	// offset of the next sequential read
+	off int64
+}
+
+var _ = fusefs.HandleReader(&fileHandle{})
+var _ = fusefs.HandleReleaser(&fileHandle{})
+
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	var n int
+	var err error
+	switch f := h.f.(type) {
+	case io.ReaderAt:
+		n, err = f.ReadAt(buf, req.Offset)
+	case io.Seeker:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+			return toErrno(err)
+		}
+		n, err = io.ReadFull(h.f, buf)
+	default:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if req.Offset != h.off {
+			return fuse.Errno(syscall.ESPIPE)
+		}
+		n, err = io.ReadFull(h.f, buf)
+		h.off += int64(n)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return toErrno(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.f.Close()
+}
+
+// toErrno maps the errors of io/fs to the errno the kernel should see.
+func toErrno(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fuse.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return fuse.EPERM
+	case errors.Is(err, fs.ErrInvalid):
+		return fuse.Errno(syscall.EINVAL)
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return fuse.Errno(errno)
+	}
+	return err
+}
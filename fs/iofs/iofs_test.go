@@ -0,0 +1,101 @@
+// +build go1.16
+
+package iofs_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fs"
+	"github.com/bpowers/fuse/fs/iofs"
+	"github.com/bpowers/fuse/testkernel"
+)
+
+func TestMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hello.txt":     {Data: []byte("hello, world\n"), Mode: 0644},
+		"sub/other.txt": {Data: []byte("other\n")},
+	}
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, iofs.New(fsys), nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	if _, err := s.Lookup(testkernel.RootID, "missing"); err != fuse.ENOENT {
+		t.Errorf("expected ENOENT for a missing file, got %v", err)
+	}
+
+	e, err := s.Lookup(testkernel.RootID, "hello.txt")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if g, e := e.Size, uint64(13); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if _, err := s.Getattr(e.Node); err != nil {
+		t.Errorf("Getattr: %v", err)
+	}
+	if _, err := s.Open(e.Node, fuse.OpenReadWrite); err != fuse.EPERM {
+		t.Errorf("expected EPERM opening for writing, got %v", err)
+	}
+	h, err := s.Open(e.Node, fuse.OpenReadOnly)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := s.Read(e.Node, h, 7, 4096)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if g, e := string(data), "world\n"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+	if err := s.Release(e.Node, h, fuse.OpenReadOnly); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+
+	dh, err := s.Opendir(testkernel.RootID)
+	if err != nil {
+		t.Fatalf("Opendir: %v", err)
+	}
+	dirents, err := s.Readdir(testkernel.RootID, dh, 0, 4096)
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	want := []struct {
+		name string
+		typ  fuse.DirentType
+	}{
+		{"hello.txt", fuse.DT_File},
+		{"sub", fuse.DT_Dir},
+	}
+	if g, e := len(dirents), len(want); g != e {
+		t.Fatalf("wrong number of entries: %d != %d: %v", g, e, dirents)
+	}
+	for i, w := range want {
+		if g, e := dirents[i].Name, w.name; g != e {
+			t.Errorf("entry %d: wrong name: %q != %q", i, g, e)
+		}
+		if g, e := dirents[i].Type, w.typ; g != e {
+			t.Errorf("entry %d: wrong type: %v != %v", i, g, e)
+		}
+	}
+	if err := s.Releasedir(testkernel.RootID, dh); err != nil {
+		t.Errorf("Releasedir: %v", err)
+	}
+}
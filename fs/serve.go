@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -111,6 +113,14 @@ type NodeGetattrer interface {
 	//
 	// If this method is not implemented, the attributes will be
 	// generated based on Attr(), with zero values filled in.
+	//
+	// The attributes may depend on the caller in req.Header, for
+	// example to show each user their own view of the file. Nothing
+	// here caches them, but the kernel does: leave resp.AttrValid
+	// zero, and set the default attribute timeout to zero with
+	// fuse.Conn.SetCacheTimeouts so that lookups are not cached
+	// either. Otherwise one caller sees the attributes fetched for
+	// another.
 	Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error
 }
 
@@ -203,6 +213,9 @@ type NodeOpener interface {
 type NodeCreater interface {
 	// Create creates a new directory entry in the receiver, which
 	// must be a directory.
+	//
+	// If req.IsExclusive, an existing entry must make Create fail
+	// with EEXIST, checked atomically with the creation.
 	Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (Node, Handle, error)
 }
 
@@ -212,9 +225,16 @@ type NodeForgetter interface {
 	//
 	// Forget is not necessarily seen on unmount, as all nodes are
 	// implicitly forgotten as part part of the unmount.
+	//
+	// Forgets are processed one at a time, apart from other
+	// requests: a slow Forget delays other forgets, but not the
+	// requests processes are waiting on.
 	Forget()
 }
 
+// NodeRenamer renames req.OldName in the receiver to req.NewName in
+// newDir. Implementations that do not support a requested
+// req.Flags bit should return fuse.Errno(syscall.EINVAL).
 type NodeRenamer interface {
 	Rename(ctx context.Context, req *fuse.RenameRequest, newDir Node) error
 }
@@ -285,6 +305,14 @@ type HandleFlusher interface {
 	Flush(ctx context.Context, req *fuse.FlushRequest) error
 }
 
+type HandleGetattrer interface {
+	// Getattr obtains the standard metadata for the file open as
+	// the receiver. It is used instead of the node's Getattr when
+	// the kernel asks through an open handle, see
+	// fuse.GetattrRequest.HandleValid.
+	Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error
+}
+
 type HandleReadAller interface {
 	ReadAll(ctx context.Context) ([]byte, error)
 }
@@ -333,6 +361,22 @@ type Server struct {
 	//
 	// See fuse.Debug for the rules that log functions must follow.
 	Debug func(msg interface{})
+
+	// Xattrs are extended attributes served for every node, such as
+	// feature flags that tools probe for. They are answered before
+	// the node is consulted, are added to every Listxattr reply, and
+	// cannot be set or removed. Must not be changed once Serve has
+	// been called.
+	Xattrs map[string][]byte
+
+	// If non-zero, small adjacent writes to the same handle are
+	// acknowledged right away and passed to HandleWriter as one
+	// larger write. Buffered data is written out when a write does
+	// not continue it, before a Read, Getattr or Setattr of the
+	// file, on Flush, Fsync and Release, and at the latest after
+	// this long. An error from a buffered write is returned by the
+	// next Write, Flush, Fsync or Release of the handle.
+	CoalesceWrites time.Duration
 }
 
 // Serve serves the FUSE connection by making calls to the methods
@@ -340,9 +384,12 @@ type Server struct {
 // when the connection has been closed or an unexpected error occurs.
 func (s *Server) Serve(c *fuse.Conn) error {
 	sc := serveConn{
+		conn:         c,
 		fs:           s.FS,
 		debug: s.Debug,
 		dynamicInode: GenerateDynamicInode,
+		xattrs:       s.Xattrs,
+		coalesce:     s.CoalesceWrites,
 	}
 	if dyn, ok := sc.fs.(FSInodeGenerator); ok {
 		sc.dynamicInode = dyn.GenerateInode
@@ -355,6 +402,16 @@ func (s *Server) Serve(c *fuse.Conn) error {
 	sc.node = append(sc.node, nil, &serveNode{inode: 1, node: root, refs: 1})
 	sc.handle = append(sc.handle, nil)
 
+	// Forgets get no response, so nobody is waiting on them; serve
+	// them on the side instead of with a goroutine each.
+	forgets := make(chan fuse.Request, forgetQueueLen)
+	defer close(forgets)
+	go func() {
+		for req := range forgets {
+			sc.serve(req)
+		}
+	}()
+
 	for {
 		req, err := c.ReadRequest()
 		if err != nil {
@@ -364,11 +421,24 @@ func (s *Server) Serve(c *fuse.Conn) error {
 			return err
 		}
 
+		switch req.(type) {
+		case *fuse.ForgetRequest, *fuse.BatchForgetRequest:
+			select {
+			case forgets <- req:
+				continue
+			default:
+				// queue is full, don't hold up the read loop
+			}
+		}
 		go sc.serve(req)
 	}
 	return nil
 }
 
+// Number of forgets that can wait to be served before the read loop
+// starts serving them concurrently like other requests.
+const forgetQueueLen = 1024
+
 // Serve serves a FUSE connection with the default settings. See
 // Server.Serve.
 func Serve(c *fuse.Conn, fs FS, debug func(msg interface{})) error {
@@ -383,6 +453,7 @@ type nothing struct{}
 
 type serveConn struct {
 	meta         sync.Mutex
+	conn         *fuse.Conn
 	fs           FS
 	node         []*serveNode
 	handle       []*serveHandle
@@ -391,6 +462,22 @@ type serveConn struct {
 	nodeGen      uint64
 	debug        func(msg interface{})
 	dynamicInode func(parent uint64, name string) uint64
+	xattrs       map[string][]byte
+	coalesce     time.Duration
+
+	// opcodes already logged as unhandled, protected by meta
+	unhandled map[uint32]bool
+}
+
+// xattrNames returns the names of the server-wide extended
+// attributes, in sorted order.
+func (c *serveConn) xattrNames() []string {
+	names := make([]string, 0, len(c.xattrs))
+	for name := range c.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type serveRequest struct {
@@ -416,6 +503,11 @@ type serveHandle struct {
 	handle   Handle
 	d atomic.Value // []byte
 	nodeID   fuse.NodeID
+
+	// coalesced writes, see Server.CoalesceWrites
+	wmu  sync.Mutex
+	wbuf *writeBuffer
+	werr error
 }
 
 func (sh *serveHandle) readData() []byte {
@@ -486,9 +578,12 @@ func (c *serveConn) saveNode(inode uint64, node Node) (id fuse.NodeID, gen uint6
 	return
 }
 
-func (c *serveConn) saveHandle(handle Handle, nodeID fuse.NodeID) (id fuse.HandleID) {
+// saveHandle saves handle, opened by the request hdr, and arranges
+// for it to be dropped again if the response never reaches the
+// kernel, which would then never release it.
+func (c *serveConn) saveHandle(hdr *fuse.Header, handle Handle) (id fuse.HandleID) {
 	c.meta.Lock()
-	shandle := &serveHandle{handle: handle, nodeID: nodeID}
+	shandle := &serveHandle{handle: handle, nodeID: hdr.Node}
 	if n := len(c.freeHandle); n > 0 {
 		id = c.freeHandle[n-1]
 		c.freeHandle = c.freeHandle[:n-1]
@@ -498,6 +593,7 @@ func (c *serveConn) saveHandle(handle Handle, nodeID fuse.NodeID) (id fuse.Handl
 		c.handle = append(c.handle, shandle)
 	}
 	c.meta.Unlock()
+	hdr.OnDrop(func() { c.dropHandle(id) })
 	return
 }
 
@@ -561,6 +657,20 @@ func (m missingHandle) String() string {
 	return fmt.Sprint("missing handle", m.Handle, m.MaxHandle)
 }
 
+// getattrHandle returns the handle to ask for attributes, or nil if
+// the node should be asked instead.
+func (c *serveConn) getattrHandle(r *fuse.GetattrRequest) HandleGetattrer {
+	if !r.HandleValid() {
+		return nil
+	}
+	shandle := c.getHandle(r.Handle)
+	if shandle == nil {
+		return nil
+	}
+	h, _ := shandle.handle.(HandleGetattrer)
+	return h
+}
+
 // Returns nil for invalid handles.
 func (c *serveConn) getHandle(id fuse.HandleID) (shandle *serveHandle) {
 	c.meta.Lock()
@@ -635,6 +745,40 @@ func (r response) String() string {
 	}
 }
 
+type unhandledOpcode struct {
+	Opcode uint32
+	Name   string
+}
+
+func (m unhandledOpcode) String() string {
+	return fmt.Sprintf("unhandled opcode %s (%d), replying ENOSYS", m.Name, m.Opcode)
+}
+
+// logUnhandled logs the opcode of a request the server has no
+// support for, the first time it is seen. This helps discovering
+// what a new kernel sends, without repeating the message for every
+// such request.
+func (c *serveConn) logUnhandled(r fuse.Request) {
+	op := r.Hdr().Opcode
+	c.meta.Lock()
+	seen := c.unhandled[op]
+	if !seen {
+		if c.unhandled == nil {
+			c.unhandled = make(map[uint32]bool)
+		}
+		c.unhandled[op] = true
+	}
+	c.meta.Unlock()
+	if seen {
+		return
+	}
+	debug := c.debug
+	if debug == nil {
+		debug = fuse.Debug
+	}
+	debug(unhandledOpcode{Opcode: op, Name: fuse.OpcodeName(op)})
+}
+
 type logMissingNode struct {
 	MaxNode fuse.NodeID
 }
@@ -668,6 +812,18 @@ func nullLog(resp interface{}) {}
 
 func (c *serveConn) serve(r fuse.Request) {
 	ctx := context.Background()//cancel := context.WithCancel(context.Background())
+	if d := c.conn.RequestTimeout(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		// Don't keep the kernel waiting on a handler that ignores
+		// its context.
+		hdr := r.Hdr()
+		timer := time.AfterFunc(d, func() {
+			hdr.Abandon(fuse.ETIMEDOUT)
+		})
+		defer timer.Stop()
+	}
 
 	//req := &serveRequest{Request: r, cancel: cancel}
 
@@ -757,6 +913,7 @@ func (c *serveConn) serve(r fuse.Request) {
 		// Note: To FUSE, ENOSYS means "this server never implements this request."
 		// It would be inappropriate to return ENOSYS for other operations in this
 		// switch that might only be unavailable in some contexts, not all.
+		c.logUnhandled(r)
 		done(fuse.ENOSYS)
 		r.RespondError(fuse.ENOSYS)
 
@@ -773,6 +930,11 @@ func (c *serveConn) serve(r fuse.Request) {
 				break
 			}
 		}
+		if err := s.Validate(); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
 		done(s)
 		r.Respond(s)
 
@@ -790,21 +952,29 @@ func (c *serveConn) serve(r fuse.Request) {
 
 	// Node operations.
 	case *fuse.GetattrRequest:
+		c.writeOutNode(ctx, hdr.Node)
 		s := &fuse.GetattrResponse{}
-		if n, ok := node.(NodeGetattrer); ok {
+		if h := c.getattrHandle(r); h != nil {
+			if err := h.Getattr(ctx, r, s); err != nil {
+				done(err)
+				r.RespondError(err)
+				break
+			}
+		} else if n, ok := node.(NodeGetattrer); ok {
 			if err := n.Getattr(ctx, r, s); err != nil {
 				done(err)
 				r.RespondError(err)
 				break
 			}
 		} else {
-			s.AttrValid = attrValidTime
 			s.Attr = snode.attr()
+			_, s.AttrValid = c.cacheTimeouts(s.Attr.Mode)
 		}
 		done(s)
 		r.Respond(s)
 
 	case *fuse.SetattrRequest:
+		c.writeOutNode(ctx, hdr.Node)
 		s := &fuse.SetattrResponse{}
 		if n, ok := node.(NodeSetattrer); ok {
 			if err := n.Setattr(ctx, r, s); err != nil {
@@ -817,10 +987,10 @@ func (c *serveConn) serve(r fuse.Request) {
 			break
 		}
 
+		s.Attr = snode.attr()
 		if s.AttrValid == 0 {
-			s.AttrValid = attrValidTime
+			_, s.AttrValid = c.cacheTimeouts(s.Attr.Mode)
 		}
-		s.Attr = snode.attr()
 		done(s)
 		r.Respond(s)
 
@@ -838,7 +1008,7 @@ func (c *serveConn) serve(r fuse.Request) {
 			r.RespondError(err)
 			break
 		}
-		c.saveLookup(&s.LookupResponse, snode, r.NewName, n2)
+		c.saveLookup(hdr, &s.LookupResponse, snode, r.NewName, n2)
 		done(s)
 		r.Respond(s)
 
@@ -887,7 +1057,7 @@ func (c *serveConn) serve(r fuse.Request) {
 			break
 		}
 		s := &fuse.LookupResponse{}
-		c.saveLookup(s, snode, r.NewName, n2)
+		c.saveLookup(hdr, s, snode, r.NewName, n2)
 		done(s)
 		r.Respond(s)
 
@@ -936,7 +1106,7 @@ func (c *serveConn) serve(r fuse.Request) {
 			r.RespondError(err)
 			break
 		}
-		c.saveLookup(s, snode, r.Name, n2)
+		c.saveLookup(hdr, s, snode, r.Name, n2)
 		done(s)
 		r.Respond(s)
 
@@ -954,7 +1124,7 @@ func (c *serveConn) serve(r fuse.Request) {
 			r.RespondError(err)
 			break
 		}
-		c.saveLookup(&s.LookupResponse, snode, r.Name, n2)
+		c.saveLookup(hdr, &s.LookupResponse, snode, r.Name, n2)
 		done(s)
 		r.Respond(s)
 
@@ -972,7 +1142,7 @@ func (c *serveConn) serve(r fuse.Request) {
 		} else {
 			h2 = node
 		}
-		s.Handle = c.saveHandle(h2, hdr.Node)
+		s.Handle = c.saveHandle(hdr, h2)
 		done(s)
 		r.Respond(s)
 
@@ -991,24 +1161,28 @@ func (c *serveConn) serve(r fuse.Request) {
 			r.RespondError(err)
 			break
 		}
-		c.saveLookup(&s.LookupResponse, snode, r.Name, n2)
-		s.Handle = c.saveHandle(h2, hdr.Node)
+		c.saveLookup(hdr, &s.LookupResponse, snode, r.Name, n2)
+		s.Handle = c.saveHandle(hdr, h2)
 		done(s)
 		r.Respond(s)
 
 	case *fuse.GetxattrRequest:
-		n, ok := node.(NodeGetxattrer)
-		if !ok {
-			done(fuse.ENOTSUP)
-			r.RespondError(fuse.ENOTSUP)
-			break
-		}
 		s := &fuse.GetxattrResponse{}
-		err := n.Getxattr(ctx, r, s)
-		if err != nil {
-			done(err)
-			r.RespondError(err)
-			break
+		if v, ok := c.xattrs[r.Name]; ok {
+			s.Xattr = v
+		} else {
+			n, ok := node.(NodeGetxattrer)
+			if !ok {
+				done(fuse.ENOTSUP)
+				r.RespondError(fuse.ENOTSUP)
+				break
+			}
+			err := n.Getxattr(ctx, r, s)
+			if err != nil {
+				done(err)
+				r.RespondError(err)
+				break
+			}
 		}
 		if r.Size != 0 && uint64(len(s.Xattr)) > uint64(r.Size) {
 			done(fuse.ERANGE)
@@ -1020,18 +1194,21 @@ func (c *serveConn) serve(r fuse.Request) {
 
 	case *fuse.ListxattrRequest:
 		n, ok := node.(NodeListxattrer)
-		if !ok {
+		if !ok && len(c.xattrs) == 0 {
 			done(fuse.ENOTSUP)
 			r.RespondError(fuse.ENOTSUP)
 			break
 		}
 		s := &fuse.ListxattrResponse{}
-		err := n.Listxattr(ctx, r, s)
-		if err != nil {
-			done(err)
-			r.RespondError(err)
-			break
+		if ok {
+			err := n.Listxattr(ctx, r, s)
+			if err != nil {
+				done(err)
+				r.RespondError(err)
+				break
+			}
 		}
+		s.Append(c.xattrNames()...)
 		if r.Size != 0 && uint64(len(s.Xattr)) > uint64(r.Size) {
 			done(fuse.ERANGE)
 			r.RespondError(fuse.ERANGE)
@@ -1041,6 +1218,11 @@ func (c *serveConn) serve(r fuse.Request) {
 		r.Respond(s)
 
 	case *fuse.SetxattrRequest:
+		if _, ok := c.xattrs[r.Name]; ok {
+			done(fuse.EPERM)
+			r.RespondError(fuse.EPERM)
+			break
+		}
 		n, ok := node.(NodeSetxattrer)
 		if !ok {
 			done(fuse.ENOTSUP)
@@ -1057,6 +1239,11 @@ func (c *serveConn) serve(r fuse.Request) {
 		r.Respond()
 
 	case *fuse.RemovexattrRequest:
+		if _, ok := c.xattrs[r.Name]; ok {
+			done(fuse.EPERM)
+			r.RespondError(fuse.EPERM)
+			break
+		}
 		n, ok := node.(NodeRemovexattrer)
 		if !ok {
 			done(fuse.ENOTSUP)
@@ -1083,6 +1270,28 @@ func (c *serveConn) serve(r fuse.Request) {
 		done(nil)
 		r.Respond()
 
+	case *fuse.BatchForgetRequest:
+		for _, f := range r.Forget {
+			c.meta.Lock()
+			var snode *serveNode
+			if f.Node < fuse.NodeID(len(c.node)) {
+				snode = c.node[f.Node]
+			}
+			c.meta.Unlock()
+			if snode == nil {
+				// same as a ForgetRequest for an unknown node
+				c.debug(nodeRefcountDropBug{N: f.N, Node: f.Node})
+				continue
+			}
+			if c.dropNode(f.Node, f.N) {
+				if n, ok := snode.node.(NodeForgetter); ok {
+					n.Forget()
+				}
+			}
+		}
+		done(nil)
+		r.Respond()
+
 	// Handle operations.
 	case *fuse.ReadRequest:
 		shandle := c.getHandle(r.Handle)
@@ -1101,6 +1310,9 @@ func (c *serveConn) serve(r fuse.Request) {
 		} else {
 			respBuf = make([]byte, 0, r.Size)
 		}
+		if !r.Dir {
+			c.writeOutNode(ctx, hdr.Node)
+		}
 		s := &fuse.ReadResponse{Data: respBuf}
 		if r.Dir {
 			if h, ok := handle.(HandleReadDirAller); ok {
@@ -1174,6 +1386,20 @@ func (c *serveConn) serve(r fuse.Request) {
 
 		s := &fuse.WriteResponse{}
 		if h, ok := shandle.handle.(HandleWriter); ok {
+			if c.coalesce != 0 {
+				buffered, err := shandle.bufferWrite(ctx, r, c.coalesce)
+				if err != nil {
+					done(err)
+					r.RespondError(err)
+					break
+				}
+				if buffered {
+					s.Size = len(r.Data)
+					done(s)
+					r.Respond(s)
+					break
+				}
+			}
 			if err := h.Write(ctx, r, s); err != nil {
 				done(err)
 				r.RespondError(err)
@@ -1196,6 +1422,11 @@ func (c *serveConn) serve(r fuse.Request) {
 		}
 		handle := shandle.handle
 
+		if err := shandle.flushWrites(ctx); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
 		if h, ok := handle.(HandleFlusher); ok {
 			if err := h.Flush(ctx, r); err != nil {
 				done(err)
@@ -1219,6 +1450,9 @@ func (c *serveConn) serve(r fuse.Request) {
 		// No matter what, release the handle.
 		c.dropHandle(r.Handle)
 
+		// Buffered writes go out before the handle is released,
+		// and an error from them is reported once Release has run.
+		werr := shandle.flushWrites(ctx)
 		if h, ok := handle.(HandleReleaser); ok {
 			if err := h.Release(ctx, r); err != nil {
 				done(err)
@@ -1226,6 +1460,11 @@ func (c *serveConn) serve(r fuse.Request) {
 				break
 			}
 		}
+		if werr != nil {
+			done(werr)
+			r.RespondError(werr)
+			break
+		}
 		done(nil)
 		r.Respond()
 
@@ -1281,11 +1520,20 @@ func (c *serveConn) serve(r fuse.Request) {
 			break
 		}
 		s := &fuse.LookupResponse{}
-		c.saveLookup(s, snode, r.Name, n2)
+		c.saveLookup(hdr, s, snode, r.Name, n2)
 		done(s)
 		r.Respond(s)
 
 	case *fuse.FsyncRequest:
+		if !r.Dir && c.coalesce != 0 {
+			if shandle := c.getHandle(r.Handle); shandle != nil {
+				if err := shandle.flushWrites(ctx); err != nil {
+					done(err)
+					r.RespondError(err)
+					break
+				}
+			}
+		}
 		n, ok := node.(NodeFsyncer)
 		if !ok {
 			done(fuse.EIO)
@@ -1334,19 +1582,38 @@ func (c *serveConn) serve(r fuse.Request) {
 	//cancel()
 }
 
-func (c *serveConn) saveLookup(s *fuse.LookupResponse, snode *serveNode, elem string, n2 Node) {
+func (c *serveConn) saveLookup(hdr *fuse.Header, s *fuse.LookupResponse, snode *serveNode, elem string, n2 Node) {
 	s.Attr = nodeAttr(n2)
 	if s.Attr.Inode == 0 {
 		s.Attr.Inode = c.dynamicInode(snode.inode, elem)
 	}
 
-	s.Node, s.Generation = c.saveNode(s.Attr.Inode, n2)
+	id, gen := c.saveNode(s.Attr.Inode, n2)
+	s.Node, s.Generation = id, gen
+	// A node the kernel never hears of is never forgotten by it.
+	hdr.OnDrop(func() {
+		if c.dropNode(id, 1) {
+			if n, ok := n2.(NodeForgetter); ok {
+				n.Forget()
+			}
+		}
+	})
+	entryValid, attrValid := c.cacheTimeouts(s.Attr.Mode)
 	if s.EntryValid == 0 {
-		s.EntryValid = entryValidTime
+		s.EntryValid = entryValid
 	}
 	if s.AttrValid == 0 {
-		s.AttrValid = attrValidTime
+		s.AttrValid = attrValid
+	}
+}
+
+// cacheTimeouts returns the cache timeouts to use for a node with the
+// given mode when the file system leaves them zero.
+func (c *serveConn) cacheTimeouts(mode os.FileMode) (entryValid, attrValid time.Duration) {
+	if entryValid, attrValid, ok := c.conn.CacheTimeouts(mode); ok {
+		return entryValid, attrValid
 	}
+	return entryValidTime, attrValidTime
 }
 
 // DataHandle returns a read-only Handle that satisfies reads
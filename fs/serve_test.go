@@ -3,11 +3,13 @@ package fs_test
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync"
@@ -21,6 +23,7 @@ import (
 	"github.com/bpowers/fuse/fs/fstestutil/record"
 	"github.com/bpowers/fuse/fuseutil"
 	"github.com/bpowers/fuse/syscallx"
+	"github.com/bpowers/fuse/testkernel"
 	"golang.org/x/net/context"
 )
 
@@ -1841,3 +1844,674 @@ func TestAttrUnlinked(t *testing.T) {
 		}
 	}
 }
+
+// Test unhandled opcodes
+
+func TestUnhandledOpcode(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var logged []string
+	server := fs.Server{
+		FS: fstestutil.SimpleFS{Node: fstestutil.Dir{}},
+		Debug: func(msg interface{}) {
+			if s, ok := msg.(fmt.Stringer); ok && strings.HasPrefix(s.String(), "unhandled opcode") {
+				mu.Lock()
+				logged = append(logged, s.String())
+				mu.Unlock()
+			}
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(c)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	for _, op := range []uint32{1000, 1001, 1000, 1000, 1001} {
+		if _, err := s.Call(op, testkernel.RootID, nil); err != fuse.ENOSYS {
+			t.Errorf("opcode %d: expected ENOSYS, got %v", op, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if g, e := len(logged), 2; g != e {
+		t.Fatalf("wrong number of unhandled opcodes logged: %d != %d: %q", g, e, logged)
+	}
+	if g, e := logged[0], "unhandled opcode opcode1000 (1000), replying ENOSYS"; g != e {
+		t.Errorf("wrong message: %q != %q", g, e)
+	}
+}
+
+// Test serving continuing on a new device
+
+// refFile keeps its NodeID for as long as the kernel knows about it.
+type refFile struct {
+	fstestutil.File
+	fs.NodeRef
+}
+
+func TestReconnect(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &refFile{}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": f}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	before, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	if err := s.Reconnect(c); err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned after Reconnect: %v", err)
+	default:
+	}
+
+	// the node handed out before is still known
+	if _, err := s.Getattr(before.Node); err != nil {
+		t.Errorf("Getattr after Reconnect: %v", err)
+	}
+	after, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup after Reconnect: %v", err)
+	}
+	if g, e := after.Node, before.Node; g != e {
+		t.Errorf("node changed across Reconnect: %v != %v", g, e)
+	}
+}
+
+// Test the context of a slow request being cancelled
+
+type blockingGetattr struct {
+	fstestutil.File
+	err     chan error
+	release chan struct{}
+}
+
+func (f *blockingGetattr) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	<-ctx.Done()
+	f.err <- ctx.Err()
+	// respond long after the deadline, successfully
+	<-f.release
+	return nil
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRequestTimeout(10 * time.Millisecond)
+	f := &blockingGetattr{
+		err:     make(chan error, 1),
+		release: make(chan struct{}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": f}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if _, err := s.Getattr(e.Node); err != fuse.ETIMEDOUT {
+		t.Errorf("expected ETIMEDOUT, got %v", err)
+	}
+	if g, e := <-f.err, context.DeadlineExceeded; g != e {
+		t.Errorf("wrong context error: %v != %v", g, e)
+	}
+
+	// the late response must not reach the kernel, where it would be
+	// taken for the reply to the next request
+	close(f.release)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.Lookup(testkernel.RootID, "child"); err != nil {
+		t.Errorf("Lookup after timeout: %v", err)
+	}
+}
+
+// Test the node of a timed out lookup being forgotten
+
+type forgottenFile struct {
+	fstestutil.File
+	forgotten chan struct{}
+}
+
+func (f *forgottenFile) Forget() {
+	close(f.forgotten)
+}
+
+type slowLookupDir struct {
+	fstestutil.Dir
+	child   fs.Node
+	release chan struct{}
+}
+
+func (d slowLookupDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	<-d.release
+	return d.child, nil
+}
+
+func TestRequestTimeoutForgetsNode(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRequestTimeout(10 * time.Millisecond)
+	child := &forgottenFile{forgotten: make(chan struct{})}
+	dir := slowLookupDir{child: child, release: make(chan struct{})}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: dir}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if _, err := s.Lookup(testkernel.RootID, "child"); err != fuse.ETIMEDOUT {
+		t.Fatalf("expected ETIMEDOUT, got %v", err)
+	}
+
+	// the kernel never got the node, so its reference is dropped when
+	// the handler finishes
+	close(dir.release)
+	select {
+	case <-child.forgotten:
+	case <-time.After(5 * time.Second):
+		t.Error("node of the timed out lookup was not forgotten")
+	}
+}
+
+// Test forgets being served apart from other requests
+
+type slowForget struct {
+	fstestutil.File
+	forgetting chan struct{}
+	release    chan struct{}
+}
+
+func (f *slowForget) Forget() {
+	close(f.forgetting)
+	<-f.release
+}
+
+func TestForgetDoesNotBlock(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &slowForget{
+		forgetting: make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": child}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if err := s.Forget(e.Node, 1); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+	select {
+	case <-child.forgetting:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Forget was not called")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Getattr(testkernel.RootID)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Getattr: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Getattr blocked behind Forget")
+	}
+	close(child.release)
+}
+
+func TestServerXattrs(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fs.Server{
+		FS: fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": &refFile{}}},
+		Xattrs: map[string][]byte{
+			"user.features": []byte("splice,sendfile"),
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(c)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	got, err := s.Getxattr(e.Node, "user.features", 100)
+	if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	if g, e := string(got), "splice,sendfile"; g != e {
+		t.Errorf("wrong value: %q != %q", g, e)
+	}
+
+	got, err = s.Getxattr(e.Node, "user.features", 0)
+	if err != nil {
+		t.Fatalf("Getxattr size: %v", err)
+	}
+	if len(got) < 4 {
+		t.Fatalf("size reply too short: %d bytes", len(got))
+	}
+	if g, e := hostOrder.Uint32(got), uint32(len("splice,sendfile")); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+
+	if _, err := s.Getxattr(e.Node, "user.features", 3); err != fuse.ERANGE {
+		t.Errorf("expected ERANGE for a short buffer, got %v", err)
+	}
+
+	// the node itself has no xattrs
+	if _, err := s.Getxattr(e.Node, "user.other", 100); err != fuse.ENOTSUP {
+		t.Errorf("expected ENOTSUP, got %v", err)
+	}
+
+	got, err = s.Listxattr(e.Node, 100)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	if g, e := string(got), "user.features\x00"; g != e {
+		t.Errorf("wrong list: %q != %q", g, e)
+	}
+}
+
+type backendWrite struct {
+	Offset int64
+	Data   string
+}
+
+// writeRecorder records the writes that reach it.
+type writeRecorder struct {
+	fstestutil.File
+	fs.NodeRef
+
+	mu     sync.Mutex
+	writes []backendWrite
+}
+
+func (w *writeRecorder) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, backendWrite{req.Offset, string(req.Data)})
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (w *writeRecorder) recorded() []backendWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]backendWrite(nil), w.writes...)
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &writeRecorder{}
+	server := fs.Server{
+		FS: fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": f}},
+		// long enough that only the test decides when data goes out
+		CoalesceWrites: time.Hour,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(c)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	h, err := s.Open(e.Node, fuse.OpenWriteOnly)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for i, b := range []string{"a", "b", "c"} {
+		n, err := s.Write(e.Node, h, int64(i), []byte(b))
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("short write: %d", n)
+		}
+	}
+	if g := f.recorded(); len(g) != 0 {
+		t.Errorf("writes reached the handle before flush: %v", g)
+	}
+	if err := s.Flush(e.Node, h); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	want := []backendWrite{{0, "abc"}}
+	if g := f.recorded(); !reflect.DeepEqual(g, want) {
+		t.Errorf("wrong backend writes: %v != %v", g, want)
+	}
+
+	// a gap writes out what was buffered before it
+	if _, err := s.Write(e.Node, h, 3, []byte("d")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := s.Write(e.Node, h, 10, []byte("e")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Release(e.Node, h, fuse.OpenWriteOnly); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	want = append(want, backendWrite{3, "d"}, backendWrite{10, "e"})
+	if g := f.recorded(); !reflect.DeepEqual(g, want) {
+		t.Errorf("wrong backend writes: %v != %v", g, want)
+	}
+}
+
+// readBackFile reads back what was written to it at offset 0.
+type readBackFile struct {
+	writeRecorder
+}
+
+func (f *readBackFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	resp.Data = resp.Data[:0]
+	for _, w := range f.recorded() {
+		resp.Data = append(resp.Data, w.Data...)
+	}
+	return nil
+}
+
+func TestCoalesceWritesReadOtherHandle(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &readBackFile{}
+	server := fs.Server{
+		FS:             fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": f}},
+		CoalesceWrites: time.Hour,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(c)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	w, err := s.Open(e.Node, fuse.OpenWriteOnly)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r, err := s.Open(e.Node, fuse.OpenReadOnly)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := s.Write(e.Node, w, 0, []byte("abc")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// the write was reported done, so a read through another handle
+	// must see it
+	got, err := s.Read(e.Node, r, 0, 4096)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if g, e := string(got), "abc"; g != e {
+		t.Errorf("read through another handle: %q != %q", g, e)
+	}
+}
+
+// perCallerAttr reports the caller's uid as its size.
+type perCallerAttr struct {
+	fstestutil.File
+	fs.NodeRef
+}
+
+func (perCallerAttr) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	resp.Attr.Mode = 0644
+	resp.Attr.Size = uint64(req.Uid)
+	return nil
+}
+
+func TestGetattrPerCaller(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCacheTimeouts(0, 0, 0)
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: fstestutil.ChildMap{"child": &perCallerAttr{}}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if e.AttrValid != 0 {
+		t.Errorf("lookup attributes are cached for %v", e.AttrValid)
+	}
+
+	for _, uid := range []uint32{1000, 2000, 1000} {
+		s.SetCaller(uid, uid, 4242)
+		a, err := s.Getattr(e.Node)
+		if err != nil {
+			t.Fatalf("Getattr: %v", err)
+		}
+		if g, e := a.Size, uint64(uid); g != e {
+			t.Errorf("uid %d got attributes of another caller: size %d", uid, g)
+		}
+		if a.Valid != 0 {
+			t.Errorf("attributes are cached for %v", a.Valid)
+		}
+	}
+}
+
+// uncachedAttrDir looks up "child" with its attributes left uncached.
+type uncachedAttrDir struct {
+	fstestutil.Dir
+}
+
+func (d uncachedAttrDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	if req.Name != "child" {
+		return nil, fuse.ENOENT
+	}
+	resp.DontCacheAttr()
+	return fstestutil.File{}, nil
+}
+
+// expiredDir looks up "child" from a server cache that has already
+// expired.
+type expiredDir struct {
+	fstestutil.Dir
+}
+
+func (d expiredDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	if req.Name != "child" {
+		return nil, fuse.ENOENT
+	}
+	resp.SetExpiry(time.Now().Add(-time.Second))
+	return fstestutil.File{}, nil
+}
+
+func TestLookupSetExpiryExpired(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: expiredDir{}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if e.EntryValid != 0 {
+		t.Errorf("expired entry is cached for %v", e.EntryValid)
+	}
+	if e.AttrValid != 0 {
+		t.Errorf("expired attributes are cached for %v", e.AttrValid)
+	}
+}
+
+func TestLookupDontCacheAttr(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: uncachedAttrDir{}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	if _, err := s.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	e, err := s.Lookup(testkernel.RootID, "child")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if e.EntryValid == 0 {
+		t.Error("entry is not cached")
+	}
+	if e.AttrValid != 0 {
+		t.Errorf("attributes are cached for %v", e.AttrValid)
+	}
+}
@@ -80,6 +80,12 @@
 // Blocking operations should select on a receive from ctx.Done() and attempt to
 // abort the operation early if the receive succeeds (meaning the channel is closed).
 // To indicate that the operation failed because it was aborted, return fuse.EINTR.
+// Returning ctx.Err() as is works too: a cancelled context is reported as
+// EINTR, and one that ran past its deadline as ETIMEDOUT.
+//
+// With Conn.SetRequestTimeout, package fs responds ETIMEDOUT itself
+// when the deadline passes, without waiting for the handler, and drops
+// whatever the handler responds with later.
 //
 // If an operation does not block for an indefinite amount of time, supporting
 // cancellation is not necessary.
@@ -108,14 +114,35 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
+
+	"golang.org/x/net/context"
 )
 
 // A Conn represents a connection to a mounted FUSE file system.
 type Conn struct {
+	// The 64-bit fields accessed atomically come first, where they
+	// are 8-byte aligned even on 32-bit platforms.
+
+	// InitFlags negotiated with the kernel, set when the InitRequest
+	// is responded to.
+	flags uint64
+	stats connStats
+	// Requests taking longer than this to respond to are logged,
+	// see SetSlowThreshold.
+	slow int64
+	// Fraction of uncached entry and attr replies to warn about, as
+	// float64 bits, see SetCacheWarning.
+	cacheWarn uint64
+	// Time allowed to serve a request, see SetRequestTimeout.
+	timeout int64
+	// Access decisions, see SetAccessCacheTTL. Starts with its TTL.
+	access accessCache
+
 	// Ready is closed when the mount is complete or has failed.
 	Ready <-chan struct{}
 
@@ -123,12 +150,106 @@ type Conn struct {
 	// after Ready is closed.
 	MountError error
 
+	// Directory passed to Mount; empty for NewConn.
+	mountpoint string
+
+	// Clock for timing requests, time.Now if nil. Replaced by tests.
+	nowFunc func() time.Time
+
 	// File handle for kernel communication. Only safe to access if
 	// rio or wio is held.
 	dev *os.File
+	// Number of times the file descriptor behind dev was replaced,
+	// see Reconnect. Accessed atomically.
+	reconnects uint32
+
 	buf []byte
 	wio sync.Mutex
 	rio sync.RWMutex
+
+	// Protocol version negotiated with the kernel, and the version
+	// the kernel itself speaks, set when the InitRequest is read.
+	proto  Protocol
+	kernel Protocol
+	// MaxWrite sent to the kernel, set along with flags. Accessed
+	// atomically.
+	maxWrite uint32
+	// Largest MaxWrite to negotiate, from the MaxWrite mount option;
+	// zero for the default. Set before serving.
+	maxWriteLimit uint32
+	// Size of the buffers to read requests into, once raised for the
+	// negotiated MaxWrite; zero for bufSize. Accessed atomically.
+	bufLen uint32
+	// Buffers to read requests into, see getBuffer.
+	bufs sync.Pool
+	// Capabilities, set when the InitRequest is responded to.
+	caps atomic.Value
+
+	// Buffers for reading requests locked into memory, see
+	// LockBuffers.
+	lockedMem  []byte
+	lockedBufs chan []byte
+
+	// Buffer allocator for responses carrying data, see
+	// SetBufferAllocator. Protected by wio.
+	alloc func(n int) []byte
+	free  func([]byte)
+	// Reused to marshal responses. Protected by wio.
+	outBuf []byte
+	iov    [2][]byte
+
+	// Requests read from the kernel that are still waiting for a
+	// response.
+	inflightMu sync.Mutex
+	inflight   map[RequestID]inflightState
+	// Highest ID ever added to inflight. The kernel hands out IDs in
+	// increasing order, so an interrupt for a higher one is for a
+	// request not read yet.
+	maxInFlight RequestID
+	// Requests already answered on behalf of their handler, whose own
+	// response is to be dropped, see Abandon, with their OnDrop
+	// functions.
+	abandoned map[RequestID]func()
+
+	// Skip malformed requests instead of failing ReadRequest, see
+	// SetSkipCorrupt. Accessed atomically.
+	skipCorrupt uint32
+
+	// Drop repeated InterruptRequests, see SetInterruptDedup.
+	// Accessed atomically.
+	dedupInterrupts uint32
+
+	// The device is in nonblocking mode, see SetNonblock. Accessed
+	// atomically.
+	nonblock uint32
+
+	// The kernel closed the device under a response, see
+	// writeFailed. Accessed atomically.
+	gone uint32
+
+	// Tracks the nodes known to the kernel if enabled, see
+	// SetNodeChecks.
+	nodes *nodeChecker
+
+	// File data handed to the kernel's page cache, see CachedRanges.
+	cached cacheTracker
+
+	// NotifyRetrieve calls waiting for the kernel's answer.
+	retrieveMu sync.Mutex
+	retrieveID uint64
+	retrieves  map[uint64]chan []byte
+
+	// Default cache timeouts by node type, see SetCacheTimeouts.
+	cacheMu  sync.RWMutex
+	cacheTTL map[os.FileMode]cacheTimeouts
+
+	// See SetUserData.
+	userMu   sync.RWMutex
+	userData interface{}
+}
+
+type cacheTimeouts struct {
+	entry, attr time.Duration
 }
 
 // Mount mounts a new FUSE connection on the named directory
@@ -153,7 +274,9 @@ func Mount(dir string, options ...MountOption) (*Conn, error) {
 
 	ready := make(chan struct{}, 1)
 	c := &Conn{
-		Ready: ready,
+		Ready:         ready,
+		mountpoint:    dir,
+		maxWriteLimit: conf.maxWrite,
 	}
 	f, err := mount(dir, &conf, ready, &c.MountError)
 	if err != nil {
@@ -163,6 +286,32 @@ func Mount(dir string, options ...MountOption) (*Conn, error) {
 	return c, nil
 }
 
+// NewConn returns a connection for reading and writing FUSE messages
+// on dev, for a file system mounted by other means, such as a
+// /dev/fuse descriptor passed in by a privileged helper. dev must
+// preserve message boundaries. Ready is closed from the start.
+//
+// After a successful return, caller must call Close to free
+// resources.
+func NewConn(dev *os.File) *Conn {
+	ready := make(chan struct{})
+	close(ready)
+	return &Conn{
+		Ready: ready,
+		dev:   dev,
+	}
+}
+
+// Protocol returns the FUSE protocol version negotiated with the
+// kernel. It is only valid after the InitRequest has been read.
+func (c *Conn) Protocol() Protocol {
+	return c.proto
+}
+
+func (c *Conn) hasFlag(fl InitFlags) bool {
+	return InitFlags(atomic.LoadUint64(&c.flags))&fl != 0
+}
+
 // A Request represents a single FUSE request received from the kernel.
 // Use a type switch to determine the specific kind.
 // A request of unrecognized type will have concrete type *Header.
@@ -173,6 +322,15 @@ type Request interface {
 	// RespondError responds to the request with the given error.
 	RespondError(error)
 
+	// OpName returns the lower-case name of the operation, such as
+	// "lookup". Unlike String, it does not depend on the arguments,
+	// so it suits metrics labels.
+	OpName() string
+
+	// Context returns a context that is cancelled once the request
+	// is interrupted or done, see Header.Context.
+	Context() context.Context
+
 	String() string
 }
 
@@ -192,6 +350,12 @@ type HandleID uint64
 const RootID NodeID = rootID
 
 // A Header describes the basic information sent in every request.
+//
+// Every request about a file carries its Node, while only some carry
+// the handle of an open file. Getattr, Setattr and Access, among
+// others, may come without one, for example from stat(2), chmod(2) or
+// an O_PATH descriptor, so servers should key per-file state on Node
+// and treat handles as optional; see fuseutil.NodeTable.
 type Header struct {
 	Conn   *Conn `json:"-"` // connection this request was received on
 	Len    uint32
@@ -202,6 +366,19 @@ type Header struct {
 	Gid    uint32    // group ID of process making request
 	Pid    uint32    // process ID of process making request
 
+	// Length of the request extensions at the end of the message,
+	// in units of 8 bytes. Always zero before protocol 7.38.
+	TotalExtLen uint16
+
+	// Supplementary groups sent as a request extension. A pointer,
+	// to keep Header comparable.
+	groups *[]uint32
+
+	// Read buffer the request's arguments point into, for requests
+	// such as writes that do not copy them out; see ReadRequest. A
+	// pointer, to keep Header comparable.
+	buf *[]byte
+
 	start time.Time
 }
 
@@ -209,22 +386,107 @@ func (h *Header) String() string {
 	return fmt.Sprintf("ID=%#x Node=%#x Uid=%d Gid=%d Pid=%d", h.ID, h.Node, h.Uid, h.Gid, h.Pid)
 }
 
+// SupplementaryGroups returns the supplementary groups of the process
+// making the request, as sent by the kernel. The kernel only sends
+// them with requests creating new nodes, once InitCreateSuppGroup
+// has been negotiated, and may restrict them to the groups relevant
+// to the request.
+func (h *Header) SupplementaryGroups() []uint32 {
+	if h.groups == nil {
+		return nil
+	}
+	return *h.groups
+}
+
 func (h *Header) Hdr() *Header {
 	return h
 }
 
+// opNames holds the lower-case opcodeNames.
+var opNames = func() map[uint32]string {
+	m := make(map[uint32]string, len(opcodeNames))
+	for op, name := range opcodeNames {
+		m[op] = strings.ToLower(name)
+	}
+	return m
+}()
+
+// OpName returns the lower-case name of the request's opcode, such as
+// "lookup". Unknown opcodes are named by their number.
+func (h *Header) OpName() string {
+	if name, ok := opNames[h.Opcode]; ok {
+		return name
+	}
+	return OpcodeName(h.Opcode)
+}
+
 func (h *Header) noResponse() {
-	//putMessage(h.msg)
+	h.release()
+}
+
+func (h *Header) respond(out outMessage) {
+	defer h.release()
+	if !h.Conn.doneInFlight(h.ID) {
+		return
+	}
+	h.checkSlow()
+	h.Conn.noteValidity(out)
+	h.Conn.respond(out)
+}
+
+func (h *Header) respondData(out outMessage, data []byte) {
+	defer h.release()
+	if !h.Conn.doneInFlight(h.ID) {
+		return
+	}
+	h.checkSlow()
+	h.Conn.respondData(out, data)
+}
+
+// holdBuffer makes buf the read buffer of a request pointing into it.
+func holdBuffer(buf []byte) *[]byte {
+	return &buf
+}
+
+// release returns the read buffer held by the request, if any, once
+// it has been responded to. The response itself may point into the
+// buffer, so this must come after it is written.
+func (h *Header) release() {
+	if h.buf == nil {
+		return
+	}
+	h.Conn.putReadBuffer(*h.buf)
+	h.buf = nil
+}
+
+// checkSlow logs the request if responding to it took longer than the
+// threshold set with SetSlowThreshold.
+func (h *Header) checkSlow() {
+	threshold := time.Duration(atomic.LoadInt64(&h.Conn.slow))
+	if threshold <= 0 || h.start.IsZero() {
+		return
+	}
+	if d := h.Conn.now().Sub(h.start); d > threshold {
+		Debug(slowResponse{
+			Opcode:   OpcodeName(h.Opcode),
+			ID:       h.ID,
+			Node:     h.Node,
+			Pid:      h.Pid,
+			Duration: d,
+		})
+	}
 }
 
-func (h *Header) respond(out *outHeader, n uintptr) {
-	h.Conn.respond(out, n)
-	//putMessage(h.msg)
+type slowResponse struct {
+	Opcode   string
+	ID       RequestID
+	Node     NodeID
+	Pid      uint32
+	Duration time.Duration
 }
 
-func (h *Header) respondData(out *outHeader, n uintptr, data []byte) {
-	h.Conn.respondData(out, n, data)
-	//putMessage(h.msg)
+func (s slowResponse) String() string {
+	return fmt.Sprintf("slow response: %s [ID=%#x Node=%#x pid=%d] took %v", s.Opcode, s.ID, s.Node, s.Pid, s.Duration)
 }
 
 // An ErrorNumber is an error with a specific error number.
@@ -251,9 +513,21 @@ const (
 	// See also fs.Intr.
 	EINTR = Errno(syscall.EINTR)
 
+	// ETIMEDOUT indicates the request took longer than the server
+	// allows, see Conn.SetRequestTimeout.
+	ETIMEDOUT = Errno(syscall.ETIMEDOUT)
+
 	ERANGE  = Errno(syscall.ERANGE)
 	ENOTSUP = Errno(syscall.ENOTSUP)
 	EEXIST  = Errno(syscall.EEXIST)
+
+	// ELOOP indicates too many symbolic links were followed, for
+	// servers that detect symlink loops themselves.
+	ELOOP = Errno(syscall.ELOOP)
+
+	// ENXIO answers an LseekRequest that finds no data, or no hole,
+	// past its offset.
+	ENXIO = Errno(syscall.ENXIO)
 )
 
 // DefaultErrno is the errno used when error returned does not
@@ -261,13 +535,16 @@ const (
 const DefaultErrno = EIO
 
 var errnoNames = map[Errno]string{
-	ENOSYS: "ENOSYS",
-	ESTALE: "ESTALE",
-	ENOENT: "ENOENT",
-	EIO:    "EIO",
-	EPERM:  "EPERM",
-	EINTR:  "EINTR",
-	EEXIST: "EEXIST",
+	ENOSYS:    "ENOSYS",
+	ESTALE:    "ESTALE",
+	ENOENT:    "ENOENT",
+	EIO:       "EIO",
+	EPERM:     "EPERM",
+	EINTR:     "EINTR",
+	ETIMEDOUT: "ETIMEDOUT",
+	EEXIST:    "EEXIST",
+	ELOOP:     "ELOOP",
+	ENXIO:     "ENXIO",
 }
 
 // Errno implements Error and ErrorNumber using a syscall.Errno.
@@ -303,66 +580,120 @@ func (e Errno) MarshalText() ([]byte, error) {
 	return []byte(s), nil
 }
 
-func (h *Header) RespondError(err error) {
-	errno := DefaultErrno
+// errnoOf returns the errno to report for err.
+func errnoOf(err error) Errno {
+	switch err {
+	case context.Canceled:
+		return EINTR
+	case context.DeadlineExceeded:
+		return ETIMEDOUT
+	}
 	if ferr, ok := err.(ErrorNumber); ok {
-		errno = ferr.Errno()
+		return ferr.Errno()
 	}
+	return DefaultErrno
+}
+
+func (h *Header) RespondError(err error) {
+	errno := errnoOf(err)
 	// FUSE uses negative errors!
 	// TODO: File bug report against OSXFUSE: positive error causes kernel panic.
 	out := &outHeader{Error: -int32(errno), Unique: uint64(h.ID)}
-	h.respond(out, unsafe.Sizeof(*out))
+	h.respond(out)
 }
 
-// Maximum file write size we are prepared to receive from the kernel.
-// 31 pages should be enough for anyone.
+// Maximum file write size we are prepared to receive from the kernel,
+// unless raised with the MaxWrite mount option. 31 pages should be
+// enough for anyone.
 const maxWrite = 31 * 4 * 1024
 
+// Largest write kernels without InitMaxPages send: their requests
+// carry at most 32 pages.
+var legacyMaxWrite = uint32(32 * syscall.Getpagesize())
+
 // All requests read from the kernel, without data, are shorter than
 // this.
 var maxRequestSize = syscall.Getpagesize()
 var bufSize = maxRequestSize + maxWrite
 
-// reqPool is a pool of messages.
-//
-// Lifetime of a logical message is from getMessage to putMessage.
-// getMessage is called by ReadRequest. putMessage is called by
-// Conn.ReadRequest, Request.Respond, or Request.RespondError.
-//
-// Messages in the pool are guaranteed to have conn and off zeroed,
-// buf allocated and len==bufSize, and hdr set.
-var bufPool = sync.Pool{
-	New: allocBuf,
+// writeLimit returns the largest MaxWrite c may negotiate.
+func (c *Conn) writeLimit() uint32 {
+	if c.maxWriteLimit != 0 {
+		return c.maxWriteLimit
+	}
+	return maxWrite
 }
 
-func allocBuf() interface{} {
-	return make([]byte, bufSize)
+// bufferSize returns the size of the buffers requests are read into:
+// bufSize, or more once a larger MaxWrite has been negotiated.
+func (c *Conn) bufferSize() int {
+	if n := atomic.LoadUint32(&c.bufLen); n != 0 {
+		return int(n)
+	}
+	return bufSize
 }
 
-func getBuffer() []byte {
-	return bufPool.Get().([]byte)
+// getBuffer returns a buffer to read a request into, from c.bufs.
+//
+// A buffer is taken by readRequest. It goes back to the pool when
+// readRequest returns, unless the decoded request points into it, in
+// which case it goes back once the request is responded to. Buffers
+// too small for the current bufferSize, left over from before the
+// InitRequest, are dropped.
+func (c *Conn) getBuffer() []byte {
+	n := c.bufferSize()
+	if buf, ok := c.bufs.Get().([]byte); ok && cap(buf) >= n {
+		return buf[:n]
+	}
+	return make([]byte, n)
 }
 
-func putBuffer(buf []byte) {
-	buf = buf[:bufSize]
-	bufPool.Put(buf)
+func (c *Conn) putBuffer(buf []byte) {
+	if cap(buf) < c.bufferSize() {
+		return
+	}
+	c.bufs.Put(buf[:cap(buf)])
 }
 
+// ReadHeader decodes the request header at the start of buf. The
+// kernel writes it in the byte order of the host.
 func ReadHeader(h *Header, buf []byte) error {
-	// FIXME: is it always little endian, or is it the endian-ness
-	// of the current arch?
-	h.Len = binary.LittleEndian.Uint32(buf[0:4])
-	h.Opcode = binary.LittleEndian.Uint32(buf[4:8])
-	h.ID = RequestID(binary.LittleEndian.Uint64(buf[8:16]))
-	h.Node = NodeID(binary.LittleEndian.Uint64(buf[16:24]))
-	h.Uid = binary.LittleEndian.Uint32(buf[24:28])
-	h.Gid = binary.LittleEndian.Uint32(buf[28:32])
-	h.Pid = binary.LittleEndian.Uint32(buf[32:36])
-
-	h.start = time.Now()
+	return readHeader(h, buf, hostOrder)
+}
+
+// readHeader is ReadHeader for a message in the given byte order.
+func readHeader(h *Header, buf []byte, order binary.ByteOrder) error {
+	h.Len = order.Uint32(buf[0:4])
+	h.Opcode = order.Uint32(buf[4:8])
+	h.ID = RequestID(order.Uint64(buf[8:16]))
+	h.Node = NodeID(order.Uint64(buf[16:24]))
+	h.Uid = order.Uint32(buf[24:28])
+	h.Gid = order.Uint32(buf[28:32])
+	h.Pid = order.Uint32(buf[32:36])
+	// padding before 7.38, so only trust it once the kernel's
+	// version is known
+	if h.Conn != nil && h.Conn.kernel.GE(Protocol{7, 38}) {
+		h.TotalExtLen = order.Uint16(buf[36:38])
+	}
+
+	if h.Conn != nil {
+		h.start = h.Conn.now()
+	} else {
+		h.start = time.Now()
+	}
 	return nil
 }
 
+// ApplyUmask returns mode with the permission bits in umask cleared,
+// as the kernel does for servers that do not negotiate InitDontMask.
+// A server that negotiates it gets the mode unmasked, together with
+// the umask of the caller, and must apply it itself for the ordinary
+// behavior. The file type and the setuid, setgid and sticky bits are
+// kept, like umask(2) does.
+func ApplyUmask(mode os.FileMode, umask uint32) os.FileMode {
+	return mode &^ os.FileMode(umask&0777)
+}
+
 // fileMode returns a Go os.FileMode from a Unix mode.
 func fileMode(unixMode uint32) os.FileMode {
 	mode := os.FileMode(unixMode & 0777)
@@ -409,15 +740,163 @@ func (malformedMessage) String() string {
 	return "malformed message"
 }
 
+// SetSkipCorrupt sets whether ReadRequest skips a request whose
+// arguments are malformed, instead of returning an error. A skipped
+// request is answered with EIO so the calling process is not left
+// waiting, reported through Debug, and ReadRequest goes on to the
+// next request.
+//
+// By default, a malformed request is an error, which usually ends the
+// serve loop and with it the mount. Skipping keeps the file system
+// available, but only the message header is known to be good: if the
+// kernel and the file system disagree about the protocol, every
+// request of that kind fails with EIO, and a corrupted forget is lost,
+// leaking the node's lookup count. Messages whose header or length is
+// wrong are always errors, as there is no telling which request they
+// belong to.
+func (c *Conn) SetSkipCorrupt(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&c.skipCorrupt, v)
+}
+
+// errSkipped is returned by readRequest for a malformed request that
+// has already been answered, and for messages that are not requests.
+// ReadRequest reads on.
+var errSkipped = errors.New("fuse: skipped malformed message")
+
 // Close closes the FUSE connection.
 func (c *Conn) Close() error {
 	c.wio.Lock()
 	defer c.wio.Unlock()
 	c.rio.Lock()
 	defer c.rio.Unlock()
+	if c.lockedMem != nil {
+		munlock(c.lockedMem)
+	}
 	return c.dev.Close()
 }
 
+// Mountpoint returns the directory c was mounted on, as passed to
+// Mount, or the empty string if c was created with NewConn.
+func (c *Conn) Mountpoint() string {
+	return c.mountpoint
+}
+
+// SetBufferAllocator makes responses carrying data, such as replies
+// to reads, assemble the message in buffers obtained from alloc
+// instead of the Go heap. alloc must return a slice of length n.
+// Once the message has been written to the kernel, the buffer is
+// passed to free, if not nil.
+//
+// Passing a nil alloc restores the default behavior.
+func (c *Conn) SetBufferAllocator(alloc func(n int) []byte, free func([]byte)) {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	c.alloc = alloc
+	c.free = free
+	if alloc == nil {
+		c.free = nil
+	}
+}
+
+// SetRequestTimeout sets how long a server may spend on a single
+// request. Servers built on package fs cancel the context passed to
+// the handler once d has passed since the request was read, and
+// respond with ETIMEDOUT without waiting for the handler. The
+// kernel itself does not time out requests, so this is about bounding
+// the server's own work, such as calls to a slow backend. A zero d, the
+// default, means no timeout.
+func (c *Conn) SetRequestTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(d))
+}
+
+// RequestTimeout returns the timeout set with SetRequestTimeout.
+func (c *Conn) RequestTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.timeout))
+}
+
+// SetSlowThreshold makes the connection log, through Debug, every
+// request that takes longer than d from being read to being responded
+// to. A zero d, the default, disables this.
+func (c *Conn) SetSlowThreshold(d time.Duration) {
+	atomic.StoreInt64(&c.slow, int64(d))
+}
+
+// SetCacheTimeouts sets how long the kernel may cache the directory
+// entries and attributes of nodes of type typ, when the file system
+// does not choose for itself. typ is compared to mode&os.ModeType, so
+// it is 0 for regular files, os.ModeDir for directories, and so on.
+//
+// The Respond methods of requests answered with attributes use them
+// in place of a zero EntryValid or AttrValid; a negative one is still
+// not cached at all.
+func (c *Conn) SetCacheTimeouts(typ os.FileMode, entryValid, attrValid time.Duration) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	if c.cacheTTL == nil {
+		c.cacheTTL = make(map[os.FileMode]cacheTimeouts)
+	}
+	c.cacheTTL[typ&os.ModeType] = cacheTimeouts{entry: entryValid, attr: attrValid}
+}
+
+// CacheTimeouts returns the cache timeouts set with SetCacheTimeouts
+// for a node with the given mode. ok is false if none were set for
+// its type.
+func (c *Conn) CacheTimeouts(mode os.FileMode) (entryValid, attrValid time.Duration, ok bool) {
+	c.cacheMu.RLock()
+	defer c.cacheMu.RUnlock()
+	t, ok := c.cacheTTL[mode&os.ModeType]
+	return t.entry, t.attr, ok
+}
+
+// entryValid returns d, or if it is zero the entry timeout set with
+// SetCacheTimeouts for nodes of the given mode.
+func (c *Conn) entryValid(mode os.FileMode, d time.Duration) time.Duration {
+	if d != 0 {
+		return d
+	}
+	d, _, _ = c.CacheTimeouts(mode)
+	return d
+}
+
+// attrValid returns d, or if it is zero the attribute timeout set
+// with SetCacheTimeouts for nodes of the given mode.
+func (c *Conn) attrValid(mode os.FileMode, d time.Duration) time.Duration {
+	if d != 0 {
+		return d
+	}
+	_, d, _ = c.CacheTimeouts(mode)
+	return d
+}
+
+// SetUserData stores v on the connection, for the server's own use.
+// Code that only has a request, such as middleware or helpers like
+// fuseutil.HandleTable, can then find the server's state with
+// req.Hdr().Conn.UserData(), without it being passed around
+// separately. The connection itself never looks at v.
+func (c *Conn) SetUserData(v interface{}) {
+	c.userMu.Lock()
+	defer c.userMu.Unlock()
+	c.userData = v
+}
+
+// UserData returns the value stored with SetUserData, or nil.
+func (c *Conn) UserData() interface{} {
+	c.userMu.RLock()
+	defer c.userMu.RUnlock()
+	return c.userData
+}
+
+func (c *Conn) now() time.Time {
+	if c.nowFunc != nil {
+		return c.nowFunc()
+	}
+	return time.Now()
+}
+
 // caller must hold wio or rio
 func (c *Conn) fd() int {
 	return int(c.dev.Fd())
@@ -427,10 +906,50 @@ func (c *Conn) fd() int {
 //
 // Caller must call either Request.Respond or Request.RespondError in
 // a reasonable time. Caller must not retain Request after that call.
+//
+// Some requests, such as writes, are not copied out of the buffer
+// they were read into: WriteRequest.Data, SetxattrRequest.Xattr and
+// IoctlRequest.InData point into it. The buffer stays with the
+// request until it is responded to, and is then reused for other
+// requests; a caller that needs the data longer must copy it. A
+// request never responded to holds on to its buffer for good.
 func (c *Conn) ReadRequest() (Request, error) {
-	buf := getBuffer()
-	defer putBuffer(buf)
+	for {
+		req, err := c.readRequest()
+		if err == errSkipped {
+			continue
+		}
+		if err == io.EOF {
+			c.endRetrieves()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := req.(*InterruptRequest); ok && c.dropInterrupt(r) {
+			continue
+		}
+		return req, nil
+	}
+}
+
+func (c *Conn) readRequest() (Request, error) {
+	msgBuf := c.readBuffer()
+	buf := msgBuf
+	var req Request
+	defer func() {
+		// Requests pointing into the buffer keep it until they are
+		// responded to.
+		if req == nil || req.Hdr().buf == nil {
+			c.putReadBuffer(msgBuf)
+		}
+	}()
 loop:
+	if atomic.LoadUint32(&c.gone) != 0 {
+		// Responses can no longer be delivered; don't serve more
+		// requests.
+		return nil, io.EOF
+	}
+	gen := atomic.LoadUint32(&c.reconnects)
 	c.rio.RLock()
 	n, err := syscall.Read(c.fd(), buf)
 	c.rio.RUnlock()
@@ -439,6 +958,13 @@ loop:
 		// completed before it got sent to userspace?
 		goto loop
 	}
+	if err == syscall.EAGAIN && atomic.LoadUint32(&c.nonblock) != 0 {
+		return nil, ErrWouldBlock
+	}
+	if (err != nil || n <= 0) && atomic.LoadUint32(&c.reconnects) != gen {
+		// The device was replaced while we were reading from it.
+		goto loop
+	}
 	if err != nil && err != syscall.ENODEV {
 		return nil, err
 	}
@@ -446,6 +972,7 @@ loop:
 		return nil, io.EOF
 	}
 	buf = buf[:n]
+	noteMax(&c.stats.maxRequestSize, uint64(n))
 
 	if n < inHeaderSize {
 		return nil, errors.New("fuse: message too short")
@@ -457,24 +984,28 @@ loop:
 	}
 	buf = buf[inHeaderSize:]
 
-	// FreeBSD FUSE sends a short length in the header
-	// for FUSE_INIT even though the actual read length is correct.
-	if hdr.Opcode == opInit && n == inHeaderSize+initInSize && hdr.Len < uint32(n) {
-		hdr.Len = uint32(n)
-	}
-
-	// OSXFUSE sometimes sends the wrong hdr.Len in a FUSE_WRITE message.
-	if hdr.Opcode == opWrite && hdr.Len < uint32(n) && hdr.Len >= writeInSize {
-		hdr.Len = uint32(n)
-	}
+	// Work around platform bugs; strict on Linux.
+	fixHeaderLen(&hdr, n)
 
 	if hdr.Len != uint32(n) {
 		return nil, fmt.Errorf("fuse: bad hdr len") //read %d opcode %d but expected %d", n, hdr.Opcode, hdr.Len)
 	}
 
+	// Split off the request extensions, so the per-opcode decoding
+	// below sees the same arguments as without them.
+	extLen := int(hdr.TotalExtLen) * 8
+	var ext []byte
+	if extLen > len(buf) {
+		goto corrupt
+	}
+	ext = buf[len(buf)-extLen:]
+	buf = buf[:len(buf)-extLen]
+	if err := hdr.readGroups(ext); err != nil {
+		goto corrupt
+	}
+
 	// Convert to data structures.
 	// Do not trust kernel to hand us well-formed data.
-	var req Request
 	switch hdr.Opcode {
 	default:
 		//Debug(noOpcode{Opcode: hdr.Opcode})
@@ -496,15 +1027,52 @@ loop:
 		if len(buf) < forgetInSize {
 			goto corrupt
 		}
-		in.Nlookup = binary.LittleEndian.Uint64(buf[0:8])
+		in.Nlookup = hostOrder.Uint64(buf[0:8])
 		req = &ForgetRequest{
 			Header: hdr,
 			N:      in.Nlookup,
 		}
 
+	case opBatchForget:
+		var in batchForgetIn
+		if len(buf) < batchForgetInSize {
+			goto corrupt
+		}
+		in.Count = hostOrder.Uint32(buf[0:4])
+		buf = buf[batchForgetInSize:]
+		// Check the count against the message before allocating
+		// for it; in 64 bits, so that no count overflows.
+		if uint64(len(buf)) < uint64(in.Count)*forgetOneSize {
+			goto corrupt
+		}
+		items := make([]ForgetItem, in.Count)
+		for i := range items {
+			items[i] = ForgetItem{
+				Node: NodeID(hostOrder.Uint64(buf[0:8])),
+				N:    hostOrder.Uint64(buf[8:16]),
+			}
+			buf = buf[forgetOneSize:]
+		}
+		req = &BatchForgetRequest{
+			Header: hdr,
+			Forget: items,
+		}
+
 	case opGetattr:
+		var in getattrIn
+		// The kernel sends getattr_in whatever the negotiated
+		// version; only kernels older than it send no body.
+		switch {
+		case len(buf) >= getattrInSize:
+			in.GetattrFlags = hostOrder.Uint32(buf[0:4])
+			in.Fh = hostOrder.Uint64(buf[8:16])
+		case len(buf) != 0:
+			goto corrupt
+		}
 		req = &GetattrRequest{
 			Header: hdr,
+			Flags:  GetattrFlags(in.GetattrFlags),
+			Handle: HandleID(in.Fh),
 		}
 
 	case opSetattr:
@@ -512,35 +1080,36 @@ loop:
 		if len(buf) < setattrInSize {
 			goto corrupt
 		}
-		in.Valid = binary.LittleEndian.Uint32(buf[0:4])
-		in.Padding = binary.LittleEndian.Uint32(buf[4:8])
-		in.Fh = binary.LittleEndian.Uint64(buf[8:16])
-		in.Size = binary.LittleEndian.Uint64(buf[16:24])
-		in.LockOwner = binary.LittleEndian.Uint64(buf[24:32])
-		in.Atime = binary.LittleEndian.Uint64(buf[32:40])
-		in.Mtime = binary.LittleEndian.Uint64(buf[40:48])
-		in.Unused2 = binary.LittleEndian.Uint64(buf[48:56])
-		in.AtimeNsec = binary.LittleEndian.Uint32(buf[56:60])
-		in.MtimeNsec = binary.LittleEndian.Uint32(buf[60:64])
-		in.Unused3 = binary.LittleEndian.Uint32(buf[64:68])
-		in.Mode = binary.LittleEndian.Uint32(buf[68:72])
-		in.Unused4 = binary.LittleEndian.Uint32(buf[72:76])
-		in.Uid = binary.LittleEndian.Uint32(buf[76:80])
-		in.Gid = binary.LittleEndian.Uint32(buf[80:84])
-		in.Unused5 = binary.LittleEndian.Uint32(buf[84:88])
+		in.Valid = hostOrder.Uint32(buf[0:4])
+		in.Padding = hostOrder.Uint32(buf[4:8])
+		in.Fh = hostOrder.Uint64(buf[8:16])
+		in.Size = hostOrder.Uint64(buf[16:24])
+		in.LockOwner = hostOrder.Uint64(buf[24:32])
+		in.Atime = hostOrder.Uint64(buf[32:40])
+		in.Mtime = hostOrder.Uint64(buf[40:48])
+		in.Unused2 = hostOrder.Uint64(buf[48:56])
+		in.AtimeNsec = hostOrder.Uint32(buf[56:60])
+		in.MtimeNsec = hostOrder.Uint32(buf[60:64])
+		in.Unused3 = hostOrder.Uint32(buf[64:68])
+		in.Mode = hostOrder.Uint32(buf[68:72])
+		in.Unused4 = hostOrder.Uint32(buf[72:76])
+		in.Uid = hostOrder.Uint32(buf[76:80])
+		in.Gid = hostOrder.Uint32(buf[80:84])
+		in.Unused5 = hostOrder.Uint32(buf[84:88])
 		req = &SetattrRequest{
-			Header:   hdr,
-			Valid:    SetattrValid(in.Valid),
-			Handle:   HandleID(in.Fh),
-			Size:     in.Size,
-			Atime:    time.Unix(int64(in.Atime), int64(in.AtimeNsec)),
-			Mtime:    time.Unix(int64(in.Mtime), int64(in.MtimeNsec)),
-			Mode:     fileMode(in.Mode),
-			Uid:      in.Uid,
-			Gid:      in.Gid,
-			Bkuptime: in.BkupTime(),
-			Chgtime:  in.Chgtime(),
-			Flags:    in.Flags(),
+			Header:    hdr,
+			Valid:     SetattrValid(in.Valid),
+			Handle:    HandleID(in.Fh),
+			Size:      in.Size,
+			LockOwner: in.LockOwner,
+			Atime:     time.Unix(int64(in.Atime), int64(in.AtimeNsec)),
+			Mtime:     time.Unix(int64(in.Mtime), int64(in.MtimeNsec)),
+			Mode:      fileMode(in.Mode),
+			Uid:       in.Uid,
+			Gid:       in.Gid,
+			Bkuptime:  in.BkupTime(),
+			Chgtime:   in.Chgtime(),
+			Flags:     in.Flags(),
 		}
 	case opReadlink:
 		if len(buf) > 0 {
@@ -551,20 +1120,28 @@ loop:
 		}
 
 	case opSymlink:
-		// buf is "newName\0target\0"
+		// buf is "newName\0target\0", maybe followed by the
+		// security context
 		names := buf
-		if len(names) == 0 || names[len(names)-1] != 0 {
+		i := bytes.IndexByte(names, '\x00')
+		if i < 0 {
 			goto corrupt
 		}
-		i := bytes.IndexByte(names, '\x00')
+		newName, names := names[:i], names[i+1:]
+		i = bytes.IndexByte(names, '\x00')
 		if i < 0 {
 			goto corrupt
 		}
-		newName, target := names[0:i], names[i+1:len(names)-1]
+		target := names[:i]
+		secctx, ok := c.securityContext(names[i+1:], ext)
+		if !ok {
+			goto corrupt
+		}
 		req = &SymlinkRequest{
 			Header:  hdr,
 			NewName: string(newName),
 			Target:  string(target),
+			secctx:  secctx,
 		}
 
 	case opLink:
@@ -572,7 +1149,7 @@ loop:
 		if len(buf) < linkInSize {
 			goto corrupt
 		}
-		in.Oldnodeid = binary.LittleEndian.Uint64(buf[0:8])
+		in.Oldnodeid = hostOrder.Uint64(buf[0:8])
 		newName := buf[linkInSize:]
 		if len(newName) < 2 || newName[len(newName)-1] != '\x00' {
 			goto corrupt
@@ -588,17 +1165,23 @@ loop:
 		if len(buf) < mknodInSize {
 			goto corrupt
 		}
-		in.Mode = binary.LittleEndian.Uint32(buf[0:4])
-		in.Rdev = binary.LittleEndian.Uint32(buf[4:8])
+		in.Mode = hostOrder.Uint32(buf[0:4])
+		in.Rdev = hostOrder.Uint32(buf[4:8])
 		name := buf[mknodInSize:]
-		if len(name) < 2 || name[len(name)-1] != '\x00' {
+		i := bytes.IndexByte(name, '\x00')
+		if i < 1 {
+			goto corrupt
+		}
+		secctx, ok := c.securityContext(name[i+1:], ext)
+		if !ok {
 			goto corrupt
 		}
 		req = &MknodRequest{
 			Header: hdr,
 			Mode:   fileMode(in.Mode),
 			Rdev:   in.Rdev,
-			Name:   string(name),
+			Name:   string(name[:i]),
+			secctx: secctx,
 		}
 
 	case opMkdir:
@@ -606,20 +1189,25 @@ loop:
 		if len(buf) < mkdirInSize {
 			goto corrupt
 		}
-		in.Mode = binary.LittleEndian.Uint32(buf[0:4])
-		in.Padding = binary.LittleEndian.Uint32(buf[4:8])
+		in.Mode = hostOrder.Uint32(buf[0:4])
+		in.Padding = hostOrder.Uint32(buf[4:8])
 		name := buf[mkdirInSize:]
 		i := bytes.IndexByte(name, '\x00')
 		if i < 0 {
 			goto corrupt
 		}
+		secctx, ok := c.securityContext(name[i+1:], ext)
+		if !ok {
+			goto corrupt
+		}
 		req = &MkdirRequest{
 			Header: hdr,
 			Name:   string(name[:i]),
 			// observed on Linux: mkdirIn.Mode & syscall.S_IFMT == 0,
 			// and this causes fileMode to go into it's "no idea"
 			// code branch; enforce type to directory
-			Mode: fileMode((in.Mode &^ syscall.S_IFMT) | syscall.S_IFDIR),
+			Mode:   fileMode((in.Mode &^ syscall.S_IFMT) | syscall.S_IFDIR),
+			secctx: secctx,
 		}
 	case opUnlink, opRmdir:
 		buf := buf
@@ -633,15 +1221,22 @@ loop:
 			Dir:    hdr.Opcode == opRmdir,
 		}
 
-	case opRename:
-		var in renameIn
-		if len(buf) < renameInSize {
+	case opRename, opRename2:
+		var in rename2In
+		size := renameInSize
+		if hdr.Opcode == opRename2 {
+			size = rename2InSize
+		}
+		if len(buf) < size {
 			goto corrupt
 		}
-		in.Newdir = binary.LittleEndian.Uint64(buf[0:8])
+		in.Newdir = hostOrder.Uint64(buf[0:8])
+		if hdr.Opcode == opRename2 {
+			in.Flags = hostOrder.Uint32(buf[8:12])
+		}
 		newDirNodeID := NodeID(in.Newdir)
 		// buf is "old\0new\0"
-		names := buf[renameInSize:]
+		names := buf[size:]
 		if len(names) == 0 || names[len(names)-1] != 0 {
 			goto corrupt
 		}
@@ -655,6 +1250,7 @@ loop:
 			NewDir:  newDirNodeID,
 			OldName: string(oldName),
 			NewName: string(newName),
+			Flags:   RenameFlags(in.Flags),
 		}
 
 	case opOpendir, opOpen:
@@ -662,28 +1258,41 @@ loop:
 		if len(buf) < openInSize {
 			goto corrupt
 		}
-		in.Flags = binary.LittleEndian.Uint32(buf[0:4])
+		in.Flags = hostOrder.Uint32(buf[0:4])
+		in.OpenFlags = hostOrder.Uint32(buf[4:8])
 		req = &OpenRequest{
-			Header: hdr,
-			Dir:    hdr.Opcode == opOpendir,
-			Flags:  openFlags(in.Flags),
+			Header:    hdr,
+			Dir:       hdr.Opcode == opOpendir,
+			Flags:     openFlags(in.Flags),
+			OpenFlags: OpenRequestFlags(in.OpenFlags),
 		}
 
-	case opRead, opReaddir:
+	case opRead, opReaddir, opReaddirplus:
 		var in readIn
-		if len(buf) < readInSize {
+		if len(buf) < readInCompatSize {
 			goto corrupt
 		}
-		in.Fh = binary.LittleEndian.Uint64(buf[0:8])
-		in.Offset = binary.LittleEndian.Uint64(buf[8:16])
-		in.Size = binary.LittleEndian.Uint32(buf[16:20])
-		in.Padding = binary.LittleEndian.Uint32(buf[20:24])
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Offset = hostOrder.Uint64(buf[8:16])
+		in.Size = hostOrder.Uint32(buf[16:20])
+		// The kernel sends the long layout whatever the
+		// negotiated version; only older kernels send the
+		// short one.
+		if len(buf) >= readInSize {
+			in.ReadFlags = hostOrder.Uint32(buf[20:24])
+			in.LockOwner = hostOrder.Uint64(buf[24:32])
+			in.Flags = hostOrder.Uint32(buf[32:36])
+		}
 		req = &ReadRequest{
-			Header: hdr,
-			Dir:    hdr.Opcode == opReaddir,
-			Handle: HandleID(in.Fh),
-			Offset: int64(in.Offset),
-			Size:   int(in.Size),
+			Header:    hdr,
+			Dir:       hdr.Opcode == opReaddir || hdr.Opcode == opReaddirplus,
+			Plus:      hdr.Opcode == opReaddirplus,
+			Handle:    HandleID(in.Fh),
+			Offset:    int64(in.Offset),
+			Size:      int(in.Size),
+			ReadFlags: ReadFlags(in.ReadFlags),
+			LockOwner: in.LockOwner,
+			FileFlags: openFlags(in.Flags),
 		}
 
 	case opWrite:
@@ -691,22 +1300,49 @@ loop:
 		if len(buf) < writeInSize {
 			goto corrupt
 		}
-		in.Fh = binary.LittleEndian.Uint64(buf[0:8])
-		in.Offset = binary.LittleEndian.Uint64(buf[8:16])
-		in.Size = binary.LittleEndian.Uint32(buf[16:20])
-		in.WriteFlags = binary.LittleEndian.Uint32(buf[20:24])
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Offset = hostOrder.Uint64(buf[8:16])
+		in.Size = hostOrder.Uint32(buf[16:20])
+		in.WriteFlags = hostOrder.Uint32(buf[20:24])
 		buf = buf[writeInSize:]
 		if uint32(len(buf)) < in.Size {
 			goto corrupt
 		}
+		hdr.buf = holdBuffer(msgBuf)
 		req = &WriteRequest{
 			Header: hdr,
 			Handle: HandleID(in.Fh),
 			Offset: int64(in.Offset),
-			Data:   buf,
+			Data:   buf[:in.Size],
 			Flags:  WriteFlags(in.WriteFlags),
 		}
 
+	case opIoctl:
+		var in ioctlIn
+		if len(buf) < ioctlInSize {
+			goto corrupt
+		}
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Flags = hostOrder.Uint32(buf[8:12])
+		in.Cmd = hostOrder.Uint32(buf[12:16])
+		in.Arg = hostOrder.Uint64(buf[16:24])
+		in.InSize = hostOrder.Uint32(buf[24:28])
+		in.OutSize = hostOrder.Uint32(buf[28:32])
+		buf = buf[ioctlInSize:]
+		if uint32(len(buf)) < in.InSize {
+			goto corrupt
+		}
+		hdr.buf = holdBuffer(msgBuf)
+		req = &IoctlRequest{
+			Header:  hdr,
+			Handle:  HandleID(in.Fh),
+			Flags:   IoctlFlags(in.Flags),
+			Cmd:     in.Cmd,
+			Arg:     in.Arg,
+			InData:  buf[:in.InSize],
+			OutSize: in.OutSize,
+		}
+
 	case opStatfs:
 		req = &StatfsRequest{
 			Header: hdr,
@@ -717,10 +1353,10 @@ loop:
 		if len(buf) < releaseInSize {
 			goto corrupt
 		}
-		in.Fh = binary.LittleEndian.Uint64(buf[0:8])
-		in.Flags = binary.LittleEndian.Uint32(buf[8:12])
-		in.ReleaseFlags = binary.LittleEndian.Uint32(buf[12:16])
-		in.LockOwner = binary.LittleEndian.Uint32(buf[16:20])
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Flags = hostOrder.Uint32(buf[8:12])
+		in.ReleaseFlags = hostOrder.Uint32(buf[12:16])
+		in.LockOwner = hostOrder.Uint64(buf[16:24])
 		req = &ReleaseRequest{
 			Header:       hdr,
 			Dir:          hdr.Opcode == opReleasedir,
@@ -735,9 +1371,9 @@ loop:
 		if len(buf) < fsyncInSize {
 			goto corrupt
 		}
-		in.Fh = binary.LittleEndian.Uint64(buf[0:8])
-		in.FsyncFlags = binary.LittleEndian.Uint32(buf[8:12])
-		in.Padding = binary.LittleEndian.Uint32(buf[12:16])
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.FsyncFlags = hostOrder.Uint32(buf[8:12])
+		in.Padding = hostOrder.Uint32(buf[12:16])
 		req = &FsyncRequest{
 			Dir:    hdr.Opcode == opFsyncdir,
 			Header: hdr,
@@ -745,13 +1381,68 @@ loop:
 			Flags:  in.FsyncFlags,
 		}
 
+	case opFallocate:
+		var in fallocateIn
+		if len(buf) < fallocateInSize {
+			goto corrupt
+		}
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Offset = hostOrder.Uint64(buf[8:16])
+		in.Length = hostOrder.Uint64(buf[16:24])
+		in.Mode = hostOrder.Uint32(buf[24:28])
+		req = &FallocateRequest{
+			Header: hdr,
+			Handle: HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Length: int64(in.Length),
+			Mode:   FallocateMode(in.Mode),
+		}
+
+	case opLseek:
+		var in lseekIn
+		if len(buf) < lseekInSize {
+			goto corrupt
+		}
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Offset = hostOrder.Uint64(buf[8:16])
+		in.Whence = hostOrder.Uint32(buf[16:20])
+		req = &LseekRequest{
+			Header: hdr,
+			Handle: HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Whence: int(in.Whence),
+		}
+
+	case opCopyFileRange:
+		var in copyFileRangeIn
+		if len(buf) < copyFileRangeInSize {
+			goto corrupt
+		}
+		in.FhIn = hostOrder.Uint64(buf[0:8])
+		in.OffIn = hostOrder.Uint64(buf[8:16])
+		in.NodeidOut = hostOrder.Uint64(buf[16:24])
+		in.FhOut = hostOrder.Uint64(buf[24:32])
+		in.OffOut = hostOrder.Uint64(buf[32:40])
+		in.Len = hostOrder.Uint64(buf[40:48])
+		in.Flags = hostOrder.Uint64(buf[48:56])
+		req = &CopyFileRangeRequest{
+			Header:    hdr,
+			HandleIn:  HandleID(in.FhIn),
+			OffsetIn:  int64(in.OffIn),
+			NodeOut:   NodeID(in.NodeidOut),
+			HandleOut: HandleID(in.FhOut),
+			OffsetOut: int64(in.OffOut),
+			Length:    in.Len,
+			Flags:     in.Flags,
+		}
+
 	case opSetxattr:
 		var in setxattrIn
 		if len(buf) < setxattrInSize {
 			goto corrupt
 		}
-		in.Size = binary.LittleEndian.Uint32(buf[0:4])
-		in.Flags = binary.LittleEndian.Uint32(buf[4:8])
+		in.Size = hostOrder.Uint32(buf[0:4])
+		in.Flags = hostOrder.Uint32(buf[4:8])
 		name := buf[setxattrInSize:]
 		i := bytes.IndexByte(name, '\x00')
 		if i < 0 {
@@ -762,6 +1453,7 @@ loop:
 			goto corrupt
 		}
 		xattr = xattr[:in.Size]
+		hdr.buf = holdBuffer(msgBuf)
 		req = &SetxattrRequest{
 			Header:   hdr,
 			Flags:    in.Flags,
@@ -775,7 +1467,7 @@ loop:
 		if len(buf) < getxattrInSize {
 			goto corrupt
 		}
-		in.Size = binary.LittleEndian.Uint32(buf[0:4])
+		in.Size = hostOrder.Uint32(buf[0:4])
 		name := buf[getxattrInSize:]
 		i := bytes.IndexByte(name, '\x00')
 		if i < 0 {
@@ -793,7 +1485,7 @@ loop:
 		if len(buf) < getxattrInSize {
 			goto corrupt
 		}
-		in.Size = binary.LittleEndian.Uint32(buf[0:4])
+		in.Size = hostOrder.Uint32(buf[0:4])
 		req = &ListxattrRequest{
 			Header:   hdr,
 			Size:     in.Size,
@@ -816,10 +1508,10 @@ loop:
 		if len(buf) < flushInSize {
 			goto corrupt
 		}
-		in.Fh = binary.LittleEndian.Uint64(buf[0:8])
-		in.FlushFlags = binary.LittleEndian.Uint32(buf[8:12])
-		in.Padding = binary.LittleEndian.Uint32(buf[12:16])
-		in.LockOwner = binary.LittleEndian.Uint64(buf[16:24])
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.FlushFlags = hostOrder.Uint32(buf[8:12])
+		in.Padding = hostOrder.Uint32(buf[12:16])
+		in.LockOwner = hostOrder.Uint64(buf[16:24])
 		req = &FlushRequest{
 			Header:    hdr,
 			Handle:    HandleID(in.Fh),
@@ -832,31 +1524,96 @@ loop:
 		if len(buf) < initInSize {
 			goto corrupt
 		}
-		in.Major = binary.LittleEndian.Uint32(buf[0:4])
-		in.Minor = binary.LittleEndian.Uint32(buf[4:8])
-		in.MaxReadahead = binary.LittleEndian.Uint32(buf[8:12])
-		in.Flags = binary.LittleEndian.Uint32(buf[12:16])
+		in.Major = hostOrder.Uint32(buf[0:4])
+		in.Minor = hostOrder.Uint32(buf[4:8])
+		in.MaxReadahead = hostOrder.Uint32(buf[8:12])
+		in.Flags = hostOrder.Uint32(buf[12:16])
+		flags := InitFlags(in.Flags)
+		kernel := Protocol{in.Major, in.Minor}
+		if kernel.GE(Protocol{7, 36}) && in.Flags&initExt != 0 && len(buf) >= initInSize+4 {
+			in.Flags2 = hostOrder.Uint32(buf[16:20])
+			flags = flags&^initExt | InitFlags(in.Flags2)<<32
+		}
+		c.kernel = kernel
+		c.proto = kernel
+		if ours := (Protocol{kernelVersion, kernelMinorVersion}); ours.LT(kernel) {
+			c.proto = ours
+		}
 		req = &InitRequest{
 			Header:       hdr,
 			Major:        in.Major,
 			Minor:        in.Minor,
 			MaxReadahead: in.MaxReadahead,
-			Flags:        InitFlags(in.Flags),
+			Flags:        flags,
 		}
 
-	case opGetlk:
-		panic("opGetlk")
-	case opSetlk:
-		panic("opSetlk")
-	case opSetlkw:
-		panic("opSetlkw")
+	case opPoll:
+		var in pollIn
+		if len(buf) < pollInSize {
+			goto corrupt
+		}
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Kh = hostOrder.Uint64(buf[8:16])
+		in.Flags = hostOrder.Uint32(buf[16:20])
+		if c.proto.GE(Protocol{7, 21}) {
+			in.Events = hostOrder.Uint32(buf[20:24])
+		}
+		req = &PollRequest{
+			Header: hdr,
+			Handle: HandleID(in.Fh),
+			Kh:     in.Kh,
+			Flags:  PollFlags(in.Flags),
+			Events: in.Events,
+		}
+
+	case opGetlk, opSetlk, opSetlkw:
+		var in lkIn
+		if len(buf) < lkInCompatSize {
+			goto corrupt
+		}
+		in.Fh = hostOrder.Uint64(buf[0:8])
+		in.Owner = hostOrder.Uint64(buf[8:16])
+		in.Lk.Start = hostOrder.Uint64(buf[16:24])
+		in.Lk.End = hostOrder.Uint64(buf[24:32])
+		in.Lk.Type = hostOrder.Uint32(buf[32:36])
+		in.Lk.Pid = hostOrder.Uint32(buf[36:40])
+		if c.proto.GE(Protocol{7, 9}) {
+			if len(buf) < lkInSize {
+				goto corrupt
+			}
+			in.LkFlags = hostOrder.Uint32(buf[40:44])
+		}
+		lock := FileLock{
+			Start: in.Lk.Start,
+			End:   in.Lk.End,
+			Type:  LockType(in.Lk.Type),
+			Pid:   in.Lk.Pid,
+		}
+		if hdr.Opcode == opGetlk {
+			req = &GetlkRequest{
+				Header:    hdr,
+				Handle:    HandleID(in.Fh),
+				LockOwner: in.Owner,
+				Lock:      lock,
+				LockFlags: LockFlags(in.LkFlags),
+			}
+			break
+		}
+		req = &SetlkRequest{
+			Header:    hdr,
+			Handle:    HandleID(in.Fh),
+			LockOwner: in.Owner,
+			Lock:      lock,
+			LockFlags: LockFlags(in.LkFlags),
+			Sleep:     hdr.Opcode == opSetlkw,
+		}
 
 	case opAccess:
 		var in accessIn
 		if len(buf) < accessInSize {
 			goto corrupt
 		}
-		in.Mask = binary.LittleEndian.Uint32(buf[0:4])
+		in.Mask = hostOrder.Uint32(buf[0:4])
 		req = &AccessRequest{
 			Header: hdr,
 			Mask:   in.Mask,
@@ -867,18 +1624,48 @@ loop:
 		if len(buf) < createInSize {
 			goto corrupt
 		}
-		in.Flags = binary.LittleEndian.Uint32(buf[0:4])
-		in.Mode = binary.LittleEndian.Uint32(buf[4:8])
+		in.Flags = hostOrder.Uint32(buf[0:4])
+		in.Mode = hostOrder.Uint32(buf[4:8])
 		name := buf[createInSize:]
 		i := bytes.IndexByte(name, '\x00')
 		if i < 0 {
 			goto corrupt
 		}
+		secctx, ok := c.securityContext(name[i+1:], ext)
+		if !ok {
+			goto corrupt
+		}
 		req = &CreateRequest{
 			Header: hdr,
 			Flags:  openFlags(in.Flags),
 			Mode:   fileMode(in.Mode),
 			Name:   string(name[:i]),
+			secctx: secctx,
+		}
+
+	case opTmpfile:
+		var in createIn
+		if len(buf) < createInSize {
+			goto corrupt
+		}
+		in.Flags = hostOrder.Uint32(buf[0:4])
+		in.Mode = hostOrder.Uint32(buf[4:8])
+		// The kernel sends a placeholder name after createIn; the
+		// file being created has no name, so it is ignored.
+		name := buf[createInSize:]
+		i := bytes.IndexByte(name, '\x00')
+		if i < 0 {
+			goto corrupt
+		}
+		secctx, ok := c.securityContext(name[i+1:], ext)
+		if !ok {
+			goto corrupt
+		}
+		req = &TmpfileRequest{
+			Header: hdr,
+			Flags:  openFlags(in.Flags),
+			Mode:   fileMode(in.Mode),
+			secctx: secctx,
 		}
 
 	case opInterrupt:
@@ -886,14 +1673,39 @@ loop:
 		if len(buf) < interruptInSize {
 			goto corrupt
 		}
-		in.Unique = binary.LittleEndian.Uint64(buf[0:8])
+		in.Unique = hostOrder.Uint64(buf[0:8])
 		req = &InterruptRequest{
 			Header: hdr,
 			IntrID: RequestID(in.Unique),
 		}
 
 	case opBmap:
-		panic("opBmap")
+		var in bmapIn
+		if len(buf) < bmapInSize {
+			goto corrupt
+		}
+		in.Block = hostOrder.Uint64(buf[0:8])
+		in.BlockSize = hostOrder.Uint32(buf[8:12])
+		req = &BmapRequest{
+			Header:    hdr,
+			Block:     in.Block,
+			BlockSize: in.BlockSize,
+		}
+
+	case opNotifyReply:
+		// Not a request, but the answer to a NotifyRetrieve.
+		var in notifyRetrieveIn
+		if len(buf) < notifyRetrieveInSize {
+			goto corrupt
+		}
+		in.Offset = hostOrder.Uint64(buf[8:16])
+		in.Size = hostOrder.Uint32(buf[16:20])
+		data := buf[notifyRetrieveInSize:]
+		if uint32(len(data)) < in.Size {
+			goto corrupt
+		}
+		c.retrieved(uint64(hdr.ID), data[:in.Size])
+		return nil, errSkipped
 
 	case opDestroy:
 		req = &DestroyRequest{
@@ -902,17 +1714,63 @@ loop:
 
 	// OS X
 	case opSetvolname:
-		panic("opSetvolname")
+		n := len(buf)
+		if n == 0 || buf[n-1] != '\x00' {
+			goto corrupt
+		}
+		req = &SetvolnameRequest{
+			Header: hdr,
+			Name:   string(buf[:n-1]),
+		}
 	case opGetxtimes:
-		panic("opGetxtimes")
+		req = &GetxtimesRequest{
+			Header: hdr,
+		}
 	case opExchange:
-		panic("opExchange")
+		var in exchangeIn
+		if len(buf) < exchangeInSize {
+			goto corrupt
+		}
+		in.Olddir = hostOrder.Uint64(buf[0:8])
+		in.Newdir = hostOrder.Uint64(buf[8:16])
+		in.Options = hostOrder.Uint64(buf[16:24])
+		// buf is "old\0new\0"
+		names := buf[exchangeInSize:]
+		if len(names) == 0 || names[len(names)-1] != 0 {
+			goto corrupt
+		}
+		i := bytes.IndexByte(names, '\x00')
+		if i < 0 {
+			goto corrupt
+		}
+		oldName, newName := names[0:i], names[i+1:len(names)-1]
+		req = &ExchangeDataRequest{
+			Header:  hdr,
+			OldDir:  NodeID(in.Olddir),
+			NewDir:  NodeID(in.Newdir),
+			OldName: string(oldName),
+			NewName: string(newName),
+			Options: in.Options,
+		}
 	}
 
+	if !hdr.noReply() {
+		c.addInFlight(hdr.ID)
+	}
 	return req, nil
 
 corrupt:
 	Debug(malformedMessage{})
+	if atomic.LoadUint32(&c.skipCorrupt) != 0 {
+		switch hdr.Opcode {
+		case opForget, opBatchForget, opInterrupt, opNotifyReply:
+			// the kernel does not wait for a response
+		default:
+			out := &outHeader{Error: -int32(EIO), Unique: uint64(hdr.ID)}
+			c.respond(out)
+		}
+		return nil, errSkipped
+	}
 	return nil, fmt.Errorf("fuse: malformed message")
 
 unrecognized:
@@ -920,9 +1778,388 @@ unrecognized:
 	// Assume higher-level code will send a "no idea what you mean" error.
 	h := new(Header)
 	*h = hdr
+	c.addInFlight(h.ID)
 	return h, nil
 }
 
+// inflightState is kept for every request in flight.
+type inflightState struct {
+	// An InterruptRequest for the request has been delivered.
+	interrupted bool
+	// The context of the request, once asked for with Context.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Set with OnDrop.
+	onDrop func()
+}
+
+func (c *Conn) addInFlight(id RequestID) {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if c.inflight == nil {
+		c.inflight = make(map[RequestID]inflightState)
+	}
+	c.inflight[id] = inflightState{}
+	if id > c.maxInFlight {
+		c.maxInFlight = id
+	}
+}
+
+// removeInFlightLocked removes the request from the in-flight
+// registry, cancelling its context. Must hold c.inflightMu.
+func (c *Conn) removeInFlightLocked(id RequestID) {
+	if st := c.inflight[id]; st.cancel != nil {
+		st.cancel()
+	}
+	delete(c.inflight, id)
+}
+
+// doneInFlight removes the request from the in-flight registry, and
+// reports whether its response should be sent; it should not if the
+// request was already answered by Abandon. The OnDrop functions of a
+// response that is not sent are called.
+func (c *Conn) doneInFlight(id RequestID) bool {
+	c.inflightMu.Lock()
+	onDrop, ok := c.abandoned[id]
+	if ok {
+		delete(c.abandoned, id)
+	} else {
+		c.removeInFlightLocked(id)
+	}
+	c.inflightMu.Unlock()
+	if ok && onDrop != nil {
+		onDrop()
+	}
+	return !ok
+}
+
+// abandonLocked moves a request in flight to c.abandoned. Must hold
+// c.inflightMu.
+func (c *Conn) abandonLocked(id RequestID, st inflightState) {
+	if c.abandoned == nil {
+		c.abandoned = make(map[RequestID]func())
+	}
+	c.abandoned[id] = st.onDrop
+}
+
+// OnDrop arranges for f to be called if the response to the request
+// is dropped, because the request was answered by Abandon or
+// FailInFlight first. The kernel never learns of anything the
+// response would have handed it, such as a node or a handle, and so
+// never forgets or releases it; f is the place to undo that. It is
+// called by the goroutine that responds, before the respond method
+// returns.
+//
+// Every call adds a function; they are called in order. OnDrop does
+// nothing if the request was already responded to.
+func (h *Header) OnDrop(f func()) {
+	c := h.Conn
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if st, ok := c.inflight[h.ID]; ok {
+		st.onDrop = chainDrop(st.onDrop, f)
+		c.inflight[h.ID] = st
+	} else if prev, ok := c.abandoned[h.ID]; ok {
+		c.abandoned[h.ID] = chainDrop(prev, f)
+	}
+}
+
+func chainDrop(prev, f func()) func() {
+	if prev == nil {
+		return f
+	}
+	return func() {
+		prev()
+		f()
+	}
+}
+
+// Context returns a context that is cancelled when the kernel
+// interrupts the request with an InterruptRequest, when the request
+// is responded to, or when it is abandoned or failed. This lets
+// servers that do not use package fs stop work that is no longer
+// wanted; the interrupt is still returned by ReadRequest as well.
+//
+// The context is created on the first call, and later calls return
+// the same one. Requests that get no response, such as forgets, have
+// a context that is never cancelled; a request that was already
+// responded to has a cancelled one. Context is safe to call
+// concurrently with ReadRequest and with responding.
+func (h *Header) Context() context.Context {
+	c := h.Conn
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	st, ok := c.inflight[h.ID]
+	if !ok {
+		if h.noReply() {
+			return context.Background()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	if st.ctx == nil {
+		st.ctx, st.cancel = context.WithCancel(context.Background())
+		if st.interrupted {
+			st.cancel()
+		}
+		c.inflight[h.ID] = st
+	}
+	return st.ctx
+}
+
+// noReply reports whether the kernel expects no response to the
+// request.
+func (h *Header) noReply() bool {
+	switch h.Opcode {
+	case opForget, opBatchForget, opInterrupt:
+		return true
+	}
+	return false
+}
+
+// Abandon responds to the request with err right away, on behalf of a
+// handler that is still working on it, for example because it is
+// taking too long. The response the handler sends when it finishes is
+// dropped. Abandon does nothing if the request was already responded
+// to, or is of a kind that gets no response.
+//
+// A little memory is held for every abandoned request until its
+// handler responds, so handlers must still respond eventually. See
+// OnDrop for undoing the work of the dropped response.
+func (h *Header) Abandon(err error) {
+	c := h.Conn
+	c.inflightMu.Lock()
+	st, ok := c.inflight[h.ID]
+	if ok {
+		c.removeInFlightLocked(h.ID)
+		c.abandonLocked(h.ID, st)
+	}
+	c.inflightMu.Unlock()
+	if !ok {
+		return
+	}
+	errno := errnoOf(err)
+	out := &outHeader{Error: -int32(errno), Unique: uint64(h.ID)}
+	c.respond(out)
+}
+
+// SetInterruptDedup sets whether ReadRequest drops an InterruptRequest
+// for a request that has already been delivered an InterruptRequest
+// and not yet responded to. A process being killed, or an application
+// retrying in a tight loop, can otherwise make the kernel send a storm
+// of interrupts for the same request.
+//
+// Interrupts for requests that are not in flight are always delivered,
+// as are all interrupts when deduplication is off, the default. Both
+// delivered and dropped interrupts are counted in Stats.
+func (c *Conn) SetInterruptDedup(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&c.dedupInterrupts, v)
+}
+
+type droppedInterrupt struct {
+	ID     RequestID
+	IntrID RequestID
+}
+
+func (d droppedInterrupt) String() string {
+	return fmt.Sprintf("dropped interrupt %v for request %v: already interrupted", d.ID, d.IntrID)
+}
+
+type earlyInterrupt struct {
+	ID     RequestID
+	IntrID RequestID
+}
+
+func (e earlyInterrupt) String() string {
+	return fmt.Sprintf("interrupt %v for request %v not read yet: asked the kernel to resend it", e.ID, e.IntrID)
+}
+
+// dropInterrupt marks the request r interrupts as such, cancelling
+// its context, and reports whether r should be dropped: because it
+// repeats an interrupt already delivered, or because it is for a
+// request not read yet.
+//
+// An interrupt may overtake its request, when another goroutine reads
+// the request or when the kernel queues the interrupt first. It is
+// then answered with EAGAIN, which makes the kernel send it again
+// later. An interrupt for a request already responded to is
+// delivered, but needs nothing done: the kernel forgets it.
+func (c *Conn) dropInterrupt(r *InterruptRequest) bool {
+	atomic.AddUint64(&c.stats.interrupts, 1)
+	c.inflightMu.Lock()
+	st, ok := c.inflight[r.IntrID]
+	early := !ok && r.IntrID > c.maxInFlight
+	interrupted := st.interrupted
+	if ok && !interrupted {
+		st.interrupted = true
+		if st.cancel != nil {
+			st.cancel()
+		}
+		c.inflight[r.IntrID] = st
+	}
+	c.inflightMu.Unlock()
+	if early {
+		Debug(earlyInterrupt{ID: r.ID, IntrID: r.IntrID})
+		c.respond(&outHeader{Error: -int32(syscall.EAGAIN), Unique: uint64(r.ID)})
+		return true
+	}
+	if !interrupted || atomic.LoadUint32(&c.dedupInterrupts) == 0 {
+		return false
+	}
+	atomic.AddUint64(&c.stats.droppedInterrupts, 1)
+	Debug(droppedInterrupt{ID: r.ID, IntrID: r.IntrID})
+	return true
+}
+
+// FailInFlight responds with err to every request that has been read
+// from the kernel but not yet responded to. This is meant for
+// shutdown, so that processes waiting on the file system see an
+// error instead of hanging.
+//
+// As with Abandon, the responses the handlers of those requests send
+// afterwards are dropped, and their OnDrop functions called.
+func (c *Conn) FailInFlight(err Errno) {
+	c.inflightMu.Lock()
+	ids := make([]RequestID, 0, len(c.inflight))
+	for id, st := range c.inflight {
+		ids = append(ids, id)
+		if st.cancel != nil {
+			st.cancel()
+		}
+		c.abandonLocked(id, st)
+	}
+	c.inflight = nil
+	c.inflightMu.Unlock()
+
+	for _, id := range ids {
+		out := &outHeader{Error: -int32(err), Unique: uint64(id)}
+		c.respond(out)
+	}
+}
+
+// extension returns the request extension of type typ, including
+// its header. A nil result with ok set means there is no such
+// extension.
+func extension(ext []byte, typ func(uint32) bool) (found []byte, ok bool) {
+	for len(ext) > 0 {
+		if len(ext) < extHeaderSize {
+			return nil, false
+		}
+		var h extHeader
+		h.Size = hostOrder.Uint32(ext[0:4])
+		h.Type = hostOrder.Uint32(ext[4:8])
+		if h.Size < extHeaderSize || h.Size%8 != 0 || uint64(h.Size) > uint64(len(ext)) {
+			return nil, false
+		}
+		if typ(h.Type) {
+			return ext[:h.Size], true
+		}
+		ext = ext[h.Size:]
+	}
+	return nil, true
+}
+
+// readGroups decodes the supplementary groups extension, if present.
+func (h *Header) readGroups(ext []byte) error {
+	found, ok := extension(ext, func(typ uint32) bool { return typ == extGroups })
+	if !ok {
+		return fmt.Errorf("fuse: malformed extension")
+	}
+	if found == nil {
+		return nil
+	}
+	found = found[extHeaderSize:]
+	if len(found) < suppGroupsSize {
+		return fmt.Errorf("fuse: malformed groups extension")
+	}
+	var in suppGroups
+	in.NrGroups = hostOrder.Uint32(found[0:4])
+	found = found[suppGroupsSize:]
+	if uint64(in.NrGroups)*4 > uint64(len(found)) {
+		return fmt.Errorf("fuse: malformed groups extension")
+	}
+	groups := make([]uint32, in.NrGroups)
+	for i := range groups {
+		groups[i] = hostOrder.Uint32(found[i*4:])
+	}
+	h.groups = &groups
+	return nil
+}
+
+// securityContext parses the security context sent with requests
+// creating a new node. Since protocol 7.38, it is a request extension
+// in ext; before that, it follows the other arguments in buf. Without
+// InitSecurityContext, nothing may follow.
+func (c *Conn) securityContext(buf []byte, ext []byte) (*[]SecurityContext, bool) {
+	if !c.hasFlag(InitSecurityContext) {
+		return nil, len(buf) == 0
+	}
+	if c.kernel.GE(Protocol{7, 38}) {
+		if len(buf) != 0 {
+			return nil, false
+		}
+		found, ok := extension(ext, func(typ uint32) bool { return typ <= extMaxNrSecctx })
+		if !ok {
+			return nil, false
+		}
+		if found == nil {
+			return nil, true
+		}
+		buf = found
+	}
+	if len(buf) < secctxHeaderSize {
+		return nil, false
+	}
+	var hdr secctxHeader
+	hdr.Size = hostOrder.Uint32(buf[0:4])
+	hdr.NrSecctx = hostOrder.Uint32(buf[4:8])
+	if hdr.Size < secctxHeaderSize || uint64(hdr.Size) > uint64(len(buf)) {
+		return nil, false
+	}
+	buf = buf[secctxHeaderSize:hdr.Size]
+
+	var ctxs []SecurityContext
+	for i := uint32(0); i < hdr.NrSecctx; i++ {
+		var in secctx
+		if len(buf) < secctxSize {
+			return nil, false
+		}
+		in.Size = hostOrder.Uint32(buf[0:4])
+		buf = buf[secctxSize:]
+		j := bytes.IndexByte(buf, '\x00')
+		if j < 0 {
+			return nil, false
+		}
+		name := string(buf[:j])
+		buf = buf[j+1:]
+		if uint64(in.Size) > uint64(len(buf)) {
+			return nil, false
+		}
+		ctxs = append(ctxs, SecurityContext{
+			Name: name,
+			// buf is recycled once the request is decoded
+			Context: append([]byte(nil), buf[:in.Size]...),
+		})
+		buf = buf[in.Size:]
+	}
+	if ctxs == nil {
+		return nil, true
+	}
+	return &ctxs, true
+}
+
+func derefSecurityContext(p *[]SecurityContext) []SecurityContext {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
 type bugShortKernelWrite struct {
 	Written int64
 	Length  int64
@@ -934,6 +2171,30 @@ func (b bugShortKernelWrite) String() string {
 	return fmt.Sprintf("short kernel write: written=%d/%d error=%q stack=\n%s", b.Written, b.Length, b.Error, b.Stack)
 }
 
+type deviceGone struct {
+	Error string
+}
+
+func (d deviceGone) String() string {
+	return fmt.Sprintf("kernel connection gone while responding: %s; dropping responses", d.Error)
+}
+
+// writeFailed checks whether err from writing to the device means the
+// kernel closed the connection, as it does when the file system is
+// force-unmounted or aborted. If so, the Conn is marked gone: the
+// first such failure is logged through Debug, later responses are
+// dropped, and ReadRequest returns io.EOF so that serve loops stop
+// instead of spinning on errors.
+func (c *Conn) writeFailed(err error) bool {
+	if err != syscall.ENODEV && err != syscall.EBADF {
+		return false
+	}
+	if atomic.CompareAndSwapUint32(&c.gone, 0, 1) {
+		Debug(deviceGone{Error: err.Error()})
+	}
+	return true
+}
+
 // safe to call even with nil error
 func errorString(err error) string {
 	if err == nil {
@@ -942,31 +2203,59 @@ func errorString(err error) string {
 	return err.Error()
 }
 
-func (c *Conn) respond(out *outHeader, n uintptr) {
+func (c *Conn) respond(out outMessage) {
+	c.respondData(out, nil)
+}
+
+// respondData sends out followed by data. Messages are assembled in a
+// buffer kept for reuse, unless a buffer allocator was set with
+// SetBufferAllocator and there is data to send.
+func (c *Conn) respondData(out outMessage, data []byte) {
 	c.wio.Lock()
 	defer c.wio.Unlock()
-	out.Len = uint32(n)
-	msg := (*[1 << 30]byte)(unsafe.Pointer(out))[:n]
-	nn, err := syscall.Write(c.fd(), msg)
-	if nn != len(msg) || err != nil {
+	if atomic.LoadUint32(&c.gone) != 0 {
+		return
+	}
+	b := out.marshal(c.outBuf[:0])
+	n := len(b)
+	out.header().Len = uint32(n + len(data))
+	hostOrder.PutUint32(b[0:4], out.header().Len)
+	noteMax(&c.stats.maxResponseSize, uint64(out.header().Len))
+	c.outBuf = b[:0]
+	if len(data) > 0 && c.alloc != nil {
+		msg := c.alloc(n + len(data))[:n+len(data)]
+		if c.free != nil {
+			defer c.free(msg)
+		}
+		copy(msg, b)
+		copy(msg[n:], data)
+		b, data = msg, nil
+	}
+	nn, err := c.writeMsg(b, data)
+	if c.writeFailed(err) {
+		return
+	}
+	if want := len(b) + len(data); nn != want || err != nil {
 		Debug(bugShortKernelWrite{
 			Written: int64(nn),
-			Length:  int64(len(msg)),
+			Length:  int64(want),
 			Error:   errorString(err),
 			Stack:   stack(),
 		})
 	}
 }
 
-func (c *Conn) respondData(out *outHeader, n uintptr, data []byte) {
-	c.wio.Lock()
-	defer c.wio.Unlock()
-	// TODO: use writev
-	out.Len = uint32(n + uintptr(len(data)))
-	msg := make([]byte, out.Len)
-	copy(msg, (*[1 << 30]byte)(unsafe.Pointer(out))[:n])
-	copy(msg[n:], data)
-	syscall.Write(c.fd(), msg)
+// writeMsg writes a message made of hdr followed by data to the
+// kernel in a single write, without copying them together.
+func (c *Conn) writeMsg(hdr, data []byte) (int, error) {
+	if len(data) == 0 {
+		return syscall.Write(c.fd(), hdr)
+	}
+	iov := c.iov[:]
+	iov[0], iov[1] = hdr, data
+	n, err := writev(c.fd(), iov)
+	iov[0], iov[1] = nil, nil
+	return n, err
 }
 
 // An InitRequest is the first request sent on a FUSE file system.
@@ -994,28 +2283,189 @@ type InitResponse struct {
 	// Maximum size of a single write operation.
 	// Linux enforces a minimum of 4 KiB.
 	MaxWrite uint32
+
+	// Maximum number of requests the kernel sends in the background,
+	// such as readahead and writeback, without waiting for replies,
+	// and the number from which it considers the file system
+	// congested and holds back more. Zero leaves the kernel's
+	// defaults. Only sent once protocol 7.13 is negotiated.
+	MaxBackground       uint16
+	CongestionThreshold uint16
+
+	// Maximum number of pages in a single request, with
+	// InitMaxPages. Reads and writes are still bounded by MaxWrite
+	// and the buffers requests are read into.
+	MaxPages uint16
+
+	// How many file systems are stacked below this one, counting the
+	// backing files of OpenPassthrough: 1 for a file system over a
+	// regular one, 2 for one over another stacking file system such
+	// as overlayfs or a passthrough FUSE. Only sent with
+	// InitPassthrough, which the kernel enables only if it is 1 or 2;
+	// zero means 1.
+	//
+	// The kernel limits how deep file systems stack to keep its own
+	// stack from overflowing. A depth smaller than the real one lets
+	// the kernel build a deeper stack than it allows for, and nested
+	// I/O through it can exhaust the stack or deadlock on locks
+	// taken at more than one level.
+	MaxStackDepth uint32
+
+	// Granularity of the file system's timestamps, which the kernel
+	// rounds the times it sets to. It must be a power of ten from
+	// 1ns to 1s; zero leaves the kernel's default of 1ns.
+	TimeGran time.Duration
 }
 
 func (r *InitResponse) String() string {
 	return fmt.Sprintf("Init %+v", *r)
 }
 
+// EnableWritebackCache sets InitWritebackCache in r if req offers it,
+// and reports whether it did.
+//
+// With the writeback cache, the kernel keeps written data in its page
+// cache and sends it later in larger WriteRequests, with
+// WriteFlags.IsCache set, instead of one request per write(2). This
+// cuts the number of requests for write-heavy workloads, at the
+// price of the kernel taking charge of some attributes:
+//
+//   - While a file is open, the kernel's idea of its size wins over
+//     the Size returned by Getattr, as it may hold data the file
+//     system has not seen yet. A SetattrRequest with a size may
+//     arrive while dirty pages are pending, and is not the last word
+//     on the size until they are written.
+//   - The kernel updates mtime and ctime itself on write, and sends
+//     them later in a SetattrRequest; a file system setting mtime on
+//     every WriteRequest would get times from writeback, not from the
+//     write(2) calls.
+//   - Writes carry the Uid, Gid and Pid of whoever triggered the
+//     writeback, not of the writer, and files opened write-only may
+//     be read to fill partial pages.
+func (r *InitResponse) EnableWritebackCache(req *InitRequest) bool {
+	if req.Flags&InitWritebackCache == 0 {
+		return false
+	}
+	r.Flags |= InitWritebackCache
+	return true
+}
+
+// Validate checks resp for values the kernel cannot take. Respond
+// fails the mount with EINVAL for those.
+func (r *InitResponse) Validate() error {
+	if r.TimeGran != 0 && !validTimeGran(r.TimeGran) {
+		return fmt.Errorf("fuse: TimeGran %v is not a power of ten from 1ns to 1s", r.TimeGran)
+	}
+	if r.MaxStackDepth > maxStackDepth {
+		return fmt.Errorf("fuse: MaxStackDepth %d is more than %d", r.MaxStackDepth, maxStackDepth)
+	}
+	return nil
+}
+
+func validTimeGran(d time.Duration) bool {
+	for g := time.Nanosecond; g <= time.Second; g *= 10 {
+		if d == g {
+			return true
+		}
+	}
+	return false
+}
+
 // Respond replies to the request with the given response.
+//
+// Flags the kernel did not offer in the request are neither sent back
+// nor enabled, even if set in resp.Flags.
 func (r *InitRequest) Respond(resp *InitResponse) {
+	if err := resp.Validate(); err != nil {
+		r.RespondError(Errno(syscall.EINVAL))
+		return
+	}
 	out := &initOut{
 		outHeader:    outHeader{Unique: uint64(r.ID)},
 		Major:        kernelVersion,
 		Minor:        kernelMinorVersion,
 		MaxReadahead: resp.MaxReadahead,
-		Flags:        uint32(resp.Flags),
 		MaxWrite:     resp.MaxWrite,
 	}
+	flags := resp.Flags
 	// MaxWrite larger than our receive buffer would just lead to
-	// errors on large writes.
-	if out.MaxWrite > maxWrite {
-		out.MaxWrite = maxWrite
+	// errors on large writes. This holds with InitSpliceWrite too:
+	// that flag is about splicing replies into the device, while
+	// requests, write data included, are still read into the buffer.
+	// The buffers grow to the MaxWrite mount option at most.
+	if limit := r.Conn.writeLimit(); out.MaxWrite > limit {
+		out.MaxWrite = limit
+	}
+	// Sent to all kernels, but only those from 7.23 get the reply
+	// far enough to see it.
+	out.TimeGran = uint32(resp.TimeGran / time.Nanosecond)
+	out.MaxPages = resp.MaxPages
+	// Writes past 32 pages need InitMaxPages, and enough pages.
+	if out.MaxWrite > legacyMaxWrite {
+		if r.Flags&InitMaxPages == 0 {
+			out.MaxWrite = maxWrite
+		} else {
+			flags |= InitMaxPages
+			page := uint32(syscall.Getpagesize())
+			if pages := (out.MaxWrite + page - 1) / page; uint32(out.MaxPages) < pages {
+				out.MaxPages = uint16(pages)
+			}
+		}
+	}
+	if n := uint32(maxRequestSize) + out.MaxWrite; int(n) > bufSize {
+		atomic.StoreUint32(&r.Conn.bufLen, n)
+	}
+	if r.Conn.proto.GE(Protocol{7, 13}) {
+		out.MaxBackground = resp.MaxBackground
+		out.CongestionThreshold = resp.CongestionThreshold
+	}
+	// Only echo what the kernel offered.
+	flags &= r.Flags
+	out.Flags = uint32(flags)
+	if flags&InitPassthrough != 0 {
+		out.MaxStackDepth = resp.MaxStackDepth
+		if out.MaxStackDepth == 0 {
+			out.MaxStackDepth = 1
+		}
+	}
+	// Kernels before 7.36 know neither flags2 nor the bit announcing
+	// it, and would take initExt for an unrelated flag.
+	if high := uint32(flags >> 32); high != 0 && (Protocol{r.Major, r.Minor}).GE(Protocol{7, 36}) {
+		out.Flags |= initExt
+		out.Flags2 = high
+	}
+	atomic.StoreUint64(&r.Conn.flags, uint64(flags))
+	atomic.StoreUint32(&r.Conn.maxWrite, out.MaxWrite)
+
+	caps := Capabilities{
+		Protocol:            r.Conn.proto,
+		Kernel:              Protocol{r.Major, r.Minor},
+		Flags:               flags,
+		MaxWrite:            out.MaxWrite,
+		MaxReadahead:        out.MaxReadahead,
+		MaxBackground:       out.MaxBackground,
+		CongestionThreshold: out.CongestionThreshold,
+		TimeGran:            time.Duration(out.TimeGran),
+		MaxStackDepth:       out.MaxStackDepth,
+	}
+	if caps.MaxReadahead > r.MaxReadahead {
+		caps.MaxReadahead = r.MaxReadahead
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	if caps.Flags&InitMaxPages != 0 {
+		caps.MaxPages = out.MaxPages
+	}
+
+	// The reply must not be larger than what the kernel knows about.
+	short := (Protocol{r.Major, r.Minor}).LT(Protocol{7, 23})
+	if short {
+		caps.TimeGran = 0
+	}
+	r.Conn.caps.Store(caps)
+	if short {
+		r.respond(truncatedOut{out, initOutCompatSize})
+		return
+	}
+	r.respond(out)
 }
 
 // A StatfsRequest requests information about the mounted file system.
@@ -1043,7 +2493,7 @@ func (r *StatfsRequest) Respond(resp *StatfsResponse) {
 			Frsize:  resp.Frsize,
 		},
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A StatfsResponse is the response to a StatfsRequest.
@@ -1079,10 +2529,151 @@ func (r *AccessRequest) String() string {
 // To deny access, use RespondError.
 func (r *AccessRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
+}
+
+// A LockType is the type of a FileLock.
+type LockType uint32
+
+const (
+	LockRead   LockType = syscall.F_RDLCK
+	LockWrite  LockType = syscall.F_WRLCK
+	LockUnlock LockType = syscall.F_UNLCK
+)
+
+func (t LockType) String() string {
+	switch t {
+	case LockRead:
+		return "LockRead"
+	case LockWrite:
+		return "LockWrite"
+	case LockUnlock:
+		return "LockUnlock"
+	}
+	return fmt.Sprintf("LockType(%d)", uint32(t))
+}
+
+// LockEnd is the End of a FileLock that extends to the end of the
+// file, however far it grows.
+const LockEnd = 1<<63 - 1
+
+// A FileLock is a POSIX byte-range lock, as set with fcntl(2).
+type FileLock struct {
+	Start uint64 // first byte of the range
+	End   uint64 // last byte of the range, or LockEnd
+	Type  LockType
+	Pid   uint32 // process holding the lock
+}
+
+func (l FileLock) String() string {
+	return fmt.Sprintf("%v %d-%d pid=%d", l.Type, l.Start, l.End, l.Pid)
+}
+
+// A PollRequest asks whether the open file is ready for I/O, as with
+// poll(2). If Flags has PollScheduleNotify, the kernel waits for a
+// NotifyPollWakeup with Kh once the file becomes ready.
+type PollRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	// Kh identifies the kernel's poll handle, for NotifyPollWakeup.
+	Kh    uint64
+	Flags PollFlags
+	// Events is the poll(2) event mask the caller waits for. It is
+	// zero if the kernel does not pass it; any event may then be of
+	// interest.
+	Events uint32
+}
+
+var _ = Request(&PollRequest{})
+
+func (r *PollRequest) String() string {
+	return fmt.Sprintf("Poll [%s] %#x kh=%#x fl=%v ev=%#x", &r.Header, r.Handle, r.Kh, r.Flags, r.Events)
+}
+
+// Respond replies to the request with the poll(2) events the file is
+// ready for.
+func (r *PollRequest) Respond(revents uint32) {
+	out := &pollOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Revents:   revents,
+	}
+	r.respond(out)
+}
+
+// A GetlkRequest asks whether a lock could be taken, as with
+// fcntl(F_GETLK).
+type GetlkRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+}
+
+var _ = Request(&GetlkRequest{})
+
+func (r *GetlkRequest) String() string {
+	return fmt.Sprintf("Getlk [%s] %#x owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request with a lock that conflicts with
+// r.Lock, or, if there is none, with a lock of type LockUnlock.
+func (r *GetlkRequest) Respond(resp *GetlkResponse) {
+	out := &lkOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Lk: fileLock{
+			Start: resp.Lock.Start,
+			End:   resp.Lock.End,
+			Type:  uint32(resp.Lock.Type),
+			Pid:   resp.Lock.Pid,
+		},
+	}
+	r.respond(out)
+}
+
+// A GetlkResponse is the response to a GetlkRequest.
+type GetlkResponse struct {
+	Lock FileLock
+}
+
+func (r *GetlkResponse) String() string {
+	return fmt.Sprintf("Getlk %v", r.Lock)
+}
+
+// A SetlkRequest asks to take or release a lock, as with
+// fcntl(F_SETLK) or, if Sleep is set, fcntl(F_SETLKW). A conflicting
+// lock is reported with EAGAIN; with Sleep, the request waits for the
+// lock instead, until it is interrupted.
+type SetlkRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+	Sleep     bool
+}
+
+var _ = Request(&SetlkRequest{})
+
+func (r *SetlkRequest) String() string {
+	return fmt.Sprintf("Setlk [%s] %#x owner=%#x %v fl=%v sleep=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags, r.Sleep)
+}
+
+// Respond replies to the request, indicating that the lock was taken
+// or released.
+func (r *SetlkRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.respond(out)
 }
 
 // An Attr is the metadata for a single file or directory.
+//
+// The fields map to those of stat(2) and statx(2) as their names
+// suggest: Inode is st_ino, Blocks is st_blocks in 512-byte units, and
+// so on. Crtime is the birth time, stx_btime in statx(2) and
+// st_birthtime on OS X. The kernel protocol only carries Crtime and
+// Flags to OS X; elsewhere they are accepted, so file systems can
+// fill them in portably, but not sent.
 type Attr struct {
 	Inode  uint64      // inode number
 	Size   uint64      // size in bytes
@@ -1090,7 +2681,7 @@ type Attr struct {
 	Atime  time.Time   // time of last access
 	Mtime  time.Time   // time of last modification
 	Ctime  time.Time   // time of last inode change
-	Crtime time.Time   // time of creation (OS X only)
+	Crtime time.Time   // time of creation (sent on OS X only)
 	Mode   os.FileMode // file mode
 	Nlink  uint32      // number of links
 	Uid    uint32      // owner uid
@@ -1099,6 +2690,23 @@ type Attr struct {
 	Flags  uint32      // chflags(2) flags (OS X only)
 }
 
+// validSec and validNsec split a cache validity duration for the
+// kernel. Zero disables caching; negative durations are treated as
+// zero, instead of wrapping around to a practically infinite time.
+func validSec(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d / time.Second)
+}
+
+func validNsec(d time.Duration) uint32 {
+	if d < 0 {
+		return 0
+	}
+	return uint32(d % time.Second / time.Nanosecond)
+}
+
 func unix(t time.Time) (sec uint64, nsec uint32) {
 	nano := t.UnixNano()
 	sec = uint64(nano / 1e9)
@@ -1151,30 +2759,47 @@ func (a *Attr) attr() (out attr) {
 // A GetattrRequest asks for the metadata for the file denoted by r.Node.
 type GetattrRequest struct {
 	Header `json:"-"`
+	Flags  GetattrFlags
+	Handle HandleID
 }
 
 var _ = Request(&GetattrRequest{})
 
 func (r *GetattrRequest) String() string {
+	if r.HandleValid() {
+		return fmt.Sprintf("Getattr [%s] fh=%#x", &r.Header, r.Handle)
+	}
 	return fmt.Sprintf("Getattr [%s]", &r.Header)
 }
 
+// HandleValid reports whether the attributes are asked for through
+// the open file Handle, as with fstat(2). Otherwise, Handle is zero
+// and the attributes are those of the node itself, as with stat(2).
+func (r *GetattrRequest) HandleValid() bool {
+	return r.Flags&GetattrFh != 0
+}
+
 // Respond replies to the request with the given response.
 func (r *GetattrRequest) Respond(resp *GetattrResponse) {
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &attrOut{
 		outHeader:     outHeader{Unique: uint64(r.ID)},
-		AttrValid:     uint64(resp.AttrValid / time.Second),
-		AttrValidNsec: uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		AttrValid:     validSec(attrValid),
+		AttrValidNsec: validNsec(attrValid),
 		Attr:          resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.checkAttr(resp.Attr.Inode)
+	r.respond(out)
 	//fmt.Printf("getattr took %s\n", time.Now().Sub(r.start))
 }
 
 // A GetattrResponse is the response to a GetattrRequest.
 type GetattrResponse struct {
-	AttrValid time.Duration // how long Attr can be cached
-	Attr      Attr          // file attributes
+	// How long Attr can be cached. The kernel shares its cache
+	// between all callers, so attributes that differ between callers
+	// must not be cached at all.
+	AttrValid time.Duration
+	Attr      Attr // file attributes
 }
 
 func (r *GetattrResponse) String() string {
@@ -1211,10 +2836,10 @@ func (r *GetxattrRequest) Respond(resp *GetxattrResponse) {
 			outHeader: outHeader{Unique: uint64(r.ID)},
 			Size:      uint32(len(resp.Xattr)),
 		}
-		r.respond(&out.outHeader, unsafe.Sizeof(*out))
+		r.respond(out)
 	} else {
 		out := &outHeader{Unique: uint64(r.ID)}
-		r.respondData(out, unsafe.Sizeof(*out), resp.Xattr)
+		r.respondData(out, resp.Xattr)
 	}
 }
 
@@ -1247,10 +2872,10 @@ func (r *ListxattrRequest) Respond(resp *ListxattrResponse) {
 			outHeader: outHeader{Unique: uint64(r.ID)},
 			Size:      uint32(len(resp.Xattr)),
 		}
-		r.respond(&out.outHeader, unsafe.Sizeof(*out))
+		r.respond(out)
 	} else {
 		out := &outHeader{Unique: uint64(r.ID)}
-		r.respondData(out, unsafe.Sizeof(*out), resp.Xattr)
+		r.respondData(out, resp.Xattr)
 	}
 }
 
@@ -1286,7 +2911,7 @@ func (r *RemovexattrRequest) String() string {
 // Respond replies to the request, indicating that the attribute was removed.
 func (r *RemovexattrRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A SetxattrRequest asks to set an extended attribute associated with a file.
@@ -1331,7 +2956,7 @@ func (r *SetxattrRequest) String() string {
 // Respond replies to the request, indicating that the extended attribute was set.
 func (r *SetxattrRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A LookupRequest asks to look up the given name in the directory named by r.Node.
@@ -1348,20 +2973,28 @@ func (r *LookupRequest) String() string {
 
 // Respond replies to the request with the given response.
 func (r *LookupRequest) Respond(resp *LookupResponse) {
+	r.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := r.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &entryOut{
 		outHeader:      outHeader{Unique: uint64(r.ID)},
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A LookupResponse is the response to a LookupRequest.
+//
+// The kernel caches the name and the attributes independently:
+// EntryValid is how long the name keeps resolving to Node without
+// another lookup, AttrValid how long Attr is used without a
+// GetattrRequest. A negative duration is not cached at all.
 type LookupResponse struct {
 	Node       NodeID
 	Generation uint64
@@ -1370,21 +3003,49 @@ type LookupResponse struct {
 	Attr       Attr
 }
 
+// DontCacheAttr keeps the kernel from caching Attr, while the name
+// stays cached for EntryValid. Use it when the attributes are about to
+// change: the kernel asks for them again on their next use. fs.Serve
+// replaces a zero AttrValid with its default timeout, but not the
+// negative one set here.
+func (r *LookupResponse) DontCacheAttr() {
+	r.AttrValid = -1
+}
+
 func (r *LookupResponse) String() string {
 	return fmt.Sprintf("Lookup %+v", *r)
 }
 
+// SetExpiry sets EntryValid and AttrValid so that the kernel caches
+// the entry exactly as long as the server's own cached copy, which
+// expires at the given time. An entry that has already expired is
+// not cached by the kernel at all; as with DontCacheAttr, the
+// durations are then negative, so fs.Serve keeps them.
+func (r *LookupResponse) SetExpiry(expiry time.Time) {
+	r.setExpiry(expiry, time.Now())
+}
+
+func (r *LookupResponse) setExpiry(expiry, now time.Time) {
+	valid := expiry.Sub(now)
+	if valid <= 0 {
+		valid = -1
+	}
+	r.EntryValid = valid
+	r.AttrValid = valid
+}
+
 // An OpenRequest asks to open a file or directory
 type OpenRequest struct {
-	Header `json:"-"`
-	Dir    bool // is this Opendir?
-	Flags  OpenFlags
+	Header    `json:"-"`
+	Dir       bool // is this Opendir?
+	Flags     OpenFlags
+	OpenFlags OpenRequestFlags
 }
 
 var _ = Request(&OpenRequest{})
 
 func (r *OpenRequest) String() string {
-	return fmt.Sprintf("Open [%s] dir=%v fl=%v", &r.Header, r.Dir, r.Flags)
+	return fmt.Sprintf("Open [%s] dir=%v fl=%v ofl=%v", &r.Header, r.Dir, r.Flags, r.OpenFlags)
 }
 
 // Respond replies to the request with the given response.
@@ -1393,8 +3054,13 @@ func (r *OpenRequest) Respond(resp *OpenResponse) {
 		outHeader: outHeader{Unique: uint64(r.ID)},
 		Fh:        uint64(resp.Handle),
 		OpenFlags: uint32(resp.Flags),
+		BackingID: resp.backingID(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	if resp.Flags&OpenKeepCache == 0 {
+		// the kernel drops the cached data on open
+		r.Conn.noteInvalidated(r.Node, 0, 0)
+	}
+	r.respond(out)
 	//fmt.Printf("open took %s\n", time.Now().Sub(r.start))
 }
 
@@ -1402,43 +3068,101 @@ func (r *OpenRequest) Respond(resp *OpenResponse) {
 type OpenResponse struct {
 	Handle HandleID
 	Flags  OpenResponseFlags
+
+	// Backing file to pass reads and writes through to, as
+	// registered with the kernel beforehand. Only used if Flags
+	// contains OpenPassthrough.
+	BackingID uint32
+}
+
+func (r *OpenResponse) backingID() uint32 {
+	if r.Flags&OpenPassthrough == 0 {
+		return 0
+	}
+	return r.BackingID
 }
 
 func (r *OpenResponse) String() string {
 	return fmt.Sprintf("Open %+v", *r)
 }
 
+// A SecurityContext is a security label, such as an SELinux context,
+// to apply to a newly created node. It is only sent when
+// InitSecurityContext has been negotiated.
+type SecurityContext struct {
+	// Name of the label, for example "security.selinux".
+	Name    string
+	Context []byte
+}
+
+func (s SecurityContext) String() string {
+	return fmt.Sprintf("%s=%q", s.Name, s.Context)
+}
+
 // A CreateRequest asks to create and open a file (not a directory).
 type CreateRequest struct {
 	Header `json:"-"`
 	Name   string
 	Flags  OpenFlags
 	Mode   os.FileMode
+
+	// See SecurityContext. A pointer, to keep the request
+	// comparable.
+	secctx *[]SecurityContext
 }
 
 var _ = Request(&CreateRequest{})
 
+// SecurityContext returns the security labels to apply to the new
+// file. It is empty unless InitSecurityContext has been negotiated.
+func (r *CreateRequest) SecurityContext() []SecurityContext {
+	return derefSecurityContext(r.secctx)
+}
+
 func (r *CreateRequest) String() string {
 	return fmt.Sprintf("Create [%s] %q fl=%v mode=%v", &r.Header, r.Name, r.Flags, r.Mode)
 }
 
+// IsExclusive reports whether the file was opened with O_EXCL. The
+// kernel only sends a create once its lookup found no such file, but
+// the file may have been created since, by another client of a
+// network file system or by the server itself. For an exclusive
+// create, the server must then fail with EEXIST, and the existence
+// check and the creation must be a single atomic step, such as
+// open(2) with O_CREAT|O_EXCL on the backing file. Checking first and
+// creating after leaves a window in which two exclusive creates both
+// succeed, breaking lock files and the like.
+func (r *CreateRequest) IsExclusive() bool {
+	return r.Flags&OpenExclusive != 0
+}
+
 // Respond replies to the request with the given response.
 func (r *CreateRequest) Respond(resp *CreateResponse) {
+	r.respondCreate(resp)
+}
+
+// respondCreate replies to a request creating and opening a file,
+// which CreateRequest and TmpfileRequest answer alike.
+func (h *Header) respondCreate(resp *CreateResponse) {
+	h.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := h.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := h.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &createOut{
-		outHeader: outHeader{Unique: uint64(r.ID)},
+		outHeader: outHeader{Unique: uint64(h.ID)},
 
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 
 		Fh:        uint64(resp.Handle),
 		OpenFlags: uint32(resp.Flags),
+		BackingID: resp.backingID(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	h.respond(out)
 }
 
 // A CreateResponse is the response to a CreateRequest.
@@ -1452,32 +3176,77 @@ func (r *CreateResponse) String() string {
 	return fmt.Sprintf("Create %+v", *r)
 }
 
+// A TmpfileRequest asks to create and open an unnamed file in the
+// directory r.Node, as with open(2) and O_TMPFILE.
+//
+// The new file has no directory entry. It is not visible to Lookup
+// until it is linked in with a LinkRequest, and is removed when the
+// last reference to it is forgotten.
+type TmpfileRequest struct {
+	Header `json:"-"`
+	Flags  OpenFlags
+	Mode   os.FileMode
+
+	// See SecurityContext.
+	secctx *[]SecurityContext
+}
+
+var _ = Request(&TmpfileRequest{})
+
+// SecurityContext returns the security labels to apply to the new
+// node, see CreateRequest.SecurityContext.
+func (r *TmpfileRequest) SecurityContext() []SecurityContext {
+	return derefSecurityContext(r.secctx)
+}
+
+func (r *TmpfileRequest) String() string {
+	return fmt.Sprintf("Tmpfile [%s] fl=%v mode=%v", &r.Header, r.Flags, r.Mode)
+}
+
+// Respond replies to the request with the given response, describing
+// the created node and the opened handle.
+func (r *TmpfileRequest) Respond(resp *CreateResponse) {
+	r.respondCreate(resp)
+}
+
 // A MkdirRequest asks to create (but not open) a directory.
 type MkdirRequest struct {
 	Header `json:"-"`
 	Name   string
 	Mode   os.FileMode
+
+	// See SecurityContext.
+	secctx *[]SecurityContext
 }
 
 var _ = Request(&MkdirRequest{})
 
+// SecurityContext returns the security labels to apply to the new
+// node, see CreateRequest.SecurityContext.
+func (r *MkdirRequest) SecurityContext() []SecurityContext {
+	return derefSecurityContext(r.secctx)
+}
+
 func (r *MkdirRequest) String() string {
 	return fmt.Sprintf("Mkdir [%s] %q mode=%v", &r.Header, r.Name, r.Mode)
 }
 
 // Respond replies to the request with the given response.
 func (r *MkdirRequest) Respond(resp *MkdirResponse) {
+	r.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := r.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &entryOut{
 		outHeader:      outHeader{Unique: uint64(r.ID)},
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A MkdirResponse is the response to a MkdirRequest.
@@ -1493,24 +3262,166 @@ func (r *MkdirResponse) String() string {
 type ReadRequest struct {
 	Header `json:"-"`
 	Dir    bool // is this Readdir?
+	// Is this Readdirplus? The entries are then encoded with
+	// AppendDirentPlus. Dir is set too.
+	Plus   bool
 	Handle HandleID
 	Offset int64
 	Size   int
+
+	// Zero from kernels older than protocol 7.9.
+	ReadFlags ReadFlags
+	LockOwner uint64    // valid if ReadFlags contains ReadLockOwner
+	FileFlags OpenFlags // flags the file was opened with
 }
 
 var _ = Request(&ReadRequest{})
 
 func (r *ReadRequest) String() string {
-	return fmt.Sprintf("Read [%s] %#x %d @%#x dir=%v", &r.Header, r.Handle, r.Size, r.Offset, r.Dir)
+	return fmt.Sprintf("Read [%s] %#x %d @%#x dir=%v plus=%v", &r.Header, r.Handle, r.Size, r.Offset, r.Dir, r.Plus)
 }
 
 // Respond replies to the request with the given response.
 func (r *ReadRequest) Respond(resp *ReadResponse) {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respondData(out, unsafe.Sizeof(*out), resp.Data)
+	r.respondData(out, resp.Data)
 	//fmt.Printf("read took %s\n", time.Now().Sub(r.start))
 }
 
+// RespondEOF replies to the request with no data, which the kernel
+// reports as end of file. A read at or past the end of the file is
+// not an error: it must be answered this way, and not with an error
+// such as EINVAL or ENXIO, which applications do not expect from
+// read(2).
+func (r *ReadRequest) RespondEOF() {
+	r.Respond(&ReadResponse{})
+}
+
+// RespondReader replies to the request with up to r.Size bytes read
+// from src. Reaching io.EOF early is a short read, as usual.
+//
+// A read response is all or nothing: once sent, the kernel hands the
+// data to the application as a successful read. If src fails with
+// any other error, for example because a network backend went away
+// partway through, the data read so far is discarded and the request
+// is responded to with the error instead, as with RespondError.
+func (r *ReadRequest) RespondReader(src io.Reader) {
+	buf := make([]byte, r.Size)
+	n, err := io.ReadFull(src, buf)
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+	default:
+		r.RespondError(err)
+		return
+	}
+	r.Respond(&ReadResponse{Data: buf[:n]})
+}
+
+// RespondSendfile replies to the request with up to r.Size bytes read
+// from the file descriptor fd at offset off, typically the real file
+// backing a mirror or passthrough file system. Reaching the end of
+// the file early is a short read, as usual, and errors reading fd are
+// responded to as with RespondError.
+//
+// On Linux, the data is spliced from fd to the kernel without being
+// copied through userspace. Elsewhere, or if splicing is not possible
+// for fd, it is read into a buffer first.
+func (r *ReadRequest) RespondSendfile(fd int, off int64) {
+	// The bookkeeping of Header.respondData, done once whichever way
+	// the reply is sent.
+	defer r.release()
+	if !r.Conn.doneInFlight(r.ID) {
+		return
+	}
+	r.checkSlow()
+	out := &outHeader{Unique: uint64(r.ID)}
+	if err := r.Conn.respondSplice(out, fd, off, r.Size); err == nil {
+		return
+	}
+	buf := make([]byte, r.Size)
+	n, err := syscall.Pread(fd, buf, off)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			err = Errno(errno)
+		}
+		out.Error = -int32(errnoOf(err))
+		r.Conn.respond(out)
+		return
+	}
+	r.Conn.respondData(out, buf[:n])
+}
+
+// RespondDirents replies to a Readdir request with the directory
+// listing entries. It can be given the complete listing every time:
+// entries are encoded with AppendDirent, and only those starting at
+// r.Offset that fit in r.Size are sent. Once r.Offset is past the
+// last entry, the reply is empty, which marks the end of the
+// directory.
+func (r *ReadRequest) RespondDirents(entries []Dirent) {
+	var data []byte
+	start, end := -1, -1
+	for _, e := range entries {
+		off := len(data)
+		data = AppendDirent(data, e)
+		if int64(off) < r.Offset {
+			continue
+		}
+		if start < 0 {
+			start, end = off, off
+		}
+		if len(data)-start > r.Size {
+			break
+		}
+		end = len(data)
+	}
+	if start < 0 {
+		start, end = 0, 0
+	}
+	r.Respond(&ReadResponse{Data: data[start:end]})
+}
+
+// RespondDirentsPlus is RespondDirents for a Readdirplus request,
+// with entries encoded by AppendDirentPlus.
+//
+// The kernel counts a lookup for every entry it is sent with a
+// non-zero Entry.Node, except "." and "..", and will forget those
+// nodes like any other. Entries beyond r.Size are not sent and do not
+// count. The entries that do are returned, so the file system can
+// bump its own lookup counts for exactly those.
+func (r *ReadRequest) RespondDirentsPlus(entries []DirentPlus) (lookups []DirentPlus) {
+	var data []byte
+	start, end := -1, -1
+	first, last := 0, 0
+	for i, e := range entries {
+		off := len(data)
+		data = AppendDirentPlus(data, e)
+		if int64(off) < r.Offset {
+			continue
+		}
+		if start < 0 {
+			start, end = off, off
+			first, last = i, i
+		}
+		if len(data)-start > r.Size {
+			break
+		}
+		end = len(data)
+		last = i + 1
+	}
+	if start < 0 {
+		start, end = 0, 0
+	}
+	for _, e := range entries[first:last] {
+		if e.Entry.Node == 0 || e.Name == "." || e.Name == ".." {
+			continue
+		}
+		r.checkEntry(e.Entry.Node, e.Entry.Generation, e.Entry.Attr.Inode)
+		lookups = append(lookups, e)
+	}
+	r.Respond(&ReadResponse{Data: data[start:end]})
+	return lookups
+}
+
 // A ReadResponse is the response to a ReadRequest.
 type ReadResponse struct {
 	Data []byte
@@ -1538,7 +3449,9 @@ type ReleaseRequest struct {
 	Handle       HandleID
 	Flags        OpenFlags // flags from OpenRequest
 	ReleaseFlags ReleaseFlags
-	LockOwner    uint32
+	// Owner of the flocks to release, if ReleaseFlags.FlockUnlock
+	// is set. See fuseutil.FlockTable.
+	LockOwner uint64
 }
 
 var _ = Request(&ReleaseRequest{})
@@ -1550,7 +3463,7 @@ func (r *ReleaseRequest) String() string {
 // Respond replies to the request, indicating that the handle has been released.
 func (r *ReleaseRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 	//fmt.Printf("release took %s\n", time.Now().Sub(r.start))
 }
 
@@ -1570,7 +3483,7 @@ func (r *DestroyRequest) String() string {
 // Respond replies to the request.
 func (r *DestroyRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A ForgetRequest is sent by the kernel when forgetting about r.Node
@@ -1588,10 +3501,40 @@ func (r *ForgetRequest) String() string {
 
 // Respond replies to the request, indicating that the forgetfulness has been recorded.
 func (r *ForgetRequest) Respond() {
+	r.checkForget(r.Node, r.N)
 	// Don't reply to forget messages.
 	r.noResponse()
 }
 
+// A ForgetItem is one node forgotten by a BatchForgetRequest.
+type ForgetItem struct {
+	Node NodeID
+	N    uint64
+}
+
+// A BatchForgetRequest is sent by the kernel to forget several nodes
+// at once. Each item has the meaning of a ForgetRequest. The Node of
+// its Header is not used.
+type BatchForgetRequest struct {
+	Header `json:"-"`
+	Forget []ForgetItem
+}
+
+var _ = Request(&BatchForgetRequest{})
+
+func (r *BatchForgetRequest) String() string {
+	return fmt.Sprintf("BatchForget [%s] %v", &r.Header, r.Forget)
+}
+
+// Respond replies to the request, indicating that the forgetfulness
+// has been recorded.
+func (r *BatchForgetRequest) Respond() {
+	for _, f := range r.Forget {
+		r.checkForget(f.Node, f.N)
+	}
+	r.noResponse()
+}
+
 // A Dirent represents a single directory entry.
 type Dirent struct {
 	// Inode this entry names.
@@ -1654,6 +3597,50 @@ func (t DirentType) String() string {
 	return "invalid"
 }
 
+// DirentTypeFromDT converts the d_type of a directory entry read from
+// a real file system, one of syscall.DT_*, to a DirentType. Types
+// without an equivalent, such as whiteouts, are DT_Unknown.
+func DirentTypeFromDT(dt uint8) DirentType {
+	switch dt {
+	case syscall.DT_SOCK:
+		return DT_Socket
+	case syscall.DT_LNK:
+		return DT_Link
+	case syscall.DT_REG:
+		return DT_File
+	case syscall.DT_BLK:
+		return DT_Block
+	case syscall.DT_DIR:
+		return DT_Dir
+	case syscall.DT_CHR:
+		return DT_Char
+	case syscall.DT_FIFO:
+		return DT_FIFO
+	}
+	return DT_Unknown
+}
+
+// DT converts t to the corresponding syscall.DT_* value.
+func (t DirentType) DT() uint8 {
+	switch t {
+	case DT_Socket:
+		return syscall.DT_SOCK
+	case DT_Link:
+		return syscall.DT_LNK
+	case DT_File:
+		return syscall.DT_REG
+	case DT_Block:
+		return syscall.DT_BLK
+	case DT_Dir:
+		return syscall.DT_DIR
+	case DT_Char:
+		return syscall.DT_CHR
+	case DT_FIFO:
+		return syscall.DT_FIFO
+	}
+	return syscall.DT_UNKNOWN
+}
+
 // AppendDirent appends the encoded form of a directory entry to data
 // and returns the resulting slice.
 func AppendDirent(data []byte, dir Dirent) []byte {
@@ -1663,9 +3650,9 @@ func AppendDirent(data []byte, dir Dirent) []byte {
 		Type:    uint32(dir.Type),
 	}
 	de.Off = uint64(len(data) + direntSize + (len(dir.Name)+7)&^7)
-	data = append(data, (*[direntSize]byte)(unsafe.Pointer(&de))[:]...)
+	data = de.marshal(data)
 	data = append(data, dir.Name...)
-	n := direntSize + uintptr(len(dir.Name))
+	n := direntSize + len(dir.Name)
 	if n%8 != 0 {
 		var pad [8]byte
 		data = append(data, pad[:8-n%8]...)
@@ -1673,13 +3660,55 @@ func AppendDirent(data []byte, dir Dirent) []byte {
 	return data
 }
 
+// A DirentPlus is a directory entry together with the result of
+// looking it up, as returned for a ReadRequest with Plus set.
+//
+// An entry with a non-zero Entry.Node counts as a lookup of that
+// node, just like a LookupResponse, and will be forgotten the same
+// way. With a zero Node, the kernel only uses the name.
+type DirentPlus struct {
+	Dirent
+	Entry LookupResponse
+}
+
+// AppendDirentPlus appends the encoded form of a directory entry and
+// its lookup result to data and returns the resulting slice.
+func AppendDirentPlus(data []byte, dir DirentPlus) []byte {
+	ep := entryPlus{
+		Nodeid:         uint64(dir.Entry.Node),
+		Generation:     dir.Entry.Generation,
+		EntryValid:     validSec(dir.Entry.EntryValid),
+		EntryValidNsec: validNsec(dir.Entry.EntryValid),
+		AttrValid:      validSec(dir.Entry.AttrValid),
+		AttrValidNsec:  validNsec(dir.Entry.AttrValid),
+		Attr:           dir.Entry.Attr.attr(),
+	}
+	de := dirent{
+		Ino:     dir.Inode,
+		Namelen: uint32(len(dir.Name)),
+		Type:    uint32(dir.Type),
+	}
+	n := entryPlusSize + direntSize + len(dir.Name)
+	padded := (n + 7) &^ 7
+	de.Off = uint64(len(data) + padded)
+	data = ep.marshal(data)
+	data = de.marshal(data)
+	data = append(data, dir.Name...)
+	if padded != n {
+		var pad [8]byte
+		data = append(data, pad[:padded-n]...)
+	}
+	return data
+}
+
 // A WriteRequest asks to write to an open file.
 type WriteRequest struct {
 	Header
 	Handle HandleID
 	Offset int64
-	Data   []byte
-	Flags  WriteFlags
+	// Valid until the request is responded to, see ReadRequest.
+	Data  []byte
+	Flags WriteFlags
 }
 
 var _ = Request(&WriteRequest{})
@@ -1711,7 +3740,7 @@ func (r *WriteRequest) Respond(resp *WriteResponse) {
 		outHeader: outHeader{Unique: uint64(r.ID)},
 		Size:      uint32(resp.Size),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A WriteResponse replies to a write indicating how many bytes were written.
@@ -1728,6 +3757,8 @@ func (r *WriteResponse) String() string {
 type SetattrRequest struct {
 	Header `json:"-"`
 	Valid  SetattrValid
+	// Open file being changed, valid if HandleValid reports true.
+	// Otherwise the request is about Header.Node only.
 	Handle HandleID
 	Size   uint64
 	Atime  time.Time
@@ -1736,6 +3767,11 @@ type SetattrRequest struct {
 	Uid    uint32
 	Gid    uint32
 
+	// Owner of the POSIX locks of the process changing the size,
+	// valid if Valid.LockOwner() is set. A server that enforces
+	// locks checks a truncation against the locks of other owners.
+	LockOwner uint64
+
 	// OS X only
 	Bkuptime time.Time
 	Chgtime  time.Time
@@ -1745,6 +3781,25 @@ type SetattrRequest struct {
 
 var _ = Request(&SetattrRequest{})
 
+// HandleValid reports whether the change is made through the open file
+// Handle, as with fchmod(2) or ftruncate(2). Otherwise it is made by
+// node, as with chmod(2).
+func (r *SetattrRequest) HandleValid() bool {
+	return r.Valid.Handle()
+}
+
+// IsFtruncate reports whether r changes the size of a file through an
+// open handle, as ftruncate(2) does. A truncate(2) by path changes the
+// size without a handle.
+//
+// The two need different checks: truncate(2) requires write
+// permission on the file, while ftruncate(2) only requires that the
+// handle was opened for writing, even if the file's mode has changed
+// since.
+func (r *SetattrRequest) IsFtruncate() bool {
+	return r.Valid.Size() && r.HandleValid()
+}
+
 func (r *SetattrRequest) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Setattr [%s]", &r.Header)
@@ -1778,7 +3833,7 @@ func (r *SetattrRequest) String() string {
 		fmt.Fprintf(&buf, " handle=INVALID-%#x", r.Handle)
 	}
 	if r.Valid.LockOwner() {
-		fmt.Fprintf(&buf, " lockowner")
+		fmt.Fprintf(&buf, " lockowner=%#x", r.LockOwner)
 	}
 	if r.Valid.Crtime() {
 		fmt.Fprintf(&buf, " crtime=%v", r.Crtime)
@@ -1798,13 +3853,18 @@ func (r *SetattrRequest) String() string {
 // Respond replies to the request with the given response,
 // giving the updated attributes.
 func (r *SetattrRequest) Respond(resp *SetattrResponse) {
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &attrOut{
 		outHeader:     outHeader{Unique: uint64(r.ID)},
-		AttrValid:     uint64(resp.AttrValid / time.Second),
-		AttrValidNsec: uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		AttrValid:     validSec(attrValid),
+		AttrValidNsec: validNsec(attrValid),
 		Attr:          resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	if r.Valid&(SetattrMode|SetattrUid|SetattrGid) != 0 {
+		r.Conn.InvalidateAccess(r.Node)
+	}
+	r.checkAttr(resp.Attr.Inode)
+	r.respond(out)
 }
 
 // A SetattrResponse is the response to a SetattrRequest.
@@ -1821,9 +3881,12 @@ func (r *SetattrResponse) String() string {
 // to storage, as when a file descriptor is being closed.  A single opened Handle
 // may receive multiple FlushRequests over its lifetime.
 type FlushRequest struct {
-	Header    `json:"-"`
-	Handle    HandleID
-	Flags     uint32
+	Header `json:"-"`
+	Handle HandleID
+	Flags  uint32
+	// Owner of POSIX locks held by the closing process. Flush does
+	// not release flocks, which belong to the open file and are
+	// dropped with its ReleaseRequest.
 	LockOwner uint64
 }
 
@@ -1836,7 +3899,7 @@ func (r *FlushRequest) String() string {
 // Respond replies to the request, indicating that the flush succeeded.
 func (r *FlushRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 	//fmt.Printf("flush took %s\n", time.Now().Sub(r.start))
 }
 
@@ -1857,34 +3920,69 @@ func (r *RemoveRequest) String() string {
 // Respond replies to the request, indicating that the file was removed.
 func (r *RemoveRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A SymlinkRequest is a request to create a symlink making NewName point to Target.
 type SymlinkRequest struct {
 	Header          `json:"-"`
 	NewName, Target string
+
+	// See SecurityContext.
+	secctx *[]SecurityContext
 }
 
 var _ = Request(&SymlinkRequest{})
 
+// SecurityContext returns the security labels to apply to the new
+// node, see CreateRequest.SecurityContext.
+func (r *SymlinkRequest) SecurityContext() []SecurityContext {
+	return derefSecurityContext(r.secctx)
+}
+
+// maxSymlinkTarget is PATH_MAX, including the terminating NUL.
+const maxSymlinkTarget = 4096
+
+// ValidSymlinkTarget checks that target can be the target of a
+// symlink, as symlink(2) would: it must not be empty, contain a NUL
+// byte or be longer than PATH_MAX. A server that gets targets from
+// elsewhere than a SymlinkRequest can use it to reject them with the
+// same errors.
+//
+// It does not look for loops, which depend on the rest of the file
+// system; a server that finds one can fail the lookup with ELOOP.
+func ValidSymlinkTarget(target string) error {
+	switch {
+	case target == "":
+		return ENOENT
+	case strings.IndexByte(target, 0) >= 0:
+		return Errno(syscall.EINVAL)
+	case len(target) >= maxSymlinkTarget:
+		return Errno(syscall.ENAMETOOLONG)
+	}
+	return nil
+}
+
 func (r *SymlinkRequest) String() string {
 	return fmt.Sprintf("Symlink [%s] from %q to target %q", &r.Header, r.NewName, r.Target)
 }
 
 // Respond replies to the request, indicating that the symlink was created.
 func (r *SymlinkRequest) Respond(resp *SymlinkResponse) {
+	r.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := r.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &entryOut{
 		outHeader:      outHeader{Unique: uint64(r.ID)},
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A SymlinkResponse is the response to a SymlinkRequest.
@@ -1905,7 +4003,7 @@ func (r *ReadlinkRequest) String() string {
 
 func (r *ReadlinkRequest) Respond(target string) {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respondData(out, unsafe.Sizeof(*out), []byte(target))
+	r.respondData(out, []byte(target))
 	//fmt.Printf("readlink took %s\n", time.Now().Sub(r.start))
 }
 
@@ -1923,17 +4021,20 @@ func (r *LinkRequest) String() string {
 }
 
 func (r *LinkRequest) Respond(resp *LookupResponse) {
+	r.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := r.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &entryOut{
 		outHeader:      outHeader{Unique: uint64(r.ID)},
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A RenameRequest is a request to rename a file.
@@ -1941,17 +4042,97 @@ type RenameRequest struct {
 	Header           `json:"-"`
 	NewDir           NodeID
 	OldName, NewName string
+	// Flags of renameat2(2). Always zero for a plain rename(2); the
+	// kernel only sends them once protocol 7.23 is negotiated. A file
+	// system that does not support a flag should respond with
+	// EINVAL.
+	Flags RenameFlags
 }
 
 var _ = Request(&RenameRequest{})
 
 func (r *RenameRequest) String() string {
-	return fmt.Sprintf("Rename [%s] from %q to dirnode %d %q", &r.Header, r.OldName, r.NewDir, r.NewName)
+	return fmt.Sprintf("Rename [%s] from %q to dirnode %d %q fl=%v", &r.Header, r.OldName, r.NewDir, r.NewName, r.Flags)
 }
 
 func (r *RenameRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
+}
+
+// A SetvolnameRequest asks to rename the mounted volume, as Finder
+// does. It is only sent by OSXFUSE.
+type SetvolnameRequest struct {
+	Header `json:"-"`
+	Name   string
+}
+
+var _ = Request(&SetvolnameRequest{})
+
+func (r *SetvolnameRequest) String() string {
+	return fmt.Sprintf("Setvolname [%s] %q", &r.Header, r.Name)
+}
+
+// Respond replies to the request, indicating that the volume was
+// renamed.
+func (r *SetvolnameRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.respond(out)
+}
+
+// A GetxtimesRequest asks for the backup and creation times of
+// r.Node. It is only sent by OSXFUSE.
+type GetxtimesRequest struct {
+	Header `json:"-"`
+}
+
+var _ = Request(&GetxtimesRequest{})
+
+func (r *GetxtimesRequest) String() string {
+	return fmt.Sprintf("Getxtimes [%s]", &r.Header)
+}
+
+// Respond replies to the request with the given response.
+func (r *GetxtimesRequest) Respond(resp *GetxtimesResponse) {
+	out := &getxtimesOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+	}
+	out.Bkuptime, out.BkuptimeNsec = unix(resp.Bkuptime)
+	out.Crtime, out.CrtimeNsec = unix(resp.Crtime)
+	r.respond(out)
+}
+
+// A GetxtimesResponse is the response to a GetxtimesRequest.
+type GetxtimesResponse struct {
+	Bkuptime time.Time // time of last backup
+	Crtime   time.Time // time of creation
+}
+
+func (r *GetxtimesResponse) String() string {
+	return fmt.Sprintf("Getxtimes bkuptime=%v crtime=%v", r.Bkuptime, r.Crtime)
+}
+
+// An ExchangeDataRequest asks to atomically swap the contents of two
+// files, as with exchangedata(2). It is only sent by OSXFUSE.
+type ExchangeDataRequest struct {
+	Header           `json:"-"`
+	OldDir, NewDir   NodeID
+	OldName, NewName string
+	// Options of exchangedata(2), such as FSOPT_NOFOLLOW.
+	Options uint64
+}
+
+var _ = Request(&ExchangeDataRequest{})
+
+func (r *ExchangeDataRequest) String() string {
+	return fmt.Sprintf("ExchangeData [%s] dirnode %d %q and dirnode %d %q opt=%#x", &r.Header, r.OldDir, r.OldName, r.NewDir, r.NewName, r.Options)
+}
+
+// Respond replies to the request, indicating that the contents were
+// exchanged.
+func (r *ExchangeDataRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.respond(out)
 }
 
 type MknodRequest struct {
@@ -1959,26 +4140,38 @@ type MknodRequest struct {
 	Name   string
 	Mode   os.FileMode
 	Rdev   uint32
+
+	// See SecurityContext.
+	secctx *[]SecurityContext
 }
 
 var _ = Request(&MknodRequest{})
 
+// SecurityContext returns the security labels to apply to the new
+// node, see CreateRequest.SecurityContext.
+func (r *MknodRequest) SecurityContext() []SecurityContext {
+	return derefSecurityContext(r.secctx)
+}
+
 func (r *MknodRequest) String() string {
 	return fmt.Sprintf("Mknod [%s] Name %q mode %v rdev %d", &r.Header, r.Name, r.Mode, r.Rdev)
 }
 
 func (r *MknodRequest) Respond(resp *LookupResponse) {
+	r.checkEntry(resp.Node, resp.Generation, resp.Attr.Inode)
+	entryValid := r.Conn.entryValid(resp.Attr.Mode, resp.EntryValid)
+	attrValid := r.Conn.attrValid(resp.Attr.Mode, resp.AttrValid)
 	out := &entryOut{
 		outHeader:      outHeader{Unique: uint64(r.ID)},
 		Nodeid:         uint64(resp.Node),
 		Generation:     resp.Generation,
-		EntryValid:     uint64(resp.EntryValid / time.Second),
-		EntryValidNsec: uint32(resp.EntryValid % time.Second / time.Nanosecond),
-		AttrValid:      uint64(resp.AttrValid / time.Second),
-		AttrValidNsec:  uint32(resp.AttrValid % time.Second / time.Nanosecond),
+		EntryValid:     validSec(entryValid),
+		EntryValidNsec: validNsec(entryValid),
+		AttrValid:      validSec(attrValid),
+		AttrValidNsec:  validNsec(attrValid),
 		Attr:           resp.Attr.attr(),
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 type FsyncRequest struct {
@@ -1997,7 +4190,225 @@ func (r *FsyncRequest) String() string {
 
 func (r *FsyncRequest) Respond() {
 	out := &outHeader{Unique: uint64(r.ID)}
-	r.respond(out, unsafe.Sizeof(*out))
+	r.respond(out)
+}
+
+// A FallocateRequest asks to allocate, or with FallocPunchHole to
+// deallocate, the Length bytes of the open file at Offset, as with
+// fallocate(2).
+type FallocateRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	Offset int64
+	Length int64
+	Mode   FallocateMode
+}
+
+var _ = Request(&FallocateRequest{})
+
+func (r *FallocateRequest) String() string {
+	return fmt.Sprintf("Fallocate [%s] %#x %d @%d mode=%v", &r.Header, r.Handle, r.Length, r.Offset, r.Mode)
+}
+
+// Respond replies to the request, indicating that the range was
+// allocated or deallocated.
+func (r *FallocateRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.respond(out)
+}
+
+// An IoctlRequest asks to carry out an ioctl(2) on the open file.
+//
+// InData holds the data the caller passes in; the reply may carry up
+// to OutSize bytes back. For most commands the kernel works out both
+// sizes from Cmd. With IoctlUnrestricted, the file system may instead
+// answer with a retry naming the ranges of the caller's memory that
+// it needs, as pointed to by Arg: the kernel then sends the request
+// again, with InData and OutSize covering those ranges.
+type IoctlRequest struct {
+	Header  `json:"-"`
+	Handle  HandleID
+	Flags   IoctlFlags
+	Cmd     uint32
+	Arg     uint64
+	InData  []byte
+	OutSize uint32
+}
+
+var _ = Request(&IoctlRequest{})
+
+func (r *IoctlRequest) String() string {
+	return fmt.Sprintf("Ioctl [%s] %#x cmd=%#x arg=%#x fl=%v in=%d out=%d",
+		&r.Header, r.Handle, r.Cmd, r.Arg, r.Flags, len(r.InData), r.OutSize)
+}
+
+// Respond replies to the request. If resp asks for a retry, the iovecs
+// are sent instead of the result; that is only allowed with
+// IoctlUnrestricted, and with at most 256 iovecs in each direction,
+// and is answered with EIO otherwise.
+func (r *IoctlRequest) Respond(resp *IoctlResponse) {
+	out := &ioctlOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+	}
+	if !resp.Retry() {
+		out.Result = resp.Result
+		data := resp.Data
+		if len(data) > int(r.OutSize) {
+			data = data[:r.OutSize]
+		}
+		r.respondData(out, data)
+		return
+	}
+
+	if r.Flags&IoctlUnrestricted == 0 || len(resp.InIovs) > maxIoctlIovs || len(resp.OutIovs) > maxIoctlIovs {
+		r.RespondError(EIO)
+		return
+	}
+	out.Flags = uint32(IoctlRetry)
+	out.InIovs = uint32(len(resp.InIovs))
+	out.OutIovs = uint32(len(resp.OutIovs))
+	iovs := make([]byte, (len(resp.InIovs)+len(resp.OutIovs))*ioctlIovecSize)
+	b := iovs
+	for _, list := range [][]IoctlIovec{resp.InIovs, resp.OutIovs} {
+		for _, v := range list {
+			hostOrder.PutUint64(b[0:8], v.Base)
+			hostOrder.PutUint64(b[8:16], v.Len)
+			b = b[ioctlIovecSize:]
+		}
+	}
+	r.respondData(out, iovs)
+}
+
+// An IoctlIovec is a range of the caller's memory.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// An IoctlResponse is the response to an IoctlRequest. It either
+// completes the ioctl with Result and Data, or, if InIovs or OutIovs
+// are set, asks the kernel to retry it.
+type IoctlResponse struct {
+	// Result is the return value of ioctl(2); to fail it, use
+	// RespondError instead.
+	Result int32
+	// Data is copied to the caller, up to the OutSize of the request.
+	Data []byte
+
+	// InIovs are the ranges of the caller's memory to pass in as
+	// InData of the retry, OutIovs those to fill with its Data.
+	InIovs  []IoctlIovec
+	OutIovs []IoctlIovec
+}
+
+// Retry reports whether the response asks for a retry.
+func (r *IoctlResponse) Retry() bool {
+	return len(r.InIovs) > 0 || len(r.OutIovs) > 0
+}
+
+func (r *IoctlResponse) String() string {
+	if r.Retry() {
+		return fmt.Sprintf("Ioctl retry in=%v out=%v", r.InIovs, r.OutIovs)
+	}
+	return fmt.Sprintf("Ioctl result=%d data=%d", r.Result, len(r.Data))
+}
+
+// A CopyFileRangeRequest asks to copy Length bytes of the open file
+// HandleIn, at OffsetIn, to the open file HandleOut of NodeOut, at
+// OffsetOut, as with copy_file_range(2). The source is the Node of the
+// Header. A file system that can copy without moving the data through
+// the kernel saves the round trip; one that cannot should respond
+// with ENOSYS, and the kernel falls back to reads and writes.
+type CopyFileRangeRequest struct {
+	Header    `json:"-"`
+	HandleIn  HandleID
+	OffsetIn  int64
+	NodeOut   NodeID
+	HandleOut HandleID
+	OffsetOut int64
+	Length    uint64
+	// Flags of copy_file_range(2); currently always zero.
+	Flags uint64
+}
+
+var _ = Request(&CopyFileRangeRequest{})
+
+func (r *CopyFileRangeRequest) String() string {
+	return fmt.Sprintf("CopyFileRange [%s] %#x @%d -> %v %#x @%d len=%d fl=%#x",
+		&r.Header, r.HandleIn, r.OffsetIn, r.NodeOut, r.HandleOut, r.OffsetOut, r.Length, r.Flags)
+}
+
+// Respond replies to the request with the number of bytes copied,
+// which may be less than r.Length.
+func (r *CopyFileRangeRequest) Respond(copied int) {
+	out := &writeOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Size:      uint32(copied),
+	}
+	r.respond(out)
+}
+
+// Whence values of LseekRequest beyond io.SeekStart, io.SeekCurrent
+// and io.SeekEnd.
+const (
+	// Seek to the next data at or after the offset.
+	SeekData = 3
+	// Seek to the next hole at or after the offset. The end of the
+	// file counts as a hole.
+	SeekHole = 4
+)
+
+// An LseekRequest asks for the offset of the next data or hole in the
+// open file, as with lseek(2) and SeekData or SeekHole. The kernel
+// handles the other kinds of seek itself.
+type LseekRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	Offset int64
+	Whence int
+}
+
+var _ = Request(&LseekRequest{})
+
+func (r *LseekRequest) String() string {
+	return fmt.Sprintf("Lseek [%s] %#x %d whence=%d", &r.Header, r.Handle, r.Offset, r.Whence)
+}
+
+// Respond replies to the request with the resulting offset. Use
+// RespondError with ENXIO if there is no data, or no hole, past
+// r.Offset.
+func (r *LseekRequest) Respond(offset int64) {
+	out := &lseekOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Offset:    uint64(offset),
+	}
+	r.respond(out)
+}
+
+// A BmapRequest asks where block r.Block of the file r.Node lives on
+// the underlying block device, as with the FIBMAP ioctl. The kernel
+// only sends it for fuseblk mounts, which are backed by a block
+// device.
+type BmapRequest struct {
+	Header    `json:"-"`
+	Block     uint64 // block number in the file
+	BlockSize uint32
+}
+
+var _ = Request(&BmapRequest{})
+
+func (r *BmapRequest) String() string {
+	return fmt.Sprintf("Bmap [%s] block=%d blocksize=%d", &r.Header, r.Block, r.BlockSize)
+}
+
+// Respond replies to the request with the device block number
+// holding the file block.
+func (r *BmapRequest) Respond(block uint64) {
+	out := &bmapOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Block:     block,
+	}
+	r.respond(out)
 }
 
 // An InterruptRequest is a request to interrupt another pending request. The
@@ -2010,7 +4421,8 @@ type InterruptRequest struct {
 var _ = Request(&InterruptRequest{})
 
 func (r *InterruptRequest) Respond() {
-	// nothing to do here
+	// nothing to do here, the kernel expects no reply; interrupts
+	// that need one are answered by ReadRequest
 	r.noResponse()
 }
 
@@ -2038,7 +4450,7 @@ func (r *XXXRequest) Respond(resp *XXXResponse) {
 		outHeader: outHeader{Unique: uint64(r.ID)},
 		xxx,
 	}
-	r.respond(&out.outHeader, unsafe.Sizeof(*out))
+	r.respond(out)
 }
 
 // A XXXResponse is the response to a XXXRequest.
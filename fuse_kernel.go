@@ -43,6 +43,27 @@ import (
 // Version is the FUSE version implemented by the package.
 const Version = "7.8"
 
+// Protocol is a FUSE protocol version number.
+type Protocol struct {
+	Major uint32
+	Minor uint32
+}
+
+func (p Protocol) String() string {
+	return fmt.Sprintf("%d.%d", p.Major, p.Minor)
+}
+
+// LT returns whether a is less than b.
+func (a Protocol) LT(b Protocol) bool {
+	return a.Major < b.Major ||
+		(a.Major == b.Major && a.Minor < b.Minor)
+}
+
+// GE returns whether a is greater than or equal to b.
+func (a Protocol) GE(b Protocol) bool {
+	return !a.LT(b)
+}
+
 const (
 	kernelVersion      = 7
 	kernelMinorVersion = 8
@@ -110,24 +131,24 @@ func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
 func (fl SetattrValid) Flags() bool     { return fl&SetattrFlags != 0 }
 
 func (fl SetattrValid) String() string {
-	return flagString(uint32(fl), setattrValidNames)
+	return flagString(uint64(fl), setattrValidNames)
 }
 
 var setattrValidNames = []flagName{
-	{uint32(SetattrMode), "SetattrMode"},
-	{uint32(SetattrUid), "SetattrUid"},
-	{uint32(SetattrGid), "SetattrGid"},
-	{uint32(SetattrSize), "SetattrSize"},
-	{uint32(SetattrAtime), "SetattrAtime"},
-	{uint32(SetattrMtime), "SetattrMtime"},
-	{uint32(SetattrHandle), "SetattrHandle"},
-	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
-	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
-	{uint32(SetattrLockOwner), "SetattrLockOwner"},
-	{uint32(SetattrCrtime), "SetattrCrtime"},
-	{uint32(SetattrChgtime), "SetattrChgtime"},
-	{uint32(SetattrBkuptime), "SetattrBkuptime"},
-	{uint32(SetattrFlags), "SetattrFlags"},
+	{uint64(SetattrMode), "SetattrMode"},
+	{uint64(SetattrUid), "SetattrUid"},
+	{uint64(SetattrGid), "SetattrGid"},
+	{uint64(SetattrSize), "SetattrSize"},
+	{uint64(SetattrAtime), "SetattrAtime"},
+	{uint64(SetattrMtime), "SetattrMtime"},
+	{uint64(SetattrHandle), "SetattrHandle"},
+	{uint64(SetattrAtimeNow), "SetattrAtimeNow"},
+	{uint64(SetattrMtimeNow), "SetattrMtimeNow"},
+	{uint64(SetattrLockOwner), "SetattrLockOwner"},
+	{uint64(SetattrCrtime), "SetattrCrtime"},
+	{uint64(SetattrChgtime), "SetattrChgtime"},
+	{uint64(SetattrBkuptime), "SetattrBkuptime"},
+	{uint64(SetattrFlags), "SetattrFlags"},
 }
 
 // Flags that can be seen in OpenRequest.Flags.
@@ -157,7 +178,7 @@ type OpenFlags uint32
 func (fl OpenFlags) String() string {
 	// O_RDONLY, O_RWONLY, O_RDWR are not flags
 	s := accModeName(fl & OpenAccessModeMask)
-	flags := uint32(fl &^ OpenAccessModeMask)
+	flags := uint64(fl &^ OpenAccessModeMask)
 	if flags != 0 {
 		s = s + "+" + flagString(flags, openFlagNames)
 	}
@@ -193,14 +214,20 @@ func accModeName(flags OpenFlags) string {
 }
 
 var openFlagNames = []flagName{
-	{uint32(OpenCreate), "OpenCreate"},
-	{uint32(OpenExclusive), "OpenExclusive"},
-	{uint32(OpenTruncate), "OpenTruncate"},
-	{uint32(OpenAppend), "OpenAppend"},
-	{uint32(OpenSync), "OpenSync"},
+	{uint64(OpenCreate), "OpenCreate"},
+	{uint64(OpenExclusive), "OpenExclusive"},
+	{uint64(OpenTruncate), "OpenTruncate"},
+	{uint64(OpenAppend), "OpenAppend"},
+	{uint64(OpenSync), "OpenSync"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
+//
+// They apply to the open file for as long as it stays open; the
+// protocol has no way of changing them later. In particular, whether
+// a file uses direct I/O must be decided when responding to the open,
+// even if, for example, its size is not known yet. Servers that may
+// need direct I/O later should set OpenDirectIO right away.
 type OpenResponseFlags uint32
 
 const (
@@ -208,23 +235,32 @@ const (
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // (Linux?)
 
+	// OpenPassthrough makes the kernel do reads and writes on the
+	// backing file given in OpenResponse.BackingID directly.
+	OpenPassthrough OpenResponseFlags = 1 << 7 // Linux only
+
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
 )
 
 func (fl OpenResponseFlags) String() string {
-	return flagString(uint32(fl), openResponseFlagNames)
+	return flagString(uint64(fl), openResponseFlagNames)
 }
 
 var openResponseFlagNames = []flagName{
-	{uint32(OpenDirectIO), "OpenDirectIO"},
-	{uint32(OpenKeepCache), "OpenKeepCache"},
-	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
-	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
+	{uint64(OpenDirectIO), "OpenDirectIO"},
+	{uint64(OpenKeepCache), "OpenKeepCache"},
+	{uint64(OpenPassthrough), "OpenPassthrough"},
+	{uint64(OpenPurgeAttr), "OpenPurgeAttr"},
+	{uint64(OpenPurgeUBC), "OpenPurgeUBC"},
 }
 
 // The InitFlags are used in the Init exchange.
-type InitFlags uint32
+//
+// The kernel protocol carries the flags in two 32-bit words; the
+// upper half of InitFlags is only exchanged with kernels that support
+// protocol 7.36 or later.
+type InitFlags uint64
 
 const (
 	InitAsyncRead       InitFlags = 1 << 0
@@ -243,49 +279,78 @@ const (
 	InitDoReaddirplus   InitFlags = 1 << 13
 	InitReaddirplusAuto InitFlags = 1 << 14
 	InitAsyncDIO        InitFlags = 1 << 15
-	InitWritebackCache  InitFlags = 1 << 16
+	InitWritebackCache  InitFlags = 1 << 16 // see InitResponse.EnableWritebackCache
 	InitNoOpenSupport   InitFlags = 1 << 17
 
+	// InitMaxPages makes the kernel take InitResponse.MaxPages as the
+	// largest number of pages in a single request, instead of 32.
+	InitMaxPages InitFlags = 1 << 22 // Linux only
+
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
 	InitXtimes        InitFlags = 1 << 31 // OS X only
+
+	// InitSecurityContext asks the kernel to send the security
+	// context of the caller with requests that create new nodes. See
+	// CreateRequest.SecurityContext.
+	InitSecurityContext InitFlags = 1 << 32 // Linux only
+
+	// InitCreateSuppGroup asks the kernel to send the supplementary
+	// groups of the caller with requests that create new nodes. See
+	// Header.SupplementaryGroups.
+	InitCreateSuppGroup InitFlags = 1 << 34 // Linux only
+
+	// InitPassthrough allows responding to opens with
+	// OpenPassthrough. The kernel only enables it along with a
+	// non-zero InitResponse.MaxStackDepth.
+	InitPassthrough InitFlags = 1 << 37 // Linux only
 )
 
+// initExt is set in the first word of the flags when the second word
+// is in use. It shares its bit with InitVolRename, but OSXFUSE never
+// speaks a protocol version recent enough to be confused by it.
+const initExt = 1 << 30
+
 type flagName struct {
-	bit  uint32
+	bit  uint64
 	name string
 }
 
 var initFlagNames = []flagName{
-	{uint32(InitAsyncRead), "InitAsyncRead"},
-	{uint32(InitPosixLocks), "InitPosixLocks"},
-	{uint32(InitFileOps), "InitFileOps"},
-	{uint32(InitAtomicTrunc), "InitAtomicTrunc"},
-	{uint32(InitExportSupport), "InitExportSupport"},
-	{uint32(InitBigWrites), "InitBigWrites"},
-	{uint32(InitDontMask), "InitDontMask"},
-	{uint32(InitSpliceWrite), "InitSpliceWrite"},
-	{uint32(InitSpliceMove), "InitSpliceMove"},
-	{uint32(InitSpliceRead), "InitSpliceRead"},
-	{uint32(InitFlockLocks), "InitFlockLocks"},
-	{uint32(InitHasIoctlDir), "InitHasIoctlDir"},
-	{uint32(InitAutoInvalData), "InitAutoInvalData"},
-	{uint32(InitDoReaddirplus), "InitDoReaddirplus"},
-	{uint32(InitReaddirplusAuto), "InitReaddirplusAuto"},
-	{uint32(InitAsyncDIO), "InitAsyncDIO"},
-	{uint32(InitWritebackCache), "InitWritebackCache"},
-	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
-
-	{uint32(InitCaseSensitive), "InitCaseSensitive"},
-	{uint32(InitVolRename), "InitVolRename"},
-	{uint32(InitXtimes), "InitXtimes"},
+	{uint64(InitAsyncRead), "InitAsyncRead"},
+	{uint64(InitPosixLocks), "InitPosixLocks"},
+	{uint64(InitFileOps), "InitFileOps"},
+	{uint64(InitAtomicTrunc), "InitAtomicTrunc"},
+	{uint64(InitExportSupport), "InitExportSupport"},
+	{uint64(InitBigWrites), "InitBigWrites"},
+	{uint64(InitDontMask), "InitDontMask"},
+	{uint64(InitSpliceWrite), "InitSpliceWrite"},
+	{uint64(InitSpliceMove), "InitSpliceMove"},
+	{uint64(InitSpliceRead), "InitSpliceRead"},
+	{uint64(InitFlockLocks), "InitFlockLocks"},
+	{uint64(InitHasIoctlDir), "InitHasIoctlDir"},
+	{uint64(InitAutoInvalData), "InitAutoInvalData"},
+	{uint64(InitDoReaddirplus), "InitDoReaddirplus"},
+	{uint64(InitReaddirplusAuto), "InitReaddirplusAuto"},
+	{uint64(InitAsyncDIO), "InitAsyncDIO"},
+	{uint64(InitWritebackCache), "InitWritebackCache"},
+	{uint64(InitNoOpenSupport), "InitNoOpenSupport"},
+	{uint64(InitMaxPages), "InitMaxPages"},
+
+	{uint64(InitCaseSensitive), "InitCaseSensitive"},
+	{uint64(InitVolRename), "InitVolRename"},
+	{uint64(InitXtimes), "InitXtimes"},
+
+	{uint64(InitSecurityContext), "InitSecurityContext"},
+	{uint64(InitCreateSuppGroup), "InitCreateSuppGroup"},
+	{uint64(InitPassthrough), "InitPassthrough"},
 }
 
 func (fl InitFlags) String() string {
-	return flagString(uint32(fl), initFlagNames)
+	return flagString(uint64(fl), initFlagNames)
 }
 
-func flagString(f uint32, names []flagName) string {
+func flagString(f uint64, names []flagName) string {
 	var s string
 
 	if f == 0 {
@@ -304,61 +369,240 @@ func flagString(f uint32, names []flagName) string {
 	return s[1:]
 }
 
+// The OpenRequestFlags are passed in OpenRequest, in addition to the
+// flags of open(2).
+type OpenRequestFlags uint32
+
+const (
+	// Clear the setuid and setgid bits, as the file is being
+	// truncated by an unprivileged process.
+	OpenKillSuidgid OpenRequestFlags = 1 << 0 // Linux only
+)
+
+func (fl OpenRequestFlags) String() string {
+	return flagString(uint64(fl), openRequestFlagNames)
+}
+
+var openRequestFlagNames = []flagName{
+	{uint64(OpenKillSuidgid), "OpenKillSuidgid"},
+}
+
+// The GetattrFlags are passed in GetattrRequest.
+type GetattrFlags uint32
+
+const (
+	// Handle field is valid.
+	GetattrFh GetattrFlags = 1 << 0
+)
+
+func (fl GetattrFlags) String() string {
+	return flagString(uint64(fl), getattrFlagNames)
+}
+
+var getattrFlagNames = []flagName{
+	{uint64(GetattrFh), "GetattrFh"},
+}
+
 // The ReleaseFlags are used in the Release exchange.
 type ReleaseFlags uint32
 
 const (
 	ReleaseFlush ReleaseFlags = 1 << 0
+	// The file held flock(2) locks, which must be dropped for the
+	// lock owner of the request. Protocol 7.17 and later.
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
+// FlockUnlock reports whether the flocks of ReleaseRequest.LockOwner
+// must be released.
+func (fl ReleaseFlags) FlockUnlock() bool { return fl&ReleaseFlockUnlock != 0 }
+
 func (fl ReleaseFlags) String() string {
-	return flagString(uint32(fl), releaseFlagNames)
+	return flagString(uint64(fl), releaseFlagNames)
 }
 
 var releaseFlagNames = []flagName{
-	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint64(ReleaseFlush), "ReleaseFlush"},
+	{uint64(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// The LockFlags are passed in GetlkRequest and SetlkRequest.
+type LockFlags uint32
+
+const (
+	// The lock is a flock(2) lock rather than a POSIX one, see
+	// InitFlockLocks.
+	LockFlock LockFlags = 1 << 0
+)
+
+func (fl LockFlags) String() string {
+	return flagString(uint64(fl), lockFlagNames)
+}
+
+var lockFlagNames = []flagName{
+	{uint64(LockFlock), "LockFlock"},
+}
+
+// The PollFlags are passed in PollRequest.
+type PollFlags uint32
+
+const (
+	// The kernel wants a NotifyPollWakeup for the poll handle when
+	// the file becomes ready.
+	PollScheduleNotify PollFlags = 1 << 0
+)
+
+func (fl PollFlags) String() string {
+	return flagString(uint64(fl), pollFlagNames)
+}
+
+var pollFlagNames = []flagName{
+	{uint64(PollScheduleNotify), "PollScheduleNotify"},
+}
+
+// The FallocateMode is passed in FallocateRequest. It has the bits of
+// the fallocate(2) mode.
+type FallocateMode uint32
+
+const (
+	// The file size does not change, even if the range extends past
+	// the end of the file.
+	FallocKeepSize FallocateMode = 0x01
+	// The range is deallocated. Always comes with FallocKeepSize.
+	FallocPunchHole FallocateMode = 0x02
+)
+
+func (fl FallocateMode) String() string {
+	return flagString(uint64(fl), fallocateModeNames)
+}
+
+var fallocateModeNames = []flagName{
+	{uint64(FallocKeepSize), "FallocKeepSize"},
+	{uint64(FallocPunchHole), "FallocPunchHole"},
+}
+
+// The RenameFlags are passed in RenameRequest, as given to
+// renameat2(2).
+type RenameFlags uint32
+
+const (
+	// Fail with EEXIST if the new name exists, instead of replacing
+	// it. The check and the rename must be atomic.
+	RenameNoReplace RenameFlags = 1 << 0
+	// Swap the two names, both of which must exist.
+	RenameExchange RenameFlags = 1 << 1
+	// Leave a whiteout at the old name, for overlay file systems.
+	RenameWhiteout RenameFlags = 1 << 2
+)
+
+func (fl RenameFlags) String() string {
+	return flagString(uint64(fl), renameFlagNames)
+}
+
+var renameFlagNames = []flagName{
+	{uint64(RenameNoReplace), "RenameNoReplace"},
+	{uint64(RenameExchange), "RenameExchange"},
+	{uint64(RenameWhiteout), "RenameWhiteout"},
+}
+
+// The IoctlFlags are passed in IoctlRequest, and returned in the
+// reply.
+type IoctlFlags uint32
+
+const (
+	// The caller is a 32-bit process on a 64-bit kernel.
+	IoctlCompat IoctlFlags = 1 << 0
+	// The file system may ask for the caller's memory with a retry.
+	// Without it, the data sizes come from the ioctl command and
+	// cannot change.
+	IoctlUnrestricted IoctlFlags = 1 << 1
+	// In a reply, the kernel should retry with the iovecs given.
+	IoctlRetry IoctlFlags = 1 << 2
+	// The caller is a 32-bit process. Since protocol 7.16.
+	Ioctl32Bit IoctlFlags = 1 << 3
+	// The ioctl is on a directory. Since protocol 7.18.
+	IoctlDir IoctlFlags = 1 << 4
+	// The caller uses the x32 ABI.
+	IoctlCompatX32 IoctlFlags = 1 << 5
+)
+
+func (fl IoctlFlags) String() string {
+	return flagString(uint64(fl), ioctlFlagNames)
+}
+
+var ioctlFlagNames = []flagName{
+	{uint64(IoctlCompat), "IoctlCompat"},
+	{uint64(IoctlUnrestricted), "IoctlUnrestricted"},
+	{uint64(IoctlRetry), "IoctlRetry"},
+	{uint64(Ioctl32Bit), "Ioctl32Bit"},
+	{uint64(IoctlDir), "IoctlDir"},
+	{uint64(IoctlCompatX32), "IoctlCompatX32"},
+}
+
+// The ReadFlags are passed in ReadRequest.
+type ReadFlags uint32
+
+const (
+	// LockOwner field is valid.
+	ReadLockOwner ReadFlags = 1 << 1
+)
+
+func (fl ReadFlags) String() string {
+	return flagString(uint64(fl), readFlagNames)
+}
+
+var readFlagNames = []flagName{
+	{uint64(ReadLockOwner), "ReadLockOwner"},
 }
 
 // Opcodes
 const (
-	opLookup      = 1
-	opForget      = 2 // no reply
-	opGetattr     = 3
-	opSetattr     = 4
-	opReadlink    = 5
-	opSymlink     = 6
-	opMknod       = 8
-	opMkdir       = 9
-	opUnlink      = 10
-	opRmdir       = 11
-	opRename      = 12
-	opLink        = 13
-	opOpen        = 14
-	opRead        = 15
-	opWrite       = 16
-	opStatfs      = 17
-	opRelease     = 18
-	opFsync       = 20
-	opSetxattr    = 21
-	opGetxattr    = 22
-	opListxattr   = 23
-	opRemovexattr = 24
-	opFlush       = 25
-	opInit        = 26
-	opOpendir     = 27
-	opReaddir     = 28
-	opReleasedir  = 29
-	opFsyncdir    = 30
-	opGetlk       = 31
-	opSetlk       = 32
-	opSetlkw      = 33
-	opAccess      = 34
-	opCreate      = 35
-	opInterrupt   = 36
-	opBmap        = 37
-	opDestroy     = 38
-	opIoctl       = 39 // Linux?
-	opPoll        = 40 // Linux?
+	opLookup        = 1
+	opForget        = 2 // no reply
+	opGetattr       = 3
+	opSetattr       = 4
+	opReadlink      = 5
+	opSymlink       = 6
+	opMknod         = 8
+	opMkdir         = 9
+	opUnlink        = 10
+	opRmdir         = 11
+	opRename        = 12
+	opLink          = 13
+	opOpen          = 14
+	opRead          = 15
+	opWrite         = 16
+	opStatfs        = 17
+	opRelease       = 18
+	opFsync         = 20
+	opSetxattr      = 21
+	opGetxattr      = 22
+	opListxattr     = 23
+	opRemovexattr   = 24
+	opFlush         = 25
+	opInit          = 26
+	opOpendir       = 27
+	opReaddir       = 28
+	opReleasedir    = 29
+	opFsyncdir      = 30
+	opGetlk         = 31
+	opSetlk         = 32
+	opSetlkw        = 33
+	opAccess        = 34
+	opCreate        = 35
+	opInterrupt     = 36
+	opBmap          = 37
+	opDestroy       = 38
+	opIoctl         = 39 // Linux?
+	opPoll          = 40 // Linux?
+	opNotifyReply   = 41 // Linux; answers a NotifyRetrieve
+	opBatchForget   = 42 // Linux; no reply
+	opFallocate     = 43 // Linux
+	opReaddirplus   = 44 // Linux
+	opRename2       = 45 // Linux
+	opLseek         = 46 // Linux
+	opCopyFileRange = 47 // Linux
+	opTmpfile       = 51 // Linux
 
 	// OS X
 	opSetvolname = 61
@@ -366,6 +610,137 @@ const (
 	opExchange   = 63
 )
 
+var opcodeNames = map[uint32]string{
+	opLookup:        "Lookup",
+	opForget:        "Forget",
+	opGetattr:       "Getattr",
+	opSetattr:       "Setattr",
+	opReadlink:      "Readlink",
+	opSymlink:       "Symlink",
+	opMknod:         "Mknod",
+	opMkdir:         "Mkdir",
+	opUnlink:        "Unlink",
+	opRmdir:         "Rmdir",
+	opRename:        "Rename",
+	opLink:          "Link",
+	opOpen:          "Open",
+	opRead:          "Read",
+	opWrite:         "Write",
+	opStatfs:        "Statfs",
+	opRelease:       "Release",
+	opFsync:         "Fsync",
+	opSetxattr:      "Setxattr",
+	opGetxattr:      "Getxattr",
+	opListxattr:     "Listxattr",
+	opRemovexattr:   "Removexattr",
+	opFlush:         "Flush",
+	opInit:          "Init",
+	opOpendir:       "Opendir",
+	opReaddir:       "Readdir",
+	opReleasedir:    "Releasedir",
+	opFsyncdir:      "Fsyncdir",
+	opGetlk:         "Getlk",
+	opSetlk:         "Setlk",
+	opSetlkw:        "Setlkw",
+	opAccess:        "Access",
+	opCreate:        "Create",
+	opInterrupt:     "Interrupt",
+	opBmap:          "Bmap",
+	opDestroy:       "Destroy",
+	opIoctl:         "Ioctl",
+	opPoll:          "Poll",
+	opNotifyReply:   "NotifyReply",
+	opBatchForget:   "BatchForget",
+	opFallocate:     "Fallocate",
+	opReaddirplus:   "Readdirplus",
+	opRename2:       "Rename2",
+	opLseek:         "Lseek",
+	opCopyFileRange: "CopyFileRange",
+	opTmpfile:       "Tmpfile",
+	opSetvolname:    "Setvolname",
+	opGetxtimes:     "Getxtimes",
+	opExchange:      "Exchange",
+}
+
+// OpcodeName returns the name of the FUSE opcode op, as found in
+// Header.Opcode, such as "Lookup". Unknown opcodes are named by their
+// number.
+func OpcodeName(op uint32) string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("opcode%d", op)
+}
+
+// Notifications are sent to the kernel unsolicited, with the code in
+// place of the error and a zero unique ID.
+type notifyCode int32
+
+const (
+	notifyPoll       notifyCode = 1
+	notifyInvalInode notifyCode = 2
+	notifyInvalEntry notifyCode = 3
+	notifyStore      notifyCode = 4
+	notifyRetrieve   notifyCode = 5
+	notifyDelete     notifyCode = 6
+)
+
+// notifyPollWakeupOut is understood since protocol 7.11.
+type notifyPollWakeupOut struct {
+	outHeader
+	Kh uint64
+}
+
+// notifyInvalInodeOut is understood since protocol 7.12.
+type notifyInvalInodeOut struct {
+	outHeader
+	Ino uint64
+	Off int64
+	Len int64
+}
+
+// notifyStoreOut is followed by Size bytes of data. It is understood
+// since protocol 7.15.
+type notifyStoreOut struct {
+	outHeader
+	Nodeid  uint64
+	Offset  uint64
+	Size    uint32
+	Padding uint32
+}
+
+// notifyRetrieveOut is understood since protocol 7.15.
+type notifyRetrieveOut struct {
+	outHeader
+	NotifyUnique uint64
+	Nodeid       uint64
+	Offset       uint64
+	Size         uint32
+	Padding      uint32
+}
+
+// notifyRetrieveIn is sent by the kernel with opNotifyReply, followed
+// by Size bytes of data.
+type notifyRetrieveIn struct {
+	Dummy1 uint64
+	Offset uint64
+	Size   uint32
+	Dummy2 uint32
+	Dummy3 uint64
+	Dummy4 uint64
+}
+
+const notifyRetrieveInSize = 8 + 8 + 4 + 4 + 8 + 8
+
+// notifyInvalEntryOut is followed by the NUL-terminated name. It is
+// understood since protocol 7.12.
+type notifyInvalEntryOut struct {
+	outHeader
+	Parent  uint64
+	Namelen uint32
+	Padding uint32
+}
+
 type entryOut struct {
 	outHeader
 	Nodeid         uint64 // Inode ID
@@ -377,12 +752,36 @@ type entryOut struct {
 	Attr           attr
 }
 
+// getattrIn is only sent with protocol 7.9 and later.
+type getattrIn struct {
+	GetattrFlags uint32
+	Dummy        uint32
+	Fh           uint64
+}
+
+const getattrInSize = 4 + 4 + 8
+
 type forgetIn struct {
 	Nlookup uint64
 }
 
 const forgetInSize = 8
 
+// batchForgetIn is followed by Count forgetOne records.
+type batchForgetIn struct {
+	Count uint32
+	Dummy uint32
+}
+
+const batchForgetInSize = 8
+
+type forgetOne struct {
+	NodeID  uint64
+	Nlookup uint64
+}
+
+const forgetOneSize = 16
+
 type attrOut struct {
 	outHeader
 	AttrValid     uint64 // Cache timeout for the attributes
@@ -423,13 +822,25 @@ type renameIn struct {
 
 const renameInSize = 8
 
+type rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
+const rename2InSize = 16
+
 // OS X
 type exchangeIn struct {
 	Olddir  uint64
 	Newdir  uint64
 	Options uint64
+	// "oldname\x00newname\x00" follows
 }
 
+const exchangeInSize = 24
+
 type linkIn struct {
 	Oldnodeid uint64
 }
@@ -458,8 +869,8 @@ type setattrInCommon struct {
 const setattrInCommonSize = 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 4 + 4 + 4 + 4 + 4 + 4 + 4 + 4
 
 type openIn struct {
-	Flags  uint32
-	Unused uint32
+	Flags     uint32
+	OpenFlags uint32 // protocol 7.33, unused before
 }
 
 const openInSize = 4 + 4
@@ -468,7 +879,7 @@ type openOut struct {
 	outHeader
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID uint32 // protocol 7.40, padding before
 }
 
 type createIn struct {
@@ -491,17 +902,17 @@ type createOut struct {
 
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID uint32 // protocol 7.40, padding before
 }
 
 type releaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
-const releaseInSize = 8 + 4 + 4 + 4
+const releaseInSize = 8 + 4 + 4 + 8
 
 type flushIn struct {
 	Fh         uint64
@@ -513,13 +924,20 @@ type flushIn struct {
 const flushInSize = 8 + 4 + 4 + 8
 
 type readIn struct {
-	Fh      uint64
-	Offset  uint64
-	Size    uint32
-	Padding uint32
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
 }
 
-const readInSize = 8 + 8 + 4 + 4
+const readInSize = 8 + 8 + 4 + 4 + 8 + 4 + 4
+
+// Before protocol 7.9, readIn ends after Size, with padding in place
+// of ReadFlags.
+const readInCompatSize = 8 + 8 + 4 + 4
 
 type writeIn struct {
 	Fh         uint64
@@ -539,11 +957,44 @@ type writeOut struct {
 // The WriteFlags are passed in WriteRequest.
 type WriteFlags uint32
 
+const (
+	// The write comes from the page cache, when writeback caching
+	// is in use, rather than directly from a process. The Uid, Gid
+	// and Pid of the request may not be those of the process that
+	// wrote the data.
+	WriteCache WriteFlags = 1 << 0
+	// LockOwner field is valid.
+	WriteLockOwner WriteFlags = 1 << 1
+	// Clear the setuid and setgid bits, as the writer is
+	// unprivileged.
+	WriteKillSuidgid WriteFlags = 1 << 2
+)
+
+// IsCache reports whether the write comes from the writeback cache.
+func (fl WriteFlags) IsCache() bool {
+	return fl&WriteCache != 0
+}
+
+// IsLockOwner reports whether the lock owner of the write is known.
+func (fl WriteFlags) IsLockOwner() bool {
+	return fl&WriteLockOwner != 0
+}
+
+// IsKillSuidgid reports whether the setuid and setgid bits should be
+// cleared.
+func (fl WriteFlags) IsKillSuidgid() bool {
+	return fl&WriteKillSuidgid != 0
+}
+
 func (fl WriteFlags) String() string {
-	return flagString(uint32(fl), writeFlagNames)
+	return flagString(uint64(fl), writeFlagNames)
 }
 
-var writeFlagNames = []flagName{}
+var writeFlagNames = []flagName{
+	{uint64(WriteCache), "WriteCache"},
+	{uint64(WriteLockOwner), "WriteLockOwner"},
+	{uint64(WriteKillSuidgid), "WriteKillSuidgid"},
+}
 
 const compatStatfsSize = 48
 
@@ -589,16 +1040,107 @@ type getxattrOut struct {
 }
 
 type lkIn struct {
-	Fh    uint64
-	Owner uint64
-	Lk    fileLock
+	Fh      uint64
+	Owner   uint64
+	Lk      fileLock
+	LkFlags uint32
+	Padding uint32
 }
 
+const lkInSize = 8 + 8 + 24 + 4 + 4
+
+// Before protocol 7.9, lkIn ends after Lk.
+const lkInCompatSize = 8 + 8 + 24
+
 type lkOut struct {
 	outHeader
 	Lk fileLock
 }
 
+type fallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	Padding uint32
+}
+
+const fallocateInSize = 8 + 8 + 8 + 4 + 4
+
+type lseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+const lseekInSize = 8 + 8 + 4 + 4
+
+type lseekOut struct {
+	outHeader
+	Offset uint64
+}
+
+type copyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
+const copyFileRangeInSize = 7 * 8
+
+// ioctlIn is followed by InSize bytes of data.
+type ioctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+const ioctlInSize = 8 + 4 + 4 + 8 + 4 + 4
+
+// ioctlOut is followed by the output data or, with IoctlRetry, by
+// InIovs and then OutIovs ioctlIovecs.
+type ioctlOut struct {
+	outHeader
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+type ioctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+const ioctlIovecSize = 8 + 8
+
+// maxIoctlIovs is the most iovecs the kernel accepts in a retry, in
+// each direction.
+const maxIoctlIovs = 256
+
+type pollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32 // since protocol 7.21; padding before
+}
+
+const pollInSize = 8 + 8 + 4 + 4
+
+type pollOut struct {
+	outHeader
+	Revents uint32
+	Padding uint32
+}
+
 type accessIn struct {
 	Mask    uint32
 	Padding uint32
@@ -611,8 +1153,12 @@ type initIn struct {
 	Minor        uint32
 	MaxReadahead uint32
 	Flags        uint32
+	Flags2       uint32 // since protocol 7.36
+	Unused       [11]uint32
 }
 
+// initInSize is the size of the oldest initIn the kernel sends; newer
+// kernels send the whole struct.
 const initInSize = 4 + 4 + 4 + 4
 
 type initOut struct {
@@ -621,10 +1167,76 @@ type initOut struct {
 	Minor        uint32
 	MaxReadahead uint32
 	Flags        uint32
-	Unused       uint32
-	MaxWrite     uint32
+
+	// Ignored by kernels before protocol 7.13.
+	MaxBackground       uint16
+	CongestionThreshold uint16
+
+	MaxWrite uint32
+
+	// Kernels older than protocol 7.23 reject anything past this
+	// point.
+	TimeGran     uint32
+	MaxPages     uint16
+	MapAlignment uint16
+	Flags2       uint32
+	// Since protocol 7.40, with InitPassthrough.
+	MaxStackDepth uint32
+	Unused2       [6]uint32
+}
+
+// maxStackDepth is FILESYSTEM_MAX_STACK_DEPTH, the deepest the kernel
+// lets file systems stack.
+const maxStackDepth = 2
+
+// initOutCompatSize is the size of initOut before protocol 7.23.
+const initOutCompatSize = outHeaderSize + 6*4
+
+// secctxHeader precedes the security contexts sent when
+// InitSecurityContext is in use. Size covers the header and all the
+// contexts. Since protocol 7.38, it doubles as the extHeader of the
+// extension carrying the contexts.
+type secctxHeader struct {
+	Size     uint32
+	NrSecctx uint32
+}
+
+const secctxHeaderSize = 4 + 4
+
+// secctx precedes each security context; "name\x00" and Size bytes
+// of context follow.
+type secctx struct {
+	Size    uint32
+	Padding uint32
 }
 
+const secctxSize = 4 + 4
+
+// extHeader precedes each request extension, see
+// Header.TotalExtLen. Size covers the header and the payload, and is
+// a multiple of 8.
+type extHeader struct {
+	Size uint32
+	Type uint32
+}
+
+const extHeaderSize = 4 + 4
+
+// Request extension types. Types up to extMaxNrSecctx are security
+// contexts, with the type being the number of contexts.
+const (
+	extMaxNrSecctx = 31
+	extGroups      = 32
+)
+
+// suppGroups is the payload of the extGroups extension; NrGroups
+// uint32 group IDs follow.
+type suppGroups struct {
+	NrGroups uint32
+}
+
+const suppGroupsSize = 4
+
 type interruptIn struct {
 	Unique uint64
 }
@@ -637,6 +1249,8 @@ type bmapIn struct {
 	Padding   uint32
 }
 
+const bmapInSize = 16
+
 type bmapOut struct {
 	outHeader
 	Block uint64
@@ -650,7 +1264,8 @@ type bmapOut struct {
 // uid    uint32
 // gid    uint32
 // pid    uint32
-// pad    uint32
+// total_extlen uint16 (protocol 7.38, padding before)
+// pad    uint16
 const inHeaderSize = 4 + 4 + 8 + 8 + 4 + 4 + 4 + 4
 
 type outHeader struct {
@@ -670,3 +1285,20 @@ type dirent struct {
 }
 
 const direntSize = 8 + 8 + 4 + 4
+
+// entryPlus starts a direntplus record, which READDIRPLUS returns in
+// place of a dirent. It is an entryOut without the header, with the
+// attributes of protocol 7.9 and later, as READDIRPLUS needs 7.21.
+type entryPlus struct {
+	Nodeid         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           attr
+	Blksize        uint32
+	Padding        uint32
+}
+
+const entryPlusSize = 8 + 8 + 8 + 8 + 4 + 4 + attrSize + 4 + 4
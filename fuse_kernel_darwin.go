@@ -24,6 +24,33 @@ type attr struct {
 	Flags_     uint32 // OS X only; see chflags(2)
 }
 
+// attrSize is the length of a marshalled attr.
+const attrSize = 7*8 + 10*4
+
+func (a *attr) marshal(b []byte) []byte {
+	b = appendUint64(b, a.Ino)
+	b = appendUint64(b, a.Size)
+	b = appendUint64(b, a.Blocks)
+	b = appendUint64(b, a.Atime)
+	b = appendUint64(b, a.Mtime)
+	b = appendUint64(b, a.Ctime)
+	b = appendUint64(b, a.Crtime_)
+	b = appendUint32(b, a.AtimeNsec)
+	b = appendUint32(b, a.MtimeNsec)
+	b = appendUint32(b, a.CtimeNsec)
+	b = appendUint32(b, a.CrtimeNsec)
+	b = appendUint32(b, a.Mode)
+	b = appendUint32(b, a.Nlink)
+	b = appendUint32(b, a.Uid)
+	b = appendUint32(b, a.Gid)
+	b = appendUint32(b, a.Rdev)
+	return appendUint32(b, a.Flags_)
+}
+
+func (a *attr) Crtime() time.Time {
+	return time.Unix(int64(a.Crtime_), int64(a.CrtimeNsec))
+}
+
 func (a *attr) SetCrtime(s uint64, ns uint32) {
 	a.Crtime_, a.CrtimeNsec = s, ns
 }
@@ -90,3 +117,11 @@ func (s *setxattrIn) position() uint32 {
 }
 
 const setxattrInSize = setxattrInCommonSize + 4 + 4
+
+// fixHeaderLen corrects hdr.Len for a message of n bytes: OSXFUSE
+// sometimes sends the wrong hdr.Len in a FUSE_WRITE message.
+func fixHeaderLen(hdr *Header, n int) {
+	if hdr.Opcode == opWrite && hdr.Len < uint32(n) && hdr.Len >= writeInSize {
+		hdr.Len = uint32(n)
+	}
+}
@@ -19,6 +19,26 @@ type attr struct {
 	Rdev      uint32
 }
 
+// attrSize is the length of a marshalled attr.
+const attrSize = 6*8 + 8*4
+
+func (a *attr) marshal(b []byte) []byte {
+	b = appendUint64(b, a.Ino)
+	b = appendUint64(b, a.Size)
+	b = appendUint64(b, a.Blocks)
+	b = appendUint64(b, a.Atime)
+	b = appendUint64(b, a.Mtime)
+	b = appendUint64(b, a.Ctime)
+	b = appendUint32(b, a.AtimeNsec)
+	b = appendUint32(b, a.MtimeNsec)
+	b = appendUint32(b, a.CtimeNsec)
+	b = appendUint32(b, a.Mode)
+	b = appendUint32(b, a.Nlink)
+	b = appendUint32(b, a.Uid)
+	b = appendUint32(b, a.Gid)
+	return appendUint32(b, a.Rdev)
+}
+
 func (a *attr) Crtime() time.Time {
 	return time.Time{}
 }
@@ -58,3 +78,12 @@ type getxattrIn struct {
 type setxattrIn struct {
 	setxattrInCommon
 }
+
+// fixHeaderLen corrects hdr.Len for a message of n bytes: FreeBSD FUSE
+// sends a short length in the header for FUSE_INIT even though the
+// actual read length is correct.
+func fixHeaderLen(hdr *Header, n int) {
+	if hdr.Opcode == opInit && n == inHeaderSize+initInSize && hdr.Len < uint32(n) {
+		hdr.Len = uint32(n)
+	}
+}
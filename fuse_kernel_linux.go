@@ -21,6 +21,26 @@ type attr struct {
 	//	padding_  uint32  // Only in protocol 7.9
 }
 
+// attrSize is the length of a marshalled attr.
+const attrSize = 6*8 + 8*4
+
+func (a *attr) marshal(b []byte) []byte {
+	b = appendUint64(b, a.Ino)
+	b = appendUint64(b, a.Size)
+	b = appendUint64(b, a.Blocks)
+	b = appendUint64(b, a.Atime)
+	b = appendUint64(b, a.Mtime)
+	b = appendUint64(b, a.Ctime)
+	b = appendUint32(b, a.AtimeNsec)
+	b = appendUint32(b, a.MtimeNsec)
+	b = appendUint32(b, a.CtimeNsec)
+	b = appendUint32(b, a.Mode)
+	b = appendUint32(b, a.Nlink)
+	b = appendUint32(b, a.Uid)
+	b = appendUint32(b, a.Gid)
+	return appendUint32(b, a.Rdev)
+}
+
 func (a *attr) Crtime() time.Time {
 	return time.Time{}
 }
@@ -74,3 +94,7 @@ type setxattrIn struct {
 }
 
 const setxattrInSize = setxattrInCommonSize
+
+// fixHeaderLen would correct hdr.Len for platform bugs, but Linux
+// gets it right, and a wrong length is an error.
+func fixHeaderLen(hdr *Header, n int) {}
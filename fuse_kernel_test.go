@@ -2,6 +2,8 @@ package fuse_test
 
 import (
 	"os"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/bpowers/fuse"
@@ -29,3 +31,102 @@ func TestOpenFlagsString(t *testing.T) {
 		t.Fatalf("OpenFlags.String: %q != %q", g, e)
 	}
 }
+
+func TestDirentTypeFromDT(t *testing.T) {
+	for _, tc := range []struct {
+		dt  uint8
+		typ fuse.DirentType
+	}{
+		{syscall.DT_UNKNOWN, fuse.DT_Unknown},
+		{syscall.DT_SOCK, fuse.DT_Socket},
+		{syscall.DT_LNK, fuse.DT_Link},
+		{syscall.DT_REG, fuse.DT_File},
+		{syscall.DT_BLK, fuse.DT_Block},
+		{syscall.DT_DIR, fuse.DT_Dir},
+		{syscall.DT_CHR, fuse.DT_Char},
+		{syscall.DT_FIFO, fuse.DT_FIFO},
+	} {
+		if g, e := fuse.DirentTypeFromDT(tc.dt), tc.typ; g != e {
+			t.Errorf("DirentTypeFromDT(%d): %v != %v", tc.dt, g, e)
+		}
+		if g, e := tc.typ.DT(), tc.dt; g != e {
+			t.Errorf("%v.DT(): %d != %d", tc.typ, g, e)
+		}
+	}
+	if g, e := fuse.DirentTypeFromDT(255), fuse.DT_Unknown; g != e {
+		t.Errorf("DirentTypeFromDT(255): %v != %v", g, e)
+	}
+}
+
+func TestWriteFlags(t *testing.T) {
+	for _, tc := range []struct {
+		bit  uint32
+		fl   fuse.WriteFlags
+		name string
+		is   func(fuse.WriteFlags) bool
+	}{
+		{1 << 0, fuse.WriteCache, "WriteCache", fuse.WriteFlags.IsCache},
+		{1 << 1, fuse.WriteLockOwner, "WriteLockOwner", fuse.WriteFlags.IsLockOwner},
+		{1 << 2, fuse.WriteKillSuidgid, "WriteKillSuidgid", fuse.WriteFlags.IsKillSuidgid},
+	} {
+		if g, e := uint32(tc.fl), tc.bit; g != e {
+			t.Errorf("%s has the wrong bit: %#x != %#x", tc.name, g, e)
+		}
+		if g, e := tc.fl.String(), tc.name; g != e {
+			t.Errorf("wrong name: %q != %q", g, e)
+		}
+		if !tc.is(tc.fl) {
+			t.Errorf("predicate false for %v", tc.fl)
+		}
+		if tc.is(^tc.fl) {
+			t.Errorf("predicate true without %v", tc.fl)
+		}
+	}
+
+	fl := fuse.WriteCache | fuse.WriteKillSuidgid | 1<<5
+	if g, e := fl.String(), "WriteCache+WriteKillSuidgid+0x20"; g != e {
+		t.Errorf("WriteFlags.String: %q != %q", g, e)
+	}
+}
+
+func TestValidSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   error
+	}{
+		{"", fuse.ENOENT},
+		{"a\x00b", fuse.Errno(syscall.EINVAL)},
+		{"\x00", fuse.Errno(syscall.EINVAL)},
+		{strings.Repeat("a", 4096), fuse.Errno(syscall.ENAMETOOLONG)},
+		{"../target", nil},
+		{strings.Repeat("a", 4095), nil},
+	}
+	for _, tt := range tests {
+		if g := fuse.ValidSymlinkTarget(tt.target); g != tt.want {
+			t.Errorf("ValidSymlinkTarget(%.20q) = %v, want %v", tt.target, g, tt.want)
+		}
+	}
+}
+
+func TestApplyUmask(t *testing.T) {
+	tests := []struct {
+		mode  os.FileMode
+		umask uint32
+		want  os.FileMode
+	}{
+		{0666, 022, 0644},
+		{0777, 022, 0755},
+		{0777, 077, 0700},
+		{0644, 0, 0644},
+		{0777, 0777, 0},
+		{os.ModeDir | 0777, 027, os.ModeDir | 0750},
+		{os.ModeSetgid | os.ModeSticky | 0775, 002, os.ModeSetgid | os.ModeSticky | 0775},
+		// only permission bits are masked
+		{0666, 07022, 0644},
+	}
+	for _, tt := range tests {
+		if g := fuse.ApplyUmask(tt.mode, tt.umask); g != tt.want {
+			t.Errorf("ApplyUmask(%v, %#o) = %v, want %v", tt.mode, tt.umask, g, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package fuseutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bpowers/fuse"
+)
+
+// DirSnapshots serves the reads of open directories from a snapshot
+// of their entries, taken when the directory is opened. The kernel
+// lists a directory in several reads; serving them all from one
+// snapshot means entries added or removed in between are neither
+// duplicated nor skipped, as POSIX requires of readdir.
+//
+// Call Open when responding to an OpenRequest for a directory, Read
+// for every ReadRequest with Dir set, and Release on its
+// ReleaseRequest. A DirSnapshots is safe for concurrent use.
+type DirSnapshots struct {
+	mu    sync.Mutex
+	snaps map[fuse.HandleID]*dirSnapshot
+}
+
+type dirSnapshot struct {
+	data []byte
+	// offset just past each entry in data, in order
+	ends []int
+}
+
+// Open stores a snapshot of entries for the directory open as handle.
+func (s *DirSnapshots) Open(handle fuse.HandleID, entries []fuse.Dirent) {
+	snap := &dirSnapshot{ends: make([]int, 0, len(entries))}
+	for _, e := range entries {
+		snap.data = fuse.AppendDirent(snap.data, e)
+		snap.ends = append(snap.ends, len(snap.data))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snaps == nil {
+		s.snaps = make(map[fuse.HandleID]*dirSnapshot)
+	}
+	s.snaps[handle] = snap
+}
+
+// Read fills resp with the entries of the snapshot of req.Handle that
+// start at or after req.Offset and fit in req.Size. It returns fuse.ESTALE if
+// there is no snapshot for the handle.
+func (s *DirSnapshots) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	s.mu.Lock()
+	snap := s.snaps[req.Handle]
+	s.mu.Unlock()
+	if snap == nil {
+		return fuse.ESTALE
+	}
+	start := 0
+	switch {
+	case req.Offset >= int64(len(snap.data)):
+		start = len(snap.data)
+	case req.Offset > 0:
+		// an offset inside an entry, as after seeking the
+		// directory, starts at the next whole one
+		start = snap.ends[sort.SearchInts(snap.ends, int(req.Offset))]
+	}
+	// only whole entries
+	end := start
+	if i := sort.SearchInts(snap.ends, start+req.Size+1); i > 0 && snap.ends[i-1] > start {
+		end = snap.ends[i-1]
+	}
+	resp.Data = append(resp.Data[:0], snap.data[start:end]...)
+	return nil
+}
+
+// Release drops the snapshot for handle.
+func (s *DirSnapshots) Release(handle fuse.HandleID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snaps, handle)
+}
@@ -0,0 +1,101 @@
+package fuseutil_test
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+	"unsafe"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fuseutil"
+)
+
+// hostOrder is the byte order AppendDirent writes numbers in.
+var hostOrder binary.ByteOrder = binary.BigEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		hostOrder = binary.LittleEndian
+	}
+}
+
+// direntNames decodes the names from the kernel format written by
+// fuse.AppendDirent.
+func direntNames(t *testing.T, data []byte) []string {
+	var names []string
+	for len(data) > 0 {
+		if len(data) < 24 {
+			t.Fatalf("truncated dirent: %d bytes", len(data))
+		}
+		namelen := int(hostOrder.Uint32(data[16:20]))
+		n := (24 + namelen + 7) &^ 7
+		if len(data) < n {
+			t.Fatalf("truncated dirent name: %d bytes", len(data))
+		}
+		names = append(names, string(data[24:24+namelen]))
+		data = data[n:]
+	}
+	return names
+}
+
+func TestDirSnapshots(t *testing.T) {
+	dir := map[string]bool{"a": true, "b": true, "c": true, "d": true}
+	list := func() []fuse.Dirent {
+		var entries []fuse.Dirent
+		for name := range dir {
+			entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		return entries
+	}
+
+	var s fuseutil.DirSnapshots
+	s.Open(1, list())
+	read := func(handle fuse.HandleID, off int64, size int) ([]string, int64) {
+		req := &fuse.ReadRequest{Handle: handle, Offset: off, Size: size, Dir: true}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, size)}
+		if err := s.Read(req, resp); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		return direntNames(t, resp.Data), off + int64(len(resp.Data))
+	}
+
+	// room for two entries of 32 bytes, and a bit
+	names, off := read(1, 0, 80)
+	if g, e := names, []string{"a", "b"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("first read: %q != %q", g, e)
+	}
+
+	// the directory changes in the middle of the listing
+	delete(dir, "c")
+	dir["e"] = true
+	s.Open(2, list())
+
+	names, off = read(1, off, 80)
+	if g, e := names, []string{"c", "d"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("second read: %q != %q", g, e)
+	}
+	if names, _ = read(1, off, 80); len(names) != 0 {
+		t.Errorf("expected the end of the directory, got %q", names)
+	}
+
+	// a new listing sees the change
+	names, _ = read(2, 0, 4096)
+	if g, e := names, []string{"a", "b", "d", "e"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("new listing: %q != %q", g, e)
+	}
+
+	// an offset inside an entry skips to the next one
+	names, _ = read(2, 40, 4096)
+	if g, e := names, []string{"d", "e"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("read inside an entry: %q != %q", g, e)
+	}
+
+	s.Release(1)
+	req := &fuse.ReadRequest{Handle: 1, Size: 4096, Dir: true}
+	if err := s.Read(req, &fuse.ReadResponse{}); err != fuse.ESTALE {
+		t.Errorf("expected ESTALE after Release, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package fuseutil
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/bpowers/fuse"
+)
+
+// FlockTable tracks the flock(2) locks held on one file.
+//
+// A flock belongs to an open file description, not to a process, and
+// the kernel identifies it by a lock owner. On close, the sequence is:
+//
+//   - a FlushRequest for every close(2) of a descriptor. Its
+//     LockOwner names the POSIX locks of the closing process; flocks
+//     must survive it, as other descriptors may share the open file.
+//   - a ReleaseRequest once the last descriptor is gone. If
+//     ReleaseFlags.FlockUnlock is set, the flocks of its LockOwner
+//     must be dropped.
+//
+// Call Release for every ReleaseRequest of the file to follow these
+// rules. A FlockTable is safe for concurrent use.
+type FlockTable struct {
+	mu sync.Mutex
+	// lock owner to whether its lock is exclusive
+	owners map[uint64]bool
+}
+
+// Lock takes a shared or exclusive flock for owner, converting any
+// flock owner already holds. It fails with EWOULDBLOCK if another
+// owner holds a conflicting lock.
+func (t *FlockTable) Lock(owner uint64, exclusive bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for o, excl := range t.owners {
+		if o != owner && (excl || exclusive) {
+			return fuse.Errno(syscall.EWOULDBLOCK)
+		}
+	}
+	if t.owners == nil {
+		t.owners = make(map[uint64]bool)
+	}
+	t.owners[owner] = exclusive
+	return nil
+}
+
+// Unlock drops the flock of owner, if any.
+func (t *FlockTable) Unlock(owner uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.owners, owner)
+}
+
+// Held reports whether owner holds a flock, and whether it is
+// exclusive.
+func (t *FlockTable) Held(owner uint64) (held, exclusive bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exclusive, held = t.owners[owner]
+	return held, exclusive
+}
+
+// Release drops the flocks that req asks to release, and reports
+// whether it did so.
+func (t *FlockTable) Release(req *fuse.ReleaseRequest) bool {
+	if !req.ReleaseFlags.FlockUnlock() {
+		return false
+	}
+	t.Unlock(req.LockOwner)
+	return true
+}
@@ -0,0 +1,62 @@
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fuseutil"
+)
+
+func TestFlockTable(t *testing.T) {
+	const owner, other = 0x1111, 0x2222
+	var locks fuseutil.FlockTable
+
+	// open, then flock(fd, LOCK_EX)
+	if err := locks.Lock(owner, true); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := locks.Lock(other, false); err == nil {
+		t.Fatal("expected a conflict with the exclusive lock")
+	}
+
+	// a release without the flag leaves the lock alone
+	if locks.Release(&fuse.ReleaseRequest{LockOwner: owner}) {
+		t.Error("Release without FlockUnlock released a lock")
+	}
+	if held, excl := locks.Held(owner); !held || !excl {
+		t.Errorf("lock lost: held=%v exclusive=%v", held, excl)
+	}
+
+	// close: the kernel flags the release of a file that held flocks
+	req := &fuse.ReleaseRequest{
+		ReleaseFlags: fuse.ReleaseFlush | fuse.ReleaseFlockUnlock,
+		LockOwner:    owner,
+	}
+	if !locks.Release(req) {
+		t.Error("Release did not release the flock")
+	}
+	if held, _ := locks.Held(owner); held {
+		t.Error("lock still held after close")
+	}
+	if err := locks.Lock(other, true); err != nil {
+		t.Errorf("Lock after close: %v", err)
+	}
+}
+
+func TestFlockTableShared(t *testing.T) {
+	var locks fuseutil.FlockTable
+	if err := locks.Lock(1, false); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := locks.Lock(2, false); err != nil {
+		t.Fatalf("second shared Lock: %v", err)
+	}
+	// upgrading conflicts with the other reader
+	if err := locks.Lock(1, true); err == nil {
+		t.Error("expected a conflict upgrading a shared lock")
+	}
+	locks.Unlock(2)
+	if err := locks.Lock(1, true); err != nil {
+		t.Errorf("upgrade: %v", err)
+	}
+}
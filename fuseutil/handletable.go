@@ -0,0 +1,132 @@
+package fuseutil
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bpowers/fuse"
+)
+
+// HandleTable hands out handle IDs for open files and maps them to the
+// server's state for them. A HandleTable is safe for concurrent use.
+//
+// It can also check that reads and writes through a handle arrive in
+// order, for files that only make sense accessed sequentially, such as
+// append-only logs or streams; see TrackOffsets.
+type HandleTable struct {
+	mu      sync.Mutex
+	handles map[fuse.HandleID]*handleEntry
+	next    fuse.HandleID
+}
+
+type handleEntry struct {
+	state interface{}
+	// Offset the next read or write is expected at, if tracked.
+	track bool
+	off   int64
+}
+
+// Add records state under a new handle ID, to be passed back to the
+// kernel in an OpenResponse or CreateResponse.
+func (t *HandleTable) Add(state interface{}) fuse.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.handles == nil {
+		t.handles = make(map[fuse.HandleID]*handleEntry)
+	}
+	t.next++
+	t.handles[t.next] = &handleEntry{state: state}
+	return t.next
+}
+
+// Handle returns the state recorded for h.
+func (t *HandleTable) Handle(h fuse.HandleID) (state interface{}, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.handles[h]
+	if e == nil {
+		return nil, false
+	}
+	return e.state, true
+}
+
+// Release drops h, typically for a ReleaseRequest.
+func (t *HandleTable) Release(h fuse.HandleID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.handles, h)
+}
+
+// TrackOffsets makes CheckOffset expect the reads and writes through h
+// to follow each other, starting at off.
+//
+// Only use it for files opened with OpenDirectIO or OpenNonSeekable,
+// or written with the page cache off: otherwise the kernel reads ahead
+// and writes back pages in whatever order it likes, and CheckOffset
+// reports that as well.
+func (t *HandleTable) TrackOffsets(h fuse.HandleID, off int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.handles[h]; e != nil {
+		e.track = true
+		e.off = off
+	}
+}
+
+// CheckOffset checks a ReadRequest or WriteRequest through a handle
+// set up with TrackOffsets against the offset the previous one ended
+// at. It reports whether req was out of order, and logs it through
+// fuse.Debug if so. The expected offset then moves past req either
+// way, so a single surprise is reported once.
+//
+// Other requests, and requests through untracked handles, are never
+// out of order.
+func (t *HandleTable) CheckOffset(req fuse.Request) bool {
+	var (
+		h    fuse.HandleID
+		off  int64
+		size int
+	)
+	switch r := req.(type) {
+	case *fuse.ReadRequest:
+		h, off, size = r.Handle, r.Offset, r.Size
+	case *fuse.WriteRequest:
+		h, off, size = r.Handle, r.Offset, len(r.Data)
+	default:
+		return false
+	}
+
+	t.mu.Lock()
+	e := t.handles[h]
+	if e == nil || !e.track {
+		t.mu.Unlock()
+		return false
+	}
+	want := e.off
+	e.off = off + int64(size)
+	t.mu.Unlock()
+
+	if off == want {
+		return false
+	}
+	fuse.Debug(outOfOrder{
+		Op:     req.Hdr().OpName(),
+		ID:     req.Hdr().ID,
+		Handle: h,
+		Offset: off,
+		Want:   want,
+	})
+	return true
+}
+
+type outOfOrder struct {
+	Op     string
+	ID     fuse.RequestID
+	Handle fuse.HandleID
+	Offset int64
+	Want   int64
+}
+
+func (o outOfOrder) String() string {
+	return fmt.Sprintf("out of order %s [ID=%#x] on handle %#x: at %d, expected %d", o.Op, o.ID, o.Handle, o.Offset, o.Want)
+}
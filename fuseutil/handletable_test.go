@@ -0,0 +1,73 @@
+package fuseutil_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fuseutil"
+)
+
+func TestHandleTableOffsets(t *testing.T) {
+	var logged []string
+	defer func(old func(interface{})) { fuse.Debug = old }(fuse.Debug)
+	fuse.Debug = func(msg interface{}) {
+		if s, ok := msg.(fmt.Stringer); ok && strings.HasPrefix(s.String(), "out of order") {
+			logged = append(logged, s.String())
+		}
+	}
+
+	var handles fuseutil.HandleTable
+	h := handles.Add("log")
+	if state, ok := handles.Handle(h); !ok || state != "log" {
+		t.Fatalf("wrong state for handle: %v, %v", state, ok)
+	}
+	other := handles.Add("other")
+
+	write := func(h fuse.HandleID, off int64, n int) bool {
+		return handles.CheckOffset(&fuse.WriteRequest{Handle: h, Offset: off, Data: make([]byte, n)})
+	}
+
+	// untracked handles are never out of order
+	if write(h, 100, 10) {
+		t.Error("untracked write out of order")
+	}
+
+	handles.TrackOffsets(h, 0)
+	for _, tt := range []struct {
+		off  int64
+		n    int
+		flag bool
+	}{
+		{0, 10, false},
+		{10, 5, false},
+		{30, 5, true}, // skipped 15..30
+		{35, 5, false},
+		{20, 5, true}, // went back
+		{25, 5, false},
+	} {
+		if g := write(h, tt.off, tt.n); g != tt.flag {
+			t.Errorf("write @%d: out of order %v, want %v", tt.off, g, tt.flag)
+		}
+	}
+	if g, e := len(logged), 2; g != e {
+		t.Errorf("wrong number of logged writes: %d != %d: %q", g, e, logged)
+	}
+
+	read := &fuse.ReadRequest{Handle: h, Offset: 0, Size: 10}
+	if !handles.CheckOffset(read) {
+		t.Error("read from the start after writes not flagged")
+	}
+	if write(other, 0, 10) {
+		t.Error("write through other handle out of order")
+	}
+
+	handles.Release(h)
+	if _, ok := handles.Handle(h); ok {
+		t.Error("handle not released")
+	}
+	if write(h, 1000, 1) {
+		t.Error("released handle checked")
+	}
+}
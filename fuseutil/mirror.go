@@ -0,0 +1,61 @@
+package fuseutil
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/bpowers/fuse"
+)
+
+// The helpers below make it easy to build a file system mirroring a
+// real directory: look up the real file, report its attributes with
+// StatToAttr, open it with OpenReal, and serve reads and writes with
+// ReadAt and WriteAt.
+
+// StatToAttr converts the result of os.Stat or os.Lstat on a real file
+// to the attributes reported to the kernel. Fields only available
+// from the underlying stat structure, such as the inode number and
+// owner, are filled in when the platform provides them.
+func StatToAttr(fi os.FileInfo) fuse.Attr {
+	a := fuse.Attr{
+		Size:  uint64(fi.Size()),
+		Mode:  fi.Mode(),
+		Mtime: fi.ModTime(),
+		Nlink: 1,
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		fillAttr(&a, st)
+	}
+	return a
+}
+
+// OpenReal opens the real file at path with the flags of an
+// OpenRequest. The kernel has already dealt with creating the file, so
+// O_CREAT and O_EXCL are ignored.
+func OpenReal(path string, flags fuse.OpenFlags) (*os.File, error) {
+	fl := int(flags) &^ (syscall.O_CREAT | syscall.O_EXCL)
+	return os.OpenFile(path, fl, 0)
+}
+
+// ReadAt handles a read request by reading from r at the requested
+// offset. Reaching the end of the file results in a short read.
+func ReadAt(req *fuse.ReadRequest, resp *fuse.ReadResponse, r io.ReaderAt) error {
+	if cap(resp.Data) < req.Size {
+		resp.Data = make([]byte, req.Size)
+	}
+	n, err := r.ReadAt(resp.Data[:req.Size], req.Offset)
+	resp.Data = resp.Data[:n]
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// WriteAt handles a write request by writing to w at the requested
+// offset.
+func WriteAt(req *fuse.WriteRequest, resp *fuse.WriteResponse, w io.WriterAt) error {
+	n, err := w.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return err
+}
@@ -0,0 +1,22 @@
+package fuseutil
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/bpowers/fuse"
+)
+
+func fillAttr(a *fuse.Attr, st *syscall.Stat_t) {
+	a.Inode = st.Ino
+	a.Blocks = uint64(st.Blocks)
+	a.Atime = time.Unix(st.Atimespec.Unix())
+	a.Mtime = time.Unix(st.Mtimespec.Unix())
+	a.Ctime = time.Unix(st.Ctimespec.Unix())
+	a.Crtime = time.Unix(st.Birthtimespec.Unix())
+	a.Nlink = uint32(st.Nlink)
+	a.Uid = st.Uid
+	a.Gid = st.Gid
+	a.Rdev = uint32(st.Rdev)
+	a.Flags = st.Flags
+}
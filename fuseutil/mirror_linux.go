@@ -0,0 +1,20 @@
+package fuseutil
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/bpowers/fuse"
+)
+
+func fillAttr(a *fuse.Attr, st *syscall.Stat_t) {
+	a.Inode = st.Ino
+	a.Blocks = uint64(st.Blocks)
+	a.Atime = time.Unix(st.Atim.Unix())
+	a.Mtime = time.Unix(st.Mtim.Unix())
+	a.Ctime = time.Unix(st.Ctim.Unix())
+	a.Nlink = uint32(st.Nlink)
+	a.Uid = st.Uid
+	a.Gid = st.Gid
+	a.Rdev = uint32(st.Rdev)
+}
@@ -0,0 +1,91 @@
+package fuseutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fuseutil"
+)
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuseutil-mirror-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("hello, world"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := fuseutil.StatToAttr(fi)
+	if g, e := a.Size, uint64(12); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := a.Mode, os.FileMode(0640); g != e {
+		t.Errorf("wrong mode: %v != %v", g, e)
+	}
+	if g, e := a.Inode, fi.Sys().(*syscall.Stat_t).Ino; g != e {
+		t.Errorf("wrong inode: %d != %d", g, e)
+	}
+	if g, e := a.Uid, uint32(os.Getuid()); g != e {
+		t.Errorf("wrong uid: %d != %d", g, e)
+	}
+	if g, e := a.Nlink, uint32(1); g != e {
+		t.Errorf("wrong link count: %d != %d", g, e)
+	}
+	if !a.Mtime.Equal(fi.ModTime()) {
+		t.Errorf("wrong mtime: %v != %v", a.Mtime, fi.ModTime())
+	}
+
+	dirfi, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := fuseutil.StatToAttr(dirfi); !a.Mode.IsDir() {
+		t.Errorf("directory has wrong mode: %v", a.Mode)
+	}
+
+	f, err := fuseutil.OpenReal(path, fuse.OpenReadWrite|fuse.OpenFlags(syscall.O_CREAT|syscall.O_EXCL))
+	if err != nil {
+		t.Fatalf("OpenReal: %v", err)
+	}
+	defer f.Close()
+
+	wreq := &fuse.WriteRequest{Offset: 7, Data: []byte("gopher")}
+	wresp := &fuse.WriteResponse{}
+	if err := fuseutil.WriteAt(wreq, wresp, f); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if g, e := wresp.Size, 6; g != e {
+		t.Errorf("wrong write size: %d != %d", g, e)
+	}
+
+	// a read past the end of the file is short
+	rreq := &fuse.ReadRequest{Offset: 7, Size: 4096}
+	rresp := &fuse.ReadResponse{}
+	if err := fuseutil.ReadAt(rreq, rresp, f); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if g, e := string(rresp.Data), "gopher"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+
+	rreq = &fuse.ReadRequest{Offset: 0, Size: 5}
+	rresp = &fuse.ReadResponse{Data: make([]byte, 0, 5)}
+	if err := fuseutil.ReadAt(rreq, rresp, f); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if g, e := string(rresp.Data), "hello"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+}
@@ -0,0 +1,16 @@
+// +build !linux,!darwin
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/bpowers/fuse"
+)
+
+func fillAttr(a *fuse.Attr, st *syscall.Stat_t) {
+	a.Inode = uint64(st.Ino)
+	a.Nlink = uint32(st.Nlink)
+	a.Uid = st.Uid
+	a.Gid = st.Gid
+}
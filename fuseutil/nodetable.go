@@ -0,0 +1,89 @@
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/bpowers/fuse"
+)
+
+// NodeTable maps the node IDs a server hands out to its own state for
+// them, following the lookup counts of the kernel.
+//
+// Every request about a file carries the node in Header.Node, whether
+// or not it comes with an open handle, so state kept here is found the
+// same way for all of them. A NodeTable is safe for concurrent use.
+type NodeTable struct {
+	mu    sync.Mutex
+	nodes map[fuse.NodeID]*nodeEntry
+}
+
+type nodeEntry struct {
+	state   interface{}
+	nlookup uint64
+}
+
+// Add records state for node and counts one lookup of it. Call it for
+// every reply that hands node to the kernel, such as a LookupResponse
+// or a CreateResponse; the kernel forgets each of them separately.
+// The root is never looked up nor forgotten: Add it once, up front.
+func (t *NodeTable) Add(node fuse.NodeID, state interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes == nil {
+		t.nodes = make(map[fuse.NodeID]*nodeEntry)
+	}
+	e := t.nodes[node]
+	if e == nil {
+		e = &nodeEntry{}
+		t.nodes[node] = e
+	}
+	e.state = state
+	e.nlookup++
+}
+
+// Get returns the state of the node req is about.
+func (t *NodeTable) Get(req fuse.Request) (state interface{}, ok bool) {
+	return t.Node(req.Hdr().Node)
+}
+
+// Node returns the state of node.
+func (t *NodeTable) Node(node fuse.NodeID) (state interface{}, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.nodes[node]
+	if e == nil {
+		return nil, false
+	}
+	return e.state, true
+}
+
+// Forget applies a ForgetRequest or BatchForgetRequest, dropping the
+// nodes the kernel no longer knows about. It reports whether req was
+// one of those; other requests are left alone.
+func (t *NodeTable) Forget(req fuse.Request) bool {
+	switch r := req.(type) {
+	case *fuse.ForgetRequest:
+		t.forget(r.Node, r.N)
+	case *fuse.BatchForgetRequest:
+		for _, f := range r.Forget {
+			t.forget(f.Node, f.N)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (t *NodeTable) forget(node fuse.NodeID, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.nodes[node]
+	if e == nil {
+		return
+	}
+	if n < e.nlookup {
+		e.nlookup -= n
+		return
+	}
+	delete(t.nodes, node)
+}
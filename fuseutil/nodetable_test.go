@@ -0,0 +1,38 @@
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fuseutil"
+)
+
+func TestNodeTable(t *testing.T) {
+	var nodes fuseutil.NodeTable
+	nodes.Add(fuse.RootID, "root")
+	nodes.Add(5, "file")
+	nodes.Add(5, "file")
+
+	// stat(2) on the file: no handle, only the node
+	req := &fuse.GetattrRequest{Header: fuse.Header{Node: 5}}
+	if state, ok := nodes.Get(req); !ok || state != "file" {
+		t.Errorf("wrong state for node 5: %v, %v", state, ok)
+	}
+	if nodes.Forget(req) {
+		t.Error("Forget applied a getattr")
+	}
+
+	if !nodes.Forget(&fuse.ForgetRequest{Header: fuse.Header{Node: 5}, N: 1}) {
+		t.Error("Forget ignored a forget")
+	}
+	if _, ok := nodes.Node(5); !ok {
+		t.Error("node forgotten with a lookup left")
+	}
+	nodes.Forget(&fuse.BatchForgetRequest{Forget: []fuse.ForgetItem{{Node: 5, N: 1}}})
+	if _, ok := nodes.Node(5); ok {
+		t.Error("node not forgotten")
+	}
+	if state, ok := nodes.Node(fuse.RootID); !ok || state != "root" {
+		t.Errorf("wrong state for the root: %v, %v", state, ok)
+	}
+}
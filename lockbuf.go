@@ -0,0 +1,67 @@
+package fuse
+
+import (
+	"unsafe"
+)
+
+// LockBuffers sets aside n buffers for reading requests, and locks
+// them into memory with mlock(2), so that reading a request never
+// waits on a page fault. This is for file systems where latency
+// matters more than memory: each buffer takes a page plus the maximum
+// write size, about 128 KiB unless raised with the MaxWrite mount
+// option, that can not be swapped out for as long as c is open.
+// Locking memory needs CAP_IPC_LOCK, or a large enough
+// RLIMIT_MEMLOCK; if it fails, or the platform does not support it,
+// the error is returned and c keeps reading into ordinary buffers.
+//
+// When more than n requests are being read and decoded at once, the
+// rest use ordinary buffers. LockBuffers must be called before
+// serving requests, and at most once.
+func (c *Conn) LockBuffers(n int) error {
+	// big enough for whatever MaxWrite gets negotiated
+	size := maxRequestSize + int(c.writeLimit())
+	if size < bufSize {
+		size = bufSize
+	}
+	mem := make([]byte, n*size)
+	// mlock faults the pages in
+	if err := mlock(mem); err != nil {
+		return err
+	}
+	free := make(chan []byte, n)
+	for i := 0; i < n; i++ {
+		free <- mem[i*size : (i+1)*size : (i+1)*size]
+	}
+	c.lockedMem = mem
+	c.lockedBufs = free
+	return nil
+}
+
+// readBuffer returns a buffer to read a request into, preferring the
+// locked ones.
+func (c *Conn) readBuffer() []byte {
+	select {
+	case buf := <-c.lockedBufs:
+		return buf
+	default:
+		return c.getBuffer()
+	}
+}
+
+// putReadBuffer releases a buffer returned by readBuffer.
+func (c *Conn) putReadBuffer(buf []byte) {
+	if c.isLocked(buf) {
+		c.lockedBufs <- buf[:cap(buf)]
+		return
+	}
+	c.putBuffer(buf)
+}
+
+func (c *Conn) isLocked(buf []byte) bool {
+	if len(c.lockedMem) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(&c.lockedMem[0]))
+	p := uintptr(unsafe.Pointer(&buf[:1][0]))
+	return p >= start && p < start+uintptr(len(c.lockedMem))
+}
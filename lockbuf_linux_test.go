@@ -0,0 +1,41 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestLockBuffers(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	if err := c.LockBuffers(2); err != nil {
+		if err == syscall.EPERM || err == syscall.ENOMEM {
+			t.Skipf("cannot lock memory: %v", err)
+		}
+		t.Fatalf("LockBuffers: %v", err)
+	}
+
+	pages := (len(c.lockedMem) + syscall.Getpagesize() - 1) / syscall.Getpagesize()
+	vec := make([]byte, pages)
+	if _, _, errno := syscall.Syscall(syscall.SYS_MINCORE,
+		uintptr(unsafe.Pointer(&c.lockedMem[0])), uintptr(len(c.lockedMem)),
+		uintptr(unsafe.Pointer(&vec[0]))); errno != 0 {
+		t.Fatalf("mincore: %v", errno)
+	}
+	for i, v := range vec {
+		if v&1 == 0 {
+			t.Fatalf("page %d of %d is not resident", i, pages)
+		}
+	}
+
+	req := k.request(c, opReadlink, nil)
+	if _, ok := req.(*ReadlinkRequest); !ok {
+		t.Errorf("wrong request type: %T", req)
+	}
+	if g, e := len(c.lockedBufs), 2; g != e {
+		t.Errorf("locked buffers not returned: %d != %d", g, e)
+	}
+}
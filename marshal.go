@@ -0,0 +1,246 @@
+package fuse
+
+// Replies and notifications are marshalled field by field, in the
+// layout of the kernel's C structs and in hostOrder. Writing out the
+// memory of the Go structs instead would depend on the compiler laying
+// them out exactly like the C compiler does.
+
+// An outMessage is a reply or a notification: an outHeader followed by
+// the arguments of the operation.
+//
+// The outHeader embedded in every message has a marshal method of its
+// own, so a message type that lacks one silently sends the header
+// only; TestMarshalLayout catches that for the types it lists.
+type outMessage interface {
+	header() *outHeader
+	// marshal appends the message, header included, to b.
+	marshal(b []byte) []byte
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	n := len(b)
+	b = append(b, 0, 0)
+	hostOrder.PutUint16(b[n:], v)
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	n := len(b)
+	b = append(b, 0, 0, 0, 0)
+	hostOrder.PutUint32(b[n:], v)
+	return b
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	n := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	hostOrder.PutUint64(b[n:], v)
+	return b
+}
+
+func (o *outHeader) header() *outHeader { return o }
+
+func (o *outHeader) marshal(b []byte) []byte {
+	b = appendUint32(b, o.Len)
+	b = appendUint32(b, uint32(o.Error))
+	return appendUint64(b, o.Unique)
+}
+
+// truncatedOut sends only the first n bytes of a message, for kernels
+// that reject the fields they do not know.
+type truncatedOut struct {
+	outMessage
+	n int
+}
+
+func (o truncatedOut) marshal(b []byte) []byte {
+	start := len(b)
+	b = o.outMessage.marshal(b)
+	return b[:start+o.n]
+}
+
+func (o *notifyPollWakeupOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	return appendUint64(b, o.Kh)
+}
+
+func (o *notifyInvalInodeOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Ino)
+	b = appendUint64(b, uint64(o.Off))
+	return appendUint64(b, uint64(o.Len))
+}
+
+func (o *notifyStoreOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Nodeid)
+	b = appendUint64(b, o.Offset)
+	b = appendUint32(b, o.Size)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *notifyRetrieveOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.NotifyUnique)
+	b = appendUint64(b, o.Nodeid)
+	b = appendUint64(b, o.Offset)
+	b = appendUint32(b, o.Size)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *notifyInvalEntryOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Parent)
+	b = appendUint32(b, o.Namelen)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *entryOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Nodeid)
+	b = appendUint64(b, o.Generation)
+	b = appendUint64(b, o.EntryValid)
+	b = appendUint64(b, o.AttrValid)
+	b = appendUint32(b, o.EntryValidNsec)
+	b = appendUint32(b, o.AttrValidNsec)
+	return o.Attr.marshal(b)
+}
+
+func (e *entryPlus) marshal(b []byte) []byte {
+	b = appendUint64(b, e.Nodeid)
+	b = appendUint64(b, e.Generation)
+	b = appendUint64(b, e.EntryValid)
+	b = appendUint64(b, e.AttrValid)
+	b = appendUint32(b, e.EntryValidNsec)
+	b = appendUint32(b, e.AttrValidNsec)
+	b = e.Attr.marshal(b)
+	b = appendUint32(b, e.Blksize)
+	return appendUint32(b, e.Padding)
+}
+
+// marshal appends the fixed part of the record; the name follows.
+func (d *dirent) marshal(b []byte) []byte {
+	b = appendUint64(b, d.Ino)
+	b = appendUint64(b, d.Off)
+	b = appendUint32(b, d.Namelen)
+	return appendUint32(b, d.Type)
+}
+
+func (o *attrOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.AttrValid)
+	b = appendUint32(b, o.AttrValidNsec)
+	b = appendUint32(b, o.Dummy)
+	return o.Attr.marshal(b)
+}
+
+func (o *getxtimesOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Bkuptime)
+	b = appendUint64(b, o.Crtime)
+	b = appendUint32(b, o.BkuptimeNsec)
+	return appendUint32(b, o.CrtimeNsec)
+}
+
+func (o *openOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Fh)
+	b = appendUint32(b, o.OpenFlags)
+	return appendUint32(b, o.BackingID)
+}
+
+func (o *createOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Nodeid)
+	b = appendUint64(b, o.Generation)
+	b = appendUint64(b, o.EntryValid)
+	b = appendUint64(b, o.AttrValid)
+	b = appendUint32(b, o.EntryValidNsec)
+	b = appendUint32(b, o.AttrValidNsec)
+	b = o.Attr.marshal(b)
+	b = appendUint64(b, o.Fh)
+	b = appendUint32(b, o.OpenFlags)
+	return appendUint32(b, o.BackingID)
+}
+
+func (o *writeOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint32(b, o.Size)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *statfsOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	st := &o.St
+	b = appendUint64(b, st.Blocks)
+	b = appendUint64(b, st.Bfree)
+	b = appendUint64(b, st.Bavail)
+	b = appendUint64(b, st.Files)
+	b = appendUint64(b, st.Ffree)
+	b = appendUint32(b, st.Bsize)
+	b = appendUint32(b, st.Namelen)
+	b = appendUint32(b, st.Frsize)
+	b = appendUint32(b, st.Padding)
+	for _, v := range st.Spare {
+		b = appendUint32(b, v)
+	}
+	return b
+}
+
+func (o *getxattrOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint32(b, o.Size)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *lkOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint64(b, o.Lk.Start)
+	b = appendUint64(b, o.Lk.End)
+	b = appendUint32(b, o.Lk.Type)
+	return appendUint32(b, o.Lk.Pid)
+}
+
+func (o *lseekOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	return appendUint64(b, o.Offset)
+}
+
+func (o *ioctlOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint32(b, uint32(o.Result))
+	b = appendUint32(b, o.Flags)
+	b = appendUint32(b, o.InIovs)
+	return appendUint32(b, o.OutIovs)
+}
+
+func (o *pollOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint32(b, o.Revents)
+	return appendUint32(b, o.Padding)
+}
+
+func (o *initOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	b = appendUint32(b, o.Major)
+	b = appendUint32(b, o.Minor)
+	b = appendUint32(b, o.MaxReadahead)
+	b = appendUint32(b, o.Flags)
+	b = appendUint16(b, o.MaxBackground)
+	b = appendUint16(b, o.CongestionThreshold)
+	b = appendUint32(b, o.MaxWrite)
+	b = appendUint32(b, o.TimeGran)
+	b = appendUint16(b, o.MaxPages)
+	b = appendUint16(b, o.MapAlignment)
+	b = appendUint32(b, o.Flags2)
+	b = appendUint32(b, o.MaxStackDepth)
+	for _, v := range o.Unused2 {
+		b = appendUint32(b, v)
+	}
+	return b
+}
+
+func (o *bmapOut) marshal(b []byte) []byte {
+	b = o.outHeader.marshal(b)
+	return appendUint64(b, o.Block)
+}
@@ -0,0 +1,108 @@
+package fuse
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TestMarshalLayout compares the marshalled messages to the memory of
+// the structs, which has the kernel's layout on the platforms this
+// package supports. A field missing from a marshal method, or a
+// message type without one, shows up as a difference.
+func TestMarshalLayout(t *testing.T) {
+	messages := []outMessage{
+		&outHeader{},
+		&notifyPollWakeupOut{},
+		&notifyInvalInodeOut{},
+		&notifyStoreOut{},
+		&notifyRetrieveOut{},
+		&notifyInvalEntryOut{},
+		&entryOut{},
+		&attrOut{},
+		&getxtimesOut{},
+		&openOut{},
+		&createOut{},
+		&writeOut{},
+		&statfsOut{},
+		&getxattrOut{},
+		&lkOut{},
+		&lseekOut{},
+		&ioctlOut{},
+		&pollOut{},
+		&initOut{},
+		&bmapOut{},
+	}
+	for _, m := range messages {
+		size := reflect.TypeOf(m).Elem().Size()
+		mem := (*[1 << 20]byte)(unsafe.Pointer(reflect.ValueOf(m).Pointer()))[:size:size]
+		// distinct bytes, so that swapped fields show up too
+		for i := range mem {
+			mem[i] = byte(i + 1)
+		}
+		if g := m.marshal(nil); !bytes.Equal(g, mem) {
+			t.Errorf("%T marshalled wrong:\n got %x\nwant %x", m, g, mem)
+		}
+	}
+}
+
+func TestMarshalTruncated(t *testing.T) {
+	out := &initOut{Major: 7, Minor: 8, MaxWrite: 4096, TimeGran: 1}
+	b := truncatedOut{out, initOutCompatSize}.marshal([]byte("prefix"))
+	if g, e := len(b), len("prefix")+initOutCompatSize; g != e {
+		t.Fatalf("wrong size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint32(b[len(b)-4:]), uint32(4096); g != e {
+		t.Errorf("message does not end with MaxWrite: %d != %d", g, e)
+	}
+}
+
+func TestAppendDirentBytes(t *testing.T) {
+	b := AppendDirent([]byte("prefix.."), Dirent{Inode: 0x0102030405060708, Type: DT_File, Name: "hello"})
+	want := make([]byte, 8+24+8)
+	copy(want, "prefix..")
+	hostOrder.PutUint64(want[8:], 0x0102030405060708)
+	// offset of the next entry, from the start of the buffer
+	hostOrder.PutUint64(want[16:], 40)
+	hostOrder.PutUint32(want[24:], 5)
+	hostOrder.PutUint32(want[28:], uint32(DT_File))
+	copy(want[32:], "hello")
+	if !bytes.Equal(b, want) {
+		t.Errorf("wrong dirent:\n got %x\nwant %x", b, want)
+	}
+}
+
+func TestAppendDirentPlusBytes(t *testing.T) {
+	b := AppendDirentPlus(nil, DirentPlus{
+		Dirent: Dirent{Inode: 9, Type: DT_Dir, Name: "sub"},
+		Entry: LookupResponse{
+			Node:       5,
+			Generation: 2,
+			EntryValid: 1500 * time.Millisecond,
+			AttrValid:  3 * time.Second,
+			Attr:       Attr{Inode: 9, Size: 4096},
+		},
+	})
+	rec := entryPlusSize + direntSize + 8
+	want := make([]byte, rec)
+	hostOrder.PutUint64(want[0:], 5)
+	hostOrder.PutUint64(want[8:], 2)
+	hostOrder.PutUint64(want[16:], 1)
+	hostOrder.PutUint64(want[24:], 3)
+	hostOrder.PutUint32(want[32:], 500000000)
+	hostOrder.PutUint32(want[36:], 0)
+	// attr has a per-platform layout, checked by TestMarshalLayout
+	attr := (&Attr{Inode: 9, Size: 4096}).attr()
+	copy(want[40:], attr.marshal(nil))
+	de := want[entryPlusSize:]
+	hostOrder.PutUint64(de[0:], 9)
+	hostOrder.PutUint64(de[8:], uint64(rec))
+	hostOrder.PutUint32(de[16:], 3)
+	hostOrder.PutUint32(de[20:], uint32(DT_Dir))
+	copy(de[24:], "sub")
+	if !bytes.Equal(b, want) {
+		t.Errorf("wrong direntplus:\n got %x\nwant %x", b, want)
+	}
+}
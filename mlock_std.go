@@ -0,0 +1,15 @@
+// +build !linux,!darwin
+
+package fuse
+
+import (
+	"errors"
+)
+
+func mlock(b []byte) error {
+	return errors.New("fuse: locking memory is not supported")
+}
+
+func munlock(b []byte) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build linux darwin
+
+package fuse
+
+import "syscall"
+
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func munlock(b []byte) error {
+	return syscall.Munlock(b)
+}
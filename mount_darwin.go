@@ -70,7 +70,7 @@ func callMount(dir string, conf *MountConfig, f *os.File, ready chan<- struct{},
 		//
 		// OSXFUSE seems to ignore InitResponse.MaxWrite, and uses
 		// this instead.
-		"-o", "iosize="+strconv.FormatUint(maxWrite, 10),
+		"-o", "iosize="+strconv.FormatUint(uint64(conf.writeLimit()), 10),
 		// refers to fd passed in cmd.ExtraFiles
 		"3",
 		dir,
@@ -0,0 +1,20 @@
+package fuse_test
+
+import (
+	"testing"
+
+	"github.com/bpowers/fuse/fs/fstestutil"
+)
+
+func TestMountpoint(t *testing.T) {
+	t.Parallel()
+	mnt, err := fstestutil.MountedT(t, fstestutil.SimpleFS{Node: fstestutil.Dir{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.Close()
+
+	if g, e := mnt.Conn.Mountpoint(), mnt.Dir; g != e {
+		t.Errorf("wrong mountpoint: %q != %q", g, e)
+	}
+}
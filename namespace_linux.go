@@ -0,0 +1,22 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+)
+
+// UserNamespace returns the user namespace of the process making the
+// request, as the target of its /proc/<pid>/ns/user link, such as
+// "user:[4026531837]". Requests from processes in the same namespace
+// return the same string.
+//
+// The process may have exited by the time this is called, and the pid
+// may even have been reused; the result is only as good as the pid.
+// Pid is zero for requests the kernel makes on its own behalf, for
+// which an error is returned.
+func (h *Header) UserNamespace() (string, error) {
+	if h.Pid == 0 {
+		return "", fmt.Errorf("fuse: request has no process")
+	}
+	return os.Readlink(fmt.Sprintf("/proc/%d/ns/user", h.Pid))
+}
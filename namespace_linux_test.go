@@ -0,0 +1,28 @@
+package fuse_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bpowers/fuse"
+)
+
+func TestUserNamespace(t *testing.T) {
+	want, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		t.Skipf("no user namespace information: %v", err)
+	}
+	h := &fuse.Header{Pid: uint32(os.Getpid())}
+	got, err := h.UserNamespace()
+	if err != nil {
+		t.Fatalf("UserNamespace: %v", err)
+	}
+	if got != want {
+		t.Errorf("wrong user namespace: %q != %q", got, want)
+	}
+
+	h = &fuse.Header{}
+	if _, err := h.UserNamespace(); err == nil {
+		t.Error("expected an error for a request without a pid")
+	}
+}
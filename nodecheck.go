@@ -0,0 +1,154 @@
+package fuse
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SetNodeChecks enables checking, at the cost of some memory and
+// time, that the file system follows the rules for the NodeID and
+// Generation in the responses to Lookup and the other requests
+// creating directory entries:
+//
+//   - a NodeID the kernel has not forgotten yet must keep its
+//     Generation;
+//   - once forgotten, a NodeID may only be reused with a different
+//     Generation, so that the kernel and NFS clients can tell the new
+//     node from the old one;
+//   - a live NodeID must keep the Attr.Inode it was first reported
+//     with, in entry replies as well as in the responses to Getattr
+//     and Setattr, or hard link detection and tools comparing inode
+//     numbers break.
+//
+// Violations are reported through Debug. This is meant for
+// development; it must be called before serving requests.
+func (c *Conn) SetNodeChecks(enabled bool) {
+	if !enabled {
+		c.nodes = nil
+		return
+	}
+	c.nodes = &nodeChecker{
+		live: make(map[NodeID]*liveNode),
+		dead: make(map[NodeID]uint64),
+	}
+}
+
+type nodeChecker struct {
+	mu   sync.Mutex
+	live map[NodeID]*liveNode
+	// generation of forgotten nodes
+	dead map[NodeID]uint64
+}
+
+type liveNode struct {
+	gen     uint64
+	nlookup uint64
+	inode   uint64
+}
+
+type nodeCheckFailed struct {
+	Node       NodeID
+	Generation uint64
+	// generation the node had before
+	Previous uint64
+	Problem  string
+}
+
+func (n nodeCheckFailed) String() string {
+	return fmt.Sprintf("node check failed: %s: node=%#x generation=%d previous=%d", n.Problem, n.Node, n.Generation, n.Previous)
+}
+
+type inodeCheckFailed struct {
+	Node  NodeID
+	Inode uint64
+	// inode the node was reported with before
+	Previous uint64
+	Request  string
+}
+
+func (n inodeCheckFailed) String() string {
+	return fmt.Sprintf("node check failed: inode of live node changed in %s: node=%#x inode=%d previous=%d", n.Request, n.Node, n.Inode, n.Previous)
+}
+
+// checkEntry records a node sent to the kernel in an entry reply,
+// with its generation and attribute inode number.
+func (h *Header) checkEntry(node NodeID, gen uint64, inode uint64) {
+	nc := h.Conn.nodes
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if n, ok := nc.live[node]; ok {
+		if n.gen != gen {
+			Debug(nodeCheckFailed{
+				Node:       node,
+				Generation: gen,
+				Previous:   n.gen,
+				Problem:    "generation of live node changed",
+			})
+			n.gen = gen
+		}
+		h.checkInodeLocked(n, node, inode)
+		n.nlookup++
+		return
+	}
+	if prev, ok := nc.dead[node]; ok && prev == gen {
+		Debug(nodeCheckFailed{
+			Node:       node,
+			Generation: gen,
+			Previous:   prev,
+			Problem:    "forgotten node reused with the same generation",
+		})
+	}
+	nc.live[node] = &liveNode{gen: gen, nlookup: 1, inode: inode}
+}
+
+// checkAttr checks the inode number of the attributes sent for
+// h.Node, in reply to Getattr or Setattr.
+func (h *Header) checkAttr(inode uint64) {
+	nc := h.Conn.nodes
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	// The root, and nodes the checks were not told about, have
+	// nothing to compare against.
+	if n, ok := nc.live[h.Node]; ok {
+		h.checkInodeLocked(n, h.Node, inode)
+	}
+}
+
+func (h *Header) checkInodeLocked(n *liveNode, node NodeID, inode uint64) {
+	if n.inode == inode {
+		return
+	}
+	Debug(inodeCheckFailed{
+		Node:     node,
+		Inode:    inode,
+		Previous: n.inode,
+		Request:  OpcodeName(h.Opcode),
+	})
+	n.inode = inode
+}
+
+// checkForget records the kernel forgetting n lookups of node.
+func (h *Header) checkForget(node NodeID, n uint64) {
+	nc := h.Conn.nodes
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	live, ok := nc.live[node]
+	if !ok {
+		return
+	}
+	if n < live.nlookup {
+		live.nlookup -= n
+		return
+	}
+	delete(nc.live, node)
+	nc.dead[node] = live.gen
+}
@@ -0,0 +1,43 @@
+package fuse
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+// ErrWouldBlock is returned by ReadRequest on a nonblocking Conn when
+// the kernel has no request ready.
+var ErrWouldBlock = errors.New("fuse: no request ready")
+
+// SetNonblock puts the device of c in nonblocking mode, or back in
+// blocking mode, the default.
+//
+// In nonblocking mode, ReadRequest returns ErrWouldBlock at once when
+// no request is ready, instead of waiting for one. This lets servers
+// with their own event loop wait for the device to become readable
+// with epoll or kqueue, using Fd, and then call ReadRequest until it
+// returns ErrWouldBlock. Serve loops such as fs.Serve and ServeSingle
+// expect blocking reads, and would spin.
+func (c *Conn) SetNonblock(enabled bool) error {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	if err := syscall.SetNonblock(c.fd(), enabled); err != nil {
+		return err
+	}
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&c.nonblock, v)
+	return nil
+}
+
+// Fd returns the file descriptor of the FUSE device, to wait for
+// requests with epoll or kqueue; see SetNonblock. Requests must still
+// be read with ReadRequest, and the descriptor must not be closed.
+func (c *Conn) Fd() int {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	return c.fd()
+}
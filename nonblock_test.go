@@ -0,0 +1,45 @@
+package fuse
+
+import (
+	"testing"
+)
+
+func TestNonblock(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	if err := c.SetNonblock(true); err != nil {
+		t.Fatalf("SetNonblock: %v", err)
+	}
+	if _, err := c.ReadRequest(); err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock with no request ready, got %v", err)
+	}
+
+	k.send(opGetattr, 10, 1, nil)
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if _, ok := req.(*GetattrRequest); !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	req.RespondError(ENOSYS)
+	k.recv()
+	if _, err := c.ReadRequest(); err != ErrWouldBlock {
+		t.Errorf("expected ErrWouldBlock once drained, got %v", err)
+	}
+
+	// blocking again: the read waits for the request
+	if err := c.SetNonblock(false); err != nil {
+		t.Fatalf("SetNonblock: %v", err)
+	}
+	go k.send(opGetattr, 11, 1, nil)
+	req, err = c.ReadRequest()
+	if err != nil {
+		t.Fatalf("blocking ReadRequest: %v", err)
+	}
+	if g, e := req.Hdr().ID, RequestID(11); g != e {
+		t.Errorf("wrong request: %v != %v", g, e)
+	}
+}
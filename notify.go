@@ -0,0 +1,144 @@
+package fuse
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// ErrNotCached is returned by cache invalidations when the kernel
+	// has nothing cached to invalidate.
+	ErrNotCached = errors.New("fuse: not cached")
+
+	// ErrNotSupported is returned by notifications the kernel is too
+	// old to understand.
+	ErrNotSupported = errors.New("fuse: not supported by the kernel")
+)
+
+// notify sends a notification to the kernel, with data following out.
+// Unlike responses, the kernel's verdict on a notification is
+// returned.
+func (c *Conn) notify(code notifyCode, out outMessage, data []byte) error {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	hdr := out.header()
+	hdr.Unique = 0
+	hdr.Error = int32(code)
+	b := out.marshal(c.outBuf[:0])
+	hdr.Len = uint32(len(b) + len(data))
+	hostOrder.PutUint32(b[0:4], hdr.Len)
+	c.outBuf = b[:0]
+	_, err := c.writeMsg(b, data)
+	c.writeFailed(err)
+	if err == syscall.ENOENT {
+		return ErrNotCached
+	}
+	return err
+}
+
+// NotifyPollWakeup wakes the poll(2) callers waiting on the kernel
+// poll handle kh, as passed in a PollRequest with PollScheduleNotify.
+// The kernel then polls the file again.
+//
+// Returns ErrNotSupported if the kernel is older than protocol 7.11.
+func (c *Conn) NotifyPollWakeup(kh uint64) error {
+	if c.kernel.LT(Protocol{7, 11}) {
+		return ErrNotSupported
+	}
+	out := &notifyPollWakeupOut{
+		Kh: kh,
+	}
+	return c.notify(notifyPoll, out, nil)
+}
+
+// NotifyInvalInode tells the kernel to drop the cached attributes of
+// node, and the cached data in the length bytes at off. This is
+// needed when the file changes behind the kernel's back, for example
+// on shared storage.
+//
+// Mind the conventions of the kernel for the range:
+//
+//   - a negative off invalidates the attributes only, no data;
+//   - a negative length, conventionally -1, invalidates from off to
+//     the end of the file; the kernel treats a zero length the same
+//     way.
+//
+// So NotifyInvalInode(node, 0, -1) drops everything cached for node,
+// and NotifyInvalInode(node, newSize, -1) drops the pages past the end
+// of a file that shrank.
+//
+// Returns ErrNotCached if the kernel has nothing cached for node, and
+// ErrNotSupported if the kernel is older than protocol 7.12.
+func (c *Conn) NotifyInvalInode(node NodeID, off int64, length int64) error {
+	if c.kernel.LT(Protocol{7, 12}) {
+		return ErrNotSupported
+	}
+	out := &notifyInvalInodeOut{
+		Ino: uint64(node),
+		Off: off,
+		Len: length,
+	}
+	err := c.notify(notifyInvalInode, out, nil)
+	switch {
+	case err == ErrNotCached:
+		c.noteInvalidated(node, 0, 0)
+	case err == nil && off >= 0:
+		c.noteInvalidated(node, off, length)
+	}
+	return err
+}
+
+// NotifyInvalEntry tells the kernel to forget the directory entry name
+// in parent, and the attributes of parent. This is needed when a name
+// is removed or replaced behind the kernel's back; otherwise the
+// kernel keeps finding the old node until the entry expires.
+//
+// Returns ErrNotCached if the kernel has no such entry cached, and
+// ErrNotSupported if the kernel is older than protocol 7.12.
+func (c *Conn) NotifyInvalEntry(parent NodeID, name string) error {
+	if c.kernel.LT(Protocol{7, 12}) {
+		return ErrNotSupported
+	}
+	out := &notifyInvalEntryOut{
+		Parent:  uint64(parent),
+		Namelen: uint32(len(name)),
+	}
+	data := append([]byte(name), 0)
+	return c.notify(notifyInvalEntry, out, data)
+}
+
+// NotifyStore pushes data into the kernel's page cache for node, at
+// offset, without waiting for the kernel to read it. The file grows
+// if the data extends past its end. Data larger than the MaxWrite
+// negotiated at init is sent in several notifications.
+//
+// Returns ErrNotCached if the kernel does not know node, and
+// ErrNotSupported if the kernel is older than protocol 7.15.
+func (c *Conn) NotifyStore(node NodeID, offset int64, data []byte) error {
+	if c.kernel.LT(Protocol{7, 15}) {
+		return ErrNotSupported
+	}
+	chunk := int(atomic.LoadUint32(&c.maxWrite))
+	if chunk == 0 {
+		chunk = maxWrite
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunk {
+			n = chunk
+		}
+		out := &notifyStoreOut{
+			Nodeid: uint64(node),
+			Offset: uint64(offset),
+			Size:   uint32(n),
+		}
+		if err := c.notify(notifyStore, out, data[:n]); err != nil {
+			return err
+		}
+		c.noteStored(node, offset, int64(n))
+		offset += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
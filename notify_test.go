@@ -0,0 +1,161 @@
+package fuse
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNotifyPollWakeup(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.kernel = Protocol{7, 10}
+	if err := c.NotifyPollWakeup(0x55); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported from an old kernel, got %v", err)
+	}
+
+	c.kernel = Protocol{7, 11}
+	if err := c.NotifyPollWakeup(0x55); err != nil {
+		t.Fatalf("NotifyPollWakeup: %v", err)
+	}
+	hdr, body := k.recv()
+	if g, e := hdr.Unique, uint64(0); g != e {
+		t.Errorf("notification has a request ID: %d", g)
+	}
+	if g, e := hdr.Error, int32(notifyPoll); g != e {
+		t.Errorf("wrong notify code: %d != %d", g, e)
+	}
+	if want := msg(uint64(0x55)); !bytes.Equal(body, want) {
+		t.Errorf("wrong body:\n got %x\nwant %x", body, want)
+	}
+}
+
+func TestNotifyInvalInode(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.kernel = Protocol{7, 11}
+	if err := c.NotifyInvalInode(5, 0, -1); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported from an old kernel, got %v", err)
+	}
+
+	c.kernel = Protocol{7, 12}
+	c.noteStored(5, 0, 8192)
+	// truncate the cache at 4096
+	if err := c.NotifyInvalInode(5, 4096, -1); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+	hdr, body := k.recv()
+	if g, e := hdr.Unique, uint64(0); g != e {
+		t.Errorf("notification has a request ID: %d", g)
+	}
+	if g, e := hdr.Error, int32(notifyInvalInode); g != e {
+		t.Errorf("wrong notify code: %d != %d", g, e)
+	}
+	if g, e := len(body), 24; g != e {
+		t.Fatalf("wrong body size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[0:8]), uint64(5); g != e {
+		t.Errorf("wrong node: %d != %d", g, e)
+	}
+	if g, e := int64(hostOrder.Uint64(body[8:16])), int64(4096); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[16:24]), uint64(0xffffffffffffffff); g != e {
+		t.Errorf("wrong length: %#x != %#x", g, e)
+	}
+	if g, e := c.CachedRanges(5), []ByteRange{{0, 4096}}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong cached ranges: %v != %v", g, e)
+	}
+
+	// attributes only
+	if err := c.NotifyInvalInode(5, -1, 0); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+	k.recv()
+	if g, e := c.CachedRanges(5), []ByteRange{{0, 4096}}; !reflect.DeepEqual(g, e) {
+		t.Errorf("attribute invalidation changed cached ranges: %v != %v", g, e)
+	}
+}
+
+func TestNotifyInvalEntry(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.kernel = Protocol{7, 11}
+	if err := c.NotifyInvalEntry(1, "gone"); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported from an old kernel, got %v", err)
+	}
+
+	c.kernel = Protocol{7, 12}
+	if err := c.NotifyInvalEntry(1, "gone"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+	hdr, body := k.recv()
+	if g, e := hdr.Unique, uint64(0); g != e {
+		t.Errorf("notification has a request ID: %d", g)
+	}
+	if g, e := hdr.Error, int32(notifyInvalEntry); g != e {
+		t.Errorf("wrong notify code: %d != %d", g, e)
+	}
+	if g, e := len(body), 16+len("gone\x00"); g != e {
+		t.Fatalf("wrong body size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[0:8]), uint64(1); g != e {
+		t.Errorf("wrong parent: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[8:12]), uint32(len("gone")); g != e {
+		t.Errorf("wrong namelen: %d != %d", g, e)
+	}
+	if g, e := string(body[16:]), "gone\x00"; g != e {
+		t.Errorf("wrong name: %q != %q", g, e)
+	}
+}
+
+func TestNotifyStore(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.kernel = Protocol{7, 14}
+	if err := c.NotifyStore(5, 0, []byte("x")); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported from an old kernel, got %v", err)
+	}
+
+	c.kernel = Protocol{7, 15}
+	c.maxWrite = 4096
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := c.NotifyStore(5, 100, data); err != nil {
+		t.Fatalf("NotifyStore: %v", err)
+	}
+	var got []byte
+	for i, size := range []int{4096, 4096, 1808} {
+		hdr, body := k.recv()
+		if g, e := hdr.Error, int32(notifyStore); g != e {
+			t.Errorf("wrong notify code: %d != %d", g, e)
+		}
+		if g, e := len(body), 24+size; g != e {
+			t.Fatalf("notification %d: wrong size: %d != %d", i, g, e)
+		}
+		if g, e := hostOrder.Uint64(body[0:8]), uint64(5); g != e {
+			t.Errorf("notification %d: wrong node: %d != %d", i, g, e)
+		}
+		if g, e := hostOrder.Uint64(body[8:16]), uint64(100+len(got)); g != e {
+			t.Errorf("notification %d: wrong offset: %d != %d", i, g, e)
+		}
+		if g, e := hostOrder.Uint32(body[16:20]), uint32(size); g != e {
+			t.Errorf("notification %d: wrong data size: %d != %d", i, g, e)
+		}
+		got = append(got, body[24:]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("stored data differs")
+	}
+	if g, e := c.CachedRanges(5), []ByteRange{{100, int64(len(data))}}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong cached ranges: %v != %v", g, e)
+	}
+}
@@ -2,6 +2,7 @@ package fuse
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -13,6 +14,16 @@ func dummyOption(conf *MountConfig) error {
 // Use it by passing MountOption values to Mount.
 type MountConfig struct {
 	options map[string]string
+	// see MaxWrite; zero for the default
+	maxWrite uint32
+}
+
+// writeLimit returns the largest MaxWrite to negotiate.
+func (m *MountConfig) writeLimit() uint32 {
+	if m.maxWrite != 0 {
+		return m.maxWrite
+	}
+	return maxWrite
 }
 
 func escapeComma(s string) string {
@@ -123,6 +134,22 @@ func DefaultPermissions() MountOption {
 	}
 }
 
+// MaxWrite sets the largest write, in bytes, the file system is
+// prepared to receive, and so the size of the buffers requests are
+// read into; the default is 124 KiB. InitResponse.MaxWrite is capped
+// at n. Writes past 128 KiB need a kernel offering InitMaxPages, which
+// is then negotiated along; other kernels get the default. Linux
+// itself allows at most 256 pages unless configured otherwise.
+func MaxWrite(n uint32) MountOption {
+	return func(conf *MountConfig) error {
+		if n < 4096 {
+			return fmt.Errorf("fuse: MaxWrite %d is less than 4096", n)
+		}
+		conf.maxWrite = n
+		return nil
+	}
+}
+
 // ReadOnly makes the mount read-only.
 func ReadOnly() MountOption {
 	return func(conf *MountConfig) error {
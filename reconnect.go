@@ -0,0 +1,46 @@
+package fuse
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	// unix is taken by the time conversion helper in fuse.go
+	sysunix "golang.org/x/sys/unix"
+)
+
+// Reconnect makes c use fd to talk to the kernel from now on, in place
+// of its current device, and takes ownership of fd. Everything else
+// about c is kept: the negotiated protocol, the requests in flight, and
+// the nodes and handles a server has handed out while serving c. A
+// ReadRequest blocked on the old device carries on with fd once the
+// old device fails.
+//
+// This is meant for restoring a server whose FUSE device was kept
+// elsewhere, for example by a checkpoint/restore tool or a service
+// manager holding the descriptor, so fd must refer to the same kernel
+// connection as before: node IDs, handles and request IDs mean nothing
+// to any other connection. A fresh mount needs a new Init exchange and
+// is not supported. Nor is asking the kernel to resend requests lost in
+// between; they stay pending until the kernel gives up on them.
+func (c *Conn) Reconnect(fd int) error {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	// Bump first, so a reader that sees the old device fail knows to
+	// retry.
+	atomic.AddUint32(&c.reconnects, 1)
+	dev := c.fd()
+	if err := sysunix.Dup2(fd, dev); err != nil {
+		return err
+	}
+	syscall.CloseOnExec(dev)
+	// Responses can be delivered again.
+	atomic.StoreUint32(&c.gone, 0)
+	// The new device comes with its own file status flags.
+	if atomic.LoadUint32(&c.nonblock) != 0 {
+		if err := syscall.SetNonblock(dev, true); err != nil {
+			syscall.Close(fd)
+			return err
+		}
+	}
+	return syscall.Close(fd)
+}
@@ -0,0 +1,1284 @@
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// parseDirents decodes the kernel format written by AppendDirent.
+func parseDirents(t *testing.T, data []byte) (names []string, offs []uint64) {
+	for len(data) > 0 {
+		if len(data) < direntSize {
+			t.Fatalf("truncated dirent: %d bytes", len(data))
+		}
+		off := hostOrder.Uint64(data[8:16])
+		namelen := int(hostOrder.Uint32(data[16:20]))
+		names = append(names, string(data[direntSize:direntSize+namelen]))
+		offs = append(offs, off)
+		data = data[(direntSize+namelen+7)&^7:]
+	}
+	return names, offs
+}
+
+func TestReadRespondDirents(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	entries := []Dirent{
+		{Inode: 2, Name: "one", Type: DT_File},
+		{Inode: 3, Name: "two", Type: DT_Dir},
+		{Inode: 4, Name: "three", Type: DT_Link},
+	}
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Dir:    true,
+		Size:   4096,
+	}
+	r.RespondDirents(entries)
+	_, body := k.recv()
+	names, offs := parseDirents(t, body)
+	if g, e := len(names), len(entries); g != e {
+		t.Fatalf("wrong number of entries: %d != %d", g, e)
+	}
+	for i, name := range names {
+		if g, e := name, entries[i].Name; g != e {
+			t.Errorf("wrong name for entry %d: %q != %q", i, g, e)
+		}
+	}
+	if g, e := offs[len(offs)-1], uint64(len(body)); g != e {
+		t.Errorf("wrong offset for last entry: %d != %d", g, e)
+	}
+
+	// continuing from the last offset reaches the end of the
+	// directory
+	r = &ReadRequest{
+		Header: Header{Conn: c, ID: 2},
+		Dir:    true,
+		Offset: int64(offs[len(offs)-1]),
+		Size:   4096,
+	}
+	r.RespondDirents(entries)
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Errorf("unexpected error: %d", hdr.Error)
+	}
+	if g, e := len(body), 0; g != e {
+		t.Errorf("expected an empty reply at EOF: %d != %d", g, e)
+	}
+}
+
+func TestReadRespondDirentsSize(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	entries := []Dirent{
+		{Inode: 2, Name: "one"},
+		{Inode: 3, Name: "two"},
+		{Inode: 4, Name: "three"},
+	}
+	// room for exactly one entry per call
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Dir:    true,
+		Size:   direntSize + 8,
+	}
+	var got []string
+	for i := 0; i < len(entries)+1; i++ {
+		r.RespondDirents(entries)
+		_, body := k.recv()
+		names, offs := parseDirents(t, body)
+		if len(names) == 0 {
+			break
+		}
+		if g, e := len(names), 1; g != e {
+			t.Fatalf("wrong number of entries: %d != %d", g, e)
+		}
+		got = append(got, names...)
+		r.Offset = int64(offs[0])
+	}
+	if g, e := len(got), len(entries); g != e {
+		t.Fatalf("wrong number of entries in total: %d != %d: %q", g, e, got)
+	}
+	for i, name := range got {
+		if g, e := name, entries[i].Name; g != e {
+			t.Errorf("wrong name for entry %d: %q != %q", i, g, e)
+		}
+	}
+}
+
+func TestLookupResponseSetExpiry(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var fresh LookupResponse
+	fresh.setExpiry(now.Add(90*time.Second), now)
+	if g, e := fresh.EntryValid, 90*time.Second; g != e {
+		t.Errorf("wrong EntryValid for fresh entry: %v != %v", g, e)
+	}
+	if g, e := fresh.AttrValid, 90*time.Second; g != e {
+		t.Errorf("wrong AttrValid for fresh entry: %v != %v", g, e)
+	}
+
+	expired := LookupResponse{
+		EntryValid: time.Minute,
+		AttrValid:  time.Minute,
+	}
+	expired.setExpiry(now.Add(-time.Second), now)
+	if g, e := expired.EntryValid, time.Duration(-1); g != e {
+		t.Errorf("wrong EntryValid for expired entry: %v != %v", g, e)
+	}
+	if g, e := expired.AttrValid, time.Duration(-1); g != e {
+		t.Errorf("wrong AttrValid for expired entry: %v != %v", g, e)
+	}
+}
+
+func TestSetBufferAllocator(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var allocs, frees []int
+	c.SetBufferAllocator(
+		func(n int) []byte {
+			allocs = append(allocs, n)
+			return make([]byte, n)
+		},
+		func(b []byte) {
+			frees = append(frees, len(b))
+		},
+	)
+
+	data := []byte("hello, world")
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Size:   4096,
+	}
+	r.Respond(&ReadResponse{Data: data})
+	_, body := k.recv()
+	if g, e := string(body), string(data); g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+	want := outHeaderSize + len(data)
+	if len(allocs) != 1 || allocs[0] != want {
+		t.Errorf("wrong allocations: %v, want [%d]", allocs, want)
+	}
+	if len(frees) != 1 || frees[0] != want {
+		t.Errorf("wrong frees: %v, want [%d]", frees, want)
+	}
+
+	c.SetBufferAllocator(nil, nil)
+	r.Respond(&ReadResponse{Data: data})
+	k.recv()
+	if g, e := len(allocs), 1; g != e {
+		t.Errorf("allocator used after reset: %d != %d", g, e)
+	}
+}
+
+func TestRespondDataLength(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	for _, n := range []int{0, 1, 4096, 64 * 1024} {
+		data := bytes.Repeat([]byte{'x'}, n)
+		r := &ReadRequest{
+			Header: Header{Conn: c, ID: 1},
+			Size:   n,
+		}
+		r.Respond(&ReadResponse{Data: data})
+		hdr, body := k.recv()
+		if g, e := int(hdr.Len), outHeaderSize+n; g != e {
+			t.Errorf("%d bytes: wrong header length: %d != %d", n, g, e)
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("%d bytes: wrong data: got %d bytes", n, len(body))
+		}
+	}
+}
+
+// drain reads and discards everything written to the kernel side
+// until it is closed.
+func (k *testKernel) drain() {
+	buf := make([]byte, bufSize)
+	for {
+		if _, err := k.dev.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// TestRespondDataAllocs guards the allocations of replies with data:
+// the header is marshalled into a reused buffer and written along
+// with the data, so only the outHeader itself is allocated.
+func TestRespondDataAllocs(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	go k.drain()
+	defer k.Close()
+
+	data := make([]byte, 4096)
+	got := testing.AllocsPerRun(100, func() {
+		c.respondData(&outHeader{Unique: 1}, data)
+	})
+	if got > 1 {
+		t.Errorf("%v allocations per reply, want at most 1", got)
+	}
+}
+
+func benchmarkRespondData(b *testing.B, size int) {
+	c, k := newTestConn(b)
+	defer c.Close()
+	go k.drain()
+	defer k.Close()
+
+	data := make([]byte, size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.respondData(&outHeader{Unique: 1}, data)
+	}
+}
+
+func BenchmarkRespondData4K(b *testing.B) {
+	benchmarkRespondData(b, 4096)
+}
+
+func BenchmarkRespondData128K(b *testing.B) {
+	benchmarkRespondData(b, 128*1024)
+}
+
+func TestWriteDataHeldUntilRespond(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	req := k.request(c, opWrite, msg(uint64(3), uint64(0), uint32(len(data)), uint32(0), data)).(*WriteRequest)
+
+	// Reuse read buffers, here and concurrently, as the reading of
+	// further requests would.
+	scribble := func() {
+		for i := 0; i < 100; i++ {
+			buf := c.readBuffer()
+			for j := range buf {
+				buf[j] = 0xff
+			}
+			c.putReadBuffer(buf)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scribble()
+	}()
+	scribble()
+	<-done
+
+	if !bytes.Equal(req.Data, data) {
+		t.Fatalf("write data overwritten before responding")
+	}
+	req.Respond(&WriteResponse{Size: len(req.Data)})
+	hdr, _ := k.recv()
+	if hdr.Error != 0 {
+		t.Errorf("unexpected error: %d", hdr.Error)
+	}
+	if req.buf != nil {
+		t.Errorf("read buffer still held after responding")
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	k.send(opGetattr, 10, 1, nil)
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	var dropped int
+	req.Hdr().OnDrop(func() { dropped++ })
+	req.Hdr().Abandon(ETIMEDOUT)
+	hdr, _ := k.recv()
+	if g, e := hdr.Unique, uint64(10); g != e {
+		t.Errorf("wrong request answered: %d != %d", g, e)
+	}
+	if g, e := hdr.Error, -int32(ETIMEDOUT); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+	// abandoning twice does nothing
+	req.Hdr().Abandon(EIO)
+
+	// the handler finishing late is dropped
+	req.(*GetattrRequest).Respond(&GetattrResponse{})
+	r := &GetattrRequest{Header: Header{Conn: c, ID: 11}}
+	r.RespondError(ENOENT)
+	hdr, _ = k.recv()
+	if g, e := hdr.Unique, uint64(11); g != e {
+		t.Errorf("late response was sent: got %d, want %d", g, e)
+	}
+	if dropped != 1 {
+		t.Errorf("OnDrop called %d times for the dropped response", dropped)
+	}
+
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if g, e := len(c.inflight)+len(c.abandoned), 0; g != e {
+		t.Errorf("requests left behind: %v %v", c.inflight, c.abandoned)
+	}
+}
+
+func TestFailInFlight(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var failed []Request
+	for _, id := range []RequestID{10, 11, 12} {
+		k.send(opGetattr, id, 1, nil)
+		req, err := c.ReadRequest()
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		failed = append(failed, req)
+	}
+	// forgets never get a response
+	k.send(opForget, 13, 1, msg(uint64(1)))
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	req.(*ForgetRequest).Respond()
+	// neither do requests that have already been responded to
+	k.send(opGetattr, 14, 1, nil)
+	req, err = c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	req.RespondError(ENOSYS)
+	k.recv()
+
+	c.FailInFlight(Errno(syscall.EIO))
+	got := map[uint64]bool{}
+	for i := 0; i < 3; i++ {
+		hdr, _ := k.recv()
+		if g, e := hdr.Error, -int32(syscall.EIO); g != e {
+			t.Errorf("wrong error for %d: %d != %d", hdr.Unique, g, e)
+		}
+		got[hdr.Unique] = true
+	}
+	for _, id := range []uint64{10, 11, 12} {
+		if !got[id] {
+			t.Errorf("request %d was not failed", id)
+		}
+	}
+
+	// nothing is left in flight
+	c.FailInFlight(Errno(syscall.EIO))
+	// and the late responses of the failed requests are dropped
+	var short int
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if _, ok := msg.(bugShortKernelWrite); ok {
+			short++
+		}
+	}
+	for _, req := range failed {
+		req.RespondError(ENOSYS)
+	}
+	if short != 0 {
+		t.Errorf("late responses logged as short writes: %d", short)
+	}
+	k.send(opGetattr, 15, 1, nil)
+	req, err = c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	req.RespondError(ENOSYS)
+	if hdr, _ := k.recv(); hdr.Unique != 15 {
+		t.Errorf("unexpected response for %d", hdr.Unique)
+	}
+}
+
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestReadRespondReader(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Size:   4096,
+	}
+	r.RespondReader(strings.NewReader("short file"))
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Errorf("unexpected error: %d", hdr.Error)
+	}
+	if g, e := string(body), "short file"; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+}
+
+func TestReadRespondEOF(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Offset: 1 << 20,
+		Size:   4096,
+	}
+	r.RespondEOF()
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Errorf("unexpected error: %d", hdr.Error)
+	}
+	if int(hdr.Len) != outHeaderSize {
+		t.Errorf("wrong reply length: %d", hdr.Len)
+	}
+	if len(body) != 0 {
+		t.Errorf("expected no data, got %q", body)
+	}
+}
+
+func TestReadRespondReaderMidStreamFailure(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Size:   4096,
+	}
+	src := &failingReader{
+		data: []byte("the first half"),
+		err:  errors.New("backend went away"),
+	}
+	r.RespondReader(src)
+	hdr, body := k.recv()
+	if g, e := hdr.Error, -int32(DefaultErrno); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+	if g, e := len(body), 0; g != e {
+		t.Errorf("partial data reached the kernel: %q", body)
+	}
+
+	r = &ReadRequest{
+		Header: Header{Conn: c, ID: 2},
+		Size:   4096,
+	}
+	src = &failingReader{
+		data: []byte("the first half"),
+		err:  Errno(syscall.ETIMEDOUT),
+	}
+	r.RespondReader(src)
+	hdr, _ = k.recv()
+	if g, e := hdr.Error, -int32(syscall.ETIMEDOUT); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+}
+
+func TestSetCacheTimeouts(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	if _, _, ok := c.CacheTimeouts(os.ModeDir | 0755); ok {
+		t.Error("unexpected cache timeouts before any were set")
+	}
+	c.SetCacheTimeouts(os.ModeDir, 5*time.Second, 2*time.Second)
+	c.SetCacheTimeouts(0, time.Hour, 30*time.Minute)
+
+	entry, attr, ok := c.CacheTimeouts(os.ModeDir | 0755)
+	if !ok {
+		t.Fatal("no cache timeouts for directories")
+	}
+	if g, e := entry, 5*time.Second; g != e {
+		t.Errorf("wrong entry timeout for directory: %v != %v", g, e)
+	}
+	if g, e := attr, 2*time.Second; g != e {
+		t.Errorf("wrong attr timeout for directory: %v != %v", g, e)
+	}
+
+	entry, attr, ok = c.CacheTimeouts(0644)
+	if !ok {
+		t.Fatal("no cache timeouts for files")
+	}
+	if g, e := entry, time.Hour; g != e {
+		t.Errorf("wrong entry timeout for file: %v != %v", g, e)
+	}
+	if g, e := attr, 30*time.Minute; g != e {
+		t.Errorf("wrong attr timeout for file: %v != %v", g, e)
+	}
+
+	if _, _, ok := c.CacheTimeouts(os.ModeSymlink | 0777); ok {
+		t.Error("unexpected cache timeouts for symlinks")
+	}
+}
+
+func TestRespondCacheTimeouts(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.SetCacheTimeouts(os.ModeDir, 5*time.Second, 2*time.Second)
+	c.SetCacheTimeouts(0, time.Hour, 30*time.Minute)
+
+	for _, tc := range []struct {
+		name        string
+		resp        LookupResponse
+		entry, attr uint64
+	}{
+		{"dir", LookupResponse{Attr: Attr{Mode: os.ModeDir | 0755}}, 5, 2},
+		{"file", LookupResponse{Attr: Attr{Mode: 0644}}, 3600, 1800},
+		{"chosen", LookupResponse{EntryValid: time.Minute, Attr: Attr{Mode: 0644}}, 60, 1800},
+		{"uncached", LookupResponse{EntryValid: -1, AttrValid: -1, Attr: Attr{Mode: 0644}}, 0, 0},
+		{"symlink", LookupResponse{Attr: Attr{Mode: os.ModeSymlink | 0777}}, 0, 0},
+	} {
+		r := &LookupRequest{Header: Header{Conn: c, ID: 1}}
+		resp := tc.resp
+		resp.Node = 2
+		resp.Attr.Inode = 2
+		r.Respond(&resp)
+		_, body := k.recv()
+		if g, e := hostOrder.Uint64(body[16:24]), tc.entry; g != e {
+			t.Errorf("%s: wrong entry timeout: %d != %d", tc.name, g, e)
+		}
+		if g, e := hostOrder.Uint64(body[24:32]), tc.attr; g != e {
+			t.Errorf("%s: wrong attr timeout: %d != %d", tc.name, g, e)
+		}
+	}
+
+	r := &GetattrRequest{Header: Header{Conn: c, ID: 2}}
+	r.Respond(&GetattrResponse{Attr: Attr{Inode: 1, Mode: os.ModeDir | 0755}})
+	_, body := k.recv()
+	if g, e := hostOrder.Uint64(body[0:8]), uint64(2); g != e {
+		t.Errorf("wrong getattr attr timeout: %d != %d", g, e)
+	}
+}
+
+func TestOpenRespondPassthrough(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &OpenRequest{Header: Header{Conn: c, ID: 1}}
+	r.Respond(&OpenResponse{
+		Handle:    12,
+		Flags:     OpenPassthrough | OpenKeepCache,
+		BackingID: 3,
+	})
+	_, body := k.recv()
+	if g, e := len(body), 16; g != e {
+		t.Fatalf("wrong reply size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[0:8]), uint64(12); g != e {
+		t.Errorf("wrong handle: %d != %d", g, e)
+	}
+	if g, e := OpenResponseFlags(hostOrder.Uint32(body[8:12])), OpenPassthrough|OpenKeepCache; g != e {
+		t.Errorf("wrong flags: %v != %v", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[12:16]), uint32(3); g != e {
+		t.Errorf("wrong backing id: %d != %d", g, e)
+	}
+
+	// without OpenPassthrough, the backing id is not sent
+	r = &OpenRequest{Header: Header{Conn: c, ID: 2}}
+	r.Respond(&OpenResponse{Handle: 12, BackingID: 3})
+	_, body = k.recv()
+	if g, e := hostOrder.Uint32(body[12:16]), uint32(0); g != e {
+		t.Errorf("backing id sent without passthrough: %d != %d", g, e)
+	}
+}
+
+func TestSetSlowThreshold(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var logged []interface{}
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(slowResponse); ok {
+			logged = append(logged, msg)
+		}
+	}
+
+	c.SetSlowThreshold(10 * time.Millisecond)
+
+	req := k.request(c, opGetattr, nil)
+	req.RespondError(ENOSYS)
+	k.recv()
+	if g, e := len(logged), 0; g != e {
+		t.Fatalf("fast response logged as slow: %v", logged)
+	}
+
+	req = k.request(c, opGetattr, nil)
+	time.Sleep(20 * time.Millisecond)
+	req.RespondError(ENOSYS)
+	k.recv()
+	if g, e := len(logged), 1; g != e {
+		t.Fatalf("wrong number of slow responses logged: %d != %d", g, e)
+	}
+	msg := logged[0].(slowResponse)
+	if g, e := msg.Opcode, "Getattr"; g != e {
+		t.Errorf("wrong opcode: %q != %q", g, e)
+	}
+	if g, e := msg.Pid, uint32(1234); g != e {
+		t.Errorf("wrong pid: %d != %d", g, e)
+	}
+	if msg.Duration < 20*time.Millisecond {
+		t.Errorf("duration too short: %v", msg.Duration)
+	}
+
+	c.SetSlowThreshold(0)
+	req = k.request(c, opGetattr, nil)
+	time.Sleep(20 * time.Millisecond)
+	req.RespondError(ENOSYS)
+	k.recv()
+	if g, e := len(logged), 1; g != e {
+		t.Errorf("slow response logged after disabling: %d != %d", g, e)
+	}
+}
+
+func TestSetCacheWarning(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var logged []uncachedReplies
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(uncachedReplies); ok {
+			logged = append(logged, msg)
+		}
+	}
+
+	lookup := func(valid time.Duration) {
+		req := k.request(c, opLookup, []byte("foo\x00")).(*LookupRequest)
+		req.Respond(&LookupResponse{Node: 8, EntryValid: valid, AttrValid: valid})
+		k.recv()
+	}
+
+	// off by default
+	for i := 0; i < cacheWarnWindow; i++ {
+		lookup(0)
+	}
+	if len(logged) != 0 {
+		t.Fatalf("warning logged while disabled: %v", logged)
+	}
+
+	c.SetCacheWarning(0.5)
+	for i := 0; i < cacheWarnWindow; i++ {
+		lookup(time.Minute)
+	}
+	if len(logged) != 0 {
+		t.Fatalf("warning logged for cached replies: %v", logged)
+	}
+	for i := 0; i < cacheWarnWindow; i++ {
+		if i%10 == 0 {
+			lookup(time.Minute)
+		} else {
+			lookup(0)
+		}
+	}
+	if g, e := len(logged), 1; g != e {
+		t.Fatalf("wrong number of warnings: %d != %d", g, e)
+	}
+	if g, e := logged[0].Uncached, uint64(cacheWarnWindow*9/10); g != e {
+		t.Errorf("wrong uncached count: %d != %d", g, e)
+	}
+
+	st := c.Stats()
+	if g, e := st.EntryReplies, uint64(3*cacheWarnWindow); g != e {
+		t.Errorf("wrong entry replies: %d != %d", g, e)
+	}
+	if g, e := st.UncachedEntries, uint64(cacheWarnWindow+cacheWarnWindow*9/10); g != e {
+		t.Errorf("wrong uncached entries: %d != %d", g, e)
+	}
+	if g, e := st.UncachedAttrs, st.UncachedEntries; g != e {
+		t.Errorf("wrong uncached attrs: %d != %d", g, e)
+	}
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestSlowResponseFakeClock(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	c.nowFunc = clock.Now
+
+	var logged []slowResponse
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(slowResponse); ok {
+			logged = append(logged, msg)
+		}
+	}
+	c.SetSlowThreshold(time.Second)
+
+	req := k.request(c, opGetattr, nil)
+	clock.Advance(1500 * time.Millisecond)
+	req.RespondError(ENOSYS)
+	k.recv()
+	if g, e := len(logged), 1; g != e {
+		t.Fatalf("wrong number of slow responses logged: %d != %d", g, e)
+	}
+	if g, e := logged[0].Duration, 1500*time.Millisecond; g != e {
+		t.Errorf("wrong duration: %v != %v", g, e)
+	}
+
+	// exactly at the threshold is not slow
+	req = k.request(c, opGetattr, nil)
+	clock.Advance(time.Second)
+	req.RespondError(ENOSYS)
+	k.recv()
+	if g, e := len(logged), 1; g != e {
+		t.Errorf("response at the threshold logged as slow: %v", logged[1:])
+	}
+}
+
+func TestCreateRespondValidity(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	for _, tc := range []struct {
+		valid time.Duration
+		sec   uint64
+		nsec  uint32
+	}{
+		{valid: 0},
+		{valid: -1},
+		{valid: -90 * time.Second},
+		{valid: 1500 * time.Millisecond, sec: 1, nsec: 5e8},
+	} {
+		r := &CreateRequest{Header: Header{Conn: c, ID: 1}}
+		resp := &CreateResponse{}
+		resp.Node = 2
+		resp.EntryValid = tc.valid
+		resp.AttrValid = tc.valid
+		r.Respond(resp)
+		_, body := k.recv()
+		if g, e := hostOrder.Uint64(body[16:24]), tc.sec; g != e {
+			t.Errorf("%v: wrong entry validity: %d != %d", tc.valid, g, e)
+		}
+		if g, e := hostOrder.Uint64(body[24:32]), tc.sec; g != e {
+			t.Errorf("%v: wrong attr validity: %d != %d", tc.valid, g, e)
+		}
+		if g, e := hostOrder.Uint32(body[32:36]), tc.nsec; g != e {
+			t.Errorf("%v: wrong entry validity nsec: %d != %d", tc.valid, g, e)
+		}
+		if g, e := hostOrder.Uint32(body[36:40]), tc.nsec; g != e {
+			t.Errorf("%v: wrong attr validity nsec: %d != %d", tc.valid, g, e)
+		}
+	}
+}
+
+func TestOpenRespondDirectIO(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	// FOPEN_DIRECT_IO is bit 0 of the open reply flags, and can
+	// only be set there
+	r := &OpenRequest{Header: Header{Conn: c, ID: 1}}
+	r.Respond(&OpenResponse{Handle: 1, Flags: OpenDirectIO})
+	_, body := k.recv()
+	if g, e := hostOrder.Uint32(body[8:12]), uint32(1<<0); g != e {
+		t.Errorf("wrong open flags: %#x != %#x", g, e)
+	}
+
+	cr := &CreateRequest{Header: Header{Conn: c, ID: 2}}
+	resp := &CreateResponse{}
+	resp.Flags = OpenDirectIO
+	cr.Respond(resp)
+	_, body = k.recv()
+	fl := body[len(body)-8:]
+	if g, e := hostOrder.Uint32(fl[0:4]), uint32(1<<0); g != e {
+		t.Errorf("wrong create flags: %#x != %#x", g, e)
+	}
+}
+
+func TestNodeChecks(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var failed []nodeCheckFailed
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(nodeCheckFailed); ok {
+			failed = append(failed, msg)
+		}
+	}
+	c.SetNodeChecks(true)
+
+	var id RequestID
+	lookup := func(node NodeID, gen uint64) {
+		id++
+		r := &LookupRequest{Header: Header{Conn: c, ID: id}}
+		r.Respond(&LookupResponse{Node: node, Generation: gen})
+		k.recv()
+	}
+	forget := func(node NodeID, n uint64) {
+		id++
+		r := &ForgetRequest{Header: Header{Conn: c, ID: id, Node: node}, N: n}
+		r.Respond()
+	}
+
+	lookup(2, 1)
+	lookup(2, 1)
+	forget(2, 1)
+	// still looked up once, so it's still live
+	lookup(2, 1)
+	forget(2, 2)
+	// forgotten, reused with a new generation
+	lookup(2, 2)
+	if len(failed) != 0 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+
+	// live node changing generation
+	lookup(2, 3)
+	if g, e := len(failed), 1; g != e {
+		t.Fatalf("wrong number of failures: %d != %d: %v", g, e, failed)
+	}
+	if g, e := failed[0].Previous, uint64(2); g != e {
+		t.Errorf("wrong previous generation: %d != %d", g, e)
+	}
+
+	// forgotten node reused with the same generation
+	forget(2, 2)
+	lookup(2, 3)
+	if g, e := len(failed), 2; g != e {
+		t.Fatalf("wrong number of failures: %d != %d: %v", g, e, failed)
+	}
+	if g, e := failed[1].Problem, "forgotten node reused with the same generation"; g != e {
+		t.Errorf("wrong problem: %q != %q", g, e)
+	}
+}
+
+func TestNodeChecksInode(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var failed []inodeCheckFailed
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if msg, ok := msg.(inodeCheckFailed); ok {
+			failed = append(failed, msg)
+		}
+	}
+	c.SetNodeChecks(true)
+
+	var id RequestID
+	lookup := func(node NodeID, inode uint64) {
+		id++
+		r := &LookupRequest{Header: Header{Conn: c, ID: id, Opcode: opLookup}}
+		r.Respond(&LookupResponse{Node: node, Generation: 1, Attr: Attr{Inode: inode}})
+		k.recv()
+	}
+	getattr := func(node NodeID, inode uint64) {
+		id++
+		r := &GetattrRequest{Header: Header{Conn: c, ID: id, Opcode: opGetattr, Node: node}}
+		r.Respond(&GetattrResponse{Attr: Attr{Inode: inode}})
+		k.recv()
+	}
+
+	lookup(2, 100)
+	getattr(2, 100)
+	lookup(2, 100)
+	// the root is never looked up
+	getattr(1, 1)
+	if len(failed) != 0 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+
+	getattr(2, 200)
+	if g, e := len(failed), 1; g != e {
+		t.Fatalf("wrong number of failures: %d != %d: %v", g, e, failed)
+	}
+	if f := failed[0]; f.Node != 2 || f.Inode != 200 || f.Previous != 100 || f.Request != "Getattr" {
+		t.Errorf("wrong failure: %+v", f)
+	}
+
+	// the new inode is remembered, so Lookup now disagrees
+	lookup(2, 100)
+	if g, e := len(failed), 2; g != e {
+		t.Fatalf("wrong number of failures: %d != %d: %v", g, e, failed)
+	}
+	if g, e := failed[1].Request, "Lookup"; g != e {
+		t.Errorf("wrong request: %q != %q", g, e)
+	}
+}
+
+func TestAttrCrtime(t *testing.T) {
+	crtime := time.Unix(1234567890, 123456789)
+	a := &Attr{Crtime: crtime}
+	out := a.attr()
+	got := out.Crtime()
+	if runtime.GOOS != "darwin" {
+		// not in the protocol
+		if !got.IsZero() {
+			t.Errorf("crtime sent on %s: %v", runtime.GOOS, got)
+		}
+		return
+	}
+	if !got.Equal(crtime) {
+		t.Errorf("wrong crtime: %v != %v", got, crtime)
+	}
+}
+
+func TestGetlkRespond(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &GetlkRequest{Header: Header{Conn: c, ID: 1}}
+	r.Respond(&GetlkResponse{
+		Lock: FileLock{Start: 10, End: LockEnd, Type: LockWrite, Pid: 99},
+	})
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	want := msg(uint64(10), uint64(LockEnd), uint32(syscall.F_WRLCK), uint32(99))
+	if !bytes.Equal(body, want) {
+		t.Errorf("wrong lkOut:\n got %x\nwant %x", body, want)
+	}
+}
+
+func TestAppendDirentPlus(t *testing.T) {
+	entries := []DirentPlus{
+		{
+			Dirent: Dirent{Inode: 2, Name: "a", Type: DT_File},
+			Entry: LookupResponse{
+				Node:       5,
+				Generation: 1,
+				EntryValid: 1500 * time.Millisecond,
+				Attr:       Attr{Inode: 2, Size: 42},
+			},
+		},
+		// no lookup; the name is exactly 8 bytes and needs no padding
+		{Dirent: Dirent{Inode: 3, Name: "eightchr", Type: DT_Dir}},
+	}
+	var data []byte
+	for _, e := range entries {
+		data = AppendDirentPlus(data, e)
+	}
+
+	// entry_out is 128 bytes with the 7.9 attributes, dirent 24
+	const recSize = 128 + 24
+	if runtime.GOOS == "linux" {
+		if g, e := int(entryPlusSize), 128; g != e {
+			t.Fatalf("wrong entry_out size: %d != %d", g, e)
+		}
+	}
+	ends := []int{
+		(int(entryPlusSize) + direntSize + 1 + 7) &^ 7,
+	}
+	ends = append(ends, ends[0]+int(entryPlusSize)+direntSize+8)
+	if g, e := len(data), ends[1]; g != e {
+		t.Fatalf("wrong length: %d != %d", g, e)
+	}
+	if runtime.GOOS == "linux" && ends[0] != (recSize+1+7)&^7 {
+		t.Errorf("first record is %d bytes", ends[0])
+	}
+
+	start := 0
+	for i, e := range entries {
+		rec := data[start:ends[i]]
+		if g, e := NodeID(hostOrder.Uint64(rec[0:8])), e.Entry.Node; g != e {
+			t.Errorf("entry %d: wrong node: %v != %v", i, g, e)
+		}
+		de := rec[entryPlusSize:]
+		if g, e := hostOrder.Uint64(de[0:8]), e.Inode; g != e {
+			t.Errorf("entry %d: wrong inode: %d != %d", i, g, e)
+		}
+		if g, e := hostOrder.Uint64(de[8:16]), uint64(ends[i]); g != e {
+			t.Errorf("entry %d: wrong offset: %d != %d", i, g, e)
+		}
+		namelen := int(hostOrder.Uint32(de[16:20]))
+		if g, e := string(de[direntSize:direntSize+namelen]), e.Name; g != e {
+			t.Errorf("entry %d: wrong name: %q != %q", i, g, e)
+		}
+		for _, b := range de[direntSize+namelen:] {
+			if b != 0 {
+				t.Errorf("entry %d: padding is not zero: %x", i, de[direntSize+namelen:])
+				break
+			}
+		}
+		start = ends[i]
+	}
+	if g, e := hostOrder.Uint64(data[16:24]), uint64(1); g != e {
+		t.Errorf("wrong entry_valid: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint32(data[32:36]), uint32(500*time.Millisecond); g != e {
+		t.Errorf("wrong entry_valid_nsec: %d != %d", g, e)
+	}
+}
+
+func TestReadRespondDirentsPlus(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+	c.SetNodeChecks(true)
+
+	attr := Attr{Mode: 0644}
+	entries := []DirentPlus{
+		{Dirent: Dirent{Inode: 1, Name: ".", Type: DT_Dir}, Entry: LookupResponse{Node: 1}},
+		{Dirent: Dirent{Inode: 1, Name: "..", Type: DT_Dir}, Entry: LookupResponse{Node: 1}},
+		{Dirent: Dirent{Inode: 5, Name: "a", Type: DT_File}, Entry: LookupResponse{Node: 5, Generation: 1, Attr: attr}},
+		// name only
+		{Dirent: Dirent{Inode: 9, Name: "b", Type: DT_File}},
+		{Dirent: Dirent{Inode: 6, Name: "c", Type: DT_File}, Entry: LookupResponse{Node: 6, Generation: 1, Attr: attr}},
+	}
+	var all []byte
+	var ends []int
+	for _, e := range entries {
+		all = AppendDirentPlus(all, e)
+		ends = append(ends, len(all))
+	}
+
+	// room for all but the last entry
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1},
+		Dir:    true,
+		Plus:   true,
+		Size:   ends[3],
+	}
+	lookups := r.RespondDirentsPlus(entries)
+	_, body := k.recv()
+	if !bytes.Equal(body, all[:ends[3]]) {
+		t.Errorf("wrong records:\n got %x\nwant %x", body, all[:ends[3]])
+	}
+	if g, e := len(lookups), 1; g != e || lookups[0].Entry.Node != 5 {
+		t.Fatalf("wrong lookups: %+v", lookups)
+	}
+
+	r = &ReadRequest{
+		Header: Header{Conn: c, ID: 2},
+		Dir:    true,
+		Plus:   true,
+		Offset: int64(ends[3]),
+		Size:   4096,
+	}
+	lookups = r.RespondDirentsPlus(entries)
+	_, body = k.recv()
+	if !bytes.Equal(body, all[ends[3]:]) {
+		t.Errorf("wrong records after offset:\n got %x\nwant %x", body, all[ends[3]:])
+	}
+	if g, e := len(lookups), 1; g != e || lookups[0].Entry.Node != 6 {
+		t.Fatalf("wrong lookups after offset: %+v", lookups)
+	}
+
+	// the same bookkeeping as lookups
+	for _, node := range []NodeID{5, 6} {
+		if n := c.nodes.live[node]; n == nil || n.nlookup != 1 {
+			t.Errorf("node %d: wrong lookup count: %+v", node, n)
+		}
+	}
+	if n := c.nodes.live[1]; n != nil {
+		t.Errorf("lookup counted for the directory itself: %+v", n)
+	}
+}
+
+func TestConnUserData(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	if v := c.UserData(); v != nil {
+		t.Fatalf("unexpected user data: %v", v)
+	}
+	type state struct{ name string }
+	s := &state{name: "test"}
+	c.SetUserData(s)
+
+	req := k.request(c, opGetattr, msg(uint32(0), uint32(0), uint64(0)))
+	got, ok := req.Hdr().Conn.UserData().(*state)
+	if !ok || got != s {
+		t.Fatalf("wrong user data: %v", req.Hdr().Conn.UserData())
+	}
+	req.RespondError(ENOENT)
+	k.recv()
+}
+
+func TestGetxtimesRespond(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	req := k.request(c, opGetxtimes, nil)
+	r, ok := req.(*GetxtimesRequest)
+	if !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	bkup := time.Unix(1500000000, 250)
+	crtime := time.Unix(1234567890, 123456789)
+	r.Respond(&GetxtimesResponse{Bkuptime: bkup, Crtime: crtime})
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	if g, e := len(body), 24; g != e {
+		t.Fatalf("wrong body length: %d != %d", g, e)
+	}
+	gotBkup := time.Unix(int64(hostOrder.Uint64(body[0:8])), int64(hostOrder.Uint32(body[16:20])))
+	gotCrtime := time.Unix(int64(hostOrder.Uint64(body[8:16])), int64(hostOrder.Uint32(body[20:24])))
+	if !gotBkup.Equal(bkup) {
+		t.Errorf("wrong bkuptime: %v != %v", gotBkup, bkup)
+	}
+	if !gotCrtime.Equal(crtime) {
+		t.Errorf("wrong crtime: %v != %v", gotCrtime, crtime)
+	}
+}
+
+func TestBmapRespond(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	r := &BmapRequest{
+		Header: Header{Conn: c, ID: 1},
+		Block:  12,
+	}
+	r.Respond(0x123456789)
+	hdr, body := k.recv()
+	if hdr.Error != 0 {
+		t.Fatalf("unexpected error: %d", hdr.Error)
+	}
+	if g, e := len(body), 8; g != e {
+		t.Fatalf("wrong body length: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body), uint64(0x123456789); g != e {
+		t.Errorf("wrong block: %#x != %#x", g, e)
+	}
+}
+
+func TestRespondDeviceGone(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	var gone, short int
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		switch msg.(type) {
+		case deviceGone:
+			gone++
+		case bugShortKernelWrite:
+			short++
+		}
+	}
+
+	req := k.request(c, opGetattr, msg(uint32(0), uint32(0), uint64(0)))
+	k.closeDevice(c)
+	req.RespondError(ENOENT)
+	r := &ReadRequest{Header: Header{Conn: c, ID: 43}}
+	r.Respond(&ReadResponse{Data: []byte("data")})
+	if gone != 1 || short != 0 {
+		t.Errorf("wrong debug events: %d gone, %d short writes", gone, short)
+	}
+
+	// Even with a request waiting, the connection is done.
+	k.send(opGetattr, 44, 7, msg(uint32(0), uint32(0), uint64(0)))
+	if _, err := c.ReadRequest(); err != io.EOF {
+		t.Fatalf("expected io.EOF after the device went away, got %v", err)
+	}
+}
+
+func TestWriteFailedErrors(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		gone bool
+	}{
+		{nil, false},
+		// the kernel answers ENODEV once the connection is aborted
+		{syscall.ENODEV, true},
+		{syscall.EBADF, true},
+		// a response to a request the kernel no longer knows
+		{syscall.ENOENT, false},
+		{syscall.EINVAL, false},
+	} {
+		c := &Conn{}
+		if g, e := c.writeFailed(tt.err), tt.gone; g != e {
+			t.Errorf("%v: wrong writeFailed: %v != %v", tt.err, g, e)
+		}
+	}
+}
+
+func TestReadRespondSendfileBookkeeping(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.addInFlight(1)
+	r := &ReadRequest{
+		Header: Header{Conn: c, ID: 1, buf: holdBuffer(c.getBuffer())},
+		Size:   16,
+	}
+	// neither splicing nor reading work on a bad descriptor
+	r.RespondSendfile(-1, 0)
+	hdr, _ := k.recv()
+	if g, e := hdr.Error, -int32(syscall.EBADF); g != e {
+		t.Errorf("wrong error: %d != %d", g, e)
+	}
+	if r.buf != nil {
+		t.Error("read buffer not released")
+	}
+	if n := len(c.inflight); n != 0 {
+		t.Errorf("%d requests still in flight", n)
+	}
+
+	// nothing else was sent for it
+	(&Header{Conn: c, ID: 2}).RespondError(ENOENT)
+	if hdr, _ := k.recv(); hdr.Unique != 2 {
+		t.Errorf("unexpected response for %d", hdr.Unique)
+	}
+}
@@ -0,0 +1,83 @@
+package fuse
+
+import (
+	"fmt"
+)
+
+// NotifyRetrieve asks the kernel for the contents of its page cache
+// for node, size bytes starting at offset. The kernel answers with a
+// message of its own, which ReadRequest consumes and delivers on the
+// returned channel; id identifies the retrieval in debug logs.
+//
+// The kernel returns only the data it has cached, contiguous from
+// offset and stopping at the first page missing from its cache, so
+// the data may be shorter than size, or empty. ReadRequest must keep
+// being called for the answer to arrive; once the notification has
+// been accepted, the kernel always answers, exactly once, unless the
+// connection ends first. The channel is then closed without a value,
+// which ReadRequest does when it returns io.EOF, so a receive that
+// reports a closed channel means there will be no answer.
+//
+// Returns ErrNotCached if the kernel does not know node, and
+// ErrNotSupported if the kernel is older than protocol 7.15.
+func (c *Conn) NotifyRetrieve(node NodeID, offset int64, size uint32) (id uint64, data <-chan []byte, err error) {
+	if c.kernel.LT(Protocol{7, 15}) {
+		return 0, nil, ErrNotSupported
+	}
+	ch := make(chan []byte, 1)
+	c.retrieveMu.Lock()
+	c.retrieveID++
+	id = c.retrieveID
+	if c.retrieves == nil {
+		c.retrieves = make(map[uint64]chan []byte)
+	}
+	c.retrieves[id] = ch
+	c.retrieveMu.Unlock()
+
+	out := &notifyRetrieveOut{
+		NotifyUnique: id,
+		Nodeid:       uint64(node),
+		Offset:       uint64(offset),
+		Size:         size,
+	}
+	if err := c.notify(notifyRetrieve, out, nil); err != nil {
+		c.retrieveMu.Lock()
+		delete(c.retrieves, id)
+		c.retrieveMu.Unlock()
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+// retrieved delivers the kernel's answer to retrieval id. data is
+// copied, as it points into the read buffer.
+func (c *Conn) retrieved(id uint64, data []byte) {
+	c.retrieveMu.Lock()
+	ch, ok := c.retrieves[id]
+	delete(c.retrieves, id)
+	c.retrieveMu.Unlock()
+	if !ok {
+		Debug(unknownRetrieve{ID: id})
+		return
+	}
+	ch <- append([]byte(nil), data...)
+}
+
+// endRetrieves closes the channels of the retrievals still waiting
+// for the kernel, once the connection has ended.
+func (c *Conn) endRetrieves() {
+	c.retrieveMu.Lock()
+	defer c.retrieveMu.Unlock()
+	for id, ch := range c.retrieves {
+		close(ch)
+		delete(c.retrieves, id)
+	}
+}
+
+type unknownRetrieve struct {
+	ID uint64
+}
+
+func (u unknownRetrieve) String() string {
+	return fmt.Sprintf("notify reply for unknown retrieve %d", u.ID)
+}
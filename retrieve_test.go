@@ -0,0 +1,93 @@
+package fuse
+
+import (
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestNotifyRetrieve(t *testing.T) {
+	c, k := newTestConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	c.kernel = Protocol{7, 14}
+	if _, _, err := c.NotifyRetrieve(5, 0, 4096); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported from an old kernel, got %v", err)
+	}
+
+	c.kernel = Protocol{7, 15}
+	id, data, err := c.NotifyRetrieve(5, 8192, 4096)
+	if err != nil {
+		t.Fatalf("NotifyRetrieve: %v", err)
+	}
+	hdr, body := k.recv()
+	if g, e := hdr.Error, int32(notifyRetrieve); g != e {
+		t.Errorf("wrong notify code: %d != %d", g, e)
+	}
+	if g, e := len(body), 32; g != e {
+		t.Fatalf("wrong body size: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[0:8]), id; g != e {
+		t.Errorf("wrong notify unique: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[8:16]), uint64(5); g != e {
+		t.Errorf("wrong node: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint64(body[16:24]), uint64(8192); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := hostOrder.Uint32(body[24:28]), uint32(4096); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+
+	// the kernel had only part of the range cached
+	k.send(opNotifyReply, RequestID(id), 5, msg(
+		uint64(0),                       // dummy
+		uint64(8192),                    // offset
+		uint32(5),                       // size
+		uint32(0), uint64(0), uint64(0), // dummies
+		"hello",
+	))
+	// the reply is consumed, and the next request returned
+	req := k.request(c, opGetattr, nil)
+	if _, ok := req.(*GetattrRequest); !ok {
+		t.Fatalf("wrong request type: %T", req)
+	}
+	select {
+	case d := <-data:
+		if g, e := string(d), "hello"; g != e {
+			t.Errorf("wrong data: %q != %q", g, e)
+		}
+	default:
+		t.Fatal("retrieved data was not delivered")
+	}
+}
+
+func TestNotifyRetrieveConnectionEnds(t *testing.T) {
+	c, k := newTestConnType(t, syscall.SOCK_SEQPACKET)
+	defer c.Close()
+
+	c.kernel = Protocol{7, 15}
+	_, data, err := c.NotifyRetrieve(5, 0, 4096)
+	if err != nil {
+		t.Fatalf("NotifyRetrieve: %v", err)
+	}
+	k.recv()
+	// unmounted before the kernel answered
+	k.Close()
+	if _, err := c.ReadRequest(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	select {
+	case d, ok := <-data:
+		if ok {
+			t.Errorf("unexpected data: %q", d)
+		}
+	default:
+		t.Fatal("channel was not closed")
+	}
+	if n := len(c.retrieves); n != 0 {
+		t.Errorf("%d retrievals still pending", n)
+	}
+}
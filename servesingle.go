@@ -0,0 +1,54 @@
+package fuse
+
+import "io"
+
+// Number of requests ServeSingle reads ahead of its handler. Every
+// one of them holds a read buffer.
+const serveSingleQueueLen = 16
+
+// ServeSingle reads requests from c and passes them to handler one at
+// a time, in the calling goroutine, until the file system is
+// unmounted. It suits simple servers whose handlers are quick and do
+// not wait on each other; a handler that blocks holds up every other
+// request. Servers that want concurrency should use their own read
+// loop, as package fs does.
+//
+// ServeSingle starts one goroutine that keeps reading requests while
+// handler runs, so that interrupts reach the request being handled:
+// handler should watch the request's Context and respond with EINTR
+// once it is cancelled. InterruptRequests themselves are not passed to
+// handler. Up to serveSingleQueueLen (16) requests read meanwhile wait
+// their turn; once that many are waiting, reading stops until handler
+// catches up, and interrupts are only seen after that.
+//
+// handler must respond to every request it is given. ServeSingle
+// returns nil once the kernel has closed the connection, and the
+// error of ReadRequest otherwise.
+func (c *Conn) ServeSingle(handler func(Request)) error {
+	reqs := make(chan Request, serveSingleQueueLen)
+	var err error
+	go func() {
+		defer close(reqs)
+		for {
+			var req Request
+			req, err = c.ReadRequest()
+			if err != nil {
+				return
+			}
+			if _, ok := req.(*InterruptRequest); ok {
+				// ReadRequest already cancelled the context of
+				// the interrupted request
+				continue
+			}
+			reqs <- req
+		}
+	}()
+
+	for req := range reqs {
+		handler(req)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeSingle(t *testing.T) {
+	c, k := newTestConnType(t, syscall.SOCK_SEQPACKET)
+	defer c.Close()
+
+	var ops []string
+	served := make(chan error, 1)
+	go func() {
+		served <- c.ServeSingle(func(req Request) {
+			ops = append(ops, req.OpName())
+			switch req.(type) {
+			case *ReadRequest:
+				// waits for the interrupt, which is read while
+				// the handler runs
+				select {
+				case <-req.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				req.RespondError(EINTR)
+			default:
+				req.RespondError(ENOSYS)
+			}
+		})
+	}()
+
+	k.send(opRead, 42, 7, benchReadBody)
+	k.send(opInterrupt, 43, 0, msg(uint64(42)))
+	k.send(opGetattr, 44, 7, nil)
+	hdr, _ := k.recv()
+	if hdr.Unique != 42 || hdr.Error != -int32(EINTR) {
+		t.Errorf("read not interrupted: %+v", hdr)
+	}
+	hdr, _ = k.recv()
+	if hdr.Unique != 44 || hdr.Error != -int32(ENOSYS) {
+		t.Errorf("wrong reply to getattr: %+v", hdr)
+	}
+
+	k.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeSingle: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeSingle did not return after the kernel closed the connection")
+	}
+	if g, e := len(ops), 2; g != e {
+		t.Errorf("wrong number of requests handled: %v", ops)
+	}
+}
+
+func TestServeSingleQueueBound(t *testing.T) {
+	c, k := newTestConnType(t, syscall.SOCK_SEQPACKET)
+	defer c.Close()
+
+	release := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- c.ServeSingle(func(req Request) {
+			<-release
+			req.RespondError(ENOSYS)
+		})
+	}()
+
+	const sent = 1 + serveSingleQueueLen + 10
+	for id := RequestID(1); id <= sent; id++ {
+		k.send(opGetattr, id, 7, nil)
+	}
+	inflight := func() int {
+		c.inflightMu.Lock()
+		defer c.inflightMu.Unlock()
+		return len(c.inflight)
+	}
+	// one being handled, the queue, and one the reader holds
+	const read = 1 + serveSingleQueueLen + 1
+	deadline := time.Now().Add(5 * time.Second)
+	for inflight() < read && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if g, e := inflight(), read; g != e {
+		t.Errorf("wrong number of requests read ahead: %d != %d", g, e)
+	}
+
+	close(release)
+	for i := 0; i < sent; i++ {
+		k.recv()
+	}
+	k.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeSingle: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeSingle did not return after the kernel closed the connection")
+	}
+}
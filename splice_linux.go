@@ -0,0 +1,100 @@
+package fuse
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+)
+
+// respondSplice writes the reply header out followed by up to size
+// bytes of fd at off, moving the data through pipes instead of
+// copying it to userspace. The FUSE device wants each reply in a
+// single write, so the header and data are assembled in one pipe and
+// spliced to the device together.
+//
+// Errors returned mean nothing was written to the device.
+func (c *Conn) respondSplice(out outMessage, fd int, off int64, size int) error {
+	data, err := newPipe(size)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	total := 0
+	for total < size {
+		m, err := syscall.Splice(fd, &off, data[1], nil, size-total, spliceMove|spliceNonblock)
+		if err != nil {
+			return err
+		}
+		if m == 0 {
+			// EOF
+			break
+		}
+		total += int(m)
+	}
+
+	hdr := out.marshal(nil)
+	msg, err := newPipe(len(hdr) + total)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+	out.header().Len = uint32(len(hdr) + total)
+	hostOrder.PutUint32(hdr[0:4], out.header().Len)
+	if _, err := syscall.Write(msg[1], hdr); err != nil {
+		return err
+	}
+	for moved := 0; moved < total; {
+		m, err := syscall.Splice(data[0], nil, msg[1], nil, total-moved, spliceMove|spliceNonblock)
+		if err != nil {
+			return err
+		}
+		moved += int(m)
+	}
+
+	noteMax(&c.stats.maxResponseSize, uint64(out.header().Len))
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	if atomic.LoadUint32(&c.gone) != 0 {
+		return nil
+	}
+	nn, err := syscall.Splice(msg[0], nil, c.fd(), nil, int(out.header().Len), spliceMove)
+	if c.writeFailed(err) {
+		return nil
+	}
+	if int64(nn) != int64(out.header().Len) || err != nil {
+		Debug(bugShortKernelWrite{
+			Written: int64(nn),
+			Length:  int64(out.header().Len),
+			Error:   errorString(err),
+			Stack:   stack(),
+		})
+	}
+	return nil
+}
+
+type pipe [2]int
+
+// newPipe returns a pipe that can hold at least size bytes, so that
+// splicing into it never blocks.
+func newPipe(size int) (pipe, error) {
+	var p pipe
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return p, err
+	}
+	if size > syscall.Getpagesize() {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p[0]), syscall.F_SETPIPE_SZ, uintptr(size)); errno != 0 {
+			p.Close()
+			return p, errno
+		}
+	}
+	return p, nil
+}
+
+func (p pipe) Close() {
+	syscall.Close(p[0])
+	syscall.Close(p[1])
+}
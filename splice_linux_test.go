@@ -0,0 +1,143 @@
+package fuse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func tempFile(t testing.TB, data []byte) *os.File {
+	f, err := ioutil.TempFile("", "fuse-splice-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// newPipeConn is like newTestConn, but connects the Conn and the
+// testKernel with a pipe. Splicing to a datagram socket can split a
+// reply into several messages, which the FUSE device never does. The
+// pipe is large enough to hold a whole reply, and the kernel side only
+// reads one reply at a time.
+func newPipeConn(t testing.TB) (*Conn, *testKernel) {
+	p, err := newPipe(bufSize)
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	c := &Conn{
+		dev: os.NewFile(uintptr(p[1]), "fuse-test-conn"),
+	}
+	k := &testKernel{
+		t:   t,
+		dev: os.NewFile(uintptr(p[0]), "fuse-test-kernel"),
+	}
+	return c, k
+}
+
+func TestReadRespondSendfile(t *testing.T) {
+	c, k := newPipeConn(t)
+	defer c.Close()
+	defer k.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16384)
+	f := tempFile(t, data)
+	defer f.Close()
+
+	for _, tc := range []struct {
+		off  int64
+		size int
+		want []byte
+	}{
+		{0, 4096, data[:4096]},
+		{100, 64 * 1024, data[100 : 100+64*1024]},
+		// short read at the end of the file
+		{int64(len(data)) - 10, 4096, data[len(data)-10:]},
+		{int64(len(data)) + 10, 4096, nil},
+	} {
+		r := &ReadRequest{
+			Header: Header{Conn: c, ID: 1},
+			Size:   tc.size,
+		}
+		r.RespondSendfile(int(f.Fd()), tc.off)
+		hdr, body := k.recv()
+		if hdr.Error != 0 {
+			t.Errorf("@%d: unexpected error: %d", tc.off, hdr.Error)
+		}
+		if !bytes.Equal(body, tc.want) {
+			t.Errorf("@%d: wrong data: %d bytes, want %d", tc.off, len(body), len(tc.want))
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, respond func(r *ReadRequest, f *os.File)) {
+	c, k := newPipeConn(b)
+	defer c.Close()
+	defer k.Close()
+
+	const size = 64 * 1024
+	f := tempFile(b, make([]byte, size))
+	defer f.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &ReadRequest{
+			Header: Header{Conn: c, ID: 1},
+			Size:   size,
+		}
+		respond(r, f)
+		k.recv()
+	}
+}
+
+func BenchmarkReadRespondSendfile(b *testing.B) {
+	benchmarkRead(b, func(r *ReadRequest, f *os.File) {
+		r.RespondSendfile(int(f.Fd()), 0)
+	})
+}
+
+func BenchmarkReadRespondCopy(b *testing.B) {
+	benchmarkRead(b, func(r *ReadRequest, f *os.File) {
+		buf := make([]byte, r.Size)
+		n, _ := f.ReadAt(buf, 0)
+		r.Respond(&ReadResponse{Data: buf[:n]})
+	})
+}
+
+func TestRespondSendfileDeviceGone(t *testing.T) {
+	p, err := newPipe(bufSize)
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	syscall.Close(p[1])
+	// Writing to the read end fails with EBADF, like a device the
+	// kernel has closed.
+	c := &Conn{dev: os.NewFile(uintptr(p[0]), "fuse-test-conn")}
+	defer c.Close()
+
+	var gone int
+	defer func(old func(interface{})) { Debug = old }(Debug)
+	Debug = func(msg interface{}) {
+		if _, ok := msg.(deviceGone); ok {
+			gone++
+		}
+	}
+
+	f := tempFile(t, []byte("data"))
+	defer f.Close()
+	r := &ReadRequest{Header: Header{Conn: c, ID: 1}, Size: 4}
+	r.RespondSendfile(int(f.Fd()), 0)
+	if gone != 1 {
+		t.Errorf("wrong number of deviceGone events: %d", gone)
+	}
+	if _, err := c.ReadRequest(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package fuse
+
+import (
+	"errors"
+)
+
+func (c *Conn) respondSplice(out outMessage, fd int, off int64, size int) error {
+	return errors.New("fuse: splice is not supported")
+}
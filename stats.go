@@ -0,0 +1,139 @@
+package fuse
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters kept by a Conn.
+type Stats struct {
+	// Number of InterruptRequests read from the kernel, including
+	// dropped ones.
+	Interrupts uint64
+	// Number of InterruptRequests dropped as duplicates, see
+	// SetInterruptDedup.
+	DroppedInterrupts uint64
+
+	// Sizes in bytes of the largest request read from the kernel and
+	// of the largest response sent, headers included. They show how
+	// close the traffic comes to MaxWrite and the buffer sizes.
+	MaxRequestSize  uint64
+	MaxResponseSize uint64
+
+	// Number of replies carrying a directory entry, such as those to
+	// lookup and create, and how many of them did not let the kernel
+	// cache the entry at all.
+	EntryReplies    uint64
+	UncachedEntries uint64
+	// Number of replies carrying attributes, entry replies included,
+	// and how many of them did not let the kernel cache the
+	// attributes at all.
+	AttrReplies   uint64
+	UncachedAttrs uint64
+}
+
+// connStats holds the counters behind Stats. Accessed atomically.
+type connStats struct {
+	interrupts        uint64
+	droppedInterrupts uint64
+	maxRequestSize    uint64
+	maxResponseSize   uint64
+	entryReplies      uint64
+	uncachedEntries   uint64
+	attrReplies       uint64
+	uncachedAttrs     uint64
+
+	// Replies counted towards the next SetCacheWarning check, and
+	// how many of them were uncached.
+	windowReplies  uint64
+	windowUncached uint64
+}
+
+// noteMax raises the high-water mark at p to n.
+func noteMax(p *uint64, n uint64) {
+	for {
+		old := atomic.LoadUint64(p)
+		if n <= old || atomic.CompareAndSwapUint64(p, old, n) {
+			return
+		}
+	}
+}
+
+// Stats returns the current values of the counters kept by c.
+func (c *Conn) Stats() Stats {
+	return Stats{
+		Interrupts:        atomic.LoadUint64(&c.stats.interrupts),
+		DroppedInterrupts: atomic.LoadUint64(&c.stats.droppedInterrupts),
+		MaxRequestSize:    atomic.LoadUint64(&c.stats.maxRequestSize),
+		MaxResponseSize:   atomic.LoadUint64(&c.stats.maxResponseSize),
+		EntryReplies:      atomic.LoadUint64(&c.stats.entryReplies),
+		UncachedEntries:   atomic.LoadUint64(&c.stats.uncachedEntries),
+		AttrReplies:       atomic.LoadUint64(&c.stats.attrReplies),
+		UncachedAttrs:     atomic.LoadUint64(&c.stats.uncachedAttrs),
+	}
+}
+
+// cacheWarnWindow is how many entry and attr replies are looked at
+// for each SetCacheWarning check.
+const cacheWarnWindow = 1000
+
+// SetCacheWarning makes the connection log, through Debug, a warning
+// whenever more than frac of the recent entry and attr replies let
+// the kernel cache nothing. Zero timeouts make the kernel ask again
+// for every path walk and stat, which is easy to miss and costly. A
+// zero frac, the default, disables the warning.
+func (c *Conn) SetCacheWarning(frac float64) {
+	atomic.StoreUint64(&c.cacheWarn, math.Float64bits(frac))
+}
+
+// noteValidity counts the cache timeouts sent in out, if it is an
+// entry or attr reply.
+func (c *Conn) noteValidity(out outMessage) {
+	uncached := false
+	switch out := out.(type) {
+	case *entryOut:
+		atomic.AddUint64(&c.stats.entryReplies, 1)
+		atomic.AddUint64(&c.stats.attrReplies, 1)
+		if out.EntryValid == 0 && out.EntryValidNsec == 0 {
+			atomic.AddUint64(&c.stats.uncachedEntries, 1)
+			uncached = true
+		}
+		if out.AttrValid == 0 && out.AttrValidNsec == 0 {
+			atomic.AddUint64(&c.stats.uncachedAttrs, 1)
+			uncached = true
+		}
+	case *attrOut:
+		atomic.AddUint64(&c.stats.attrReplies, 1)
+		if out.AttrValid == 0 && out.AttrValidNsec == 0 {
+			atomic.AddUint64(&c.stats.uncachedAttrs, 1)
+			uncached = true
+		}
+	default:
+		return
+	}
+
+	frac := math.Float64frombits(atomic.LoadUint64(&c.cacheWarn))
+	if frac <= 0 {
+		return
+	}
+	if uncached {
+		atomic.AddUint64(&c.stats.windowUncached, 1)
+	}
+	if atomic.AddUint64(&c.stats.windowReplies, 1)%cacheWarnWindow != 0 {
+		return
+	}
+	n := atomic.SwapUint64(&c.stats.windowUncached, 0)
+	if float64(n) > frac*cacheWarnWindow {
+		Debug(uncachedReplies{Uncached: n, Replies: cacheWarnWindow})
+	}
+}
+
+type uncachedReplies struct {
+	Uncached uint64
+	Replies  uint64
+}
+
+func (u uncachedReplies) String() string {
+	return fmt.Sprintf("%d of the last %d entry and attr replies had zero cache timeouts", u.Uncached, u.Replies)
+}
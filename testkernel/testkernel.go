@@ -0,0 +1,446 @@
+// Package testkernel plays the part of the kernel for a FUSE server,
+// so that file systems can be tested without mounting them.
+//
+// A Session sends real FUSE messages to the Conn it was created
+// with, and decodes the replies:
+//
+//	s, c, err := testkernel.New()
+//	...
+//	go fs.Serve(c, myFS, nil)
+//	if _, err := s.Init(); err != nil { ... }
+//	e, err := s.Lookup(testkernel.RootID, "hello")
+//
+// Requests are sent one at a time, so the server sees them in order.
+package testkernel // import "github.com/bpowers/fuse/testkernel"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/bpowers/fuse"
+)
+
+// hostOrder is the byte order of FUSE messages, that of the host.
+var hostOrder = nativeOrder()
+
+func nativeOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// RootID is the node ID of the root of the file system.
+const RootID fuse.NodeID = 1
+
+// Opcodes of the requests sent by Session.
+const (
+	opLookup     = 1
+	opForget     = 2
+	opGetattr    = 3
+	opOpen       = 14
+	opRead       = 15
+	opWrite      = 16
+	opRelease    = 18
+	opGetxattr   = 22
+	opListxattr  = 23
+	opFlush      = 25
+	opInit       = 26
+	opOpendir    = 27
+	opReaddir    = 28
+	opReleasedir = 29
+)
+
+// The protocol version the session claims to speak.
+const (
+	kernelVersion      = 7
+	kernelMinorVersion = 8
+)
+
+const (
+	inHeaderSize  = 40
+	outHeaderSize = 16
+)
+
+// Credentials sent with requests, unless changed with SetCaller.
+const (
+	Uid = 1000
+	Gid = 1000
+	Pid = 4242
+)
+
+// ErrShortReply is returned when a reply is too short for the request
+// it answers.
+var ErrShortReply = errors.New("testkernel: short reply")
+
+// A Session is the kernel side of a FUSE connection.
+type Session struct {
+	mu   sync.Mutex
+	dev  *os.File
+	next uint64
+	buf  []byte
+
+	// credentials of the caller, see SetCaller
+	uid, gid, pid uint32
+}
+
+// New returns a new Session, and the Conn the file system server
+// under test should serve.
+func New() (*Session, *fuse.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("socketpair: %v", err)
+	}
+	s := &Session{
+		dev: os.NewFile(uintptr(fds[1]), "testkernel"),
+		buf: make([]byte, 1<<20),
+		uid: Uid,
+		gid: Gid,
+		pid: Pid,
+	}
+	c := fuse.NewConn(os.NewFile(uintptr(fds[0]), "testkernel-conn"))
+	return s, c, nil
+}
+
+// Close closes the kernel side of the connection. The server sees
+// this as the file system being unmounted.
+func (s *Session) Close() error {
+	return s.dev.Close()
+}
+
+// Reconnect moves the session to a new connection, and hands the
+// server's end of it to c with Conn.Reconnect. The old connection is
+// closed.
+func (s *Session) Reconnect(c *fuse.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return fmt.Errorf("socketpair: %v", err)
+	}
+	if err := c.Reconnect(fds[0]); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return err
+	}
+	old := s.dev
+	s.dev = os.NewFile(uintptr(fds[1]), "testkernel")
+	return old.Close()
+}
+
+// SetCaller sets the credentials of the process that the following
+// requests are made on behalf of.
+func (s *Session) SetCaller(uid, gid, pid uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uid, s.gid, s.pid = uid, gid, pid
+}
+
+// Call sends a request with the given opcode about node, and returns
+// the body of the reply. An error reply is returned as a fuse.Errno.
+func (s *Session) Call(opcode uint32, node fuse.NodeID, body []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := s.send(opcode, node, body)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := s.dev.Read(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	reply := s.buf[:n]
+	if n < outHeaderSize {
+		return nil, ErrShortReply
+	}
+	if l := hostOrder.Uint32(reply[0:4]); l != uint32(n) {
+		return nil, fmt.Errorf("testkernel: reply length %d in header, read %d", l, n)
+	}
+	errno := int32(hostOrder.Uint32(reply[4:8]))
+	if unique := hostOrder.Uint64(reply[8:16]); unique != id {
+		return nil, fmt.Errorf("testkernel: reply to %d, expected %d", unique, id)
+	}
+	if errno != 0 {
+		return nil, fuse.Errno(-errno)
+	}
+	return append([]byte(nil), reply[outHeaderSize:]...), nil
+}
+
+// Send sends a request that gets no reply, such as a forget.
+func (s *Session) Send(opcode uint32, node fuse.NodeID, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.send(opcode, node, body)
+	return err
+}
+
+// caller must hold mu
+func (s *Session) send(opcode uint32, node fuse.NodeID, body []byte) (id uint64, err error) {
+	s.next++
+	id = s.next
+	var msg bytes.Buffer
+	write(&msg,
+		uint32(inHeaderSize+len(body)),
+		opcode,
+		id,
+		uint64(node),
+		s.uid,
+		s.gid,
+		s.pid,
+		uint32(0),
+	)
+	msg.Write(body)
+	if _, err := s.dev.Write(msg.Bytes()); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func write(buf *bytes.Buffer, data ...interface{}) {
+	for _, d := range data {
+		if err := binary.Write(buf, hostOrder, d); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Init performs the INIT exchange that starts every session, and
+// returns the protocol version chosen by the server.
+func (s *Session) Init() (fuse.Protocol, error) {
+	var body bytes.Buffer
+	write(&body,
+		uint32(kernelVersion),
+		uint32(kernelMinorVersion),
+		uint32(128*1024), // max readahead
+		uint32(0),        // flags
+	)
+	reply, err := s.Call(opInit, 0, body.Bytes())
+	if err != nil {
+		return fuse.Protocol{}, err
+	}
+	if len(reply) < 8 {
+		return fuse.Protocol{}, ErrShortReply
+	}
+	return fuse.Protocol{
+		Major: hostOrder.Uint32(reply[0:4]),
+		Minor: hostOrder.Uint32(reply[4:8]),
+	}, nil
+}
+
+// An Entry is the reply to a Lookup.
+type Entry struct {
+	Node       fuse.NodeID
+	Generation uint64
+	EntryValid time.Duration
+	AttrValid  time.Duration
+	// The leading attributes, common to all platforms.
+	Inode uint64
+	Size  uint64
+}
+
+// Lookup looks up name in the directory parent.
+func (s *Session) Lookup(parent fuse.NodeID, name string) (*Entry, error) {
+	reply, err := s.Call(opLookup, parent, append([]byte(name), 0))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 56 {
+		return nil, ErrShortReply
+	}
+	e := &Entry{
+		Node:       fuse.NodeID(hostOrder.Uint64(reply[0:8])),
+		Generation: hostOrder.Uint64(reply[8:16]),
+		EntryValid: duration(hostOrder.Uint64(reply[16:24]), hostOrder.Uint32(reply[32:36])),
+		AttrValid:  duration(hostOrder.Uint64(reply[24:32]), hostOrder.Uint32(reply[36:40])),
+		Inode:      hostOrder.Uint64(reply[40:48]),
+		Size:       hostOrder.Uint64(reply[48:56]),
+	}
+	return e, nil
+}
+
+func duration(sec uint64, nsec uint32) time.Duration {
+	return time.Duration(sec)*time.Second + time.Duration(nsec)
+}
+
+// Forget tells the server that the kernel dropped n lookups of node.
+// There is no reply.
+func (s *Session) Forget(node fuse.NodeID, n uint64) error {
+	var body bytes.Buffer
+	write(&body, n)
+	return s.Send(opForget, node, body.Bytes())
+}
+
+// Attr is the reply to a Getattr.
+type Attr struct {
+	Valid time.Duration
+	// The leading attributes, common to all platforms.
+	Inode uint64
+	Size  uint64
+}
+
+// Getattr asks for the attributes of node.
+func (s *Session) Getattr(node fuse.NodeID) (*Attr, error) {
+	reply, err := s.Call(opGetattr, node, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 32 {
+		return nil, ErrShortReply
+	}
+	a := &Attr{
+		Valid: duration(hostOrder.Uint64(reply[0:8]), hostOrder.Uint32(reply[8:12])),
+		Inode: hostOrder.Uint64(reply[16:24]),
+		Size:  hostOrder.Uint64(reply[24:32]),
+	}
+	return a, nil
+}
+
+// Open opens node with the given flags, and returns the handle chosen
+// by the server.
+func (s *Session) Open(node fuse.NodeID, flags fuse.OpenFlags) (fuse.HandleID, error) {
+	var body bytes.Buffer
+	write(&body, uint32(flags), uint32(0))
+	reply, err := s.Call(opOpen, node, body.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 16 {
+		return 0, ErrShortReply
+	}
+	return fuse.HandleID(hostOrder.Uint64(reply[0:8])), nil
+}
+
+// Read reads up to size bytes at offset from an open handle.
+func (s *Session) Read(node fuse.NodeID, handle fuse.HandleID, offset int64, size int) ([]byte, error) {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint64(offset), uint32(size), uint32(0))
+	return s.Call(opRead, node, body.Bytes())
+}
+
+// Write writes data at offset to an open handle, and returns the
+// number of bytes the server reports as written.
+func (s *Session) Write(node fuse.NodeID, handle fuse.HandleID, offset int64, data []byte) (int, error) {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint64(offset), uint32(len(data)), uint32(0))
+	body.Write(data)
+	reply, err := s.Call(opWrite, node, body.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 8 {
+		return 0, ErrShortReply
+	}
+	return int(hostOrder.Uint32(reply[0:4])), nil
+}
+
+// Flush flushes an open handle, as on close(2) of a file descriptor.
+func (s *Session) Flush(node fuse.NodeID, handle fuse.HandleID) error {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint32(0), uint32(0), uint64(0))
+	_, err := s.Call(opFlush, node, body.Bytes())
+	return err
+}
+
+// Release closes an open handle.
+func (s *Session) Release(node fuse.NodeID, handle fuse.HandleID, flags fuse.OpenFlags) error {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint32(flags), uint32(0), uint64(0))
+	_, err := s.Call(opRelease, node, body.Bytes())
+	return err
+}
+
+// Opendir opens the directory node, and returns the handle chosen by
+// the server.
+func (s *Session) Opendir(node fuse.NodeID) (fuse.HandleID, error) {
+	var body bytes.Buffer
+	write(&body, uint32(fuse.OpenReadOnly|fuse.OpenFlags(syscall.O_DIRECTORY)), uint32(0))
+	reply, err := s.Call(opOpendir, node, body.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 16 {
+		return 0, ErrShortReply
+	}
+	return fuse.HandleID(hostOrder.Uint64(reply[0:8])), nil
+}
+
+// A Dirent is a directory entry returned by Readdir.
+type Dirent struct {
+	Inode uint64
+	// Offset of the next entry.
+	Offset int64
+	Type   fuse.DirentType
+	Name   string
+}
+
+// Readdir reads the entries of an open directory, starting at offset,
+// in a reply of up to size bytes. An empty result means the end of the
+// directory.
+func (s *Session) Readdir(node fuse.NodeID, handle fuse.HandleID, offset int64, size int) ([]Dirent, error) {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint64(offset), uint32(size), uint32(0))
+	reply, err := s.Call(opReaddir, node, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var dirents []Dirent
+	for len(reply) > 0 {
+		if len(reply) < 24 {
+			return nil, ErrShortReply
+		}
+		namelen := int(hostOrder.Uint32(reply[16:20]))
+		if len(reply) < 24+namelen {
+			return nil, ErrShortReply
+		}
+		dirents = append(dirents, Dirent{
+			Inode:  hostOrder.Uint64(reply[0:8]),
+			Offset: int64(hostOrder.Uint64(reply[8:16])),
+			Type:   fuse.DirentType(hostOrder.Uint32(reply[20:24])),
+			Name:   string(reply[24 : 24+namelen]),
+		})
+		// entries are padded to 8 bytes
+		n := (24 + namelen + 7) &^ 7
+		if n > len(reply) {
+			n = len(reply)
+		}
+		reply = reply[n:]
+	}
+	return dirents, nil
+}
+
+// Releasedir closes an open directory handle.
+func (s *Session) Releasedir(node fuse.NodeID, handle fuse.HandleID) error {
+	var body bytes.Buffer
+	write(&body, uint64(handle), uint32(fuse.OpenReadOnly|fuse.OpenFlags(syscall.O_DIRECTORY)), uint32(0), uint64(0))
+	_, err := s.Call(opReleasedir, node, body.Bytes())
+	return err
+}
+
+// Getxattr reads the extended attribute name of node. With a size of
+// 0, the reply holds only the size of the value, as a uint32 in the
+// host's byte order.
+func (s *Session) Getxattr(node fuse.NodeID, name string, size uint32) ([]byte, error) {
+	var body bytes.Buffer
+	write(&body, size, uint32(0))
+	body.WriteString(name)
+	body.WriteByte(0)
+	return s.Call(opGetxattr, node, body.Bytes())
+}
+
+// Listxattr returns the NUL-terminated names of the extended
+// attributes of node, in a reply of up to size bytes.
+func (s *Session) Listxattr(node fuse.NodeID, size uint32) ([]byte, error) {
+	var body bytes.Buffer
+	write(&body, size, uint32(0))
+	return s.Call(opListxattr, node, body.Bytes())
+}
@@ -0,0 +1,81 @@
+package testkernel_test
+
+import (
+	"testing"
+
+	"github.com/bpowers/fuse"
+	"github.com/bpowers/fuse/fs"
+	"github.com/bpowers/fuse/fs/fstestutil"
+	"github.com/bpowers/fuse/testkernel"
+	"golang.org/x/net/context"
+)
+
+type hello struct{}
+
+func (hello) Attr(a *fuse.Attr) {
+	a.Inode = 2
+	a.Mode = 0444
+	a.Size = uint64(len(helloText))
+}
+
+func (hello) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(helloText), nil
+}
+
+const helloText = "hello, world\n"
+
+func TestLookupOpenRead(t *testing.T) {
+	s, c, err := testkernel.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fs.Serve(c, fstestutil.SimpleFS{Node: fstestutil.ChildMap{"hello": hello{}}}, nil)
+	}()
+	defer func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		c.Close()
+	}()
+
+	proto, err := s.Init()
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if g, e := proto, (fuse.Protocol{Major: 7, Minor: 8}); g != e {
+		t.Errorf("wrong protocol: %v != %v", g, e)
+	}
+
+	if _, err := s.Lookup(testkernel.RootID, "missing"); err != fuse.ENOENT {
+		t.Errorf("expected ENOENT for a missing entry: %v", err)
+	}
+
+	e, err := s.Lookup(testkernel.RootID, "hello")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if g, e := e.Inode, uint64(2); g != e {
+		t.Errorf("wrong inode: %d != %d", g, e)
+	}
+	if g, e := e.Size, uint64(len(helloText)); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+
+	h, err := s.Open(e.Node, fuse.OpenReadOnly)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := s.Read(e.Node, h, 7, 4096)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if g, e := string(data), helloText[7:]; g != e {
+		t.Errorf("wrong data: %q != %q", g, e)
+	}
+	if err := s.Release(e.Node, h, fuse.OpenReadOnly); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+// +build !linux,!darwin
+
+package fuse
+
+import (
+	"syscall"
+)
+
+// writev writes the buffers of iov with a single write, copying them
+// together first.
+func writev(fd int, iov [][]byte) (int, error) {
+	var n int
+	for _, b := range iov {
+		n += len(b)
+	}
+	msg := make([]byte, 0, n)
+	for _, b := range iov {
+		msg = append(msg, b...)
+	}
+	return syscall.Write(fd, msg)
+}
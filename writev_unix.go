@@ -0,0 +1,11 @@
+// +build linux darwin
+
+package fuse
+
+import (
+	sysunix "golang.org/x/sys/unix"
+)
+
+func writev(fd int, iov [][]byte) (int, error) {
+	return sysunix.Writev(fd, iov)
+}
@@ -0,0 +1,48 @@
+package fuse
+
+import "strings"
+
+// Extended attribute namespaces known to Linux. An attribute name is
+// the namespace, a dot, and the name within the namespace, for
+// example "user.mime_type".
+const (
+	XattrNamespaceUser     = "user"
+	XattrNamespaceSystem   = "system"
+	XattrNamespaceTrusted  = "trusted"
+	XattrNamespaceSecurity = "security"
+)
+
+// XattrNamespace returns the namespace part of the extended attribute
+// name, for example "user" for "user.mime_type". It returns "" if
+// the name has no namespace.
+func XattrNamespace(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// CheckXattrPermission applies the Linux rules for which callers may
+// set or remove the extended attribute name, as used for
+// SetxattrRequest and RemovexattrRequest. It returns 0 if uid is
+// allowed to proceed, and otherwise the errno to respond with.
+//
+// Attributes in the user namespace are governed by the normal file
+// permissions, and system attributes (such as POSIX ACLs) by file
+// ownership; both are left for the caller to check. Trusted and
+// security attributes are reserved for root, which stands in for the
+// CAP_SYS_ADMIN capability the kernel would check. Names outside the
+// known namespaces are not supported.
+func CheckXattrPermission(name string, uid uint32) Errno {
+	switch XattrNamespace(name) {
+	case XattrNamespaceUser, XattrNamespaceSystem:
+		return 0
+	case XattrNamespaceTrusted, XattrNamespaceSecurity:
+		if uid != 0 {
+			return EPERM
+		}
+		return 0
+	}
+	return ENOTSUP
+}
@@ -0,0 +1,52 @@
+package fuse_test
+
+import (
+	"testing"
+
+	"github.com/bpowers/fuse"
+)
+
+func TestXattrNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ns   string
+	}{
+		{"user.mime_type", "user"},
+		{"system.posix_acl_access", "system"},
+		{"trusted.overlay.opaque", "trusted"},
+		{"security.selinux", "security"},
+		{"noprefix", ""},
+		{".hidden", ""},
+	} {
+		if g, e := fuse.XattrNamespace(tc.name), tc.ns; g != e {
+			t.Errorf("XattrNamespace(%q): %q != %q", tc.name, g, e)
+		}
+	}
+}
+
+func TestCheckXattrPermission(t *testing.T) {
+	const (
+		root = 0
+		user = 1000
+	)
+	for _, tc := range []struct {
+		name  string
+		uid   uint32
+		errno fuse.Errno
+	}{
+		{"user.foo", root, 0},
+		{"user.foo", user, 0},
+		{"system.posix_acl_access", root, 0},
+		{"system.posix_acl_access", user, 0},
+		{"trusted.foo", root, 0},
+		{"trusted.foo", user, fuse.EPERM},
+		{"security.selinux", root, 0},
+		{"security.selinux", user, fuse.EPERM},
+		{"bogus.foo", root, fuse.ENOTSUP},
+		{"nonamespace", user, fuse.ENOTSUP},
+	} {
+		if g, e := fuse.CheckXattrPermission(tc.name, tc.uid), tc.errno; g != e {
+			t.Errorf("CheckXattrPermission(%q, %d): %v != %v", tc.name, tc.uid, g, e)
+		}
+	}
+}